@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// AtomicEnvironment is a Puppet environment of atomic_deploy, which gets built in a staging directory next to its environment directory
+// and swapped with it after all its modules got synced
+type AtomicEnvironment struct {
+	liveDir    string
+	stagingDir string
+	failure    string
+}
+
+// atomicEnvironments contains the Puppet environments of atomic_deploy which got started, but not swapped or rolled back yet
+var atomicEnvironments = struct {
+	sync.Mutex
+	m map[string]*AtomicEnvironment
+}{m: make(map[string]*AtomicEnvironment)}
+
+// isAtomicDeploy returns true if the Puppet environments get built in a staging directory and swapped with their environment directory
+func isAtomicDeploy() bool {
+	return config.AtomicDeploy && !dryRun
+}
+
+// getStagingDir returns the staging directory of this g10k run for the environment directory liveDir
+// it is a hidden directory next to it, so that the swap stays on the same filesystem and Puppet does not consider it an environment
+func getStagingDir(liveDir string) string {
+	liveDir = filepath.Clean(liveDir)
+	return filepath.Join(filepath.Dir(liveDir), "."+filepath.Base(liveDir)+".g10k-staging."+strconv.Itoa(os.Getpid())) + "/"
+}
+
+// getEnvironmentLockFile returns the lock file which serializes the swaps of the environment directory liveDir of concurrent g10k runs
+// it lives in the cachedir, because the purge of unmanaged environments would remove it from the basedir
+func getEnvironmentLockFile(liveDir string) string {
+	return filepath.Join(config.EnvCacheDir, strings.Replace(strings.Trim(filepath.Clean(liveDir), "/"), "/", "_", -1)+".environment.lock")
+}
+
+// purgeStaleStagingDirs removes the staging directories of liveDir which were left behind by g10k runs that exited before swapping them
+func purgeStaleStagingDirs(liveDir string) {
+	liveDir = filepath.Clean(liveDir)
+	stagingDirs, _ := filepath.Glob(filepath.Join(filepath.Dir(liveDir), "."+filepath.Base(liveDir)+".g10k-staging.*"))
+	for _, stagingDir := range stagingDirs {
+		pid, err := strconv.Atoi(stagingDir[strings.LastIndex(stagingDir, ".")+1:])
+		if err != nil || pid == os.Getpid() || syscall.Kill(pid, 0) != syscall.ESRCH {
+			continue
+		}
+		purgeDir(stagingDir, "purgeStaleStagingDirs(), because g10k run "+strconv.Itoa(pid)+" exited before swapping it")
+	}
+}
+
+// startAtomicEnvironment returns the empty staging directory in which the Puppet environment env gets built instead of its environment directory liveDir
+func startAtomicEnvironment(env string, liveDir string) string {
+	purgeStaleStagingDirs(liveDir)
+	stagingDir := getStagingDir(liveDir)
+	createOrPurgeDir(stagingDir, "startAtomicEnvironment()")
+	atomicEnvironments.Lock()
+	atomicEnvironments.m[env] = &AtomicEnvironment{liveDir: normalizeDir(liveDir), stagingDir: stagingDir}
+	atomicEnvironments.Unlock()
+	Debugf("Building environment " + env + " in staging directory " + stagingDir)
+	return stagingDir
+}
+
+// failAtomicEnvironment marks the Puppet environment env with the reason of its first failure, so that its staging directory gets removed instead of swapped with its environment directory
+func failAtomicEnvironment(env string, reason string) {
+	atomicEnvironments.Lock()
+	defer atomicEnvironments.Unlock()
+	if ae, ok := atomicEnvironments.m[env]; ok && len(ae.failure) == 0 {
+		ae.failure = reason
+	}
+}
+
+// validateAtomicEnvironment runs the validate_command against the staging directory of the Puppet environment env and marks the environment as failed if it exits non-zero
+func validateAtomicEnvironment(env string) {
+	if len(config.ValidateCommand) == 0 {
+		return
+	}
+	atomicEnvironments.Lock()
+	ae, ok := atomicEnvironments.m[env]
+	atomicEnvironments.Unlock()
+	if !ok || len(ae.failure) > 0 {
+		return
+	}
+	command := strings.Replace(strings.Replace(config.ValidateCommand, "$environment", env, -1), "$path", ae.stagingDir, -1)
+	er := executeCommand(runContext, command, config.Timeout, true)
+	if er.returnCode != 0 {
+		Warnf("WARN: validate_command " + command + " of environment " + env + " failed with exit code " + strconv.Itoa(er.returnCode) + " Output: " + strings.TrimSpace(er.output+er.stderr))
+		failAtomicEnvironment(env, "its validate_command failed")
+		return
+	}
+	Debugf("validate_command " + command + " of environment " + env + " succeeded")
+}
+
+// finishAtomicEnvironment swaps the staging directory of the Puppet environment env with its environment directory and removes the previous environment afterwards
+// if a module of the environment could not be synced or its validate_command failed the staging directory gets removed instead and the environment directory stays as it was
+// it returns the environment directory and why the environment got rolled back, which is empty if it got swapped
+func finishAtomicEnvironment(env string, st *SyncStats) (string, string) {
+	atomicEnvironments.Lock()
+	ae, ok := atomicEnvironments.m[env]
+	delete(atomicEnvironments.m, env)
+	atomicEnvironments.Unlock()
+	if !ok {
+		Fatalf("finishAtomicEnvironment(): Error: environment " + env + " was not built in a staging directory")
+	}
+	if len(ae.failure) == 0 && shutdownRequested() {
+		ae.failure = "g10k is shutting down"
+	}
+	if len(ae.failure) > 0 {
+		Warnf("WARN: Not swapping environment " + ae.liveDir + ", because " + ae.failure + ". Removing its staging directory " + ae.stagingDir)
+		purgeDir(ae.stagingDir, "finishAtomicEnvironment(), because the environment got rolled back")
+		return ae.liveDir, ae.failure
+	}
+	// concurrent g10k runs swap the same environment one after the other
+	unlock, _ := lockFile(getEnvironmentLockFile(ae.liveDir), true)
+	defer unlock()
+	if err := swapDirs(ae.stagingDir, ae.liveDir); err != nil {
+		Fatalf("finishAtomicEnvironment(): Error while swapping staging directory " + ae.stagingDir + " with environment " + ae.liveDir + " Error: " + err.Error())
+	}
+	Debugf("Swapped staging directory " + ae.stagingDir + " with environment " + ae.liveDir)
+	purgeDir(ae.stagingDir, "finishAtomicEnvironment(), because it contains the previous environment")
+	st.rebaseDirs(ae.stagingDir, ae.liveDir)
+	return ae.liveDir, ""
+}
+
+// rollbackAtomicEnvironments removes the staging directories of all Puppet environments which did not get swapped, e.g. because g10k is shutting down
+func rollbackAtomicEnvironments() {
+	atomicEnvironments.Lock()
+	defer atomicEnvironments.Unlock()
+	for env, ae := range atomicEnvironments.m {
+		Warnf("WARN: Not swapping environment " + ae.liveDir + ", because it did not finish. Removing its staging directory " + ae.stagingDir)
+		purgeDir(ae.stagingDir, "rollbackAtomicEnvironments()")
+		delete(atomicEnvironments.m, env)
+	}
+}
+
+// swapDirs replaces the directory liveDir with stagingDir, afterwards stagingDir contains the previous content of liveDir
+// if the kernel or filesystem can not exchange directories atomically, liveDir is replaced with two renames, between which it is missing for an instant
+func swapDirs(stagingDir string, liveDir string) error {
+	stagingDir = filepath.Clean(stagingDir)
+	liveDir = filepath.Clean(liveDir)
+	if _, err := os.Lstat(liveDir); os.IsNotExist(err) {
+		if err := os.Rename(stagingDir, liveDir); err != nil {
+			return err
+		}
+		return os.Mkdir(stagingDir, 0755)
+	}
+	err := exchangeDirs(stagingDir, liveDir)
+	if err == nil {
+		return nil
+	}
+	Debugf("Could not exchange " + stagingDir + " with " + liveDir + " atomically, renaming them one after the other. Error: " + err.Error())
+	previousDir := stagingDir + ".previous"
+	if err := os.Rename(liveDir, previousDir); err != nil {
+		return err
+	}
+	if err := os.Rename(stagingDir, liveDir); err != nil {
+		os.Rename(previousDir, liveDir)
+		return err
+	}
+	return os.Rename(previousDir, stagingDir)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameExchange is the RENAME_EXCHANGE flag of renameat2
+const renameExchange = 2
+
+// exchangeDirs exchanges the directories a and b atomically with the renameat2 syscall of Linux
+func exchangeDirs(a string, b string) error {
+	pathA, err := syscall.BytePtrFromString(a)
+	if err != nil {
+		return err
+	}
+	pathB, err := syscall.BytePtrFromString(b)
+	if err != nil {
+		return err
+	}
+	// AT_FDCWD lets renameat2 resolve relative paths like rename
+	atFdcwd := unix.AT_FDCWD
+	if _, _, errno := syscall.Syscall6(unix.SYS_RENAMEAT2, uintptr(atFdcwd), uintptr(unsafe.Pointer(pathA)), uintptr(atFdcwd), uintptr(unsafe.Pointer(pathB)), renameExchange, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "syscall"
+
+// exchangeDirs can not exchange directories atomically without the renameat2 syscall of Linux, so swapDirs() falls back to two renames
+func exchangeDirs(a string, b string) error {
+	return syscall.ENOSYS
+}
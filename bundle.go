@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// getBundleFile returns the git bundle in the bundle_dir for the cached git repository workDir
+// the bundle is named after the directory name of workDir without the .git suffix, e.g. https-__github.com_puppetlabs_puppetlabs-stdlib.bundle
+func getBundleFile(workDir string) string {
+	return filepath.Join(config.BundleDir, strings.TrimSuffix(filepath.Base(filepath.Clean(workDir)), ".git")+".bundle")
+}
+
+// mirrorFromBundle clones or updates the cached git repository workDir from its git bundle in the bundle_dir instead of the git repository url
+// the bundle gets verified against workDir first, so that a bundle which lacks prerequisite commits of an incremental update fails with a clear error
+func mirrorFromBundle(gitModule GitModule, workDir string, st *SyncStats) bool {
+	url := gitModule.git
+	bundleFile := getBundleFile(workDir)
+	fail := func(lastError string) bool {
+		Warnf("WARN: git repository " + url + " can not be updated from the bundle_dir: " + lastError)
+		recordGitRepositoryResult(url, false, false, lastError)
+		return false
+	}
+	if !fileExists(bundleFile) {
+		return fail("git bundle " + bundleFile + " does not exist")
+	}
+	st.addGitFetch()
+	runGitCommand := func(gitCmd string) ExecResult {
+		er := executeGitCommand(runContext, gitCmd, gitModule.timeout, true)
+		writeGitLog(workDir, gitCmd, er)
+		return er
+	}
+	getLastError := func(gitCmd string, er ExecResult) string {
+		return gitCmd + ": " + strings.TrimSpace(er.output+"\n"+er.stderr)
+	}
+
+	isMirror := isDir(workDir)
+	if !isMirror {
+		// git bundle verify needs a repository, the origin remote keeps the url for a later update over the network
+		for _, gitCmd := range []string{"git init --bare " + workDir, "git --git-dir " + workDir + " remote add --mirror=fetch origin " + url} {
+			if er := runGitCommand(gitCmd); er.returnCode != 0 {
+				purgeDir(workDir, "mirrorFromBundle(), because the initialization of the git repository failed")
+				return fail(getLastError(gitCmd, er))
+			}
+		}
+	}
+
+	gitCmd := "git --git-dir " + workDir + " bundle verify " + bundleFile
+	if er := runGitCommand(gitCmd); er.returnCode != 0 {
+		if !isMirror {
+			purgeDir(workDir, "mirrorFromBundle(), because the git bundle "+bundleFile+" is invalid")
+		}
+		return fail("git bundle " + bundleFile + " does not match the cached git repository " + workDir + ": " + getLastError(gitCmd, er))
+	}
+	gitCmd = "git --git-dir " + workDir + " fetch --prune " + bundleFile + " '+refs/*:refs/*'"
+	if er := runGitCommand(gitCmd); er.returnCode != 0 {
+		if !isMirror {
+			purgeDir(workDir, "mirrorFromBundle(), because the fetch from the git bundle "+bundleFile+" failed")
+		}
+		return fail(getLastError(gitCmd, er))
+	}
+	updateMirrorHeadFromBundle(workDir, bundleFile, gitModule.timeout)
+
+	recordGitRepositoryResult(url, true, false, "")
+	writeLastUpdateFile(workDir)
+	if !strings.HasPrefix(workDir, config.EnvCacheDir) {
+		markModuleCacheDirUsed(workDir)
+		recordRunState("git_repository", url, "")
+	}
+	return true
+}
+
+// updateMirrorHeadFromBundle points HEAD of the cached git repository workDir to the branch of the git bundle which has the commit of its HEAD
+// if the branch HEAD pointed to does not exist, because a bundle does not record which branch its HEAD is
+func updateMirrorHeadFromBundle(workDir string, bundleFile string, timeout int) {
+	er := executeCommand(runContext, "git --git-dir "+workDir+" symbolic-ref HEAD", config.Timeout, true)
+	head := strings.TrimSpace(er.output)
+	if er.returnCode == 0 && executeCommand(runContext, "git --git-dir "+workDir+" rev-parse --verify --quiet "+head, config.Timeout, true).returnCode == 0 {
+		return
+	}
+	er = executeGitCommand(runContext, "git bundle list-heads "+bundleFile, timeout, true)
+	heads := make(map[string]string)
+	for _, line := range strings.Split(er.output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			heads[fields[1]] = fields[0]
+		}
+	}
+	headCommit, ok := heads["HEAD"]
+	if !ok {
+		return
+	}
+	branches := []string{}
+	for ref, commit := range heads {
+		if strings.HasPrefix(ref, "refs/heads/") && commit == headCommit {
+			branches = append(branches, ref)
+		}
+	}
+	if len(branches) == 0 {
+		return
+	}
+	// prefer a well known default branch, if several branches point to the same commit
+	sort.Strings(branches)
+	branch := branches[0]
+	for _, b := range branches {
+		if b == "refs/heads/main" || b == "refs/heads/master" {
+			branch = b
+			break
+		}
+	}
+	Debugf("Changing HEAD of " + workDir + " from " + head + " to " + branch)
+	executeCommand(runContext, "git --git-dir "+workDir+" symbolic-ref HEAD "+branch, config.Timeout, true)
+}
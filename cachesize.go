@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usedModuleCacheDirs contains the cached git repositories of the module cache which are used by the current run and must not be evicted
+// the value is true once their last access time got updated
+var usedModuleCacheDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// getLastAccessFile returns the file in which the time of the last use of the cached git repository workDir is stored
+func getLastAccessFile(workDir string) string {
+	return filepath.Join(workDir, ".g10k-last-access")
+}
+
+// markModuleCacheDirUsed protects the cached git repository workDir of the module cache from the eviction of this run
+// and updates its last access time once per run if it exists
+func markModuleCacheDirUsed(workDir string) {
+	if !strings.HasPrefix(workDir, config.ModulesCacheDir) || isReadOnlyCacheDir(workDir) {
+		return
+	}
+	workDir = filepath.Clean(workDir)
+	usedModuleCacheDirs.Lock()
+	defer usedModuleCacheDirs.Unlock()
+	if usedModuleCacheDirs.dirs[workDir] {
+		return
+	}
+	if config.MaxCacheSizeGB <= 0 || !isDir(workDir) {
+		usedModuleCacheDirs.dirs[workDir] = false
+		return
+	}
+	lastAccessFile := getLastAccessFile(workDir)
+	if err := ioutil.WriteFile(lastAccessFile, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		Warnf("markModuleCacheDirUsed(): WARN: Could not write " + lastAccessFile + " Error: " + err.Error())
+	}
+	usedModuleCacheDirs.dirs[workDir] = true
+}
+
+// getLastAccessTime returns when the cached git repository workDir was used the last time
+// for git repositories cached before max_cache_size_gb got set the time of their last update or the modification time of the directory gets used
+func getLastAccessTime(workDir string) time.Time {
+	for _, file := range []string{getLastAccessFile(workDir), getLastUpdateFile(workDir)} {
+		if content, err := ioutil.ReadFile(file); err == nil {
+			if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content))); err == nil {
+				return t
+			}
+		}
+	}
+	if fi, err := os.Stat(workDir); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// getDirSize returns the summed up size of all files in dir
+func getDirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// CachedGitRepository is a git repository of the module cache, which can be evicted to keep the cache below max_cache_size_gb
+type CachedGitRepository struct {
+	dir        string
+	size       int64
+	lastAccess time.Time
+}
+
+// evictModuleCache removes the least recently used git repositories of the module cache until it is smaller than maxBytes
+// git repositories used by the current run are never evicted, with -dryrun the git repositories that would be evicted only get logged
+// it returns the number of evicted git repositories
+func evictModuleCache(maxBytes int64) int {
+	defer timeTrack(time.Now(), funcName())
+	entries, err := ioutil.ReadDir(config.ModulesCacheDir)
+	if err != nil {
+		Warnf("evictModuleCache(): WARN: Could not read module cache " + config.ModulesCacheDir + " Error: " + err.Error())
+		return 0
+	}
+	var total int64
+	candidates := []CachedGitRepository{}
+	usedModuleCacheDirs.Lock()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(config.ModulesCacheDir, entry.Name())
+		cgr := CachedGitRepository{dir: dir, size: getDirSize(dir), lastAccess: getLastAccessTime(dir)}
+		total += cgr.size
+		if _, used := usedModuleCacheDirs.dirs[dir]; !used {
+			candidates = append(candidates, cgr)
+		}
+	}
+	usedModuleCacheDirs.Unlock()
+	if total <= maxBytes {
+		Debugf("Module cache " + config.ModulesCacheDir + " uses " + strconv.FormatInt(total>>20, 10) + " MB, which is below max_cache_size_gb")
+		return 0
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].lastAccess.Equal(candidates[j].lastAccess) {
+			return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+		}
+		return candidates[i].dir < candidates[j].dir
+	})
+	evicted := 0
+	for _, cgr := range candidates {
+		if total <= maxBytes {
+			break
+		}
+		reason := strconv.FormatInt(cgr.size>>20, 10) + " MB, last used " + time.Since(cgr.lastAccess).Truncate(time.Second).String() + " ago"
+		if dryRun {
+			Infof("Would evict cached git repository " + cgr.dir + " (" + reason + "), because the module cache exceeds max_cache_size_gb")
+		} else {
+			Infof("Evicting cached git repository " + cgr.dir + " (" + reason + "), because the module cache exceeds max_cache_size_gb")
+			purgeDir(cgr.dir, "evictModuleCache()")
+		}
+		total -= cgr.size
+		evicted++
+	}
+	if total > maxBytes {
+		Warnf("WARN: module cache " + config.ModulesCacheDir + " still uses " + strconv.FormatInt(total>>20, 10) + " MB, which exceeds max_cache_size_gb " + strconv.Itoa(config.MaxCacheSizeGB) + ", because the remaining git repositories are used by this run")
+	}
+	return evicted
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reCommitHash matches an abbreviated or full SHA-1 commit hash
+var reCommitHash = regexp.MustCompile("^[0-9a-fA-F]{7,40}$")
+
+// getCommitHashOfModule returns the commit hash to which the git module is pinned with :commit or with a :ref looking like a commit hash
+// a :ref which is the name of a tag or a branch of the cached git repository moduleCacheDir is no commit hash
+func getCommitHashOfModule(gitModule GitModule, moduleCacheDir string) (string, bool) {
+	if len(gitModule.commit) > 0 {
+		return gitModule.commit, true
+	}
+	if !reCommitHash.MatchString(gitModule.ref) {
+		return "", false
+	}
+	if _, ok := readGitRef(moduleCacheDir, "refs/tags/"+gitModule.ref); ok {
+		return "", false
+	}
+	if _, ok := readGitRef(moduleCacheDir, "refs/heads/"+gitModule.ref); ok {
+		return "", false
+	}
+	return gitModule.ref, true
+}
+
+// resolveCommitHash returns the full commit hash of hash in the git repository gitDir
+// otherwise it returns why hash can not be resolved to exactly one commit
+func resolveCommitHash(gitDir string, hash string, timeout int) (string, string) {
+	er := executeGitCommand(runContext, "git --git-dir "+gitDir+" rev-parse --verify --quiet '"+hash+"^{commit}'", timeout, true)
+	if er.returnCode == 0 {
+		return strings.TrimSpace(er.output), ""
+	}
+	er = executeGitCommand(runContext, "git --git-dir "+gitDir+" rev-parse --disambiguate="+hash, timeout, true)
+	if candidates := strings.Fields(er.output); len(candidates) > 1 {
+		return "", "is ambiguous, it matches the " + strconv.Itoa(len(candidates)) + " objects " + strings.Join(candidates, ", ")
+	}
+	return "", "is invalid, it does not match any commit"
+}
+
+// verifyCommitHashes makes sure that every git module pinned to a commit hash can be resolved to exactly one commit of its cached git repository
+// and exits before any module gets synced otherwise, with expand_commit_hashes abbreviated commit hashes get replaced by the full commit hash
+func verifyCommitHashes(allPuppetfiles map[string]Puppetfile) {
+	// the same commit hash of the same git repository is usually used by many environments
+	resolved := make(map[string]string)
+	reasons := make(map[string]string)
+	envs := make([]string, 0, len(allPuppetfiles))
+	for env := range allPuppetfiles {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	invalid := 0
+	for _, env := range envs {
+		pf := allPuppetfiles[env]
+		for gitName, gitModule := range pf.gitModules {
+			if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.tarball) > 0 {
+				continue
+			}
+			moduleCacheDir := getModuleCacheDir(gitModule.git)
+			if !isDir(moduleCacheDir) {
+				// the git repository could not be mirrored, which is reported already
+				continue
+			}
+			hash, ok := getCommitHashOfModule(gitModule, moduleCacheDir)
+			if !ok {
+				continue
+			}
+			key := moduleCacheDir + "@" + hash
+			if _, ok := resolved[key]; !ok {
+				resolved[key], reasons[key] = resolveCommitHash(moduleCacheDir, hash, gitModule.timeout)
+			}
+			if len(reasons[key]) > 0 {
+				location := filepath.Join(pf.workDir, "Puppetfile")
+				if pf.source == "global_modules" {
+					location = "global_modules in " + configFile
+				}
+				if len(gitModule.lineNumber) > 0 {
+					location += ":" + gitModule.lineNumber
+				}
+				message := "commit hash " + hash + " of git module " + gitName + " of environment " + env + " in " + location + " " + reasons[key] + " in git repository " + getTokenFreeGitURL(gitModule.git)
+				if gitModule.ignoreUnreachable {
+					Warnf("WARN: The " + message + ", ignoring it because of ignore_unreachable")
+					continue
+				}
+				Warnf("WARN: The " + message)
+				invalid++
+				continue
+			}
+			if config.ExpandCommitHashes && resolved[key] != hash {
+				Debugf("Expanding commit hash " + hash + " of git module " + gitName + " of environment " + env + " to " + resolved[key])
+				if len(gitModule.commit) > 0 {
+					gitModule.commit = resolved[key]
+				} else {
+					gitModule.ref = resolved[key]
+				}
+				pf.gitModules[gitName] = gitModule
+			}
+		}
+	}
+	if invalid > 0 {
+		Fatalf("Error: Found " + strconv.Itoa(invalid) + " ambiguous or invalid commit hashes of git modules")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// compactModuleCommits contains the commits of the git module directories of the previous deploys, read from the module_commits of their .g10k-deploy.json with compact_deploy_metadata
+var compactModuleCommits = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// loadCompactModuleCommits remembers the module_commits of the previous deploy dr of the Puppet environment envDir
+// it needs to be called before syncing the control repository overwrites the .g10k-deploy.json
+func loadCompactModuleCommits(envDir string, dr DeployResult) {
+	compactModuleCommits.Lock()
+	defer compactModuleCommits.Unlock()
+	for moduleDir, commit := range dr.ModuleCommits {
+		compactModuleCommits.m[normalizeDir(filepath.Join(envDir, moduleDir))] = commit
+	}
+}
+
+// readModuleCommit returns the deployed commit of the git module directory targetDir from the module_commits of its environment
+// and falls back to reading its .latest_commit file hashFile if the environment got deployed without compact_deploy_metadata
+func readModuleCommit(targetDir string, hashFile string) string {
+	compactModuleCommits.Lock()
+	commit, ok := compactModuleCommits.m[normalizeDir(targetDir)]
+	compactModuleCommits.Unlock()
+	if ok {
+		return commit
+	}
+	content, _ := ioutil.ReadFile(hashFile)
+	return string(content)
+}
+
+// getModuleCommits returns the commits of the git module directories of the Puppet environment envDir which got synced or were up to date in this run, relative to envDir
+// with -module the other modules keep their commits of the previous deploy
+func getModuleCommits(envDir string) map[string]string {
+	moduleCommits := make(map[string]string)
+	addModuleCommits := func(commits map[string]string) {
+		for targetDir, commit := range commits {
+			if normalizeDir(targetDir) == normalizeDir(envDir) || !isSameOrSubDir(envDir, targetDir) {
+				continue
+			}
+			moduleDir, _ := filepath.Rel(envDir, targetDir)
+			moduleCommits[moduleDir] = commit
+		}
+	}
+	if len(moduleParam) > 0 {
+		compactModuleCommits.Lock()
+		addModuleCommits(compactModuleCommits.m)
+		compactModuleCommits.Unlock()
+	}
+	mutex.Lock()
+	addModuleCommits(resolvedModuleCommits)
+	mutex.Unlock()
+	return moduleCommits
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ModuleComparison contains the deployed version of a module in both compared Puppet environments, an empty version means that the module is missing
+type ModuleComparison struct {
+	module   string
+	version1 string
+	version2 string
+}
+
+// readDeployedModules returns the commit of each git module and the version of each Forge module deployed in the Puppet environment envDir
+// the modules are found by their .latest_commit or metadata.json file and keyed by their path relative to envDir
+func readDeployedModules(envDir string) map[string]string {
+	modules := make(map[string]string)
+	envDir = filepath.Clean(envDir)
+	err := filepath.Walk(envDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == envDir {
+			return nil
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// modules deployed with dedup_modules are symlinks to the module store
+			if target, err := os.Stat(path); err != nil || !target.IsDir() {
+				return nil
+			}
+		} else if !info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(envDir, path)
+		if commit, err := ioutil.ReadFile(getLatestCommitFile(path)); err == nil {
+			modules[rel] = strings.TrimSpace(string(commit))
+			return filepath.SkipDir
+		}
+		if fileExists(filepath.Join(path, "metadata.json")) {
+			modules[rel] = "version " + readModuleMetadata(filepath.Join(path, "metadata.json"), syncStats).version
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		Fatalf("readDeployedModules(): Error while reading the modules of environment " + envDir + " Error: " + err.Error())
+	}
+	return modules
+}
+
+// compareEnvironments returns the modules of both Puppet environment directories sorted by name and if any of them differ
+func compareEnvironments(envDir1 string, envDir2 string) ([]ModuleComparison, bool) {
+	modules1 := readDeployedModules(envDir1)
+	modules2 := readDeployedModules(envDir2)
+	names := []string{}
+	for name := range modules1 {
+		names = append(names, name)
+	}
+	for name := range modules2 {
+		if _, ok := modules1[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	differ := false
+	comparisons := []ModuleComparison{}
+	for _, name := range names {
+		mc := ModuleComparison{module: name, version1: modules1[name], version2: modules2[name]}
+		if mc.version1 != mc.version2 {
+			differ = true
+		}
+		comparisons = append(comparisons, mc)
+	}
+	return comparisons, differ
+}
+
+// printEnvironmentComparison prints the control repository commits and the modules of both Puppet environment directories to w
+// mismatching modules are marked with ! and modules which are only deployed in one of the environments with < or >
+func printEnvironmentComparison(w io.Writer, envDir1 string, envDir2 string) bool {
+	for _, envDir := range []string{envDir1, envDir2} {
+		if !isDir(envDir) {
+			Fatalf("printEnvironmentComparison(): Error: Puppet environment directory " + envDir + " does not exist")
+		}
+	}
+	comparisons, differ := compareEnvironments(envDir1, envDir2)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, " \tMODULE\t"+envDir1+"\t"+envDir2)
+	deploy1 := readEnvironmentSignature(envDir1)
+	deploy2 := readEnvironmentSignature(envDir2)
+	marker := " "
+	if deploy1 != deploy2 {
+		marker = "!"
+	}
+	fmt.Fprintln(tw, marker+"\t(control repository)\t"+deploy1+"\t"+deploy2)
+	for _, mc := range comparisons {
+		marker := " "
+		version1 := mc.version1
+		version2 := mc.version2
+		if len(version1) == 0 {
+			marker = ">"
+			version1 = "-"
+		} else if len(version2) == 0 {
+			marker = "<"
+			version2 = "-"
+		} else if version1 != version2 {
+			marker = "!"
+		}
+		fmt.Fprintln(tw, marker+"\t"+mc.module+"\t"+version1+"\t"+version2)
+	}
+	tw.Flush()
+	return differ || deploy1 != deploy2
+}
+
+// readEnvironmentSignature returns the control repository commit of the .g10k-deploy.json of the Puppet environment envDir
+func readEnvironmentSignature(envDir string) string {
+	deployFile := getDeployFile(envDir)
+	if !fileExists(deployFile) {
+		return "-"
+	}
+	dr := readDeployResultFile(deployFile)
+	if len(dr.Signature) == 0 {
+		return "-"
+	}
+	return dr.Signature
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,29 +17,23 @@ import (
 
 // readConfigfile creates the ConfigSettings struct from the g10k config file
 func readConfigfile(configFile string) ConfigSettings {
-	Debugf("Trying to read g10k config file: " + configFile)
-	data, err := ioutil.ReadFile(configFile)
+	configData := readConfigfileData(configFile, []string{})
+	mergedConfig, err := yaml.Marshal(configData)
 	if err != nil {
-		Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
-	}
-
-	rubySymbolsRemoved := ""
-	for _, line := range strings.Split(string(data), "\n") {
-		reWhitespaceColon := regexp.MustCompile("^(\\s*):")
-		m := reWhitespaceColon.FindStringSubmatch(line)
-		if len(m) > 0 {
-			rubySymbolsRemoved += reWhitespaceColon.ReplaceAllString(line, m[1]) + "\n"
-		} else {
-			rubySymbolsRemoved += line + "\n"
-		}
+		Fatalf("readConfigfile(): There was an error merging the config file " + configFile + " with its included config files: " + err.Error())
 	}
 	var config ConfigSettings
-	err = yaml.Unmarshal([]byte(rubySymbolsRemoved), &config)
+	err = yaml.Unmarshal(mergedConfig, &config)
 	if err != nil {
 		Fatalf("YAML unmarshal error: " + err.Error())
 	}
 
-	if len(os.Getenv("g10k_cachedir")) > 0 {
+	applyEnvironmentConfig(&config)
+
+	if len(cacheDirParam) > 0 {
+		Debugf("Using -cachedir parameter set to : " + cacheDirParam)
+		config.CacheDir = checkDirAndCreate(cacheDirParam, "cachedir CLI param")
+	} else if len(os.Getenv("g10k_cachedir")) > 0 {
 		cachedir := os.Getenv("g10k_cachedir")
 		Debugf("Found environment variable g10k_cachedir set to: " + cachedir)
 		config.CacheDir = checkDirAndCreate(cachedir, "cachedir environment variable g10k_cachedir")
@@ -49,6 +45,15 @@ func readConfigfile(configFile string) ConfigSettings {
 	config.ForgeCacheDir = checkDirAndCreate(config.CacheDir+"forge/", "cachedir/forge")
 	config.ModulesCacheDir = checkDirAndCreate(config.CacheDir+"modules/", "cachedir/modules")
 	config.EnvCacheDir = checkDirAndCreate(config.CacheDir+"environments/", "cachedir/environments")
+	if len(config.SecretsFile) > 0 {
+		secretsFileValues = readSecretsFile(config.SecretsFile)
+	}
+	if len(config.ReadOnlyCacheDir) > 0 {
+		config.ReadOnlyCacheDir = normalizeDir(config.ReadOnlyCacheDir)
+		if !isDir(config.ReadOnlyCacheDir + "modules/") {
+			Fatalf("readConfigfile(): Error: read_only_cachedir " + config.ReadOnlyCacheDir + " from config file " + configFile + " does not contain a modules directory")
+		}
+	}
 
 	if len(config.Forge.Baseurl) == 0 {
 		config.Forge.Baseurl = "https://forgeapi.puppetlabs.com"
@@ -69,9 +74,16 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.RetryGitCommands = true
 	}
 
+	if retries > 0 {
+		config.RetryGitCommands = true
+	} else if retries == 0 {
+		config.RetryGitCommands = false
+	}
+
 	if gitObjectSyntaxNotSupported {
 		config.GitObjectSyntaxNotSupported = true
 	}
+	applyGitVersion()
 
 	// set default max Go routines for Forge and Git module resolution if none is given
 	if !(config.Maxworker > 0) {
@@ -116,6 +128,232 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.PurgeLevels = []string{"deployment", "puppetfile"}
 	}
 
+	if len(config.Git.SSHStrictHostKeyChecking) > 0 {
+		strictHostKeyChecking, ok := normalizeStrictHostKeyChecking(config.Git.SSHStrictHostKeyChecking)
+		if !ok {
+			Fatalf("readConfigfile(): Invalid value " + config.Git.SSHStrictHostKeyChecking + " of git setting ssh_strict_host_key_checking in config file " + configFile + ", must be yes, no or accept-new")
+		}
+		config.Git.SSHStrictHostKeyChecking = strictHostKeyChecking
+	}
+
+	if len(config.DryRunDeployDir) > 0 {
+		config.DryRunDeployDir = checkDirAndCreate(config.DryRunDeployDir, "dryrun_deploy_dir from g10k config "+configFile)
+	}
+
+	if len(config.GitLogDir) > 0 {
+		config.GitLogDir = checkDirAndCreate(config.GitLogDir, "git_log_dir from g10k config "+configFile)
+	}
+
+	if len(config.MetadataDir) > 0 {
+		// the metadata files are stored below the absolute paths of the deployed directories
+		metadataDir, err := filepath.Abs(config.MetadataDir)
+		if err != nil {
+			Fatalf("readConfigfile(): Error while resolving the absolute path of metadata_dir " + config.MetadataDir + " Error: " + err.Error())
+		}
+		config.MetadataDir = checkDirAndCreate(metadataDir, "metadata_dir from g10k config "+configFile)
+	}
+
+	if len(config.BundleDir) > 0 {
+		bundleDir, err := filepath.Abs(config.BundleDir)
+		if err != nil || !isDir(bundleDir) {
+			Fatalf("readConfigfile(): Error: bundle_dir " + config.BundleDir + " from config file " + configFile + " is not a directory")
+		}
+		config.BundleDir = bundleDir
+	}
+
+	for name := range config.Git.Env {
+		if len(name) == 0 || strings.ContainsAny(name, "= ") {
+			Fatalf("readConfigfile(): Invalid environment variable name '" + name + "' of git setting env in config file " + configFile)
+		}
+	}
+
+	if len(config.Git.CloneReferenceMode) > 0 && config.Git.CloneReferenceMode != "alternates" && config.Git.CloneReferenceMode != "dissociate" {
+		Fatalf("readConfigfile(): Invalid value " + config.Git.CloneReferenceMode + " of git setting clone_reference_mode in config file " + configFile + ", must be alternates or dissociate")
+	}
+	if len(config.Git.CloneReferenceMode) > 0 && len(config.Git.CloneReference) == 0 {
+		Fatalf("readConfigfile(): Error: git setting clone_reference_mode requires the git setting clone_reference in config file " + configFile)
+	}
+
+	for _, cc := range config.Git.ClientCertificates {
+		if len(cc.URLPattern) == 0 || len(cc.Cert) == 0 || len(cc.Key) == 0 {
+			Fatalf("readConfigfile(): Error: Each git client_certificates entry needs url_pattern, cert and key in config file " + configFile)
+		}
+	}
+
+	for i, rule := range config.Git.URLRewriteRules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil || len(rule.Pattern) == 0 {
+			Fatalf("readConfigfile(): Error: Invalid git url_rewrite_rules pattern '" + rule.Pattern + "' in config file " + configFile)
+		}
+		config.Git.URLRewriteRules[i].re = re
+	}
+
+	for source, sa := range config.Sources {
+		if len(sa.BranchIncludeRegex) > 0 {
+			re, err := regexp.Compile(sa.BranchIncludeRegex)
+			if err != nil {
+				Fatalf("readConfigfile(): Error: Invalid branch_include_regex '" + sa.BranchIncludeRegex + "' of source " + source + " in config file " + configFile + " Error: " + err.Error())
+			}
+			sa.branchIncludeRe = re
+		}
+		if len(sa.BranchExcludeRegex) > 0 {
+			re, err := regexp.Compile(sa.BranchExcludeRegex)
+			if err != nil {
+				Fatalf("readConfigfile(): Error: Invalid branch_exclude_regex '" + sa.BranchExcludeRegex + "' of source " + source + " in config file " + configFile + " Error: " + err.Error())
+			}
+			sa.branchExcludeRe = re
+		}
+		config.Sources[source] = sa
+	}
+
+	if len(config.Umask) > 0 {
+		if umask, err := strconv.ParseUint(config.Umask, 8, 32); err != nil || umask > 0777 {
+			Fatalf("readConfigfile(): Invalid value " + config.Umask + " of setting umask in config file " + configFile + ", must be an octal number like 0002")
+		}
+	}
+
+	for _, wlpattern := range config.DeploymentPurgeWhitelist {
+		// a malformed pattern never matches, so the directories it should protect would get purged
+		if _, err := filepath.Match(wlpattern, ""); err != nil {
+			Fatalf("readConfigfile(): Invalid pattern " + wlpattern + " of setting deployment_purge_whitelist in config file " + configFile + " Error: " + err.Error())
+		}
+	}
+
+	if len(config.VerifyPurge) > 0 && config.VerifyPurge != "warn" && config.VerifyPurge != "purge" {
+		Fatalf("readConfigfile(): Invalid value " + config.VerifyPurge + " of setting verify_purge in config file " + configFile + ", must be warn or purge")
+	}
+
+	for pattern, level := range config.EnvironmentPurgeLevels {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			Fatalf("readConfigfile(): Invalid environment name pattern " + pattern + " of setting environment_purge_levels in config file " + configFile + " Error: " + err.Error())
+		}
+		if level != "none" && level != "whitelist" && level != "strict" {
+			Fatalf("readConfigfile(): Invalid purge level " + level + " of environment name pattern " + pattern + " of setting environment_purge_levels in config file " + configFile + ", must be none, whitelist or strict")
+		}
+	}
+
+	if len(config.CaseCollisions) > 0 && config.CaseCollisions != "ignore" && config.CaseCollisions != "warn" && config.CaseCollisions != "fail" {
+		Fatalf("readConfigfile(): Invalid value " + config.CaseCollisions + " of setting case_collisions in config file " + configFile + ", must be ignore, warn or fail")
+	}
+	if failOnEmptyEnvironment {
+		config.EmptyEnvironments = "fail"
+	}
+	if len(config.EmptyEnvironments) > 0 && config.EmptyEnvironments != "ignore" && config.EmptyEnvironments != "warn" && config.EmptyEnvironments != "fail" {
+		Fatalf("readConfigfile(): Invalid value " + config.EmptyEnvironments + " of setting empty_environments in config file " + configFile + ", must be ignore, warn or fail")
+	}
+	if _, ok := syslogFacilities[config.Syslog.Facility]; len(config.Syslog.Facility) > 0 && !ok {
+		Fatalf("readConfigfile(): Invalid value " + config.Syslog.Facility + " of setting syslog facility in config file " + configFile + ", must be one of kern, user, daemon, auth, syslog, authpriv, cron or local0 to local7")
+	}
+	if config.ReadConcurrency < 0 || config.WriteConcurrency < 0 {
+		Fatalf("readConfigfile(): Invalid value of setting read_concurrency or write_concurrency in config file " + configFile + ", must be a positive number or 0 to only limit them with maxextractworker")
+	}
+	if config.MinFreeDiskMB < 0 {
+		Fatalf("readConfigfile(): Invalid value " + strconv.Itoa(config.MinFreeDiskMB) + " of setting min_free_disk_mb in config file " + configFile + ", must be a positive number or 0 to disable the check")
+	}
+	if len(config.ForgeAllowlistMode) > 0 && config.ForgeAllowlistMode != "warn" && config.ForgeAllowlistMode != "fail" {
+		Fatalf("readConfigfile(): Invalid value " + config.ForgeAllowlistMode + " of setting forge_allowlist_mode in config file " + configFile + ", must be warn or fail")
+	}
+	if len(config.ForgeToGit) > 0 {
+		// the Forge modules can be given as author-name or author/name like in the Puppetfile
+		forgeToGit := make(map[string]ForgeToGit)
+		for slug, ftg := range config.ForgeToGit {
+			normalizedSlug := strings.Replace(slug, "/", "-", 1)
+			if !strings.Contains(normalizedSlug, "-") || len(ftg.Git) == 0 {
+				Fatalf("readConfigfile(): Error: forge_to_git entry " + slug + " in config file " + configFile + " needs a Forge module like puppetlabs-stdlib and a git repository url")
+			}
+			forgeToGit[normalizedSlug] = ftg
+		}
+		config.ForgeToGit = forgeToGit
+	}
+	if len(config.UnmanagedModuleDirs) > 0 && config.UnmanagedModuleDirs != "overwrite" && config.UnmanagedModuleDirs != "backup" && config.UnmanagedModuleDirs != "fail" {
+		Fatalf("readConfigfile(): Invalid value " + config.UnmanagedModuleDirs + " of setting unmanaged_module_dirs in config file " + configFile + ", must be overwrite, backup or fail")
+	}
+	if len(config.MissingControlBranch) > 0 && config.MissingControlBranch != "fail" && config.MissingControlBranch != "warn" && config.MissingControlBranch != "skip" {
+		Fatalf("readConfigfile(): Invalid value " + config.MissingControlBranch + " of setting missing_control_branch in config file " + configFile + ", must be fail, warn or skip")
+	}
+	if len(config.EnforceImmutableRefs) > 0 && config.EnforceImmutableRefs != "warn" && config.EnforceImmutableRefs != "fail" {
+		Fatalf("readConfigfile(): Invalid value " + config.EnforceImmutableRefs + " of setting enforce_immutable_refs in config file " + configFile + ", must be warn or fail")
+	}
+
+	if len(config.RemoteDeploy.Host) > 0 {
+		if len(config.RemoteDeploy.Path) == 0 {
+			Fatalf("readConfigfile(): Error: remote_deploy setting path is missing in config file " + configFile)
+		}
+		if config.DedupModules {
+			Fatalf("readConfigfile(): Error: remote_deploy can not be used together with dedup_modules in config file " + configFile)
+		}
+	}
+	if len(config.Masters.Hosts) > 0 && len(config.RemoteDeploy.Host) > 0 {
+		// the environments of remote_deploy do not exist locally, so there is nothing to distribute
+		Fatalf("readConfigfile(): Error: masters can not be used together with remote_deploy in config file " + configFile)
+	}
+	if config.AtomicDeploy && (len(config.RemoteDeploy.Host) > 0 || len(config.MetadataDir) > 0) {
+		// the remote environments and the metadata_dir are not part of the swapped environment directory
+		Fatalf("readConfigfile(): Error: atomic_deploy can not be used together with remote_deploy or metadata_dir in config file " + configFile)
+	}
+	if len(config.ValidateCommand) > 0 && !config.AtomicDeploy {
+		// only a staging directory can be validated before it replaces the environment
+		Fatalf("readConfigfile(): Error: validate_command needs atomic_deploy in config file " + configFile)
+	}
+	if len(config.MetadataDir) > 0 && config.DedupModules {
+		// the module store keeps the .latest_commit of each commit inside the module directories
+		Fatalf("readConfigfile(): Error: metadata_dir can not be used together with dedup_modules in config file " + configFile)
+	}
+
+	if len(config.CopyStrategy) > 0 {
+		if !config.DedupModules {
+			Fatalf("readConfigfile(): Error: copy_strategy can only be used together with dedup_modules in config file " + configFile)
+		}
+		if !stringSliceContains(copyStrategies, config.CopyStrategy) {
+			Fatalf("readConfigfile(): Invalid value " + config.CopyStrategy + " of setting copy_strategy in config file " + configFile + ", must be untar, copy, reflink or hardlink")
+		}
+	}
+	if config.DedupModules {
+		if len(config.DedupModulesMode) == 0 {
+			config.DedupModulesMode = "symlink"
+		} else if config.DedupModulesMode != "symlink" && config.DedupModulesMode != "hardlink" && config.DedupModulesMode != "copy" {
+			Fatalf("readConfigfile(): Invalid value " + config.DedupModulesMode + " of setting dedup_modules_mode in config file " + configFile + ", must be symlink, hardlink or copy")
+		}
+		if len(config.CopyStrategy) > 0 && config.DedupModulesMode == "symlink" {
+			Fatalf("readConfigfile(): Error: copy_strategy can only be used together with dedup_modules_mode hardlink or copy in config file " + configFile)
+		}
+		if len(config.ModuleStoreDir) == 0 {
+			config.ModuleStoreDir = config.CacheDir + "module_store/"
+		}
+		// the symlinks in the environments need an absolute path to the module store
+		moduleStoreDir, err := filepath.Abs(config.ModuleStoreDir)
+		if err != nil {
+			Fatalf("readConfigfile(): Error while resolving the absolute path of module_store_dir " + config.ModuleStoreDir + " Error: " + err.Error())
+		}
+		config.ModuleStoreDir = checkDirAndCreate(moduleStoreDir, "module_store_dir from g10k config "+configFile)
+	}
+
+	if len(config.DeployRootPrefix) > 0 {
+		deployRootPrefix, err := filepath.Abs(config.DeployRootPrefix)
+		if err != nil || !isDir(deployRootPrefix) {
+			Fatalf("readConfigfile(): Error: deploy_root_prefix " + config.DeployRootPrefix + " from config file " + configFile + " is not a directory")
+		}
+		if len(config.RemoteDeploy.Host) > 0 {
+			Fatalf("readConfigfile(): Error: remote_deploy can not be used together with deploy_root_prefix in config file " + configFile)
+		}
+		if config.DedupModules && config.DedupModulesMode == "symlink" {
+			// the symlinks would point to the module store outside of the deploy root
+			Fatalf("readConfigfile(): Error: dedup_modules_mode symlink can not be used together with deploy_root_prefix in config file " + configFile + ", use hardlink or copy")
+		}
+		config.DeployRootPrefix = deployRootPrefix
+		// every target path is derived from the basedir, e.g. /etc/puppetlabs/code/environments/ becomes <deploy_root_prefix>/etc/puppetlabs/code/environments/
+		for source, sa := range config.Sources {
+			if len(sa.Basedir) > 0 {
+				sa.Basedir = normalizeDir(filepath.Join(deployRootPrefix, sa.Basedir))
+				config.Sources[source] = sa
+			}
+		}
+	}
+
+	if config.ForgeExtractFilter && len(config.ForgeExtractIgnore) == 0 {
+		config.ForgeExtractIgnore = defaultForgeExtractIgnore
+	}
+
 	if validate {
 		Validatef()
 	}
@@ -124,8 +362,174 @@ func readConfigfile(configFile string) ConfigSettings {
 	return config
 }
 
+// applyEnvironmentConfig overrides the settings of the g10k config file with the G10K_* environment variables
+// CLI parameters are applied afterwards and take precedence over both
+func applyEnvironmentConfig(config *ConfigSettings) {
+	stringSettings := map[string]*string{
+		"G10K_CACHEDIR":          &config.CacheDir,
+		"G10K_FORGE_BASEURL":     &config.Forge.Baseurl,
+		"G10K_FORGE_AUTH_HEADER": &config.Forge.AuthHeader,
+		"G10K_UMASK":             &config.Umask,
+	}
+	intSettings := map[string]*int{
+		"G10K_TIMEOUT":                   &config.Timeout,
+		"G10K_MAXWORKER":                 &config.Maxworker,
+		"G10K_MAXEXTRACTWORKER":          &config.MaxExtractworker,
+		"G10K_MAX_MEMORY_MB":             &config.MaxMemoryMB,
+		"G10K_READ_CONCURRENCY":          &config.ReadConcurrency,
+		"G10K_WRITE_CONCURRENCY":         &config.WriteConcurrency,
+		"G10K_FETCH_RATE_LIMIT_KBPS":     &config.FetchRateLimitKBps,
+		"G10K_RAMP_UP_SECONDS":           &config.RampUpSeconds,
+		"G10K_UNTAR_RETRIES":             &config.UntarRetries,
+		"G10K_TRUNCATED_ARCHIVE_RETRIES": &config.TruncatedArchiveRetries,
+		"G10K_MIN_FREE_DISK_MB":          &config.MinFreeDiskMB,
+	}
+	boolSettings := map[string]*bool{
+		"G10K_IGNORE_UNREACHABLE_MODULES":      &config.IgnoreUnreachableModules,
+		"G10K_USE_CACHE_FALLBACK":              &config.UseCacheFallback,
+		"G10K_RETRY_GIT_COMMANDS":              &config.RetryGitCommands,
+		"G10K_FETCH_TAGS":                      &config.FetchTags,
+		"G10K_GIT_OBJECT_SYNTAX_NOT_SUPPORTED": &config.GitObjectSyntaxNotSupported,
+		"G10K_TRUST_GIT_REFS":                  &config.TrustGitRefs,
+		"G10K_PARTIAL_CLONE":                   &config.PartialClone,
+		"G10K_HTTPS_FALLBACK":                  &config.HTTPSFallback,
+	}
+
+	for envName, setting := range stringSettings {
+		if value, ok := os.LookupEnv(envName); ok && len(value) > 0 {
+			if envName == "G10K_FORGE_AUTH_HEADER" {
+				// do not log credentials
+				Debugf("Found environment variable " + envName)
+			} else {
+				Debugf("Found environment variable " + envName + " set to: " + value)
+			}
+			*setting = value
+		}
+	}
+	for envName, setting := range intSettings {
+		if value, ok := os.LookupEnv(envName); ok && len(value) > 0 {
+			Debugf("Found environment variable " + envName + " set to: " + value)
+			i, err := strconv.Atoi(value)
+			if err != nil || i < 0 {
+				Fatalf("readConfigfile(): Can not convert value " + value + " of environment variable " + envName + " to a positive number")
+			}
+			*setting = i
+		}
+	}
+	for envName, setting := range boolSettings {
+		if value, ok := os.LookupEnv(envName); ok && len(value) > 0 {
+			Debugf("Found environment variable " + envName + " set to: " + value)
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				Fatalf("readConfigfile(): Can not convert value " + value + " of environment variable " + envName + " to boolean")
+			}
+			*setting = b
+		}
+	}
+}
+
+// readConfigfileData reads the given g10k config file and merges the config files of its include directive into it
+// later included config files override the settings of the previous ones, hashes like the sources are merged by their keys
+func readConfigfileData(configFile string, includeStack []string) map[interface{}]interface{} {
+	Debugf("Trying to read g10k config file: " + configFile)
+	absConfigFile, err := filepath.Abs(configFile)
+	if err != nil {
+		Fatalf("readConfigfile(): Error while resolving the absolute path of config file " + configFile + ": " + err.Error())
+	}
+	for _, includingFile := range includeStack {
+		if includingFile == absConfigFile {
+			Fatalf("readConfigfile(): Error circular include of config file " + absConfigFile + " detected: " + strings.Join(append(includeStack, absConfigFile), " -> "))
+		}
+	}
+	includeStack = append(includeStack, absConfigFile)
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
+	}
+
+	rubySymbolsRemoved := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		reWhitespaceColon := regexp.MustCompile("^(\\s*):")
+		m := reWhitespaceColon.FindStringSubmatch(line)
+		if len(m) > 0 {
+			rubySymbolsRemoved += reWhitespaceColon.ReplaceAllString(line, m[1]) + "\n"
+		} else {
+			rubySymbolsRemoved += line + "\n"
+		}
+	}
+	configData := make(map[interface{}]interface{})
+	err = yaml.Unmarshal([]byte(rubySymbolsRemoved), &configData)
+	if err != nil {
+		Fatalf("YAML unmarshal error: " + err.Error())
+	}
+
+	includes := []string{}
+	switch include := configData["include"].(type) {
+	case nil:
+	case string:
+		includes = append(includes, include)
+	case []interface{}:
+		for _, includeFile := range include {
+			if includeString, ok := includeFile.(string); ok {
+				includes = append(includes, includeString)
+			} else {
+				Fatalf("readConfigfile(): Error include directive in config file " + configFile + " must only contain file names")
+			}
+		}
+	default:
+		Fatalf("readConfigfile(): Error include directive in config file " + configFile + " must be a file name or a list of file names")
+	}
+	delete(configData, "include")
+
+	for _, includeFile := range includes {
+		// relative paths are relative to the directory of the including config file
+		if !filepath.IsAbs(includeFile) {
+			includeFile = filepath.Join(filepath.Dir(configFile), includeFile)
+		}
+		Debugf("including config file " + includeFile + " in " + configFile)
+		configData = mergeConfigData(configData, readConfigfileData(includeFile, includeStack))
+	}
+
+	return configData
+}
+
+// mergeConfigData merges the override config settings into the base config settings
+// hashes are merged recursively, all other values are replaced
+func mergeConfigData(base map[interface{}]interface{}, override map[interface{}]interface{}) map[interface{}]interface{} {
+	for key, overrideValue := range override {
+		baseMap, baseIsMap := base[key].(map[interface{}]interface{})
+		overrideMap, overrideIsMap := overrideValue.(map[interface{}]interface{})
+		if baseIsMap && overrideIsMap {
+			base[key] = mergeConfigData(baseMap, overrideMap)
+		} else {
+			base[key] = overrideValue
+		}
+	}
+	return base
+}
+
+// normalizeStrictHostKeyChecking converts the given toggle to a StrictHostKeyChecking value of ssh
+func normalizeStrictHostKeyChecking(value string) (string, bool) {
+	switch strings.ToLower(value) {
+	case "true", "yes":
+		return "yes", true
+	case "false", "no":
+		return "no", true
+	case "accept-new":
+		return "accept-new", true
+	}
+	return "", false
+}
+
 // preparePuppetfile remove whitespace and comment lines from the given Puppetfile and merges Puppetfile resources that are identified with having a , at the end
 func preparePuppetfile(pf string) string {
+	pfString, _ := preparePuppetfileWithLineNumbers(pf)
+	return pfString
+}
+
+// preparePuppetfileWithLineNumbers works like preparePuppetfile and also returns the line number in the Puppetfile at which each of the merged lines starts
+func preparePuppetfileWithLineNumbers(pf string) (string, []int) {
 	file, err := os.Open(pf)
 	if err != nil {
 		Fatalf("preparePuppetfile(): Error while opening Puppetfile " + pf + " Error: " + err.Error())
@@ -137,20 +541,29 @@ func preparePuppetfile(pf string) string {
 	reEmpty := regexp.MustCompile("^$")
 
 	pfString := ""
+	lineNumbers := []int{}
+	lineNumber := 0
+	startLineNumber := 0
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
+		lineNumber++
 		line := strings.TrimSpace(scanner.Text())
 		if !reComment.MatchString(line) && !reEmpty.MatchString(line) {
 			if strings.Contains(line, "#") {
 				Debugf("found inline comment in " + pf + "line: " + line)
 				line = strings.Split(line, "#")[0]
 			}
+			if startLineNumber == 0 {
+				startLineNumber = lineNumber
+			}
 			if reComma.MatchString(line) {
 				pfString += line
 				Debugf("adding line:" + line)
 			} else {
 				pfString += line + "\n"
 				Debugf("adding line:" + line)
+				lineNumbers = append(lineNumbers, startLineNumber)
+				startLineNumber = 0
 			}
 		}
 	}
@@ -158,24 +571,27 @@ func preparePuppetfile(pf string) string {
 		Fatalf("preparePuppetfile(): Error while scanning Puppetfile " + pf + " Error: " + err.Error())
 	}
 
-	return pfString
+	return pfString, lineNumbers
 }
 
 // readPuppetfile creates the ConfigSettings struct from the Puppetfile
 func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions bool, replacedPuppetfileContent bool) Puppetfile {
+	if replacedPuppetfileContent {
+		return parsePuppetfile(pf, pf, nil, sshKey, source, forceForgeVersions)
+	}
+	Debugf("Trying to parse: " + pf)
+	n, lineNumbers := preparePuppetfileWithLineNumbers(pf)
+	return parsePuppetfile(pf, n, lineNumbers, sshKey, source, forceForgeVersions)
+}
+
+// parsePuppetfile parses the prepared content n of the Puppetfile pf, lineNumbers contains the line number in pf of each line of n if known
+func parsePuppetfile(pf string, n string, lineNumbers []int, sshKey string, source string, forceForgeVersions bool) Puppetfile {
+	defer timeTrack(time.Now(), funcName())
 	var puppetFile Puppetfile
-	var n string
 	puppetFile.privateKey = sshKey
 	puppetFile.source = source
 	puppetFile.forgeModules = map[string]ForgeModule{}
 	puppetFile.gitModules = map[string]GitModule{}
-	if replacedPuppetfileContent {
-		Debugf("Using replaced Puppetfile content, probably because a Git module was found in Forge notation")
-		n = pf
-	} else {
-		Debugf("Trying to parse: " + pf)
-		n = preparePuppetfile(pf)
-	}
 
 	reEmptyLine := regexp.MustCompile("^\\s*$")
 	reModuledir := regexp.MustCompile("^\\s*(?:moduledir)\\s+['\"]?([^'\"]+)['\"]?")
@@ -184,11 +600,33 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 	reForgeModule := regexp.MustCompile("^\\s*(?:mod)\\s+['\"]?([^'\"]+[-/][^'\"]+)['\"](?:\\s*)[,]?(.*)")
 	reForgeAttribute := regexp.MustCompile("\\s*['\"]?([^\\s'\"]+)\\s*['\"]?(?:=>)?\\s*['\"]?([^'\"]+)?")
 	reGitModule := regexp.MustCompile("^\\s*(?:mod)\\s+['\"]?([^'\"/]+)['\"]\\s*,(.*)")
-	reGitAttribute := regexp.MustCompile("\\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local)\\s*=>\\s*['\"]?([^'\"]+)['\"]?")
-	reUniqueGitAttribute := regexp.MustCompile("\\s*:(?:commit|tag|branch|ref|link)\\s*=>")
+	reGitAttribute := regexp.MustCompile("\\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|fetch_refspec|fetch_tags|https_fallback|timeout|ssh_port|ssh_known_hosts|ssh_strict_host_key_checking|private_key|target_name|tarball|sha256sum|targets|shallow_since|post_sync)\\s*=>\\s*['\"]?([^'\"]+)['\"]?")
+	reUniqueGitAttribute := regexp.MustCompile("\\s*:(?:commit|tag|branch|ref|link|targets)\\s*=>")
 	reDanglingAttribute := regexp.MustCompile("^\\s*:[^ ]+\\s*=>")
+	// used to detect attributes that are set multiple times for the same module
+	reGitAttributeKey := []*regexp.Regexp{}
+	for _, attribute := range []string{"git", "tag", "branch", "ref", "link"} {
+		reGitAttributeKey = append(reGitAttributeKey, regexp.MustCompile(":"+attribute+"\\s*=>"))
+	}
 	moduleDir := "modules/"
 	var moduleDirs []string
+	// contains the index of the line each module got declared in to report duplicate module declarations
+	moduleLines := make(map[string]int)
+	getLineNumber := func(i int) string {
+		if i < len(lineNumbers) {
+			return strconv.Itoa(lineNumbers[i])
+		}
+		return strconv.Itoa(i + 1)
+	}
+	duplicateModule := func(message string, moduleName string, i int) {
+		message += " (declared in line " + getLineNumber(moduleLines[moduleName]) + " and line " + getLineNumber(i) + ")"
+		if !config.WarnDuplicateModules {
+			Fatalf(message)
+		}
+		Warnf("WARN: " + strings.TrimPrefix(message, "Error: ") + ", using the last declaration")
+		delete(puppetFile.gitModules, moduleName)
+		delete(puppetFile.forgeModules, moduleName)
+	}
 	//nextLineAttr := false
 
 	lines := strings.Split(n, "\n")
@@ -197,8 +635,10 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 		if m := reEmptyLine.FindStringSubmatch(line); len(m) > 0 {
 			continue
 		}
-		if strings.Count(line, ":git") > 1 || strings.Count(line, ":tag") > 1 || strings.Count(line, ":branch") > 1 || strings.Count(line, ":ref") > 1 || strings.Count(line, ":link") > 1 {
-			Fatalf("Error: trailing comma found in " + pf + " somewhere here: " + line)
+		for _, reKey := range reGitAttributeKey {
+			if len(reKey.FindAllString(line, -1)) > 1 {
+				Fatalf("Error: trailing comma found in " + pf + " somewhere here: " + line)
+			}
 		}
 		if m := reDanglingAttribute.FindStringSubmatch(line); len(m) >= 1 {
 			previousLine := ""
@@ -208,13 +648,19 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 			Fatalf("Error: found dangling module attribute in " + pf + " somewhere here: " + previousLine + line + " Check for missing , at the end of the line.")
 		}
 		if m := reModuledir.FindStringSubmatch(line); len(m) > 1 {
+			// the modules declared before the first moduledir are deployed to the default module directory, which needs to be purged as well
+			if len(moduleDirs) == 0 && len(moduleLines) > 0 {
+				moduleDirs = append(moduleDirs, moduleDir)
+			}
 			// moduledir CLI parameter override
 			if len(moduleDirParam) != 0 {
 				moduleDir = moduleDirParam
 			} else {
-				moduleDir = normalizeDir(m[1])
+				moduleDir = normalizeDir(strings.TrimSpace(m[1]))
+			}
+			if !stringSliceContains(moduleDirs, moduleDir) {
+				moduleDirs = append(moduleDirs, moduleDir)
 			}
-			moduleDirs = append(moduleDirs, moduleDir)
 		} else if m := reForgeBaseURL.FindStringSubmatch(line); len(m) > 1 {
 			puppetFile.forgeBaseURL = m[1]
 			//fmt.Println("found forge base URL parameter ---> ", m[1])
@@ -238,7 +684,7 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 			}
 			forgeModuleName = comp[0] + "/" + comp[1]
 			if _, ok := puppetFile.forgeModules[comp[1]]; ok {
-				Fatalf("Error: Duplicate forge module found in " + pf + " for module " + forgeModuleName + " line: " + line)
+				duplicateModule("Error: Duplicate forge module found in "+pf+" for module "+forgeModuleName+" line: "+line, comp[1], i)
 			}
 			//Debugf("Found Forge module name " + forgeModuleName + " with " + forgeModuleNameSeparator + " as a separator")
 			forgeModuleVersion := "present"
@@ -250,6 +696,12 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 				//fmt.Println("found forge mod attribute array ---> ", forgeModuleAttributesArray)
 				//fmt.Println("len(forgeModuleAttributesArray) --> ", len(forgeModuleAttributesArray))
 				for i := 0; i <= strings.Count(forgeModuleAttributes, ","); i++ {
+					if quoted := strings.TrimSpace(forgeModuleAttributesArray[i]); len(quoted) > 1 && strings.ContainsAny(quoted[:1], "'\"") && strings.ContainsAny(quoted, " <>=~^|*") {
+						// a quoted version range like '>= 5.0.0 < 6.0.0'
+						forgeModuleVersion = strings.TrimSpace(strings.Trim(quoted, "'\""))
+						Debugf("setting forge module " + forgeModuleName + " to version range " + forgeModuleVersion)
+						continue
+					}
 					a := reForgeAttribute.FindStringSubmatch(forgeModuleAttributesArray[i])
 					//fmt.Println("a[1] ---> ", a[1])
 					forgeAttribute := strings.Replace(strings.TrimSpace(a[1]), ":", "", 1)
@@ -278,7 +730,8 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 								//fmt.Print("n:", n)
 								newN := strings.Replace(n, line, replacedLine, 1)
 								//fmt.Print("newN:", newN)
-								return readPuppetfile(newN, sshKey, source, forceForgeVersions, true)
+								Debugf("Using replaced Puppetfile content, probably because a Git module was found in Forge notation")
+								return parsePuppetfile(pf, newN, lineNumbers, sshKey, source, forceForgeVersions)
 							}
 						}
 					}
@@ -288,9 +741,14 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 				Fatalf("Error: Found " + forgeModuleVersion + " setting for forge module in " + pf + " for module " + forgeModuleName + " line: " + line + " and force_forge_versions is set to true! Please specify a version (e.g. '2.3.0')")
 			}
 			if _, ok := puppetFile.gitModules[comp[1]]; ok {
-				Fatalf("Error: Forge Puppet module with same name found in " + pf + " for module " + comp[1] + " line: " + line)
+				duplicateModule("Error: Forge Puppet module with same name found in "+pf+" for module "+comp[1]+" line: "+line, comp[1], i)
+			}
+			moduleLines[comp[1]] = i
+			if ftg, ok := getForgeToGit(comp[0], comp[1]); ok {
+				puppetFile.gitModules[comp[1]] = getForgeToGitModule(ftg, comp[0], comp[1], moduleDir, getLineNumber(i))
+			} else {
+				puppetFile.forgeModules[comp[1]] = ForgeModule{version: forgeModuleVersion, name: comp[1], author: comp[0], sha256sum: forgeChecksum, moduleDir: moduleDir}
 			}
-			puppetFile.forgeModules[comp[1]] = ForgeModule{version: forgeModuleVersion, name: comp[1], author: comp[0], sha256sum: forgeChecksum, moduleDir: moduleDir}
 		} else if m := reGitModule.FindStringSubmatch(line); len(m) > 1 {
 			gitModuleName := m[1]
 			//fmt.Println("found git mod name ---> ", gitModuleName)
@@ -301,14 +759,11 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 			if len(m[2]) > 1 {
 				gitModuleAttributes := m[2]
 				//fmt.Println("found git mod attribute ---> ", gitModuleAttributes)
-				if strings.Count(gitModuleAttributes, ":git") < 1 && strings.Count(gitModuleAttributes, ":local") < 1 {
+				if strings.Count(gitModuleAttributes, ":git") < 1 && strings.Count(gitModuleAttributes, ":local") < 1 && strings.Count(gitModuleAttributes, ":tarball") < 1 {
 					Fatalf("Error: Missing :git url in " + pf + " for module " + gitModuleName + " line: " + line)
 				}
-				if strings.Count(gitModuleAttributes, ",") > 3 {
-					Fatalf("Error: Too many attributes in " + pf + " for module " + gitModuleName + " line: " + line)
-				}
 				if _, ok := puppetFile.gitModules[gitModuleName]; ok {
-					Fatalf("Error: Duplicate module found in " + pf + " for module " + gitModuleName + " line: " + line)
+					duplicateModule("Error: Duplicate module found in "+pf+" for module "+gitModuleName+" line: "+line, gitModuleName, i)
 				}
 				gas := reUniqueGitAttribute.FindAllStringSubmatch(gitModuleAttributes, -1)
 				cga := ""
@@ -319,7 +774,10 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 					Fatalf("Error: Found conflicting git attributes " + cga + "in " + pf + " for module " + gitModuleName + " line: " + line)
 				}
 				puppetFile.gitModules[gitModuleName] = GitModule{}
-				gm := GitModule{moduleDir: moduleDir}
+				gm := GitModule{moduleDir: moduleDir, lineNumber: getLineNumber(i)}
+				// the target directory names and refs of :targets in the order of the Puppetfile
+				targetNames := []string{}
+				targetRefs := make(map[string]string)
 				gitModuleAttributesArray := strings.Split(gitModuleAttributes, ",")
 				//fmt.Println("found git mod attribute array ---> ", gitModuleAttributesArray)
 				//fmt.Println("len(gitModuleAttributesArray) --> ", len(gitModuleAttributesArray))
@@ -335,10 +793,10 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 					}
 					gitModuleAttribute := a[1]
 					if gitModuleAttribute == "git" {
-						if strings.Contains(a[2], "ProxyCommand") {
+						gm.git = rewriteGitURL(a[2])
+						if strings.Contains(gm.git, "ProxyCommand") {
 							Fatalf("Error: Found ProxyCommand option in git url in " + pf + " for module " + gitModuleName + " line: " + line)
 						}
-						gm.git = a[2]
 					} else if gitModuleAttribute == "branch" {
 						if a[2] == ":control_branch" || a[2] == "control_branch" {
 							gm.link = true
@@ -348,11 +806,31 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 					} else if gitModuleAttribute == "tag" {
 						gm.tag = a[2]
 					} else if gitModuleAttribute == "commit" {
+						if !reCommitHash.MatchString(a[2]) {
+							Fatalf("Error: Invalid commit hash " + a[2] + " of parameter " + gitModuleAttribute + ", must be 7 to 40 hexadecimal characters. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
 						gm.commit = a[2]
 					} else if gitModuleAttribute == "ref" {
 						gm.ref = a[2]
 					} else if gitModuleAttribute == "install_path" {
 						gm.installPath = a[2]
+					} else if gitModuleAttribute == "target_name" {
+						if strings.Contains(a[2], "/") || a[2] == "." || a[2] == ".." {
+							Fatalf("Error: Invalid value " + a[2] + " of parameter " + gitModuleAttribute + ", must be a plain directory name. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.targetName = a[2]
+					} else if gitModuleAttribute == "targets" {
+						for _, target := range strings.Split(a[2], "|") {
+							nameRef := strings.SplitN(strings.TrimSpace(target), "=", 2)
+							if len(nameRef) != 2 || len(nameRef[0]) == 0 || len(nameRef[1]) == 0 || strings.Contains(nameRef[0], "/") || nameRef[0] == "." || nameRef[0] == ".." {
+								Fatalf("Error: Invalid value " + target + " of parameter " + gitModuleAttribute + ", must be a plain directory name and a ref like mymod_next=v2.0.0. In " + pf + " for module " + gitModuleName + " line: " + line)
+							}
+							if _, ok := targetRefs[nameRef[0]]; ok {
+								Fatalf("Error: Duplicate target " + nameRef[0] + " of parameter " + gitModuleAttribute + " in " + pf + " for module " + gitModuleName + " line: " + line)
+							}
+							targetNames = append(targetNames, nameRef[0])
+							targetRefs[nameRef[0]] = nameRef[1]
+						}
 					} else if gitModuleAttribute == "link" {
 						link, err := strconv.ParseBool(a[2])
 						if err != nil {
@@ -372,25 +850,138 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 							//fmt.Println("--------> ", i, strings.TrimSpace(fallbackBranch))
 							gm.fallback[i] = strings.TrimSpace(fallbackBranch)
 						}
-					} else if gitModuleAttribute == "local" {
-						local, err := strconv.ParseBool(a[2])
+					} else if gitModuleAttribute == "fetch_refspec" {
+						for _, refspec := range strings.Split(a[2], "|") {
+							gm.fetchRefspecs = append(gm.fetchRefspecs, strings.TrimSpace(refspec))
+						}
+					} else if gitModuleAttribute == "fetch_tags" {
+						fetchTags, err := strconv.ParseBool(a[2])
 						if err != nil {
 							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
 						}
-						if local {
+						gm.fetchTags = fetchTags
+					} else if gitModuleAttribute == "https_fallback" {
+						httpsFallback, err := strconv.ParseBool(a[2])
+						if err != nil {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.httpsFallback = httpsFallback
+					} else if gitModuleAttribute == "shallow_since" {
+						shallowSince, ok := parseShallowSince(strings.TrimSpace(a[2]))
+						if !ok {
+							Fatalf("Error: Invalid value " + a[2] + " of parameter " + gitModuleAttribute + ", must be a date like 2024-01-31 or a number of days like 90 days ago. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.shallowSince = shallowSince
+					} else if gitModuleAttribute == "post_sync" {
+						// the post_sync command runs on the g10k host, so every author of a control repository branch could run commands there
+						if !config.AllowPostSync {
+							Fatalf("Error: Found parameter " + gitModuleAttribute + ", which is only allowed with allow_post_sync: true in the g10k config. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						// a quote inside the command would end the match of the value and the command would run truncated
+						// and the attributes are split at each comma, so the rest of a command with a comma would be an invalid setting
+						truncated := strings.TrimSpace(a[0]) != strings.TrimSpace(gitModuleAttributesArray[i])
+						splitAtComma := i+1 < len(gitModuleAttributesArray) && len(strings.TrimSpace(gitModuleAttributesArray[i+1])) > 0 && len(reGitAttribute.FindStringSubmatch(gitModuleAttributesArray[i+1])) == 0
+						if truncated || splitAtComma {
+							Fatalf("Error: The value of parameter " + gitModuleAttribute + " must not contain quotes or commas. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.postSync = strings.TrimSpace(a[2])
+					} else if gitModuleAttribute == "timeout" {
+						timeout, err := strconv.Atoi(a[2])
+						if err != nil || timeout < 1 {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to a positive number of seconds. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.timeout = timeout
+					} else if gitModuleAttribute == "ssh_port" {
+						sshPort, err := strconv.Atoi(a[2])
+						if err != nil || sshPort < 1 || sshPort > 65535 {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to a valid port. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.sshPort = sshPort
+					} else if gitModuleAttribute == "ssh_known_hosts" {
+						gm.sshKnownHosts = a[2]
+					} else if gitModuleAttribute == "private_key" {
+						gm.privateKey = a[2]
+					} else if gitModuleAttribute == "ssh_strict_host_key_checking" {
+						strictHostKeyChecking, ok := normalizeStrictHostKeyChecking(a[2])
+						if !ok {
+							Fatalf("Error: Invalid value " + a[2] + " of parameter " + gitModuleAttribute + ", must be yes, no or accept-new. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.sshStrictHostKeyChecking = strictHostKeyChecking
+					} else if gitModuleAttribute == "tarball" {
+						if !strings.HasPrefix(a[2], "https://") && !strings.HasPrefix(a[2], "http://") {
+							Fatalf("Error: Invalid value " + a[2] + " of parameter " + gitModuleAttribute + ", must be a http or https URL. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.tarball = a[2]
+					} else if gitModuleAttribute == "sha256sum" {
+						if !reSha256sum.MatchString(a[2]) {
+							Fatalf("Error: Invalid value " + a[2] + " of parameter " + gitModuleAttribute + ", must be a SHA256 sum. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.tarballSHA256 = a[2]
+					} else if gitModuleAttribute == "local" {
+						local, err := strconv.ParseBool(a[2])
+						if err != nil {
+							// :local can also point to a local working copy of the module
+							if !strings.Contains(a[2], "/") {
+								Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean or a local module directory. In " + pf + " for module " + gitModuleName + " line: " + line)
+							}
+							// a relative path is resolved against the directory of the Puppetfile, so that it does not depend on the working directory of g10k
+							localPath := a[2]
+							if !filepath.IsAbs(localPath) {
+								localPath = filepath.Join(filepath.Dir(pf), localPath)
+							}
+							localPath, err := filepath.Abs(localPath)
+							if err != nil {
+								Fatalf("Error: Can not resolve the local module directory " + a[2] + " in " + pf + " for module " + gitModuleName + " line: " + line + " Error: " + err.Error())
+							}
+							gm.localPath = localPath
+						} else if local {
 							gm.local = true
 						}
 					}
 
 				}
-				if _, ok := puppetFile.forgeModules[gitModuleName]; ok {
-					Fatalf("Error: Git Puppet module with same name found in " + pf + " for module " + gitModuleName + " line: " + line)
+				if len(gm.tarball) > 0 && (len(gm.git) > 0 || gm.local || len(gm.localPath) > 0) {
+					Fatalf("Error: Found conflicting module sources :tarball and :git or :local in " + pf + " for module " + gitModuleName + " line: " + line)
 				}
-				if config.IgnoreUnreachableModules {
-					Debugf("Setting :ignore_unreachable for Git module " + gitModuleName)
-					gm.ignoreUnreachable = true
+				if len(gm.tarballSHA256) > 0 && len(gm.tarball) == 0 {
+					Fatalf("Error: Found :sha256sum without :tarball in " + pf + " for module " + gitModuleName + " line: " + line)
+				}
+				gitModules := map[string]GitModule{gitModuleName: gm}
+				if len(targetNames) > 0 {
+					if len(gm.git) == 0 || len(gm.targetName) > 0 {
+						Fatalf("Error: Found :targets without :git or with :target_name in " + pf + " for module " + gitModuleName + " line: " + line)
+					}
+					// each target gets deployed like a git module of its own, all of them share the cached git repository
+					delete(puppetFile.gitModules, gitModuleName)
+					gitModules = make(map[string]GitModule)
+					for _, targetName := range targetNames {
+						tgm := gm
+						tgm.ref = targetRefs[targetName]
+						tgm.fetchRefspecs = append([]string{}, gm.fetchRefspecs...)
+						gitModules[targetName] = tgm
+						if _, ok := puppetFile.gitModules[targetName]; ok {
+							duplicateModule("Error: Duplicate module found in "+pf+" for target "+targetName+" of module "+gitModuleName+" line: "+line, targetName, i)
+						}
+					}
+				} else {
+					targetNames = []string{gitModuleName}
+				}
+				for _, name := range targetNames {
+					gm := gitModules[name]
+					if _, ok := puppetFile.forgeModules[name]; ok {
+						duplicateModule("Error: Git Puppet module with same name found in "+pf+" for module "+name+" line: "+line, name, i)
+					}
+					moduleLines[name] = i
+					// a full ref path like refs/pull/42/head needs its namespace in the mirror
+					if refspec := getRefNamespaceFetchRefspec(gm.ref); len(refspec) > 0 && !stringSliceContains(gm.fetchRefspecs, refspec) {
+						gm.fetchRefspecs = append(gm.fetchRefspecs, refspec)
+					}
+					if config.IgnoreUnreachableModules {
+						Debugf("Setting :ignore_unreachable for Git module " + name)
+						gm.ignoreUnreachable = true
+					}
+					puppetFile.gitModules[name] = gm
 				}
-				puppetFile.gitModules[gitModuleName] = gm
 			}
 		} else {
 			// for now only in dry run mode
@@ -402,6 +993,9 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 
 	}
 
+	checkModuleDirCollisions(puppetFile, pf)
+	checkModuleRefs(puppetFile, pf)
+
 	if len(moduleDirs) < 1 {
 		// adding at least the default module directory
 		moduleDirs = append(moduleDirs, moduleDir)
@@ -415,3 +1009,63 @@ func readPuppetfile(pf string, sshKey string, source string, forceForgeVersions
 	//fmt.Printf("%+v\n", puppetFile)
 	return puppetFile
 }
+
+// checkModuleDirCollisions makes sure that no two modules of the Puppetfile get deployed to the same directory
+func checkModuleDirCollisions(puppetFile Puppetfile, pf string) {
+	moduleDirectories := make(map[string]string)
+	names := make([]string, 0, len(puppetFile.gitModules)+len(puppetFile.forgeModules))
+	directories := make(map[string]string)
+	for gitName, gm := range puppetFile.gitModules {
+		dirName := gitName
+		if len(gm.targetName) > 0 {
+			dirName = gm.targetName
+		}
+		if len(gm.installPath) > 0 {
+			directories[gitName] = filepath.Join(gm.installPath, dirName)
+		} else {
+			directories[gitName] = filepath.Join(gm.moduleDir, dirName)
+		}
+		names = append(names, gitName)
+	}
+	for forgeModuleName, fm := range puppetFile.forgeModules {
+		directories[forgeModuleName] = filepath.Join(fm.moduleDir, fm.name)
+		names = append(names, forgeModuleName)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := directories[name]
+		if otherName, ok := moduleDirectories[dir]; ok {
+			Fatalf("Error: Modules " + otherName + " and " + name + " both resolve to the same module directory " + dir + " in " + pf)
+		}
+		moduleDirectories[dir] = name
+	}
+}
+
+// checkModuleRefs makes sure that every git module which is pinned to the commit of another git module with
+// :ref => 'module:<name>' references an existing git module of the Puppetfile and that these references contain no cycle
+func checkModuleRefs(puppetFile Puppetfile, pf string) {
+	for gitName, gm := range puppetFile.gitModules {
+		if !strings.HasPrefix(gm.ref, moduleRefPrefix) {
+			continue
+		}
+		chain := []string{gitName}
+		current := gm
+		for strings.HasPrefix(current.ref, moduleRefPrefix) {
+			refName := strings.TrimPrefix(current.ref, moduleRefPrefix)
+			refModule, ok := puppetFile.gitModules[refName]
+			if !ok {
+				Fatalf("Error: Git module " + chain[len(chain)-1] + " references the commit of module " + refName + ", but there is no git module " + refName + " in " + pf)
+			}
+			if refModule.local || len(refModule.localPath) > 0 || len(refModule.tarball) > 0 {
+				Fatalf("Error: Git module " + chain[len(chain)-1] + " references the commit of module " + refName + ", which is a local module in " + pf)
+			}
+			for _, name := range chain {
+				if name == refName {
+					Fatalf("Error: Found cycle in module references " + strings.Join(append(chain, refName), " -> ") + " in " + pf)
+				}
+			}
+			chain = append(chain, refName)
+			current = refModule
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// getContentHash returns a SHA256 sum over the sorted relative paths, modes and content hashes of all files, directories and symlinks in dir
+// symlinks are hashed by their target without following them, the .g10k-deploy.json files of dir itself are skipped as they contain the hash
+func getContentHash(dir string) (string, error) {
+	return hashDirContent(dir, func(rel string, info os.FileInfo) bool {
+		return strings.HasPrefix(rel, ".g10k-deploy.json")
+	})
+}
+
+// hashDirContent returns the content hash of dir like getContentHash() without the paths for which skip returns true, a skipped directory is skipped as a whole
+func hashDirContent(dir string, skip func(rel string, info os.FileInfo) bool) (string, error) {
+	dir = filepath.Clean(dir)
+	h := sha256.New()
+	// filepath.Walk visits the paths in lexical order, which makes the hash deterministic
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if rel == "." {
+			return nil
+		}
+		if skip(rel, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "l %s %s\n", rel, target)
+		case info.IsDir():
+			fmt.Fprintf(h, "d %s\n", rel)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fh := sha256.New()
+			if _, err := io.Copy(fh, f); err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "f %s %o %s\n", rel, info.Mode().Perm(), hex.EncodeToString(fh.Sum(nil)))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeContentHashes stores the content hash of each deployed Puppet environment in its .g10k-deploy.json
+// it runs after the unmanaged content got purged, so that the hash covers exactly the deployed files
+// the hash of an environment in which nothing got synced is kept, so that a later run does not accept files that were changed on disk
+func writeContentHashes(allPuppetfiles map[string]Puppetfile, st *SyncStats) {
+	defer timeTrack(time.Now(), funcName())
+	for _, pf := range allPuppetfiles {
+		if shutdownRequested() {
+			return
+		}
+		deployFile := getDeployFile(pf.workDir)
+		if !fileExists(deployFile) {
+			continue
+		}
+		dr := readDeployResultFile(deployFile)
+		if len(dr.ContentHash) > 0 && !environmentSynced(pf.workDir, st) {
+			Debugf("Keeping content hash " + dr.ContentHash + " of " + pf.workDir + ", because nothing got synced into it")
+			continue
+		}
+		contentHash, err := getContentHash(pf.workDir)
+		if err != nil {
+			Warnf("WARN: Could not compute the content hash of " + pf.workDir + " Error: " + err.Error())
+			continue
+		}
+		dr.ContentHash = contentHash
+		Debugf("Writing content hash " + contentHash + " of " + pf.workDir + " to " + deployFile)
+		writeStructJSONFile(deployFile, dr)
+	}
+}
+
+// environmentSynced returns true if the environment workDir itself or any of its modules got synced in this run
+func environmentSynced(workDir string, st *SyncStats) bool {
+	st.Lock()
+	defer st.Unlock()
+	for _, dir := range st.needSyncDirs {
+		if isSameOrSubDir(workDir, dir) {
+			return true
+		}
+	}
+	return false
+}
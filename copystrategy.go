@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// copyStrategies are the valid values of the copy_strategy setting
+var copyStrategies = []string{"untar", "copy", "reflink", "hardlink"}
+
+// ficlone is the FICLONE ioctl of Linux, which lets a file share the data blocks of another file on copy-on-write filesystems like Btrfs or XFS
+const ficlone = 0x40049409
+
+// copyStrategyFallbacks makes sure that the fallback of each copy strategy is only reported once per run
+var copyStrategyFallbacks sync.Map
+
+// reflinkFile creates target as a copy-on-write clone of the file path with mode
+func reflinkFile(path string, target string, mode os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		dst.Close()
+		os.Remove(target)
+		return errno
+	}
+	return dst.Close()
+}
+
+// isCopyStrategySupported tries the copy strategy with the .latest_commit file of the module store directory storeDir in targetDir
+// hardlinks fail across filesystems and reflinks on filesystems without copy-on-write support
+func isCopyStrategySupported(strategy string, storeDir string, targetDir string) bool {
+	probe := filepath.Join(targetDir, ".g10k-copy-strategy")
+	defer os.Remove(probe)
+	var err error
+	switch strategy {
+	case "hardlink":
+		err = os.Link(filepath.Join(storeDir, ".latest_commit"), probe)
+	case "reflink":
+		err = reflinkFile(filepath.Join(storeDir, ".latest_commit"), probe, 0644)
+	}
+	if err != nil {
+		Debugf("copy_strategy " + strategy + " is not supported from " + storeDir + " to " + targetDir + " Error: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// populateModuleDir fills the empty module directory targetDir with the module store directory storeDir of the commit commitHash of the git repository srcDir
+// using the copy_strategy, a strategy which the filesystems do not support falls back to extracting the git archive of the commit again
+func populateModuleDir(ctx context.Context, srcDir string, storeDir string, targetDir string, commitHash string, allowFail bool, ignoreUnreachable bool, timeout int, st *SyncStats) bool {
+	strategy := config.CopyStrategy
+	if !isCopyStrategySupported(strategy, storeDir, targetDir) {
+		if _, reported := copyStrategyFallbacks.LoadOrStore(strategy, true); !reported {
+			Warnf("WARN: copy_strategy " + strategy + " is not supported by the filesystem of " + targetDir + ", falling back to untar")
+		}
+		strategy = "untar"
+	}
+	switch strategy {
+	case "untar":
+		if !extractGitArchive(ctx, srcDir, targetDir, commitHash, allowFail, ignoreUnreachable, timeout, st) {
+			return false
+		}
+		if err := ioutil.WriteFile(filepath.Join(targetDir, ".latest_commit"), []byte(commitHash), 0644); err != nil {
+			Fatalf("populateModuleDir(): Error while writing " + filepath.Join(targetDir, ".latest_commit") + " Error: " + err.Error())
+		}
+	case "copy":
+		copyLocalDir(storeDir, targetDir)
+	case "hardlink":
+		linkModuleStoreDir(storeDir, targetDir)
+	case "reflink":
+		reflinkModuleStoreDir(storeDir, targetDir)
+	}
+	return true
+}
+
+// reflinkModuleStoreDir recreates the module store directory storeDir in targetDir with copy-on-write clones of its files
+func reflinkModuleStoreDir(storeDir string, targetDir string) {
+	err := filepath.Walk(storeDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(storeDir, path)
+		if relPath == "." {
+			return nil
+		}
+		target := filepath.Join(targetDir, relPath)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := reflinkFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, info.Mode()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+	})
+	if err != nil {
+		Fatalf("reflinkModuleStoreDir(): Error while reflinking module store directory " + storeDir + " to " + targetDir + " Error: " + err.Error())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// forgeReleases caches the available versions of each Forge module, as multiple environments can depend on the same module
+var forgeReleases = struct {
+	sync.Mutex
+	m map[string][]string
+}{m: make(map[string][]string)}
+
+// ModuleDependency is a dependency of a Puppet module as declared in the metadata.json of the module
+type ModuleDependency struct {
+	author             string
+	name               string
+	versionRequirement string
+	requiredBy         string
+}
+
+// String returns the dependency in the notation of an error message, e.g. puppetlabs-apt requires puppetlabs-stdlib >= 4.13.1 < 9.0.0
+func (dep ModuleDependency) String() string {
+	requirement := dep.versionRequirement
+	if len(requirement) == 0 {
+		requirement = "in any version"
+	}
+	return dep.requiredBy + " requires " + dep.author + "-" + dep.name + " " + requirement
+}
+
+// readModuleDependencies returns the dependencies declared in the metadata.json file of a Puppet module
+func readModuleDependencies(file string) []ModuleDependency {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Debugf("Could not read module metadata " + file + " to resolve its dependencies")
+		return []ModuleDependency{}
+	}
+	requiredBy := strings.Replace(gjson.GetBytes(content, "name").String(), "/", "-", -1)
+	if len(requiredBy) == 0 {
+		requiredBy = filepath.Base(filepath.Dir(file))
+	}
+	deps := []ModuleDependency{}
+	for _, d := range gjson.GetBytes(content, "dependencies").Array() {
+		comp := strings.SplitN(strings.Replace(d.Get("name").String(), "/", "-", 1), "-", 2)
+		if len(comp) != 2 {
+			Warnf("WARN: Ignoring invalid dependency name " + d.Get("name").String() + " in " + file)
+			continue
+		}
+		deps = append(deps, ModuleDependency{author: strings.ToLower(comp[0]), name: comp[1], versionRequirement: strings.TrimSpace(d.Get("version_requirement").String()), requiredBy: requiredBy})
+	}
+	return deps
+}
+
+// getForgeModuleReleases returns the versions of all releases of the Forge module, which were not deleted
+func getForgeModuleReleases(fm ForgeModule, st *SyncStats) []string {
+	moduleName := fm.author + "-" + fm.name
+	forgeReleases.Lock()
+	defer forgeReleases.Unlock()
+	if versions, ok := forgeReleases.m[moduleName]; ok {
+		return versions
+	}
+	baseURL := config.Forge.Baseurl
+	if len(fm.baseURL) > 0 {
+		baseURL = fm.baseURL
+	}
+	url := baseURL + "/v3/modules/" + moduleName + "?exclude_fields=readme+changelog+license+current_release"
+	req, err := newForgeRequest(url, "keep-alive")
+	if err != nil {
+		Fatalf("getForgeModuleReleases(): Error creating GET request for Puppetlabs forge API" + err.Error())
+	}
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		Fatalf("getForgeModuleReleases(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	before := time.Now()
+	resp, err := client.Do(req)
+	st.addSyncForgeTime(time.Since(before).Seconds())
+	if err != nil {
+		Fatalf("getForgeModuleReleases(): Error while querying the releases of Forge module " + moduleName + " from " + url + " Error: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		Fatalf("getForgeModuleReleases(): Unexpected response code while GETing " + url + " " + resp.Status + " Does the dependency " + moduleName + " really exist on the Forge?")
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		Fatalf("getForgeModuleReleases(): Error while reading response body for Forge module " + moduleName + " from " + url + ": " + err.Error())
+	}
+	versions := []string{}
+	for _, release := range gjson.GetBytes(body, "releases").Array() {
+		if deleted := release.Get("deleted_at"); deleted.Exists() && deleted.Value() != nil {
+			continue
+		}
+		versions = append(versions, release.Get("version").String())
+	}
+	forgeReleases.m[moduleName] = versions
+	return versions
+}
+
+// selectDependencyVersion returns the highest version which satisfies the version requirements of all dependencies
+func selectDependencyVersion(versions []string, deps []ModuleDependency) (string, bool) {
+	selected := ""
+	var selectedVersion [3]int
+	for _, version := range versions {
+		v, _, ok := parseVersion(version)
+		if !ok || !satisfiesDependencies(version, deps) {
+			continue
+		}
+		if len(selected) == 0 || compareVersions(v, selectedVersion) > 0 {
+			selected = version
+			selectedVersion = v
+		}
+	}
+	return selected, len(selected) > 0
+}
+
+// satisfiesDependencies returns true if version satisfies the version requirements of all dependencies
+func satisfiesDependencies(version string, deps []ModuleDependency) bool {
+	for _, dep := range deps {
+		if len(dep.versionRequirement) > 0 && !versionMatchesRequirement(version, dep.versionRequirement) {
+			return false
+		}
+	}
+	return true
+}
+
+// describeDependencies returns all dependencies as a readable list for error messages
+func describeDependencies(deps []ModuleDependency) string {
+	descriptions := []string{}
+	for _, dep := range deps {
+		descriptions = append(descriptions, dep.String())
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// resolveModuleDependencies adds the missing dependencies of the modules of the Puppetfile as Forge modules to the first moduledir of the Puppet environment
+// the metadata.json of the added modules is resolved recursively, each module is only added once so that circular dependencies terminate
+// it returns the module directories of the added dependencies, so that they do not get purged
+func resolveModuleDependencies(env string, pf Puppetfile, st *SyncStats) []string {
+	defer timeTrack(time.Now(), funcName())
+	moduleDir := normalizeDir(filepath.Join(pf.workDir, pf.moduleDirs[0]))
+	// the modules declared in the Puppetfile always satisfy a dependency of the same name, even if they are from a different author
+	declared := make(map[string]string)
+	metadataFiles := []string{}
+	for gitName, gitModule := range pf.gitModules {
+		name := gitName
+		if len(gitModule.targetName) > 0 {
+			name = gitModule.targetName
+		}
+		dir := filepath.Join(pf.workDir, gitModule.moduleDir, name)
+		if len(gitModule.installPath) > 0 {
+			dir = filepath.Join(pf.workDir, gitModule.installPath, name)
+		}
+		declared[name] = filepath.Join(dir, "metadata.json")
+		metadataFiles = append(metadataFiles, declared[name])
+	}
+	for _, fm := range pf.forgeModules {
+		declared[fm.name] = filepath.Join(pf.workDir, fm.moduleDir, fm.name, "metadata.json")
+		metadataFiles = append(metadataFiles, declared[fm.name])
+	}
+
+	requirements := make(map[string][]ModuleDependency)
+	resolved := make(map[string]ForgeModule)
+	resolvedDirs := []string{}
+	for len(metadataFiles) > 0 {
+		sort.Strings(metadataFiles)
+		missing := []string{}
+		for _, file := range metadataFiles {
+			for _, dep := range readModuleDependencies(file) {
+				if _, ok := requirements[dep.name]; !ok {
+					if _, ok := declared[dep.name]; !ok {
+						missing = append(missing, dep.name)
+					}
+				}
+				requirements[dep.name] = append(requirements[dep.name], dep)
+			}
+		}
+		metadataFiles = []string{}
+
+		// new requirements of this round must also be satisfied by the already added dependencies
+		for name, fm := range resolved {
+			if !satisfiesDependencies(fm.version, requirements[name]) {
+				Fatalf("resolveModuleDependencies(): Error: Conflicting version requirements in environment " + env + " for dependency " + fm.author + "-" + name + ", version " + fm.version + " was already added, but: " + describeDependencies(requirements[name]))
+			}
+		}
+
+		for _, name := range missing {
+			deps := requirements[name]
+			if _, ok := resolved[name]; ok || shutdownRequested() {
+				continue
+			}
+			fm := ForgeModule{author: deps[0].author, name: name, baseURL: pf.forgeBaseURL, cacheTTL: pf.forgeCacheTTL, moduleDir: pf.moduleDirs[0]}
+			if !isForgeModuleAllowed(fm.author, name) {
+				message := "dependency " + fm.author + "-" + name + " of environment " + env + " is not on the forge_allowlist, required by: " + describeDependencies(deps)
+				if config.ForgeAllowlistMode != "warn" {
+					Fatalf("resolveModuleDependencies(): Error: " + message)
+				}
+				Warnf("WARN: Forge module " + message)
+			}
+			version, ok := selectDependencyVersion(getForgeModuleReleases(fm, st), deps)
+			if !ok {
+				Fatalf("resolveModuleDependencies(): Error: No release of Forge module " + fm.author + "-" + name + " satisfies the version requirements in environment " + env + ": " + describeDependencies(deps))
+			}
+			fm.version = version
+			resolved[name] = fm
+			Infof("Adding Forge module " + fm.author + "-" + name + " in version " + version + " to environment " + env + ", because " + describeDependencies(deps))
+			doModuleInstallOrNothing(fm, st)
+			syncForgeToModuleDir(name, fm, moduleDir, env, st)
+			resolvedDirs = append(resolvedDirs, moduleDir+name)
+			metadataFiles = append(metadataFiles, config.ForgeCacheDir+fm.author+"-"+name+"-"+version+"/metadata.json")
+		}
+	}
+
+	// modules declared in the Puppetfile are never replaced, but the user should know if they do not fit
+	for name, file := range declared {
+		if deps, ok := requirements[name]; ok && fileExists(file) {
+			version := readModuleMetadata(file, st).version
+			if !satisfiesDependencies(version, deps) {
+				Warnf("WARN: Module " + name + " in version " + version + " declared in the Puppetfile of environment " + env + " does not satisfy all dependencies: " + describeDependencies(deps))
+			}
+		}
+	}
+	return resolvedDirs
+}
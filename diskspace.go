@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// getFreeDiskMB returns the MiB available to unprivileged users on the filesystem which contains path
+// path does not need to exist yet, then its nearest existing parent directory is used
+func getFreeDiskMB(path string) (uint64, error) {
+	dir := filepath.Clean(path)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize) / 1024 / 1024, nil
+}
+
+// hasFreeDiskSpace returns false and the reason if less than min_free_disk_mb are available on the filesystem which contains targetDir
+// it always returns true if min_free_disk_mb is not set, a failed check only results in a warning
+func hasFreeDiskSpace(targetDir string) (bool, string) {
+	if config.MinFreeDiskMB <= 0 {
+		return true, ""
+	}
+	freeMB, err := getFreeDiskMB(targetDir)
+	if err != nil {
+		Warnf("hasFreeDiskSpace(): WARN: Could not check the free disk space of the filesystem containing " + targetDir + " Error: " + err.Error())
+		return true, ""
+	}
+	if freeMB < uint64(config.MinFreeDiskMB) {
+		return false, "only " + strconv.FormatUint(freeMB, 10) + " MB are free on the filesystem containing " + targetDir + ", but min_free_disk_mb is set to " + strconv.Itoa(config.MinFreeDiskMB)
+	}
+	return true, ""
+}
+
+// checkFreeDiskSpace exits if less than min_free_disk_mb are available on the filesystem which contains targetDir
+func checkFreeDiskSpace(targetDir string) {
+	if ok, reason := hasFreeDiskSpace(targetDir); !ok {
+		Fatalf("checkFreeDiskSpace(): Error: Not enough free disk space, " + reason)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// maxExecTraceOutput is the number of bytes of the command output that get written to the exec trace file
+const maxExecTraceOutput = 4096
+
+// ExecTraceEntry is a line of the exec trace file, which records a command executed by g10k and its result
+type ExecTraceEntry struct {
+	Command    string  `json:"command"`
+	Duration   float64 `json:"duration_seconds"`
+	ReturnCode int     `json:"return_code"`
+	Output     string  `json:"output"`
+	Stderr     string  `json:"stderr,omitempty"`
+}
+
+// execTrace contains the file to which the executed commands get recorded and the recorded results that get replayed
+var execTrace = struct {
+	sync.Mutex
+	file   *os.File
+	replay map[string][]ExecTraceEntry
+}{}
+
+// openExecTrace creates the exec trace file to which every command executed by g10k gets appended
+func openExecTrace(file string) {
+	execTrace.Lock()
+	defer execTrace.Unlock()
+	f, err := os.Create(file)
+	if err != nil {
+		Fatalf("openExecTrace(): Error while creating exec trace file " + file + " Error: " + err.Error())
+	}
+	execTrace.file = f
+}
+
+// readExecReplay reads the recorded results of an exec trace file, which get returned instead of executing the commands
+// the results of the same command are replayed in the recorded order
+func readExecReplay(file string) {
+	execTrace.Lock()
+	defer execTrace.Unlock()
+	f, err := os.Open(file)
+	if err != nil {
+		Fatalf("readExecReplay(): Error while opening exec replay file " + file + " Error: " + err.Error())
+	}
+	defer f.Close()
+	execTrace.replay = make(map[string][]ExecTraceEntry)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for i := 1; scanner.Scan(); i++ {
+		var entry ExecTraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			Fatalf("readExecReplay(): Error while parsing line " + strconv.Itoa(i) + " of exec replay file " + file + " Error: " + err.Error())
+		}
+		execTrace.replay[entry.Command] = append(execTrace.replay[entry.Command], entry)
+	}
+}
+
+// replayExecTrace returns the next recorded result of the command if an exec replay file is used
+// it fails if the command was not recorded, because the replayed run diverged from the recorded one
+func replayExecTrace(command string) (ExecTraceEntry, bool) {
+	execTrace.Lock()
+	defer execTrace.Unlock()
+	if execTrace.replay == nil {
+		return ExecTraceEntry{}, false
+	}
+	// the commands were recorded with masked secrets
+	command = maskSecrets(command)
+	entries := execTrace.replay[command]
+	if len(entries) == 0 {
+		Fatalf("replayExecTrace(): Error: No recorded result left for command " + command + " in the exec replay file")
+	}
+	execTrace.replay[command] = entries[1:]
+	return entries[0], true
+}
+
+// recordExecTrace appends the executed command and its result to the exec trace file, the output and stderr get truncated to maxExecTraceOutput bytes
+func recordExecTrace(command string, duration float64, returnCode int, output string, stderr string) {
+	execTrace.Lock()
+	defer execTrace.Unlock()
+	if execTrace.file == nil {
+		return
+	}
+	if len(output) > maxExecTraceOutput {
+		output = output[:maxExecTraceOutput]
+	}
+	if len(stderr) > maxExecTraceOutput {
+		stderr = stderr[:maxExecTraceOutput]
+	}
+	line, _ := json.Marshal(ExecTraceEntry{Command: maskSecrets(command), Duration: duration, ReturnCode: returnCode, Output: maskSecrets(output), Stderr: maskSecrets(stderr)})
+	if _, err := execTrace.file.Write(append(line, '\n')); err != nil {
+		Warnf("WARN: Could not write to exec trace file " + execTrace.file.Name() + " Error: " + err.Error())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// exportTarball writes all Puppet environments deployed in this g10k run including their .g10k-deploy.json into the tar archive tarball
+// every environment is stored in a directory named like the environment directory, the archive is gzip compressed if tarball ends with .gz or .tgz
+func exportTarball(tarball string, st *SyncStats) {
+	st.Lock()
+	workDirs := []string{}
+	for _, de := range st.deployedEnvironments {
+		workDirs = append(workDirs, de.workDir)
+	}
+	st.Unlock()
+	if len(workDirs) == 0 {
+		Fatalf("exportTarball(): Error: no Puppet environment was deployed, not creating " + tarball)
+	}
+	sort.Strings(workDirs)
+
+	tmpFile := tarball + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		Fatalf("exportTarball(): Error while creating " + tmpFile + " Error: " + err.Error())
+	}
+	var w io.Writer = file
+	var gw *gzip.Writer
+	if strings.HasSuffix(tarball, ".gz") || strings.HasSuffix(tarball, ".tgz") {
+		gw = gzip.NewWriter(file)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for _, workDir := range workDirs {
+		Debugf("Adding " + workDir + " to " + tarball)
+		writeTar(tw, workDir, filepath.Base(filepath.Clean(workDir)))
+		if len(config.MetadataDir) > 0 && fileExists(getDeployFile(workDir)) {
+			// the .g10k-deploy.json is not inside the environment directory
+			writeTar(tw, getDeployFile(workDir), filepath.Join(filepath.Base(filepath.Clean(workDir)), ".g10k-deploy.json"))
+		}
+	}
+	if err = tw.Close(); err == nil && gw != nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		Fatalf("exportTarball(): Error while writing " + tmpFile + " Error: " + err.Error())
+	}
+	if err = os.Rename(tmpFile, tarball); err != nil {
+		Fatalf("exportTarball(): Error while renaming " + tmpFile + " to " + tarball + " Error: " + err.Error())
+	}
+	Infof("Exported " + strings.Join(workDirs, ", ") + " to " + tarball)
+}
@@ -4,7 +4,7 @@ import (
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -19,10 +19,9 @@ import (
 	"github.com/fatih/color"
 	"github.com/klauspost/pgzip"
 	"github.com/tidwall/gjson"
-	"github.com/xorpaul/uiprogress"
 )
 
-func doModuleInstallOrNothing(fm ForgeModule) {
+func doModuleInstallOrNothing(fm ForgeModule, st *SyncStats) {
 	moduleName := fm.author + "-" + fm.name
 	moduleVersion := fm.version
 	workDir := config.ForgeCacheDir + moduleName + "-" + fm.version
@@ -34,7 +33,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 		if !isDir(workDir) {
 			Debugf("" + workDir + " does not exist, fetching module")
 			// check forge API what the latest version is
-			fr = queryForgeAPI(fm)
+			fr = queryForgeAPI(fm, st)
 			if fr.needToGet {
 				if _, ok := uniqueForgeModules[moduleName+"-"+fr.versionNumber]; ok {
 					Debugf("no need to fetch Forge module " + moduleName + " in latest, because latest is " + fr.versionNumber + " and that will already be fetched")
@@ -63,7 +62,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 					if fileInfo.ModTime().Add(fm.cacheTTL).After(time.Now()) {
 						Debugf("No need to check forge API if latest version of module " + moduleName + " has been updated, because last-checked file " + lastCheckedFile + " is not older than " + fm.cacheTTL.String())
 						// need to add the current (cached!) -latest version number to the latestForgeModules, because otherwise we would always sync this module, because 1.4.1 != -latest
-						me := readModuleMetadata(workDir + "/metadata.json")
+						me := readModuleMetadata(workDir+"/metadata.json", st)
 						latestForgeModules.Lock()
 						latestForgeModules.m[moduleName] = me.version
 						latestForgeModules.Unlock()
@@ -73,13 +72,13 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 						if fi, err := os.Stat(lastCheckedFile); err == nil {
 							if fi.Size() < 1 {
 								Debugf("found empty file " + lastCheckedFile)
-								fr = queryForgeAPI(fm)
+								fr = queryForgeAPI(fm, st)
 							} else {
 								json, err := ioutil.ReadFile(lastCheckedFile)
 								if err != nil {
 									Fatalf("doModuleInstallOrNothing(): Error while reading Forge API result from file " + lastCheckedFile + err.Error())
 								}
-								_ = parseForgeAPIResult(string(json), fm)
+								_ = parseForgeAPIResult(string(json), fm, st)
 								return
 							}
 						}
@@ -92,7 +91,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 			// XXX: disable adding If-Modified-Since header for now
 			// because then the latestForgeModules does not get set with the actual module version for latest
 			// maybe if received 304 get the actual version from the -latest symlink
-			fr = queryForgeAPI(fm)
+			fr = queryForgeAPI(fm, st)
 			//fmt.Println(needToGet)
 		}
 
@@ -106,7 +105,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 			}
 			Debugf("we got " + fm.author + "-" + fm.name + "-" + fm.version + ", but no " + latestDir + " to use. Getting -latest")
 			fm.version = "latest"
-			doModuleInstallOrNothing(fm)
+			doModuleInstallOrNothing(fm, st)
 			return
 		}
 		Debugf("Nothing to do for module " + fm.author + "-" + fm.name + "-" + fm.version + ", because " + latestDir + " exists")
@@ -146,23 +145,37 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 				}
 			}
 		}
-		downloadForgeModule(moduleName, fr.versionNumber, fm, 1)
+		downloadForgeModule(moduleName, fr.versionNumber, fm, 1, st)
 	}
 
 }
 
-func queryForgeAPI(fm ForgeModule) ForgeResult {
+// newForgeRequest returns a GET request for the Forge url with the forge auth_header as Authorization header
+// the auth_header is only sent to the Forge baseurl of the g10k config and not to other Forges set in a Puppetfile
+func newForgeRequest(url string, connection string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+	req.Header.Set("Connection", connection)
+	if len(config.Forge.AuthHeader) > 0 && strings.HasPrefix(url, strings.TrimSuffix(config.Forge.Baseurl, "/")+"/") {
+		req.Header.Set("Authorization", config.Forge.AuthHeader)
+	}
+	return req, nil
+}
+
+func queryForgeAPI(fm ForgeModule, st *SyncStats) ForgeResult {
+	defer timeTrack(time.Now(), funcName())
 	baseURL := config.Forge.Baseurl
 	if len(fm.baseURL) > 0 {
 		baseURL = fm.baseURL
 	}
 	url := baseURL + "/v3/modules/" + fm.author + "-" + fm.name + "?exclude_fields=changelog+readme+license+releases"
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := newForgeRequest(url, "keep-alive")
 	if err != nil {
 		Fatalf("queryForgeAPI(): Error creating GET request for Puppetlabs forge API" + err.Error())
 	}
-	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
-	req.Header.Set("Connection", "keep-alive")
 
 	proxyURL, err := http.ProxyFromEnvironment(req)
 	if err != nil {
@@ -179,12 +192,17 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		}
 		Fatalf("queryForgeAPI(): Error while issuing the HTTP request to " + url + " Error: " + err.Error())
 	}
+	if resp.StatusCode >= 500 && config.UseCacheFallback {
+		// a private Forge mirror or proxy returns server errors if it can not reach its upstream
+		resp.Body.Close()
+		Warnf("Forge API returned " + resp.Status + ", trying to use cache for module " + fm.author + "/" + fm.author + "-" + fm.name)
+		_ = getLatestCachedModule(fm)
+		return ForgeResult{false, "", "", 0}
+	}
 	duration := time.Since(before).Seconds()
 	Verbosef("Querying Forge API " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 
-	mutex.Lock()
-	syncForgeTime += duration
-	mutex.Unlock()
+	st.addSyncForgeTime(duration)
 	defer resp.Body.Close()
 
 	if strings.TrimSpace(resp.Status) == "200 OK" {
@@ -195,7 +213,7 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		}
 
 		json := string(body)
-		fr := parseForgeAPIResult(json, fm)
+		fr := parseForgeAPIResult(json, fm, st)
 
 		lastCheckedFile := config.ForgeCacheDir + fm.author + "-" + fm.name + "-latest-last-checked"
 		Debugf("writing last-checked file " + lastCheckedFile)
@@ -217,7 +235,7 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 }
 
 // parseForgeAPIResult parses the JSON response of the Forge API
-func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
+func parseForgeAPIResult(json string, fm ForgeModule, st *SyncStats) ForgeResult {
 
 	before := time.Now()
 	currentRelease := gjson.Get(json, "current_release").Map()
@@ -229,9 +247,7 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 	modulemd5sum := currentRelease["file_md5"].String()
 	moduleFilesize := currentRelease["file_size"].Int()
 
-	mutex.Lock()
-	forgeJSONParseTime += duration
-	mutex.Unlock()
+	st.addForgeJSONParseTime(duration)
 
 	if deprecatedTimestamp.Exists() && deprecatedTimestamp.Value() != nil {
 		supersededText := ""
@@ -262,15 +278,16 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 }
 
 // getMetadataForgeModule queries the configured Puppet Forge and return
-func getMetadataForgeModule(fm ForgeModule) ForgeModule {
+func getMetadataForgeModule(fm ForgeModule, st *SyncStats) ForgeModule {
 	baseURL := config.Forge.Baseurl
 	if len(fm.baseURL) > 0 {
 		baseURL = fm.baseURL
 	}
 	url := baseURL + "/v3/releases/" + fm.author + "-" + fm.name + "-" + fm.version
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
-	req.Header.Set("Connection", "keep-alive")
+	req, err := newForgeRequest(url, "keep-alive")
+	if err != nil {
+		Fatalf("getMetadataForgeModule(): Error creating GET request for Puppetlabs forge API" + err.Error())
+	}
 	proxyURL, err := http.ProxyFromEnvironment(req)
 	if err != nil {
 		Fatalf("getMetadataForgeModule(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
@@ -281,9 +298,7 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 	resp, err := client.Do(req)
 	duration := time.Since(before).Seconds()
 	Verbosef("GETing Forge metadata from " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-	mutex.Lock()
-	syncForgeTime += duration
-	mutex.Unlock()
+	st.addSyncForgeTime(duration)
 	if err != nil {
 		Fatalf("getMetadataForgeModule(): Error while querying metadata for Forge module " + fm.name + " from " + url + ": " + err.Error())
 	}
@@ -303,9 +318,7 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 		moduleFilesize := currentRelease["file_size"].Int()
 		Debugf("module: " + fm.author + "/" + fm.name + " modulemd5sum: " + modulemd5sum + " moduleFilesize: " + strconv.FormatInt(moduleFilesize, 10))
 
-		mutex.Lock()
-		forgeJSONParseTime += duration
-		mutex.Unlock()
+		st.addForgeJSONParseTime(duration)
 
 		return ForgeModule{md5sum: modulemd5sum, fileSize: moduleFilesize}
 	}
@@ -313,109 +326,121 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 	return ForgeModule{}
 }
 
-func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, fileName string) {
-	defer wgForgeModule.Done()
+// extractForgeModule extracts the downloaded Forge module archive fileName in the Forge cache directory
+func extractForgeModule(fileName string, st *SyncStats) {
 	funcName := funcName()
 
 	before := time.Now()
+	file, err := os.Open(config.ForgeCacheDir + fileName)
+	if err != nil {
+		Fatalf(funcName + "(): Error while opening Forge module archive " + config.ForgeCacheDir + fileName + " Error: " + err.Error())
+	}
+	defer file.Close()
 	fileReader, err := pgzip.NewReader(file)
-
-	unTar(fileReader, config.ForgeCacheDir)
-
 	if err != nil {
 		Fatalf(funcName + "(): pgzip reader error for module " + fileName + " error:" + err.Error())
 	}
 	defer fileReader.Close()
 
+	checkFreeDiskSpace(config.ForgeCacheDir)
+	unTar(fileReader, config.ForgeCacheDir)
+
 	duration := time.Since(before).Seconds()
 	Verbosef("Extracting " + config.ForgeCacheDir + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-	mutex.Lock()
-	ioForgeTime += duration
-	mutex.Unlock()
+	st.addIOForgeTime(duration)
 }
 
-func downloadForgeModule(name string, version string, fm ForgeModule, retryCount int) {
-	funcName := funcName()
-	var wgForgeModule sync.WaitGroup
+// downloadForgeArchive downloads the Forge module archive url to file
+// the content is written to file.part first, so that the download of an interrupted archive resumes with a HTTP range request at the existing byte offset
+func downloadForgeArchive(url string, file string, st *SyncStats) error {
+	partFile := file + ".part"
+	var offset int64
+	if fi, err := os.Stat(partFile); err == nil {
+		offset = fi.Size()
+	}
+	req, err := newForgeRequest(url, "close")
+	if err != nil {
+		return errors.New("Error creating GET request for " + url + " Error: " + err.Error())
+	}
+	if offset > 0 {
+		Debugf("Resuming download of " + url + " to " + partFile + " at byte " + strconv.FormatInt(offset, 10))
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return errors.New("Error while getting http proxy with golang http.ProxyFromEnvironment() " + err.Error())
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	before := time.Now()
+	Debugf("GETing " + url)
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.New("Error while GETing " + url + " Error: " + err.Error())
+	}
+	defer resp.Body.Close()
 
-	extractR, extractW := io.Pipe()
-	saveFileR, saveFileW := io.Pipe()
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// the Forge ignored the range request or there was nothing to resume
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-"):
+		flags |= os.O_APPEND
+	default:
+		// the next try must start from zero, e.g. because the partial download is already bigger than the archive
+		os.Remove(partFile)
+		return errors.New("Unexpected response code while GETing " + url + " " + resp.Status)
+	}
+	out, err := os.OpenFile(partFile, flags, 0644)
+	if err != nil {
+		return errors.New("Error while creating file " + partFile + " Error: " + err.Error())
+	}
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	duration := time.Since(before).Seconds()
+	Verbosef("GETing " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	st.addSyncForgeTime(duration)
+	if err != nil {
+		return errors.New("Error while downloading " + url + " to " + partFile + " Error: " + err.Error())
+	}
+	if err := os.Rename(partFile, file); err != nil {
+		return errors.New("Error while renaming " + partFile + " to " + file + " Error: " + err.Error())
+	}
+	return nil
+}
+
+func downloadForgeModule(name string, version string, fm ForgeModule, retryCount int, st *SyncStats) {
+	defer timeTrack(time.Now(), funcName())
+	funcName := funcName()
 
 	//url := "https://forgeapi.puppetlabs.com/v3/files/puppetlabs-apt-2.1.1.tar.gz"
 	fileName := name + "-" + version + ".tar.gz"
 
-	if !isDir(config.ForgeCacheDir + name + "-" + version) {
+	extracted := isDir(config.ForgeCacheDir + name + "-" + version)
+	if !extracted {
 		baseURL := config.Forge.Baseurl
 		if len(fm.baseURL) > 0 {
 			baseURL = fm.baseURL
 		}
 		url := baseURL + "/v3/files/" + fileName
-		req, err := http.NewRequest("GET", url, nil)
-		req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
-		req.Header.Set("Connection", "close")
-		proxyURL, err := http.ProxyFromEnvironment(req)
-		if err != nil {
-			Fatalf(funcName + "(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
-		}
-		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
-		before := time.Now()
-		Debugf("GETing " + url)
-		resp, err := client.Do(req)
-		duration := time.Since(before).Seconds()
-		Verbosef("GETing " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-		mutex.Lock()
-		syncForgeTime += duration
-		mutex.Unlock()
-		if err != nil {
-			Fatalf(funcName + "(): Error while GETing Forge module " + name + " from " + url + ": " + err.Error())
-		}
-		defer resp.Body.Close()
-
-		if strings.TrimSpace(resp.Status) == "200 OK" {
-			wgForgeModule.Add(1)
-			go func() {
-				defer wgForgeModule.Done()
-				Debugf(funcName + "(): Trying to create " + config.ForgeCacheDir + fileName)
-				out, err := os.Create(config.ForgeCacheDir + fileName)
-				if err != nil {
-					Fatalf(funcName + "(): Error while creating file for Forge module " + config.ForgeCacheDir + fileName + " Error: " + err.Error())
-				}
-				defer out.Close()
-				io.Copy(out, saveFileR)
-				Debugf(funcName + "(): Finished creating " + config.ForgeCacheDir + fileName)
-			}()
-			wgForgeModule.Add(1)
-			go extractForgeModule(&wgForgeModule, extractR, fileName)
-			wgForgeModule.Add(1)
-			go func() {
-				defer wgForgeModule.Done()
-
-				// after completing the copy, we need to close
-				// the PipeWriters to propagate the EOF to all
-				// PipeReaders to avoid deadlock
-				defer extractW.Close()
-				defer saveFileW.Close()
-
-				var mw io.Writer
-				// build the multiwriter for all the pipes
-				mw = io.MultiWriter(extractW, saveFileW)
-
-				// copy the data into the multiwriter
-				if _, err := io.Copy(mw, resp.Body); err != nil {
-					Fatalf("Error while writing to MultiWriter " + err.Error())
-				}
-			}()
-		} else {
-			Fatalf(funcName + "(): Unexpected response code while GETing " + url + " " + resp.Status)
+		if err := downloadForgeArchive(url, config.ForgeCacheDir+fileName, st); err != nil {
+			if retryCount == 0 {
+				Fatalf(funcName + "(): Error while downloading Forge module " + name + " from " + url + ": " + err.Error())
+			}
+			Warnf("WARN: Error while downloading Forge module " + name + " from " + url + ": " + err.Error() + " Retrying...")
+			downloadForgeModule(name, version, fm, retryCount-1, st)
+			return
 		}
 	} else {
 		Debugf("Using cache for Forge module " + name + " version: " + version)
 	}
-	wgForgeModule.Wait()
 
+	// the checksums must match before the archive gets extracted
 	if checkSum || fm.sha256sum != "" {
 		fm.version = version
-		if doForgeModuleIntegrityCheck(fm) {
+		if doForgeModuleIntegrityCheck(fm, st) {
 			if retryCount == 0 {
 				Fatalf("downloadForgeModule(): giving up for Puppet module " + name + " version: " + version)
 			}
@@ -423,14 +448,17 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			purgeDir(config.ForgeCacheDir+fileName, "downloadForgeModule()")
 			purgeDir(strings.Replace(config.ForgeCacheDir+fileName, ".tar.gz", "/", -1), "downloadForgeModule()")
 			// retry if hash sum mismatch found
-			downloadForgeModule(name, version, fm, retryCount-1)
+			downloadForgeModule(name, version, fm, retryCount-1, st)
+			return
 		}
 	}
-
+	if !extracted {
+		extractForgeModule(fileName, st)
+	}
 }
 
 // readModuleMetadata returns the Forgemodule struct of the given module file path
-func readModuleMetadata(file string) ForgeModule {
+func readModuleMetadata(file string, st *SyncStats) ForgeModule {
 	content, _ := ioutil.ReadFile(file)
 
 	before := time.Now()
@@ -438,9 +466,7 @@ func readModuleMetadata(file string) ForgeModule {
 	version := gjson.Get(string(content), "version").String()
 	author := gjson.Get(string(content), "author").String()
 	duration := time.Since(before).Seconds()
-	mutex.Lock()
-	metadataJSONParseTime += duration
-	mutex.Unlock()
+	st.addMetadataJSONParseTime(duration)
 
 	Debugf("Found in file " + file + " name: " + name + " version: " + version + " author: " + author)
 
@@ -454,76 +480,51 @@ func readModuleMetadata(file string) ForgeModule {
 	return ForgeModule{name: moduleName, version: version, author: strings.ToLower(author)}
 }
 
-func resolveForgeModules(modules map[string]ForgeModule) {
-	defer timeTrack(time.Now(), funcName())
-	if len(modules) <= 0 {
-		Debugf("empty ForgeModule[] found, skipping...")
-		return
-	}
-	bar := uiprogress.AddBar(len(modules)).AppendCompleted().PrependElapsed()
-	bar.PrependFunc(func(b *uiprogress.Bar) string {
-		return fmt.Sprintf("Resolving Forge modules (%d/%d)", b.Current(), len(modules))
-	})
-	// Dummy channel to coordinate the number of concurrent goroutines.
-	// This channel should be buffered otherwise we will be immediately blocked
-	// when trying to fill it.
-
-	Debugf("Resolving " + strconv.Itoa(len(modules)) + " Forge modules with " + strconv.Itoa(config.Maxworker) + " workers")
-	concurrentGoroutines := make(chan struct{}, config.Maxworker)
-	// Fill the dummy channel with config.Maxworker empty struct.
-	for i := 0; i < config.Maxworker; i++ {
-		concurrentGoroutines <- struct{}{}
-	}
-
-	// The done channel indicates when a single goroutine has
-	// finished its job.
-	done := make(chan bool)
-	// The waitForAllJobs channel allows the main program
-	// to wait until we have indeed done all the jobs.
-	waitForAllJobs := make(chan bool)
-	// Collect all the jobs, and since the job is finished, we can
-	// release another spot for a goroutine.
-	go func() {
-		for i := 1; i <= len(modules); i++ {
-			<-done
-			// Say that another goroutine can now start.
-			concurrentGoroutines <- struct{}{}
-		}
-		// We have collected all the jobs, the program can now terminate
-		waitForAllJobs <- true
-	}()
-	wg := sync.WaitGroup{}
-	wg.Add(len(modules))
-
-	for m, fm := range modules {
-		go func(m string, fm ForgeModule, bar *uiprogress.Bar) {
-			// Try to receive from the concurrentGoroutines channel. When we have something,
-			// it means we can start a new goroutine because another one finished.
-			// Otherwise, it will block the execution until an execution
-			// spot is available.
-			<-concurrentGoroutines
-			defer bar.Incr()
-			defer wg.Done()
-			Debugf("resolveForgeModules(): Trying to get forge module " + m + " with Forge base url " + fm.baseURL + " and CacheTtl set to " + fm.cacheTTL.String())
-			doModuleInstallOrNothing(fm)
-			done <- true
-		}(m, fm, bar)
-	}
-	// Wait for all jobs to finish
-	<-waitForAllJobs
-	wg.Wait()
-}
-
-func check4ForgeUpdate(moduleName string, currentVersion string, latestVersion string) {
+func check4ForgeUpdate(moduleName string, currentVersion string, latestVersion string, st *SyncStats) {
 	Verbosef("found currently deployed Forge module " + moduleName + " in version: " + currentVersion)
 	Verbosef("found latest Forge module of " + moduleName + " in version: " + latestVersion)
 	if currentVersion != latestVersion {
 		color.Yellow("ATTENTION: Forge module: " + moduleName + " latest: " + latestVersion + " currently deployed: " + currentVersion)
-		needSyncForgeCount++
+		st.addOutdatedForgeModule()
+	}
+}
+
+// isForgeVersionRange returns true if the version of a Forge module in the Puppetfile is a version range like >= 5.0.0 < 6.0.0 instead of an exact version, latest or present
+func isForgeVersionRange(version string) bool {
+	if len(version) == 0 || version == "latest" || version == "present" {
+		return false
+	}
+	if _, _, ok := parseVersion(version); ok {
+		return false
+	}
+	return strings.ContainsAny(version, " <>=~^|*xX")
+}
+
+// resolveForgeVersionRange returns the highest release of the Forge module which satisfies its version range
+// the previous version keeps the module at the release it resolved to in the previous deploy as long as it still satisfies the version range, unless -upgrade is set
+func resolveForgeVersionRange(fm ForgeModule, previousVersion string, st *SyncStats) (string, bool) {
+	if len(previousVersion) > 0 && !upgradeForgeModules && versionMatchesRequirement(previousVersion, fm.versionRange) {
+		Debugf("Keeping Forge module " + fm.author + "-" + fm.name + " in version " + previousVersion + " of the previous deploy, because it satisfies the version range " + fm.versionRange)
+		return previousVersion, true
 	}
+	return selectDependencyVersion(getForgeModuleReleases(fm, st), []ModuleDependency{ModuleDependency{versionRequirement: fm.versionRange}})
 }
 
-func doForgeModuleIntegrityCheck(m ForgeModule) bool {
+// getForgeVersions returns the versions which the version ranges of the Forge modules of the Puppetfile resolved to for the deploy metadata
+func getForgeVersions(pf Puppetfile) map[string]string {
+	forgeVersions := make(map[string]string)
+	for _, fm := range pf.forgeModules {
+		if len(fm.versionRange) > 0 {
+			forgeVersions[fm.author+"-"+fm.name] = fm.version
+		}
+	}
+	if len(forgeVersions) == 0 {
+		return nil
+	}
+	return forgeVersions
+}
+
+func doForgeModuleIntegrityCheck(m ForgeModule, st *SyncStats) bool {
 	funcName := funcName()
 	var wgCheckSum sync.WaitGroup
 
@@ -531,7 +532,7 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 	fmm := ForgeModule{}
 	go func(m ForgeModule) {
 		defer wgCheckSum.Done()
-		fmm = getMetadataForgeModule(m)
+		fmm = getMetadataForgeModule(m, st)
 		Debugf(funcName + "(): target md5 hash sum: " + fmm.md5sum)
 		if m.sha256sum != "" {
 			Debugf(funcName + "(): target sha256 hash sum from Puppetfile: " + m.sha256sum)
@@ -644,21 +645,25 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 
 }
 
-func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspondingPuppetEnvironment string) {
+func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspondingPuppetEnvironment string, st *SyncStats) {
+	defer timeTrack(time.Now(), funcName())
 	funcName := funcName()
-	mutex.Lock()
-	syncForgeCount++
-	mutex.Unlock()
+	if shutdownRequested() {
+		Debugf("Skipping sync of Forge module " + name + ", because g10k is shutting down")
+		return
+	}
+	st.addSyncedForgeModule()
 	moduleName := m.author + "-" + m.name
 	//Debugf("m.name " + m.name + " m.version " + m.version + " moduleName " + moduleName)
 	targetDir := normalizeDir(moduleDir + m.name)
 	if m.version == "present" {
 		if fileExists(targetDir + "metadata.json") {
 			Debugf("Nothing to do, found existing Forge module: " + targetDir + "metadata.json")
+			st.addUnchangedDir(targetDir)
 			if check4update {
-				me := readModuleMetadata(targetDir + "metadata.json")
+				me := readModuleMetadata(targetDir+"metadata.json", st)
 				latestForgeModules.RLock()
-				check4ForgeUpdate(m.name, me.version, latestForgeModules.m[moduleName])
+				check4ForgeUpdate(m.name, me.version, latestForgeModules.m[moduleName], st)
 				latestForgeModules.RUnlock()
 			}
 			return
@@ -669,7 +674,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 	}
 	if isDir(targetDir) {
 		if fileExists(targetDir + "metadata.json") {
-			me := readModuleMetadata(targetDir + "metadata.json")
+			me := readModuleMetadata(targetDir+"metadata.json", st)
 			if m.version == "latest" {
 				//fmt.Println(latestForgeModules)
 				//fmt.Println("checking latestForgeModules for key", moduleName)
@@ -682,17 +687,19 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 			}
 			if check4update {
 				latestForgeModules.RLock()
-				check4ForgeUpdate(m.name, me.version, latestForgeModules.m[moduleName])
+				check4ForgeUpdate(m.name, me.version, latestForgeModules.m[moduleName], st)
 				latestForgeModules.RUnlock()
 			}
 			if me.version == m.version {
 				Debugf("Nothing to do, existing Forge module: " + targetDir + " has the same version " + me.version + " as the to be synced version: " + m.version)
+				st.addUnchangedDir(targetDir)
 				return
 			}
-			Infof("Need to sync, because existing Forge module: " + targetDir + " has version " + me.version + " and the to be synced version is: " + m.version)
+			InfoModulef("Need to sync, because existing Forge module: " + targetDir + " has version " + me.version + " and the to be synced version is: " + m.version)
 			createOrPurgeDir(targetDir, " targetDir for module "+me.name)
 		} else {
 			Debugf("Need to purge " + targetDir + ", because it exists without a metadata.json. This shouldn't happen!")
+			handleUnmanagedModuleDir(targetDir, false)
 			createOrPurgeDir(targetDir, " targetDir for module "+m.name+" with missing metadata.json")
 		}
 	}
@@ -710,7 +717,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		Fatalf(funcName + "(): Forge module not found in dir: " + workDir)
 	}
 
-	Infof("Need to sync " + targetDir)
+	InfoModulef("Need to sync " + targetDir)
 	if !dryRun {
 		targetDir = checkDirAndCreate(targetDir, "as targetDir for module "+name)
 		var targetDirDevice, workDirDevice uint64
@@ -733,13 +740,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 			Fatalf("Error: Can't hardlink Forge module files over different devices. Please consider changing the cachedir setting. ForgeCachedir: " + config.ForgeCacheDir + " target dir: " + targetDir)
 		}
 
-		mutex.Lock()
-		needSyncDirs = append(needSyncDirs, targetDir)
-		if _, ok := needSyncEnvs[correspondingPuppetEnvironment]; !ok {
-			needSyncEnvs[correspondingPuppetEnvironment] = struct{}{}
-		}
-		needSyncForgeCount++
-		mutex.Unlock()
+		st.addNeedSyncForgeDir(targetDir, correspondingPuppetEnvironment)
 		destination := func(path string, info os.FileInfo, err error) error {
 			if filepath.Base(path) != filepath.Base(workDir) { // skip the root dir
 				target, err := filepath.Rel(workDir, path)
@@ -749,7 +750,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 
 				if info.IsDir() {
 					//Debugf(funcName + "() Trying to mkdir " + targetDir + target)
-					err = os.Mkdir(filepath.Join(targetDir, target), os.FileMode(0755))
+					err = os.Mkdir(filepath.Join(targetDir, target), getDirMode(os.FileMode(0755)))
 					if err != nil {
 						Fatalf(funcName + "(): error while Mkdir() " + targetDir + "/" + target + " Error: " + err.Error())
 					}
@@ -778,9 +779,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		go func() { c <- filepath.Walk(workDir, destination) }()
 		<-c // Walk done
 		duration := time.Since(before).Seconds()
-		mutex.Lock()
-		ioForgeTime += duration
-		mutex.Unlock()
+		st.addIOForgeTime(duration)
 		Verbosef("Populating " + targetDir + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	}
 }
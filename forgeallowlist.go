@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DisallowedForgeModule is a Forge module of a Puppet environment which does not match any pattern of the forge_allowlist
+type DisallowedForgeModule struct {
+	environment string
+	module      string
+	location    string
+}
+
+// isForgeModuleAllowed returns true if forge_allowlist is not set or if the Forge module author-name matches one of its patterns
+// the patterns are shell patterns like puppetlabs-* and match the module as author-name or author/name
+func isForgeModuleAllowed(author string, name string) bool {
+	if len(config.ForgeAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range config.ForgeAllowlist {
+		for _, module := range []string{author + "-" + name, author + "/" + name} {
+			if matched, _ := filepath.Match(pattern, module); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findDisallowedForgeModules returns the Forge modules of all Puppet environments which are not on the forge_allowlist sorted by environment and module
+func findDisallowedForgeModules(allPuppetfiles map[string]Puppetfile) []DisallowedForgeModule {
+	disallowed := []DisallowedForgeModule{}
+	for env, pf := range allPuppetfiles {
+		for _, fm := range pf.forgeModules {
+			if isForgeModuleAllowed(fm.author, fm.name) {
+				continue
+			}
+			location := filepath.Join(pf.workDir, "Puppetfile")
+			if pf.source == "global_modules" {
+				location = "global_modules in " + configFile
+			}
+			disallowed = append(disallowed, DisallowedForgeModule{environment: env, module: fm.author + "-" + fm.name, location: location})
+		}
+	}
+	sort.Slice(disallowed, func(i, j int) bool {
+		if disallowed[i].environment != disallowed[j].environment {
+			return disallowed[i].environment < disallowed[j].environment
+		}
+		return disallowed[i].module < disallowed[j].module
+	})
+	return disallowed
+}
+
+// enforceForgeAllowlist reports each Forge module which is not on the forge_allowlist
+// and exits before any Forge module gets downloaded unless forge_allowlist_mode is set to warn
+func enforceForgeAllowlist(allPuppetfiles map[string]Puppetfile) {
+	disallowed := findDisallowedForgeModules(allPuppetfiles)
+	if len(disallowed) == 0 {
+		return
+	}
+	modules := []string{}
+	for _, dfm := range disallowed {
+		Warnf("WARN: Forge module " + dfm.module + " of environment " + dfm.environment + " in " + dfm.location + " is not on the forge_allowlist")
+		if !stringSliceContains(modules, dfm.module) {
+			modules = append(modules, dfm.module)
+		}
+	}
+	if config.ForgeAllowlistMode != "warn" {
+		sort.Strings(modules)
+		Fatalf("Error: Found Forge modules which are not on the forge_allowlist: " + strings.Join(modules, ", "))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ForgeToGit contains the git repository and the optional ref from which a Forge module of the forge_to_git setting gets deployed instead of the Forge
+type ForgeToGit struct {
+	Git string `yaml:"git"`
+	Ref string `yaml:"ref"`
+}
+
+// ForgeToGitCommit records in the deploy metadata from which git repository and commit a Forge module of the forge_to_git setting got deployed
+type ForgeToGitCommit struct {
+	Git    string `json:"git"`
+	Commit string `json:"commit"`
+}
+
+// getForgeToGit returns the git repository of the Forge module author-name from the forge_to_git setting
+func getForgeToGit(author string, name string) (ForgeToGit, bool) {
+	ftg, ok := config.ForgeToGit[author+"-"+name]
+	return ftg, ok
+}
+
+// getForgeToGitModule returns the git module which replaces the Forge module author-name of the forge_to_git setting
+// without a ref the default branch of the git repository gets deployed
+func getForgeToGitModule(ftg ForgeToGit, author string, name string, moduleDir string, lineNumber string) GitModule {
+	Debugf("Deploying Forge module " + author + "-" + name + " from git repository " + ftg.Git + " instead of the Forge, because of the forge_to_git setting")
+	gm := GitModule{git: rewriteGitURL(ftg.Git), ref: ftg.Ref, moduleDir: moduleDir, lineNumber: lineNumber, forgeSlug: author + "-" + name}
+	if refspec := getRefNamespaceFetchRefspec(gm.ref); len(refspec) > 0 {
+		gm.fetchRefspecs = []string{refspec}
+	}
+	if config.IgnoreUnreachableModules {
+		gm.ignoreUnreachable = true
+	}
+	return gm
+}
+
+// getForgeToGitCommits returns the git repositories and commits which the Forge modules of the forge_to_git setting of the Puppetfile got deployed from for the deploy metadata
+func getForgeToGitCommits(pf Puppetfile) map[string]ForgeToGitCommit {
+	var commits map[string]ForgeToGitCommit
+	for name, gm := range pf.gitModules {
+		if len(gm.forgeSlug) == 0 {
+			continue
+		}
+		content, err := ioutil.ReadFile(getLatestCommitFile(filepath.Join(pf.workDir, gm.moduleDir, name)))
+		if err != nil {
+			Debugf("Could not read the deployed commit of Forge module " + gm.forgeSlug + " Error: " + err.Error())
+			continue
+		}
+		if commits == nil {
+			commits = make(map[string]ForgeToGitCommit)
+		}
+		commits[gm.forgeSlug] = ForgeToGitCommit{Git: getTokenFreeGitURL(gm.git), Commit: strings.TrimSpace(string(content))}
+	}
+	return commits
+}
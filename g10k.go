@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
@@ -19,37 +24,62 @@ var (
 	force                        bool
 	usemove                      bool
 	usecacheFallback             bool
+	frozen                       bool
+	execTraceParam               string
+	execReplayParam              string
 	retryGitCommands             bool
+	retries                      int
 	pfMode                       bool
 	pfLocation                   string
 	dryRun                       bool
+	interactive                  bool
 	validate                     bool
 	check4update                 bool
+	upgradeForgeModules          bool
+	failFast                     bool
+	failOnEmptyEnvironment       bool
 	checkSum                     bool
 	gitObjectSyntaxNotSupported  bool
 	moduleDirParam               string
 	cacheDirParam                string
 	branchParam                  string
 	environmentParam             string
+	environmentsFromParam        string
+	strictEnvironments           bool
+	environmentsFilter           map[string]bool
 	tags                         bool
+	stdinMode                    bool
+	stats                        bool
+	incremental                  bool
+	onlyNew                      bool
+	gcDeployMetadataMode         bool
+	exportTarballParam           string
+	profile                      bool
+	cpuProfileParam              string
+	compareEnvironmentsParam     string
+	moduleUsageParam             string
+	reportStaleCacheMode         bool
+	verifyDeployedMode           bool
+	warmCacheMode                bool
+	maintainCacheMode            bool
+	enforceImmutableRefsMode     bool
+	r10kOutput                   bool
+	summaryOnly                  bool
+	slowestModules               int
+	progressFd                   int
+	serveParam                   string
+	sinceParam                   string
+	sinceTime                    time.Time
+	labelParams                  = labelFlags{}
+	moduleOverrideParams         = labelFlags{}
+	deployLabels                 map[string]string
 	outputNameParam              string
 	moduleParam                  string
 	configFile                   string
 	config                       ConfigSettings
 	mutex                        sync.Mutex
 	empty                        struct{}
-	syncGitCount                 int
-	syncForgeCount               int
-	needSyncGitCount             int
-	needSyncForgeCount           int
-	needSyncDirs                 []string
-	needSyncEnvs                 map[string]struct{}
-	syncGitTime                  float64
-	syncForgeTime                float64
-	ioGitTime                    float64
-	ioForgeTime                  float64
-	forgeJSONParseTime           float64
-	metadataJSONParseTime        float64
+	syncStats                    *SyncStats
 	gmetadataJSONParseTime       float64
 	buildtime                    string
 	uniqueForgeModules           map[string]ForgeModule
@@ -57,9 +87,19 @@ var (
 	maxworker                    int
 	maxExtractworker             int
 	forgeModuleDeprecationNotice string
-	desiredContent               []string
+	gitRepositoryResults         map[string]*GitRepositoryResult
+	resolvedModuleCommits        map[string]string
+	shutdown                     chan struct{}
+	receivedSignal               syscall.Signal
+	runStartedAt                 time.Time
 )
 
+// moduleRefPrefix is the prefix of a :ref setting which pins a git module to the resolved commit of another git module
+const moduleRefPrefix = "module:"
+
+// shutdownGracePeriod is the time in-flight git archive commands get to finish after g10k received SIGINT or SIGTERM
+var shutdownGracePeriod = 10 * time.Second
+
 // LatestForgeModules contains a map of unique Forge modules
 // that should be the latest versions of them
 type LatestForgeModules struct {
@@ -70,28 +110,89 @@ type LatestForgeModules struct {
 // ConfigSettings contains the key value pairs from the g10k config file
 type ConfigSettings struct {
 	CacheDir                    string `yaml:"cachedir"`
+	ReadOnlyCacheDir            string `yaml:"read_only_cachedir"`
 	ForgeCacheDir               string
 	ModulesCacheDir             string
 	EnvCacheDir                 string
 	Git                         Git
 	Forge                       Forge
 	Sources                     map[string]Source
-	Timeout                     int            `yaml:"timeout"`
-	IgnoreUnreachableModules    bool           `yaml:"ignore_unreachable_modules"`
-	Maxworker                   int            `yaml:"maxworker"`
-	MaxExtractworker            int            `yaml:"maxextractworker"`
-	UseCacheFallback            bool           `yaml:"use_cache_fallback"`
-	RetryGitCommands            bool           `yaml:"retry_git_commands"`
-	GitObjectSyntaxNotSupported bool           `yaml:"git_object_syntax_not_supported"`
-	PostRunCommand              []string       `yaml:"postrun"`
-	Deploy                      DeploySettings `yaml:"deploy"`
-	PurgeLevels                 []string       `yaml:"purge_levels"`
-	PurgeWhitelist              []string       `yaml:"purge_whitelist"`
-	DeploymentPurgeWhitelist    []string       `yaml:"deployment_purge_whitelist"`
-	WriteLock                   string         `yaml:"write_lock"`
-	GenerateTypes               bool           `yaml:"generate_types"`
-	PuppetPath                  string         `yaml:"puppet_path"`
-	PurgeBlacklist              []string       `yaml:"purge_blacklist"`
+	Timeout                     int                   `yaml:"timeout"`
+	IgnoreUnreachableModules    bool                  `yaml:"ignore_unreachable_modules"`
+	Maxworker                   int                   `yaml:"maxworker"`
+	MaxExtractworker            int                   `yaml:"maxextractworker"`
+	MaxMemoryMB                 int                   `yaml:"max_memory_mb"`
+	PreserveMtimes              bool                  `yaml:"preserve_mtimes"`
+	ReadConcurrency             int                   `yaml:"read_concurrency"`
+	WriteConcurrency            int                   `yaml:"write_concurrency"`
+	FetchRateLimitKBps          int                   `yaml:"fetch_rate_limit_kbps"`
+	RampUpSeconds               int                   `yaml:"ramp_up_seconds"`
+	ResolveDependencies         bool                  `yaml:"resolve_dependencies"`
+	RunStateFile                string                `yaml:"run_state_file"`
+	MaxFileSizeKB               int                   `yaml:"max_file_size_kb"`
+	UntarRetries                int                   `yaml:"untar_retries"`
+	TruncatedArchiveRetries     int                   `yaml:"truncated_archive_retries"`
+	Umask                       string                `yaml:"umask"`
+	RemoteDeploy                RemoteDeploy          `yaml:"remote_deploy"`
+	Masters                     Masters               `yaml:"masters"`
+	DeployLabels                map[string]string     `yaml:"deploy_labels"`
+	UseCacheFallback            bool                  `yaml:"use_cache_fallback"`
+	MaxCacheAge                 time.Duration         `yaml:"max_cache_age"`
+	MaxCacheSizeGB              int                   `yaml:"max_cache_size_gb"`
+	MaintainCacheMinAge         time.Duration         `yaml:"maintain_cache_min_age"`
+	RetryGitCommands            bool                  `yaml:"retry_git_commands"`
+	FetchTags                   bool                  `yaml:"fetch_tags"`
+	HTTPSFallback               bool                  `yaml:"https_fallback"`
+	GitObjectSyntaxNotSupported bool                  `yaml:"git_object_syntax_not_supported"`
+	ResolveRefsOnce             bool                  `yaml:"resolve_refs_once"`
+	TrustGitRefs                bool                  `yaml:"trust_git_refs"`
+	ContentHash                 bool                  `yaml:"content_hash"`
+	SecretsFile                 string                `yaml:"secrets_file"`
+	PartialClone                bool                  `yaml:"partial_clone"`
+	PostRunCommand              []string              `yaml:"postrun"`
+	Deploy                      DeploySettings        `yaml:"deploy"`
+	PurgeLevels                 []string              `yaml:"purge_levels"`
+	PurgeWhitelist              []string              `yaml:"purge_whitelist"`
+	DeploymentPurgeWhitelist    []string              `yaml:"deployment_purge_whitelist"`
+	EnvironmentPurgeLevels      map[string]string     `yaml:"environment_purge_levels"`
+	WriteLock                   string                `yaml:"write_lock"`
+	GenerateTypes               bool                  `yaml:"generate_types"`
+	PuppetPath                  string                `yaml:"puppet_path"`
+	PurgeBlacklist              []string              `yaml:"purge_blacklist"`
+	ForgeExtractFilter          bool                  `yaml:"forge_extract_filter"`
+	ForgeExtractIgnore          []string              `yaml:"forge_extract_ignore"`
+	DryRunDeployDir             string                `yaml:"dryrun_deploy_dir"`
+	GitLogDir                   string                `yaml:"git_log_dir"`
+	MetadataDir                 string                `yaml:"metadata_dir"`
+	BundleDir                   string                `yaml:"bundle_dir"`
+	DeployRootPrefix            string                `yaml:"deploy_root_prefix"`
+	MinFreeDiskMB               int                   `yaml:"min_free_disk_mb"`
+	ArchiveFilterCommand        string                `yaml:"archive_filter_command"`
+	GlobalModules               []string              `yaml:"global_modules"`
+	WarnDuplicateModules        bool                  `yaml:"warn_duplicate_modules"`
+	SkipUnchangedPuppetfiles    bool                  `yaml:"skip_unchanged_puppetfiles"`
+	UnmanagedModuleDirs         string                `yaml:"unmanaged_module_dirs"`
+	DedupModules                bool                  `yaml:"dedup_modules"`
+	DedupModulesMode            string                `yaml:"dedup_modules_mode"`
+	CopyStrategy                string                `yaml:"copy_strategy"`
+	AtomicDeploy                bool                  `yaml:"atomic_deploy"`
+	CompactDeployMetadata       bool                  `yaml:"compact_deploy_metadata"`
+	ValidateCommand             string                `yaml:"validate_command"`
+	AllowPostSync               bool                  `yaml:"allow_post_sync"`
+	ModuleStoreDir              string                `yaml:"module_store_dir"`
+	VerifyPurge                 string                `yaml:"verify_purge"`
+	EnforceImmutableRefs        string                `yaml:"enforce_immutable_refs"`
+	ExpandCommitHashes          bool                  `yaml:"expand_commit_hashes"`
+	CaseCollisions              string                `yaml:"case_collisions"`
+	EmptyEnvironments           string                `yaml:"empty_environments"`
+	MissingControlBranch        string                `yaml:"missing_control_branch"`
+	FixSSHKeyPermissions        bool                  `yaml:"fix_ssh_key_permissions"`
+	ForgeAllowlist              []string              `yaml:"forge_allowlist"`
+	ForgeAllowlistMode          string                `yaml:"forge_allowlist_mode"`
+	ForgeToGit                  map[string]ForgeToGit `yaml:"forge_to_git"`
+	NotifyURL                   string                `yaml:"notify_url"`
+	NotifyAuthHeader            string                `yaml:"notify_auth_header"`
+	Syslog                      Syslog                `yaml:"syslog"`
 }
 
 // DeploySettings is a struct for settings for controlling how g10k deploys behave.
@@ -109,13 +210,37 @@ type DeploySettings struct {
 // Forge is a simple struct that contains the base URL of
 // the Forge that g10k should use. Defaults to: https://forgeapi.puppetlabs.com
 type Forge struct {
-	Baseurl string `yaml:"baseurl"`
+	Baseurl    string `yaml:"baseurl"`
+	AuthHeader string `yaml:"auth_header"`
 }
 
 // Git is a simple struct that contains the optional SSH private key to
 // use for authentication
 type Git struct {
-	privateKey string `yaml:"private_key"`
+	privateKey               string                 `yaml:"private_key"`
+	SSHPort                  int                    `yaml:"ssh_port"`
+	SSHKnownHosts            string                 `yaml:"ssh_known_hosts"`
+	SSHStrictHostKeyChecking string                 `yaml:"ssh_strict_host_key_checking"`
+	DefaultBranch            string                 `yaml:"default_branch"`
+	ClientCertificates       []GitClientCertificate `yaml:"client_certificates"`
+	URLRewriteRules          []GitURLRewriteRule    `yaml:"url_rewrite_rules"`
+	CloneReference           string                 `yaml:"clone_reference"`
+	CloneReferenceMode       string                 `yaml:"clone_reference_mode"`
+	Env                      map[string]string      `yaml:"env"`
+}
+
+// GitClientCertificate contains the TLS client certificate and key to use for the git repositories over https whose URL matches the url_pattern
+type GitClientCertificate struct {
+	URLPattern string `yaml:"url_pattern"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+}
+
+// GitURLRewriteRule replaces the match of the regular expression pattern in the git URLs of the modules with the replacement, which can use $1 style references
+type GitURLRewriteRule struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	re          *regexp.Regexp
 }
 
 // Source contains basic information about a Puppet environment repository
@@ -128,48 +253,72 @@ type Source struct {
 	WarnMissingBranch           bool   `yaml:"warn_if_branch_is_missing"`
 	ExitIfUnreachable           bool   `yaml:"exit_if_unreachable"`
 	AutoCorrectEnvironmentNames string `yaml:"invalid_branches"`
+	TagPattern                  string `yaml:"tag_pattern"`
+	BranchIncludeRegex          string `yaml:"branch_include_regex"`
+	BranchExcludeRegex          string `yaml:"branch_exclude_regex"`
+	branchIncludeRe             *regexp.Regexp
+	branchExcludeRe             *regexp.Regexp
 }
 
 // Puppetfile contains the key value pairs from the Puppetfile
 type Puppetfile struct {
-	forgeBaseURL      string
-	forgeCacheTTL     time.Duration
-	forgeModules      map[string]ForgeModule
-	gitModules        map[string]GitModule
-	privateKey        string
-	source            string
-	workDir           string
-	moduleDirs        []string
-	controlRepoBranch string
+	forgeBaseURL          string
+	forgeCacheTTL         time.Duration
+	forgeModules          map[string]ForgeModule
+	gitModules            map[string]GitModule
+	privateKey            string
+	source                string
+	workDir               string
+	moduleDirs            []string
+	controlRepoBranch     string
+	previousForgeVersions map[string]string
 }
 
 // ForgeModule contains information (Version, Name, Author, md5 checksum, file size of the tar.gz archive, Forge BaseURL if custom) about a Puppetlabs Forge module
 type ForgeModule struct {
-	version   string
-	name      string
-	author    string
-	md5sum    string
-	fileSize  int64
-	baseURL   string
-	cacheTTL  time.Duration
-	sha256sum string
-	moduleDir string
+	version      string
+	name         string
+	author       string
+	md5sum       string
+	fileSize     int64
+	baseURL      string
+	cacheTTL     time.Duration
+	sha256sum    string
+	moduleDir    string
+	versionRange string
 }
 
 // GitModule contains information about a Git Puppet module
 type GitModule struct {
-	privateKey        string
-	git               string
-	branch            string
-	tag               string
-	commit            string
-	ref               string
-	link              bool
-	ignoreUnreachable bool
-	fallback          []string
-	installPath       string
-	local             bool
-	moduleDir         string
+	privateKey               string
+	git                      string
+	branch                   string
+	tag                      string
+	commit                   string
+	ref                      string
+	link                     bool
+	ignoreUnreachable        bool
+	fallback                 []string
+	installPath              string
+	targetName               string
+	local                    bool
+	localPath                string
+	moduleDir                string
+	fetchRefspecs            []string
+	fetchTags                bool
+	timeout                  int
+	sshPort                  int
+	sshKnownHosts            string
+	sshStrictHostKeyChecking string
+	lineNumber               string
+	httpsFallback            bool
+	sshURL                   string
+	tarball                  string
+	tarballSHA256            string
+	forgeSlug                string
+	shallowSince             string
+	postSync                 string
+	pinnedCommits            []string
 }
 
 // ForgeResult is returned by queryForgeAPI and contains if and which version of the Puppetlabs Forge module needs to be downloaded
@@ -184,22 +333,73 @@ type ForgeResult struct {
 type ExecResult struct {
 	returnCode int
 	output     string
+	stderr     string
+}
+
+// StdinDeployRequest contains the branch and optional module name that should be deployed when g10k was called with -stdin
+type StdinDeployRequest struct {
+	Branch string `json:"branch"`
+	Module string `json:"module"`
 }
 
 // DeployResult contains information about the Puppet environment which was deployed by g10k and tries to emulate the .r10k-deploy.json
 type DeployResult struct {
-	Name               string    `json:"name"`
-	Signature          string    `json:"signature"`
-	StartedAt          time.Time `json:"started_at"`
-	FinishedAt         time.Time `json:"finished_at"`
-	DeploySuccess      bool      `json:"deploy_success"`
-	PuppetfileChecksum string    `json:"puppetfile_checksum"`
+	Name               string                      `json:"name"`
+	Signature          string                      `json:"signature"`
+	StartedAt          time.Time                   `json:"started_at"`
+	FinishedAt         time.Time                   `json:"finished_at"`
+	DeploySuccess      bool                        `json:"deploy_success"`
+	PuppetfileChecksum string                      `json:"puppetfile_checksum"`
+	Labels             map[string]string           `json:"labels,omitempty"`
+	ModuleOverrides    map[string]string           `json:"module_overrides,omitempty"`
+	ForgeVersions      map[string]string           `json:"forge_versions,omitempty"`
+	ForgeToGit         map[string]ForgeToGitCommit `json:"forge_to_git,omitempty"`
+	ContentHash        string                      `json:"content_hash,omitempty"`
+	GitVersion         string                      `json:"git_version,omitempty"`
+	ModuleCommits      map[string]string           `json:"module_commits,omitempty"`
+}
+
+// labelFlags collects the key=value pairs of the repeatable -label and -moduleoverride parameters
+type labelFlags map[string]string
+
+func (lf labelFlags) String() string {
+	labels := []string{}
+	for key, value := range lf {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+func (lf labelFlags) Set(label string) error {
+	kv := strings.SplitN(label, "=", 2)
+	if len(kv) != 2 || len(kv[0]) == 0 {
+		return fmt.Errorf("%s must be in the key=value format", label)
+	}
+	lf[kv[0]] = kv[1]
+	return nil
 }
 
+// GitRepositoryResult contains the number of attempts and the outcome of the git commands that mirrored or updated a git repository
+type GitRepositoryResult struct {
+	attempts      int
+	success       bool
+	cacheFallback bool
+	lastError     string
+}
+
+// defaultForgeExtractIgnore contains the paths that are skipped while extracting Forge modules if forge_extract_filter is enabled
+var defaultForgeExtractIgnore = []string{"spec/", ".git/", ".fixtures.yml"}
+
 func init() {
 	// initialize global maps
-	needSyncEnvs = make(map[string]struct{})
+	syncStats = newSyncStats()
 	uniqueForgeModules = make(map[string]ForgeModule)
+	gitRepositoryResults = make(map[string]*GitRepositoryResult)
+	resolvedModuleCommits = make(map[string]string)
+	shutdown = make(chan struct{})
+	// -1 means that the -retries parameter is not set
+	retries = -1
 }
 
 func main() {
@@ -208,9 +408,12 @@ func main() {
 		configFileFlag = flag.String("config", "", "which config file to use")
 		versionFlag    = flag.Bool("version", false, "show build time and version number")
 	)
-	flag.StringVar(&branchParam, "branch", "", "which git branch of the Puppet environment to update. Just the branch name, e.g. master, qa, dev")
+	flag.StringVar(&branchParam, "branch", "", "which git branch of the Puppet environment to update. Just the branch name, e.g. master, qa, dev, or a full ref path like refs/pull/42/head")
 	flag.StringVar(&environmentParam, "environment", "", "which Puppet environment to update. Source name inside the config + '_' + branch name, e.g. foo_master, foo_qa, foo_dev")
+	flag.StringVar(&environmentsFromParam, "environmentsfrom", "", "which Puppet environments to update, read from this file with one environment name (source name + '_' + branch name) per line, lines starting with # are ignored")
+	flag.BoolVar(&strictEnvironments, "strictenvironments", false, "fail if an environment listed in the -environmentsfrom file can not be found in any source instead of only warning")
 	flag.BoolVar(&tags, "tags", false, "to pull tags as well as branches")
+	flag.BoolVar(&stdinMode, "stdin", false, "read the branch to deploy from stdin, either as plain branch name, as JSON payload like {\"branch\": \"master\", \"module\": \"stdlib\"} or in the git post-receive hook format")
 	flag.StringVar(&outputNameParam, "outputname", "", "overwrite the environment name if -branch is specified")
 	flag.StringVar(&moduleParam, "module", "", "which module of the Puppet environment to update, e.g. stdlib")
 	flag.StringVar(&moduleDirParam, "moduledir", "", "allows overriding of Puppetfile specific moduledir setting, the folder in which Puppet modules will be extracted")
@@ -219,20 +422,51 @@ func main() {
 	flag.IntVar(&maxExtractworker, "maxextractworker", 20, "how many Goroutines are allowed to run in parallel for local Git and Forge module extracting processes (git clone, untar and gunzip)")
 	flag.BoolVar(&pfMode, "puppetfile", false, "install all modules from Puppetfile in cwd")
 	flag.StringVar(&pfLocation, "puppetfilelocation", "./Puppetfile", "which Puppetfile to use in -puppetfile mode")
-	flag.BoolVar(&force, "force", false, "purge the Puppet environment directory and do a full sync")
+	flag.BoolVar(&force, "force", false, "purge the Puppet environment directory and do a full sync, ignoring the .g10k-deploy.lock files of the environments")
 	flag.BoolVar(&dryRun, "dryrun", false, "do not modify anything, just print what would be changed")
+	flag.BoolVar(&interactive, "interactive", false, "list the git modules that need to be synced with their old and new commit and ask for each of them whether it should be synced, deploys all modules if stdin is not a terminal")
 	flag.BoolVar(&validate, "validate", false, "only validate given configuration and exit")
 	flag.BoolVar(&usemove, "usemove", false, "do not use hardlinks to populate your Puppet environments with Puppetlabs Forge modules. Instead uses simple move commands and purges the Forge cache directory after each run! (Useful for g10k runs inside a Docker container)")
 	flag.BoolVar(&check4update, "check4update", false, "only check if the is newer version of the Puppet module avaialable. Does implicitly set dryrun to true")
+	flag.BoolVar(&upgradeForgeModules, "upgrade", false, "resolve the version ranges of Forge modules to the highest matching release again instead of keeping the version they resolved to in the previous deploy")
+	flag.BoolVar(&failOnEmptyEnvironment, "failonemptyenvironment", false, "exit with 1 before syncing any module if the Puppetfile of an environment does not contain any module or the environment has no Puppetfile, overrides the empty_environments setting of the config file")
+	flag.BoolVar(&failFast, "failfast", false, "stop after the first git repository that could not be cloned or updated instead of retrying it or continuing with the other modules. The modules which did not start yet are skipped")
 	flag.BoolVar(&checkSum, "checksum", false, "get the md5 check sum for each Puppetlabs Forge module and verify the integrity of the downloaded archive. Increases g10k run time!")
 	flag.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
 	flag.BoolVar(&verbose, "verbose", false, "log verbose output, defaults to false")
 	flag.BoolVar(&info, "info", false, "log info output, defaults to false")
 	flag.BoolVar(&quiet, "quiet", false, "no output, defaults to false")
+	flag.BoolVar(&frozen, "frozen", false, "do not clone or update any git repository and deploy only from the cached git repositories, fails if a required git repository is not cached")
+	flag.StringVar(&execTraceParam, "exectrace", "", "write every command executed by g10k with its duration, return code and truncated output as JSON lines to this file for debugging")
+	flag.StringVar(&execReplayParam, "execreplay", "", "do not execute the commands, but return their recorded results from this -exectrace file, e.g. to reproduce the behavior of another host. git archive is always executed")
 	flag.BoolVar(&usecacheFallback, "usecachefallback", false, "if g10k should try to use its cache for sources and modules instead of failing")
 	flag.BoolVar(&retryGitCommands, "retrygitcommands", false, "if g10k should purge the local repository and retry a failed git command (clone or remote update) instead of failing")
+	flag.IntVar(&retries, "retries", -1, "how many times g10k should purge the local repository and retry a failed git command (clone or remote update), 0 disables retries, overrides retry_git_commands")
+	flag.BoolVar(&incremental, "incremental", false, "only resolve the Puppetfile of environments whose Puppetfile changed since the last successful deploy according to git diff of the control repository")
+	flag.StringVar(&exportTarballParam, "exporttarball", "", "write the deployed environments including their .g10k-deploy.json to this tar archive, gzip compressed if it ends with .gz or .tgz")
+	flag.BoolVar(&gcDeployMetadataMode, "gcdeploymetadata", false, "only remove the deploy metadata (.g10k-deploy.json) of environments whose branch does not exist anymore in their source and exit")
+	flag.BoolVar(&onlyNew, "onlynew", false, "only deploy environments which do not exist yet, existing environments are neither synced nor purged")
+	flag.BoolVar(&profile, "profile", false, "print the number of calls and the total and average duration of the main g10k functions after the sync")
+	flag.StringVar(&cpuProfileParam, "cpuprofile", "", "write a pprof CPU profile of the g10k run to this file")
+	flag.BoolVar(&verifyDeployedMode, "verifydeployed", false, "only verify that the control repository and modules of all deployed environments still match what their sources and pinned refs resolve to, print the drifted ones and exit with 1 if any environment drifted. Uses only the cached git repositories if use_cache_fallback is set")
+	flag.BoolVar(&warmCacheMode, "warmcache", false, "only mirror or update the git repositories of all control repositories and of all git modules used by any of their branches without deploying anything, so that later deploys find everything in the cache")
+	flag.BoolVar(&maintainCacheMode, "maintaincache", false, "only run git gc on all cached git repositories of the control repositories and modules in parallel and exit, git repositories which were updated within maintain_cache_min_age or are being updated by another g10k run are skipped")
+	flag.StringVar(&moduleUsageParam, "moduleusage", "", "only print which environments of all sources use the module with the given name, Forge module name or git repository url and at which ref, e.g. stdlib or puppetlabs-stdlib and exit with 1 if no environment uses it. Reads the Puppetfiles of all branches from the cached control repositories without updating them")
+	flag.BoolVar(&reportStaleCacheMode, "reportstalecache", false, "only print the cached git repositories of the module cache which no Puppetfile of any branch of the cached control repositories uses anymore together with their size and last update time without removing anything")
+	flag.StringVar(&compareEnvironmentsParam, "compareenvironments", "", "only print the differences between the modules of two deployed Puppet environment directories separated by a comma, e.g. /etc/puppetlabs/code/environments/staging,/etc/puppetlabs/code/environments/production and exit with 1 if they differ")
+	flag.StringVar(&serveParam, "serve", "", "run as a daemon with an HTTP server listening on this address, e.g. :8080, which deploys the environment or branch of each POST to /deploy with a JSON body like {\"environment\": \"foo_master\"} or {\"branch\": \"master\"}")
+	flag.BoolVar(&enforceImmutableRefsMode, "enforceimmutablerefs", false, "warn about every git module which is not pinned to a tag or a full commit hash, fails instead if enforce_immutable_refs is set to fail in the config file")
+	flag.Var(moduleOverrideParams, "moduleoverride", "deploy the git module with this name=ref in all environments with the given ref instead of the one in the Puppetfile, e.g. -moduleoverride stdlib=v9.0.0, the overrides are recorded in the .g10k-deploy.json")
+	flag.Var(labelParams, "label", "add this key=value label to the .g10k-deploy.json of the deployed environments, e.g. -label build=1234 -label requester=jdoe, overrides the deploy_labels of the config file")
+	flag.BoolVar(&r10kOutput, "r10koutput", false, "print the deployed environments and synced modules like r10k deploy -v info instead of the g10k summary, so that log parsers written for r10k keep working")
+	flag.BoolVar(&summaryOnly, "summaryonly", false, "suppress the per-module output like Need to sync of -info, -verbose and -debug and print only the number of processed environments, synced and unchanged modules and the duration instead of the g10k summary, warnings and errors are still printed")
+	flag.IntVar(&slowestModules, "slowestmodules", 0, "print the given number of git repositories which took the longest to be fetched and to be archived and extracted into the module directories after the summary and add them to the notify_url JSON body")
+	flag.IntVar(&progressFd, "progressfd", 0, "write the progress as JSON lines with the events module_started, module_fetched, module_synced, module_skipped and environment_complete to this already open file descriptor instead of showing the progress bar, e.g. 3 with 3>/tmp/g10k.progress")
+	flag.StringVar(&sinceParam, "since", "", "only sync git modules whose resolved commit was committed after this time, given as RFC3339 timestamp, unix timestamp or duration before now like 2h. Modules with older commits keep their deployed version, which can leave the environment partially stale")
+	flag.BoolVar(&stats, "stats", false, "print cache hit and miss statistics of the git modules per environment after the sync")
 	flag.BoolVar(&gitObjectSyntaxNotSupported, "gitobjectsyntaxnotsupported", false, "if your git version is too old to support reference syntax like master^{object} use this setting to revert to the older syntax")
 	flag.Parse()
+	handleSignals()
 
 	configFile = *configFileFlag
 	version := *versionFlag
@@ -241,18 +475,63 @@ func main() {
 		fmt.Println("g10k version 0.7.2 Build time:", buildtime, "UTC")
 		os.Exit(0)
 	}
+	if len(sinceParam) > 0 {
+		t, err := parseSinceParam(sinceParam, time.Now())
+		if err != nil {
+			Fatalf("Error: Invalid value " + sinceParam + " of parameter -since: " + err.Error())
+		}
+		sinceTime = t
+	}
+
+	if len(execTraceParam) > 0 {
+		openExecTrace(execTraceParam)
+	}
+	if progressFd > 0 {
+		openProgressEvents(progressFd)
+	}
+	if len(execReplayParam) > 0 {
+		readExecReplay(execReplayParam)
+	}
 
 	if check4update {
 		dryRun = true
 	}
+	if interactive {
+		if dryRun {
+			Fatalf("Error: -interactive parameter is not allowed with -dryrun or -check4update parameter!")
+		}
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			Warnf("WARN: stdin is not a terminal, ignoring parameter -interactive and syncing all git modules")
+			interactive = false
+		}
+	}
+
+	if len(compareEnvironmentsParam) > 0 {
+		envDirs := strings.Split(compareEnvironmentsParam, ",")
+		if len(envDirs) != 2 {
+			Fatalf("Error: -compareenvironments parameter needs two Puppet environment directories separated by a comma, but got " + compareEnvironmentsParam)
+		}
+		if printEnvironmentComparison(os.Stdout, strings.TrimSpace(envDirs[0]), strings.TrimSpace(envDirs[1])) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	// check for git executable dependency
 	if _, err := exec.LookPath("git"); err != nil {
 		Fatalf("Error: could not find 'git' executable in PATH")
 	}
+	gitVersion = detectGitVersion()
+	Verbosef("Using git version " + gitVersion)
+
+	stopCPUProfile := func() {}
+	if len(cpuProfileParam) > 0 {
+		stopCPUProfile = startCPUProfile(cpuProfileParam)
+	}
 
 	target := ""
 	before := time.Now()
+	runStartedAt = before
 	if len(configFile) > 0 {
 		if usemove {
 			Fatalf("Error: -usemove parameter is only allowed in -puppetfile mode!")
@@ -260,16 +539,102 @@ func main() {
 		if pfMode {
 			Fatalf("Error: -puppetfile parameter is not allowed with -config parameter!")
 		}
+		if stdinMode {
+			sdr := readStdinDeployRequest(os.Stdin)
+			if len(sdr.Branch) == 0 {
+				Fatalf("Error: -stdin specified, but could not read a branch name from stdin!")
+			}
+			branchParam = sdr.Branch
+			if len(sdr.Module) > 0 {
+				moduleParam = sdr.Module
+			}
+		}
 		if (len(outputNameParam) > 0) && (len(branchParam) == 0) {
 			Fatalf("Error: -outputname specified without -branch!")
 		}
+		if len(environmentsFromParam) > 0 {
+			if len(branchParam) > 0 {
+				Fatalf("Error: -environmentsfrom parameter is not allowed with -branch parameter!")
+			}
+			environmentsFilter = readEnvironmentsFile(environmentsFromParam)
+		}
+		if len(exportTarballParam) > 0 && dryRun {
+			Fatalf("Error: -exporttarball parameter is not allowed with -dryrun parameter!")
+		}
 		if usecacheFallback {
 			config.UseCacheFallback = true
 		}
 		Debugf("Using as config file: " + configFile)
 		config = readConfigfile(configFile)
+		if frozen && config.PartialClone {
+			Fatalf("Error: -frozen parameter is not allowed with the partial_clone setting, because git archive needs to fetch the missing blobs of the partial clones from the remote repositories")
+		}
+		if config.AtomicDeploy && (interactive || len(moduleParam) > 0) {
+			Fatalf("Error: -interactive and -module parameters are not allowed with the atomic_deploy setting, because each environment gets built from scratch with all its modules")
+		}
 		checkDirAndCreate(config.CacheDir, "cachedir configured value")
 		target = configFile
+		deployLabels = getDeployLabels()
+		applyUmask()
+		if len(config.RunStateFile) > 0 && !dryRun && !gcDeployMetadataMode && !verifyDeployedMode && !warmCacheMode && !maintainCacheMode && !reportStaleCacheMode && len(moduleUsageParam) == 0 && len(serveParam) == 0 {
+			openRunState(config.RunStateFile)
+		}
+		if verifyDeployedMode {
+			if verifyDeployedEnvironments(os.Stdout) {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+		if len(moduleUsageParam) > 0 {
+			if printModuleUsage(os.Stdout, moduleUsageParam) {
+				os.Exit(0)
+			}
+			os.Exit(1)
+		}
+		if reportStaleCacheMode {
+			printStaleCacheReport(os.Stdout)
+			os.Exit(0)
+		}
+		if warmCacheMode {
+			if len(branchParam) > 0 || len(environmentParam) > 0 {
+				Fatalf("Error: -warmcache parameter is not allowed with -branch or -environment parameter, it warms the cache for all environments!")
+			}
+			repositories, failed := warmCache()
+			if !quiet {
+				fmt.Println("Warmed the cache of", target, "with", repositories, "git repositories of modules")
+			}
+			if failed > 0 {
+				Warnf("WARN: Could not mirror or update " + strconv.Itoa(failed) + " git repositories")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+		if maintainCacheMode {
+			maintained, skipped, failed := maintainCache()
+			if !quiet {
+				fmt.Println("Maintained the cache of", target, "with", maintained, "git repositories,", skipped, "skipped")
+			}
+			if failed > 0 {
+				Warnf("WARN: Could not run git gc on " + strconv.Itoa(failed) + " git repositories")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+		if gcDeployMetadataMode {
+			removed := gcDeployMetadata()
+			if dryRun && !quiet {
+				fmt.Println("Would remove deploy metadata of", removed, "environments of", target)
+			} else if !quiet {
+				fmt.Println("Removed deploy metadata of", removed, "environments of", target)
+			}
+			os.Exit(0)
+		}
+		if len(serveParam) > 0 {
+			if len(branchParam) > 0 || len(environmentParam) > 0 {
+				Fatalf("Error: -serve parameter is not allowed with -branch or -environment parameter, the environment is set by each deploy request!")
+			}
+			serveDeploys(serveParam)
+		}
 		if len(branchParam) > 0 {
 			resolvePuppetEnvironment(branchParam, tags, outputNameParam)
 			target += " with branch " + branchParam
@@ -277,6 +642,33 @@ func main() {
 			resolvePuppetEnvironment("", tags, "")
 		}
 	} else {
+		if stdinMode {
+			Fatalf("Error: -stdin parameter is only allowed with -config parameter!")
+		}
+		if len(exportTarballParam) > 0 {
+			Fatalf("Error: -exporttarball parameter is only allowed with -config parameter!")
+		}
+		if len(environmentsFromParam) > 0 {
+			Fatalf("Error: -environmentsfrom parameter is only allowed with -config parameter!")
+		}
+		if verifyDeployedMode {
+			Fatalf("Error: -verifydeployed parameter is only allowed with -config parameter!")
+		}
+		if warmCacheMode {
+			Fatalf("Error: -warmcache parameter is only allowed with -config parameter!")
+		}
+		if len(moduleUsageParam) > 0 {
+			Fatalf("Error: -moduleusage parameter is only allowed with -config parameter!")
+		}
+		if reportStaleCacheMode {
+			Fatalf("Error: -reportstalecache parameter is only allowed with -config parameter!")
+		}
+		if maintainCacheMode {
+			Fatalf("Error: -maintaincache parameter is only allowed with -config parameter!")
+		}
+		if len(serveParam) > 0 {
+			Fatalf("Error: -serve parameter is only allowed with -config parameter!")
+		}
 		if pfMode {
 			Debugf("Trying to use as Puppetfile: " + pfLocation)
 			sm := make(map[string]Source)
@@ -294,7 +686,8 @@ func main() {
 			}
 			// default purge_levels
 			forgeDefaultSettings := Forge{Baseurl: "https://forgeapi.puppetlabs.com"}
-			config = ConfigSettings{CacheDir: cachedir, ForgeCacheDir: cachedir, ModulesCacheDir: cachedir, EnvCacheDir: cachedir, Sources: sm, Forge: forgeDefaultSettings, Maxworker: maxworker, UseCacheFallback: usecacheFallback, MaxExtractworker: maxExtractworker, RetryGitCommands: retryGitCommands, GitObjectSyntaxNotSupported: gitObjectSyntaxNotSupported}
+			config = ConfigSettings{CacheDir: cachedir, ForgeCacheDir: cachedir, ModulesCacheDir: cachedir, EnvCacheDir: cachedir, Sources: sm, Forge: forgeDefaultSettings, Maxworker: maxworker, UseCacheFallback: usecacheFallback, MaxExtractworker: maxExtractworker, RetryGitCommands: retryGitCommands || retries > 0, GitObjectSyntaxNotSupported: gitObjectSyntaxNotSupported}
+			applyGitVersion()
 			config.PurgeLevels = []string{"puppetfile"}
 			target = pfLocation
 			puppetfile := readPuppetfile(target, "", "cmdlineparam", false, false)
@@ -312,18 +705,68 @@ func main() {
 		defer purgeDir(config.ForgeCacheDir, "main() -puppetfile mode with -usemove parameter")
 	}
 
-	Debugf("Forge response JSON parsing took " + strconv.FormatFloat(forgeJSONParseTime, 'f', 4, 64) + " seconds")
-	Debugf("Forge modules metadata.json parsing took " + strconv.FormatFloat(metadataJSONParseTime, 'f', 4, 64) + " seconds")
+	Debugf("Forge response JSON parsing took " + strconv.FormatFloat(syncStats.forgeJSONParseTime, 'f', 4, 64) + " seconds")
+	Debugf("Forge modules metadata.json parsing took " + strconv.FormatFloat(syncStats.metadataJSONParseTime, 'f', 4, 64) + " seconds")
 
-	if !check4update && !quiet {
+	if shutdownRequested() {
+		Warnf("WARN: g10k was interrupted by signal " + receivedSignal.String() + ", exiting without purging unmanaged content and executing the postrun command")
+		sendNotification(false, "g10k was interrupted by signal "+receivedSignal.String())
+		sendFailedDeployEvents("g10k was interrupted by signal " + receivedSignal.String())
+		os.Exit(signalExitCode())
+	}
+
+	if config.MaxCacheSizeGB > 0 {
+		evictModuleCache(int64(config.MaxCacheSizeGB) << 30)
+	}
+
+	if len(exportTarballParam) > 0 {
+		exportTarball(exportTarballParam, syncStats)
+	}
+
+	distributeToMasters(syncStats)
+
+	if r10kOutput {
+		printR10kOutput(os.Stdout, syncStats)
+	} else if !check4update && !quiet {
 		if len(forgeModuleDeprecationNotice) > 0 {
 			Warnf(strings.TrimSuffix(forgeModuleDeprecationNotice, "\n"))
 		}
-		fmt.Println("Synced", target, "with", syncGitCount, "git repositories and", syncForgeCount, "Forge modules in "+strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64)+"s with git ("+strconv.FormatFloat(syncGitTime, 'f', 1, 64)+"s sync, I/O", strconv.FormatFloat(ioGitTime, 'f', 1, 64)+"s) and Forge ("+strconv.FormatFloat(syncForgeTime, 'f', 1, 64)+"s query+download, I/O", strconv.FormatFloat(ioForgeTime, 'f', 1, 64)+"s) using", strconv.Itoa(config.Maxworker), "resolv and", strconv.Itoa(config.MaxExtractworker), "extract workers")
+		if summaryOnly {
+			printSyncSummary(os.Stdout, target, syncStats, time.Since(before))
+		} else {
+			fmt.Println("Synced", target, "with", syncStats.syncGitCount, "git repositories and", syncStats.syncForgeCount, "Forge modules in "+strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64)+"s with git ("+strconv.FormatFloat(syncStats.syncGitTime, 'f', 1, 64)+"s sync, I/O", strconv.FormatFloat(syncStats.ioGitTime, 'f', 1, 64)+"s) and Forge ("+strconv.FormatFloat(syncStats.syncForgeTime, 'f', 1, 64)+"s query+download, I/O", strconv.FormatFloat(syncStats.ioForgeTime, 'f', 1, 64)+"s) using", strconv.Itoa(config.Maxworker), "resolv and", strconv.Itoa(config.MaxExtractworker), "extract workers")
+			printChangeSummary(os.Stdout, syncStats)
+		}
+		if slowestModules > 0 {
+			printSlowestModules(os.Stdout, syncStats, slowestModules)
+		}
+		printMastersSummary(os.Stdout, syncStats)
+	}
+	if stats {
+		printStats(syncStats)
+	}
+	if profile {
+		printProfile()
+	}
+	stopCPUProfile()
+	clearRunState()
+	outOfSyncMasters := 0
+	for _, mr := range syncStats.getMasterResults() {
+		if !mr.InSync {
+			outOfSyncMasters++
+		}
+	}
+	if outOfSyncMasters > 0 {
+		sendNotification(false, strconv.Itoa(outOfSyncMasters)+" masters could not be synced")
+	} else {
+		sendNotification(true, "")
 	}
-	if dryRun && (needSyncForgeCount > 0 || needSyncGitCount > 0) {
+	if dryRun && (syncStats.needSyncForgeCount > 0 || syncStats.needSyncGitCount > 0) {
 		os.Exit(1)
 	}
 
 	checkForAndExecutePostrunCommand()
+	if outOfSyncMasters > 0 {
+		os.Exit(1)
+	}
 }
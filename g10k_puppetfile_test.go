@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -98,7 +101,16 @@ func equalGitModule(a, b GitModule) bool {
 		a.ref != b.ref ||
 		a.link != b.link ||
 		a.ignoreUnreachable != b.ignoreUnreachable ||
-		a.installPath != b.installPath {
+		a.fetchTags != b.fetchTags ||
+		a.localPath != b.localPath ||
+		a.timeout != b.timeout ||
+		a.sshPort != b.sshPort ||
+		a.sshKnownHosts != b.sshKnownHosts ||
+		a.sshStrictHostKeyChecking != b.sshStrictHostKeyChecking ||
+		a.installPath != b.installPath ||
+		a.targetName != b.targetName ||
+		a.tarball != b.tarball ||
+		a.tarballSHA256 != b.tarballSHA256 {
 		return false
 	}
 	if len(a.fallback) != len(b.fallback) {
@@ -109,6 +121,14 @@ func equalGitModule(a, b GitModule) bool {
 			return false
 		}
 	}
+	if len(a.fetchRefspecs) != len(b.fetchRefspecs) {
+		return false
+	}
+	for i, v := range a.fetchRefspecs {
+		if b.fetchRefspecs[i] != v {
+			return false
+		}
+	}
 	return true
 }
 
@@ -291,6 +311,10 @@ func TestReadPuppetfileConflictingGitAttributesCommit(t *testing.T) {
 	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
 }
 
+func TestReadPuppetfileInvalidCommitHash(t *testing.T) {
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Invalid commit hash 8f4fc5 of parameter commit, must be 7 to 40 hexadecimal characters. In tests/TestReadPuppetfileInvalidCommitHash for module example_module")
+}
+
 func TestReadPuppetfileConflictingGitAttributesRef(t *testing.T) {
 	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
 }
@@ -500,3 +524,340 @@ func TestReadPuppetfileGitDashNSlashNotation(t *testing.T) {
 		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
 	}
 }
+
+func TestReadPuppetfileFetchRefspec(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["gerrit_module"] = GitModule{git: "https://gerrit.domain.tld/gerrit-module.git", ref: "refs/changes/42/1337/2",
+		fetchRefspecs: []string{"+refs/changes/*:refs/changes/*"}}
+	gm["another_module"] = GitModule{git: "https://gerrit.domain.tld/another-module.git",
+		fetchRefspecs: []string{"+refs/changes/*:refs/changes/*", "+refs/meta/*:refs/meta/*"}}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileFetchTags(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["example_module"] = GitModule{git: "https://github.com/foo/example-module.git", tag: "v1.2.3", fetchTags: true}
+	gm["another_module"] = GitModule{git: "https://github.com/foo/another-module.git", branch: "master"}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileLocalModulePath(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	// the relative path gets resolved against the directory tests/ of the Puppetfile
+	relativeModule, _ := filepath.Abs("puppet-relativemodule")
+	gm := make(map[string]GitModule)
+	gm["devmodule"] = GitModule{localPath: "/home/dev/puppet-devmodule"}
+	gm["relativemodule"] = GitModule{localPath: relativeModule}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileTimeout(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["huge_module"] = GitModule{git: "https://github.com/foo/huge-module.git", branch: "master", timeout: 600}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileSSHOptions(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["internal_module"] = GitModule{git: "git@gitserver.domain.tld:foo/internal-module.git", branch: "master",
+		sshPort: 2222, sshKnownHosts: "/etc/g10k/known_hosts", sshStrictHostKeyChecking: "no"}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileManyAttributes(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["internal_module"] = GitModule{git: "git@gitserver.domain.tld:foo/internal-module.git", branch: "master", ignoreUnreachable: true, fetchTags: true,
+		installPath: "external", timeout: 600, sshPort: 2222, sshKnownHosts: "/etc/g10k/known_hosts", sshStrictHostKeyChecking: "no",
+		privateKey: "/etc/g10k/internal_key", targetName: "internal"}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfilePrivateKey(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "/etc/g10k/source_key", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["internal_module"] = GitModule{git: "git@gitserver.domain.tld:foo/internal-module.git", privateKey: "/etc/g10k/internal_module_key"}
+	gm["other_module"] = GitModule{git: "git@gitserver.domain.tld:foo/other-module.git"}
+
+	expected := Puppetfile{source: "test", privateKey: "/etc/g10k/source_key", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileTargetName(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["puppetlabs_stdlib"] = GitModule{git: "https://github.com/puppetlabs/puppetlabs-stdlib.git", tag: "4.25.0", targetName: "stdlib"}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileTarball(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["vendored"] = GitModule{tarball: "https://artifacts.domain.tld/puppet/vendored-1.2.0.tar.gz", tarballSHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}
+	gm["nightly"] = GitModule{tarball: "https://artifacts.domain.tld/puppet/nightly.tar.gz", timeout: 30}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileTarballConflictingSources(t *testing.T) {
+	quiet = true
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Found conflicting module sources :tarball and :git or :local in tests/TestReadPuppetfileTarballConflictingSources for module vendored")
+}
+
+func TestReadPuppetfileTargets(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	gm := make(map[string]GitModule)
+	gm["mymod_current"] = GitModule{git: "https://github.com/foo/mymod.git", ref: "v1.0.0"}
+	gm["mymod_next"] = GitModule{git: "https://github.com/foo/mymod.git", ref: "main"}
+	gm["other"] = GitModule{git: "https://github.com/foo/other.git", tag: "v2.0.0"}
+
+	expected := Puppetfile{source: "test", gitModules: gm}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileTargetsConflictingRefs(t *testing.T) {
+	quiet = true
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Found conflicting git attributes :tag, :targets, in tests/TestReadPuppetfileTargetsConflictingRefs for module mymod")
+}
+
+func TestReadPuppetfileTargetNameCollision(t *testing.T) {
+	quiet = true
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Modules puppetlabs_stdlib and stdlib both resolve to the same module directory modules/stdlib in tests/TestReadPuppetfileTargetNameCollision")
+}
+
+func TestReadPuppetfileDuplicateModuleLineNumbers(t *testing.T) {
+	quiet = true
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Duplicate module found in tests/TestReadPuppetfileDuplicateModuleLineNumbers for module foo line: mod 'foo',:git => 'https://github.com/foo/foo.git',:tag => 'v2.0.0' (declared in line 2 and line 8)")
+}
+
+func TestReadPuppetfileWarnDuplicateModules(t *testing.T) {
+	quiet = true
+	config = ConfigSettings{WarnDuplicateModules: true}
+	defer func() { config = ConfigSettings{} }()
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	if foo := got.gitModules["foo"]; foo.tag != "v2.0.0" {
+		t.Errorf("Expected the last declaration of the duplicate module foo with tag v2.0.0, but got %+v", foo)
+	}
+	if _, ok := got.forgeModules["stdlib"]; !ok {
+		t.Errorf("Expected Forge module stdlib, but got %+v", got.forgeModules)
+	}
+}
+
+func TestReadPuppetfileModuleRefCycle(t *testing.T) {
+	quiet = true
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Found cycle in module references")
+}
+
+func TestReadPuppetfileModuleRefMissing(t *testing.T) {
+	quiet = true
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Git module moda references the commit of module modc, but there is no git module modc in tests/TestReadPuppetfileModuleRefMissing")
+}
+
+func TestSortGitModulesByRef(t *testing.T) {
+	gm := make(map[string]GitModule)
+	gm["a"] = GitModule{ref: "module:c"}
+	gm["b"] = GitModule{branch: "master"}
+	gm["c"] = GitModule{ref: "module:d"}
+	gm["d"] = GitModule{tag: "v1.0.0"}
+
+	got := sortGitModulesByRef(gm)
+	expected := []string{"d", "c", "a", "b"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected sorted git modules %v, but got %v", expected, got)
+	}
+}
+
+func TestAddGlobalModules(t *testing.T) {
+	quiet = true
+	config = ConfigSettings{GlobalModules: []string{
+		"mod 'base', :git => 'https://git.example.com/puppet/base.git', :tag => 'v1.0.0'",
+		"mod 'puppetlabs/stdlib', '4.25.0'",
+		"mod 'concat',\n  :git => 'https://git.example.com/puppet/concat.git'",
+	}}
+	globalModulesOnce = sync.Once{}
+	defer func() { globalModulesOnce = sync.Once{} }()
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := addGlobalModules(readPuppetfile("tests/"+funcName, "", "test", false, false), "tests/"+funcName)
+
+	if len(got.gitModules) != 1 || got.gitModules["base"].branch != "feature" {
+		t.Errorf("Expected git module base of the Puppetfile to override the global module, but got %+v", got.gitModules)
+	}
+	if len(got.forgeModules) != 2 || got.forgeModules["concat"].version != "4.2.1" {
+		t.Errorf("Expected Forge module concat of the Puppetfile to override the global git module, but got %+v", got.forgeModules)
+	}
+	if stdlib := got.forgeModules["stdlib"]; stdlib.version != "4.25.0" || stdlib.moduleDir != "external_modules/" {
+		t.Errorf("Expected global Forge module stdlib 4.25.0 in external_modules/, but got %+v", stdlib)
+	}
+}
+
+func TestReadPuppetfileForgeVersionRange(t *testing.T) {
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", false, false)
+
+	fm := make(map[string]ForgeModule)
+	fm["stdlib"] = ForgeModule{version: ">= 5.0.0 < 6.0.0", author: "puppetlabs", name: "stdlib"}
+	fm["apt"] = ForgeModule{version: "2.x", author: "puppetlabs", name: "apt"}
+	fm["ntp"] = ForgeModule{version: "6.0.0", author: "puppetlabs", name: "ntp"}
+	fm["concat"] = ForgeModule{version: ">=2.2.0 <3.0.0", author: "puppetlabs", name: "concat", sha256sum: "ec0407abab71f57e106ade6ed394410d08eec29bdad4c285580e7b56514c5194"}
+
+	expected := Puppetfile{forgeModules: fm, source: "test"}
+
+	if !equalPuppetfile(got, expected) {
+		spew.Dump(expected)
+		spew.Dump(got)
+		t.Error("Expected Puppetfile:", expected, ", but got Puppetfile:", got)
+	}
+}
+
+func TestReadPuppetfileModuledirSections(t *testing.T) {
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	pf := readPuppetfile("tests/"+funcName, "", "test", false, false)
+	expectedModuleDirs := []string{"modules/", "external/", "site/"}
+	if !reflect.DeepEqual(pf.moduleDirs, expectedModuleDirs) {
+		t.Errorf("Expected module directories %v, but got %v", expectedModuleDirs, pf.moduleDirs)
+	}
+	expected := map[string]string{"stdlib": "modules/", "apt": "external/", "ntp": "external/"}
+	for name, moduleDir := range expected {
+		if pf.forgeModules[name].moduleDir != moduleDir {
+			t.Errorf("Expected module directory %s for Forge module %s, but got %s", moduleDir, name, pf.forgeModules[name].moduleDir)
+		}
+	}
+	expected = map[string]string{"sensu": "external/", "profile": "site/"}
+	for name, moduleDir := range expected {
+		if pf.gitModules[name].moduleDir != moduleDir {
+			t.Errorf("Expected module directory %s for git module %s, but got %s", moduleDir, name, pf.gitModules[name].moduleDir)
+		}
+	}
+}
+
+func TestReadPuppetfileShallowSince(t *testing.T) {
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	pf := readPuppetfile("tests/"+funcName, "", "test", false, false)
+	if pf.gitModules["apt"].shallowSince != "2024-01-31" {
+		t.Errorf("Expected shallow_since 2024-01-31 of git module apt, but got %s", pf.gitModules["apt"].shallowSince)
+	}
+	if expected := time.Now().AddDate(0, 0, -90).Format("2006-01-02"); pf.gitModules["ntp"].shallowSince != expected {
+		t.Errorf("Expected shallow_since %s of git module ntp, but got %s", expected, pf.gitModules["ntp"].shallowSince)
+	}
+}
+
+func TestReadPuppetfileInvalidShallowSince(t *testing.T) {
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Invalid value last year of parameter shallow_since, must be a date like 2024-01-31 or a number of days like 90 days ago. In tests/TestReadPuppetfileInvalidShallowSince for module apt")
+}
+
+func TestReadPuppetfilePostSyncNotAllowed(t *testing.T) {
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Found parameter post_sync, which is only allowed with allow_post_sync: true in the g10k config. In tests/TestReadPuppetfilePostSyncNotAllowed for module example_tool")
+}
+
+func TestReadPuppetfilePostSyncQuotes(t *testing.T) {
+	config.AllowPostSync = true
+	defer func() { config.AllowPostSync = false }()
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: The value of parameter post_sync must not contain quotes or commas. In tests/TestReadPuppetfilePostSyncQuotes for module example_tool")
+}
+
+func TestReadPuppetfilePostSyncCommas(t *testing.T) {
+	config.AllowPostSync = true
+	defer func() { config.AllowPostSync = false }()
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: The value of parameter post_sync must not contain quotes or commas. In tests/TestReadPuppetfilePostSyncCommas for module example_tool")
+}
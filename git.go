@@ -1,142 +1,1194 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
-	"github.com/xorpaul/uiprogress"
+	"github.com/kballard/go-shellquote"
 )
 
-func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
+// resolveModules updates the cached git repositories and downloads the Forge modules concurrently
+// both share a pool of maxworker workers and a progress bar, so that the git modules and Forge modules of environments mixing both do not wait for each other
+func resolveModules(uniqueGitModules map[string]GitModule, uniqueForgeModules map[string]ForgeModule, st *SyncStats) {
 	defer timeTrack(time.Now(), funcName())
-	if len(uniqueGitModules) <= 0 {
-		Debugf("uniqueGitModules[] is empty, skipping...")
+	total := len(uniqueGitModules) + len(uniqueForgeModules)
+	if total <= 0 {
+		Debugf("uniqueGitModules[] and uniqueForgeModules[] are empty, skipping...")
 		return
 	}
-	bar := uiprogress.AddBar(len(uniqueGitModules)).AppendCompleted().PrependElapsed()
-	bar.PrependFunc(func(b *uiprogress.Bar) string {
-		return fmt.Sprintf("Resolving Git modules (%d/%d)", b.Current(), len(uniqueGitModules))
-	})
+	progress := newModuleProgress(total)
+	moduleProgress = progress
+
+	Debugf("Resolving " + strconv.Itoa(len(uniqueGitModules)) + " Git modules and " + strconv.Itoa(len(uniqueForgeModules)) + " Forge modules with " + strconv.Itoa(config.Maxworker) + " workers")
 	// Dummy channel to coordinate the number of concurrent goroutines.
 	// This channel should be buffered otherwise we will be immediately blocked
 	// when trying to fill it.
-
-	Debugf("Resolving " + strconv.Itoa(len(uniqueGitModules)) + " Git modules with " + strconv.Itoa(config.Maxworker) + " workers")
 	concurrentGoroutines := make(chan struct{}, config.Maxworker)
-	// Fill the dummy channel with config.Maxworker empty struct.
-	for i := 0; i < config.Maxworker; i++ {
-		concurrentGoroutines <- struct{}{}
-	}
-
-	// The done channel indicates when a single goroutine has finished its job.
-	done := make(chan bool)
-	// The waitForAllJobs channel allows the main program
-	// to wait until we have indeed done all the jobs.
-	waitForAllJobs := make(chan bool)
-	// Collect all the jobs, and since the job is finished, we can
-	// release another spot for a goroutine.
-	go func() {
-		for _, gm := range uniqueGitModules {
-			go func(gm GitModule) {
-				<-done
-				// Say that another goroutine can now start.
-				concurrentGoroutines <- struct{}{}
-			}(gm)
-		}
-		// We have collected all the jobs, the program can now terminate
-		waitForAllJobs <- true
-	}()
-	wg := sync.WaitGroup{}
-	wg.Add(len(uniqueGitModules))
+	stopRampUp := make(chan struct{})
+	defer close(stopRampUp)
+	// Fill the dummy channel with config.Maxworker empty struct, optionally ramped up over ramp_up_seconds.
+	fillWorkerSlots(concurrentGoroutines, config.Maxworker, time.Duration(config.RampUpSeconds)*time.Second, stopRampUp)
+
+	// the sync times of the summary are measured until the last git repository and the last Forge module got resolved
+	// with -failfast the first git error cancels all git and Forge modules which did not start yet
+	// it also kills the git commands of the other git repositories, which are still running
+	ctx, cancel := context.WithCancel(runContext)
+	defer cancel()
 
+	before := time.Now()
+	wgGit := sync.WaitGroup{}
+	wgGit.Add(len(uniqueGitModules))
+	wgForge := sync.WaitGroup{}
+	wgForge.Add(len(uniqueForgeModules))
 	for url, gm := range uniqueGitModules {
 		Debugf("git repo url " + url)
-		privateKey := gm.privateKey
-		go func(url string, privateKey string, gm GitModule, bar *uiprogress.Bar) {
+		go func(url string, gm GitModule) {
+			defer wgGit.Done()
 			// Try to receive from the concurrentGoroutines channel. When we have something,
 			// it means we can start a new goroutine because another one finished.
 			// Otherwise, it will block the execution until an execution
 			// spot is available.
-			<-concurrentGoroutines
-			defer bar.Incr()
-			defer wg.Done()
-
-			if len(gm.privateKey) > 0 {
-				Debugf("git repo url " + url + " with ssh key " + privateKey)
-			} else {
-				Debugf("git repo url " + url + " without ssh key")
+			if !waitForWorkerSlot(ctx, concurrentGoroutines) {
+				Debugf("Skipping git repo url " + url + ", because -failfast stops after the first git error")
+				return
+			}
+			// Say that another goroutine can now start.
+			defer func() { concurrentGoroutines <- struct{}{} }()
+			sendModuleStarted(getTokenFreeGitURL(url))
+			ok := resolveGitRepository(ctx, url, gm, st)
+			sendModuleFetched(getTokenFreeGitURL(url), ok)
+			progress.resolve()
+			if !ok && failFast {
+				// only the git commands and modules of this resolveModules() run get cancelled
+				cancel()
+			}
+		}(url, gm)
+	}
+	for m, fm := range uniqueForgeModules {
+		go func(m string, fm ForgeModule) {
+			defer wgForge.Done()
+			if !waitForWorkerSlot(ctx, concurrentGoroutines) {
+				Debugf("Skipping Forge module " + m + ", because -failfast stops after the first git error")
+				return
 			}
+			defer func() { concurrentGoroutines <- struct{}{} }()
+			Debugf("resolveModules(): Trying to get forge module " + m + " with Forge base url " + fm.baseURL + " and CacheTtl set to " + fm.cacheTTL.String())
+			sendModuleStarted(m)
+			doModuleInstallOrNothing(fm, st)
+			sendModuleFetched(m, true)
+			progress.resolve()
+		}(m, fm)
+	}
+
+	// Wait for all jobs to finish
+	wgPhases := sync.WaitGroup{}
+	wgPhases.Add(2)
+	go func() {
+		defer wgPhases.Done()
+		wgGit.Wait()
+		if len(uniqueGitModules) > 0 {
+			st.setSyncGitTime(time.Since(before).Seconds())
+		}
+	}()
+	go func() {
+		defer wgPhases.Done()
+		wgForge.Wait()
+		if len(uniqueForgeModules) > 0 {
+			st.setSyncForgeTime(time.Since(before).Seconds())
+		}
+	}()
+	wgPhases.Wait()
+	if len(uniqueGitModules) > 0 {
+		printGitRepositoryResults()
+	}
+	// ctx also gets cancelled together with runContext, e.g. by a second shutdown signal, which is not the first git error
+	if ctx.Err() != nil && runContext.Err() == nil {
+		Fatalf("Error: Stopped resolving the git and Forge modules after the first git error, because -failfast is set")
+	}
+}
 
-			//log.Println(config)
-			// create save directory name from Git repo name
-			repoDir := strings.Replace(strings.Replace(url, "/", "_", -1), ":", "-", -1)
-			workDir := config.ModulesCacheDir + repoDir
+// waitForWorkerSlot blocks until a worker slot is free and returns false without taking a slot if ctx got cancelled
+func waitForWorkerSlot(ctx context.Context, slots chan struct{}) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-slots:
+		if ctx.Err() != nil {
+			slots <- struct{}{}
+			return false
+		}
+		return true
+	}
+}
 
-			success := doMirrorOrUpdate(url, workDir, privateKey, gm.ignoreUnreachable, 1)
-			if !success && config.UseCacheFallback == false {
-				Fatalf("Fatal: Could not reach git repository " + url)
+// resolveGitRepository clones or updates the cached git repository of the git module with the given url
+// it returns false if that failed and -failfast is set, otherwise g10k exits unless use_cache_fallback is set
+func resolveGitRepository(ctx context.Context, url string, gm GitModule, st *SyncStats) bool {
+	if shutdownRequested() {
+		Debugf("Skipping git repo url " + url + ", because g10k is shutting down")
+		return true
+	}
+
+	if len(gm.privateKey) > 0 {
+		Debugf("git repo url " + url + " with ssh key " + gm.privateKey)
+	} else {
+		Debugf("git repo url " + url + " without ssh key")
+	}
+
+	workDir := getModuleCacheDir(url)
+	if isReadOnlyCacheDir(workDir) {
+		Debugf("Skipping update of " + workDir + ", because it is in the read_only_cachedir")
+		recordGitRepositoryResult(url, true, false, "")
+		return true
+	}
+
+	success := doMirrorOrUpdate(ctx, gm, workDir, getGitRetryCount(), st)
+	if !success && failFast {
+		Warnf("WARN: Could not reach git repository " + url + ", stopping because -failfast is set")
+		return false
+	}
+	if !success && config.UseCacheFallback == false {
+		Fatalf("Fatal: Could not reach git repository " + url)
+	}
+	return success
+}
+
+// getModuleCacheDir returns the directory of the cached git repository of the git module with the given url
+// the git repository of the read_only_cachedir gets used if it exists there, otherwise the one of the writable cachedir
+func getModuleCacheDir(url string) string {
+	// create save directory name from Git repo name
+	// the secrets of ${VAR} placeholders must not end up in the directory name
+	repoDir := strings.Replace(strings.Replace(getTokenFreeGitURL(url), "/", "_", -1), ":", "-", -1)
+	if len(config.ReadOnlyCacheDir) > 0 && isDir(config.ReadOnlyCacheDir+"modules/"+repoDir) {
+		return config.ReadOnlyCacheDir + "modules/" + repoDir
+	}
+	return config.ModulesCacheDir + repoDir
+}
+
+// isReadOnlyCacheDir returns true if the cached git repository workDir is in the read_only_cachedir, which g10k must never write to
+func isReadOnlyCacheDir(workDir string) bool {
+	return len(config.ReadOnlyCacheDir) > 0 && strings.HasPrefix(workDir, config.ReadOnlyCacheDir)
+}
+
+// fillWorkerSlots puts a slot for each of the workers into the slots channel
+// with a ramp up interval it starts with a single slot and adds the other slots evenly spread over the interval in the background,
+// so that the git servers do not get all connections at the start of the g10k run
+func fillWorkerSlots(slots chan struct{}, workers int, rampUp time.Duration, stop chan struct{}) {
+	if rampUp <= 0 || workers <= 1 || rampUp/time.Duration(workers-1) <= 0 {
+		for i := 0; i < workers; i++ {
+			slots <- struct{}{}
+		}
+		return
+	}
+	slots <- struct{}{}
+	Debugf("Ramping up to " + strconv.Itoa(workers) + " git workers in " + rampUp.String())
+	go func() {
+		ticker := time.NewTicker(rampUp / time.Duration(workers-1))
+		defer ticker.Stop()
+		for i := 1; i < workers; i++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				slots <- struct{}{}
 			}
-			//	doCloneOrPull(source, workDir, targetDir, sa.Remote, branch, sa.PrivateKey)
-            done <- true
-		}(url, privateKey, gm, bar)
+		}
+	}()
+}
+
+// recordGitRepositoryResult records the outcome of a git mirror or update attempt for the given git repository
+func recordGitRepositoryResult(url string, success bool, cacheFallback bool, lastError string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	grr, ok := gitRepositoryResults[url]
+	if !ok {
+		grr = &GitRepositoryResult{}
+		gitRepositoryResults[url] = grr
+	}
+	grr.attempts++
+	grr.success = success
+	grr.cacheFallback = cacheFallback
+	if len(lastError) > 0 {
+		grr.lastError = maskSecrets(lastError)
 	}
+}
 
-	// Wait for all jobs to finish
-	<-waitForAllJobs
-	wg.Wait()
+// printGitRepositoryResults prints a summary of all git repositories that needed retries, used the cache fallback or failed
+func printGitRepositoryResults() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	urls := []string{}
+	for url, grr := range gitRepositoryResults {
+		if grr.attempts > 1 || grr.cacheFallback || !grr.success {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		Debugf("all git repositories were mirrored or updated with the first attempt")
+		return
+	}
+	sort.Strings(urls)
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GIT REPOSITORY\tATTEMPTS\tSUCCESS\tCACHE FALLBACK\tLAST ERROR")
+	for _, url := range urls {
+		grr := gitRepositoryResults[url]
+		lastError := strings.Replace(strings.TrimSpace(grr.lastError), "\n", " ", -1)
+		fmt.Fprintln(w, url+"\t"+strconv.Itoa(grr.attempts)+"\t"+strconv.FormatBool(grr.success)+"\t"+strconv.FormatBool(grr.cacheFallback)+"\t"+lastError)
+	}
+	w.Flush()
+	Warnf("Summary of git repositories with retries, cache fallbacks or failures:\n" + strings.TrimSuffix(b.String(), "\n"))
 }
 
-func doMirrorOrUpdate(url string, workDir string, sshPrivateKey string, allowFail bool, retryCount int) bool {
+// getGitRetryCount returns how many times a failed git clone or update gets retried, which is once unless the -retries parameter is set
+// with -failfast nothing gets retried
+func getGitRetryCount() int {
+	if failFast {
+		return 0
+	}
+	if retries >= 0 {
+		return retries
+	}
+	return 1
+}
+
+func doMirrorOrUpdate(ctx context.Context, gitModule GitModule, workDir string, retryCount int, st *SyncStats) bool {
+	defer timeTrack(time.Now(), funcName())
+	// -maintaincache must not run git gc while the git repository gets updated
+	unlock, _ := lockMirror(workDir, true)
+	defer unlock()
+	url := gitModule.git
+	// the control repositories are always updated, so that a resumed run deploys their latest commits
+	isModuleRepository := !strings.HasPrefix(workDir, config.EnvCacheDir)
+	if isModuleRepository {
+		markModuleCacheDirUsed(workDir)
+	}
+	forgetBatchResolvedGitObjects(workDir)
+	if _, ok := resumedRunState("git_repository", url); ok && isModuleRepository && isDir(workDir) {
+		Debugf("Skipping update of " + workDir + ", because it was already updated by the interrupted g10k run")
+		return true
+	}
+	if frozen {
+		if !isDir(workDir) {
+			Fatalf("doMirrorOrUpdate(): Error: git repository " + url + " is not cached in " + workDir + " and -frozen forbids to clone it")
+		}
+		Debugf("Skipping update of " + workDir + ", because -frozen is set")
+		return true
+	}
+	if len(config.BundleDir) > 0 {
+		return mirrorFromBundle(gitModule, workDir, st)
+	}
+	st.addGitFetch()
+	before := time.Now()
+	defer func() {
+		st.addModuleFetchTime(workDir, getTokenFreeGitURL(url), time.Since(before).Seconds())
+	}()
+	sshPrivateKey := getSSHPrivateKey(gitModule.privateKey)
+	allowFail := gitModule.ignoreUnreachable
+	if _, ok := getHTTPSFallbackURL(gitModule); ok {
+		// a failed git command over ssh must return to be retried over https
+		allowFail = true
+	}
 	needSSHKey := true
-	if strings.Contains(url, "github.com") || len(sshPrivateKey) == 0 {
+
+	// ${VAR} placeholders in the user info of the URL are passed to git as HTTP Authorization header in its environment, which does not get written into the git config
+	cloneURL, credentialEnv, err := expandGitURLSecrets(url)
+	if err != nil {
+		Warnf("WARN: git repository " + url + " can not be mirrored: " + err.Error())
+		recordGitRepositoryResult(url, false, false, err.Error())
+		return false
+	}
+	if strings.Contains(url, "github.com") || len(sshPrivateKey) == 0 || len(credentialEnv) > 0 {
 		needSSHKey = false
 	}
 
-	er := ExecResult{}
-	gitCmd := "git clone --mirror " + url + " " + workDir
-	if isDir(workDir) {
+	gitSSHCommand := getGitSSHCommand(gitModule)
+	clientCertificateOptions := getGitClientCertificateOptions(cloneURL)
+	runGitCommand := func(gitCmd string) ExecResult {
+		if len(clientCertificateOptions) > 0 {
+			gitCmd = "git" + clientCertificateOptions + strings.TrimPrefix(gitCmd, "git")
+		}
+		gitCmd = getRateLimitedGitCommand(gitCmd)
+		if len(gitSSHCommand) > 0 {
+			gitCmd = "env GIT_SSH_COMMAND=\"" + gitSSHCommand + "\" " + gitCmd
+		}
+		if needSSHKey {
+			gitCmd = "ssh-agent bash -c 'ssh-add " + sshPrivateKey + "; " + gitCmd + "'"
+		}
+		er := executeGitCommand(ctx, gitCmd, gitModule.timeout, allowFail, credentialEnv...)
+		writeGitLog(workDir, gitCmd, er)
+		return er
+	}
+
+	fetchRefspecs := append([]string{}, gitModule.fetchRefspecs...)
+	if gitModule.fetchTags || config.FetchTags {
+		// some git servers do not advertise new tags on remote update, so fetch them explicitly
+		fetchRefspecs = append(fetchRefspecs, "+refs/tags/*:refs/tags/*")
+	}
+
+	isMirror := isDir(workDir)
+	if isMirror && !checkMirrorAlternates(workDir) {
+		purgeDir(workDir, "doMirrorOrUpdate(), because an object store of its alternates is missing")
+		isMirror = false
+	}
+	shallowOptions := ""
+	if len(gitModule.shallowSince) > 0 {
+		// only the history since shallow_since gets mirrored, git ignores it for local paths without file://
+		shallowOptions = " --shallow-since=" + gitModule.shallowSince
+	}
+	gitCmd := "git clone --mirror" + shallowOptions + getCloneReferenceOptions() + " " + cloneURL + " " + workDir
+	if config.PartialClone {
+		// the blobs are fetched on demand by git archive when the module gets synced
+		gitCmd = "git clone --mirror --filter=blob:none" + shallowOptions + getCloneReferenceOptions() + " " + cloneURL + " " + workDir
+	}
+	if isMirror {
+		if gitModule.httpsFallback || config.HTTPSFallback || len(gitModule.sshURL) > 0 || cloneURL != url {
+			// a previous https fallback changed the URL of the mirror or the mirror still contains an expanded secret
+			setMirrorRemoteURL(ctx, workDir, cloneURL, gitModule.timeout)
+		}
+		addFetchRefspecs(ctx, workDir, gitModule.fetchRefspecs, gitModule.timeout)
 		gitCmd = "git --git-dir " + workDir + " remote update --prune"
+		if len(shallowOptions) > 0 && isShallowMirror(workDir) {
+			gitCmd = "git --git-dir " + workDir + " fetch --prune" + shallowOptions + " origin"
+		}
 	}
 
-	if needSSHKey {
-		er = executeCommand("ssh-agent bash -c 'ssh-add "+sshPrivateKey+"; "+gitCmd+"'", config.Timeout, allowFail)
-	} else {
-		er = executeCommand(gitCmd, config.Timeout, allowFail)
+	er := runGitCommand(gitCmd)
+	if er.returnCode == 0 && !isMirror && config.PartialClone {
+		setPartialCloneSSHCommand(workDir, gitModule, needSSHKey, gitSSHCommand)
+	}
+	if er.returnCode == 0 && len(fetchRefspecs) > 0 {
+		if !isMirror {
+			addFetchRefspecs(ctx, workDir, gitModule.fetchRefspecs, gitModule.timeout)
+		}
+		// explicitly fetch the custom refspecs and tags, because some git servers (e.g. Gerrit) do not
+		// advertise them to a mirror clone. --prune also removes refs in these namespaces that
+		// were deleted on the remote side
+		gitCmd = "git --git-dir " + workDir + " fetch --prune origin " + strings.Join(fetchRefspecs, " ")
+		er = runGitCommand(gitCmd)
 	}
 
+	if er.returnCode == 0 && len(shallowOptions) > 0 && isShallowMirror(workDir) {
+		gitCmd = "git --git-dir " + workDir + " fetch --unshallow origin"
+		er = deepenShallowMirror(gitModule, workDir, runGitCommand)
+	}
+
+	if er.returnCode != 0 && ctx.Err() != nil {
+		// the git command got killed, because g10k is exiting or -failfast stopped after another git error, so neither retry nor fall back to https
+		if !isMirror {
+			purgeDir(workDir, "doMirrorOrUpdate, because the git clone got killed and is incomplete")
+		}
+		recordGitRepositoryResult(url, false, false, gitCmd+": killed, because g10k is exiting")
+		return false
+	}
 	if er.returnCode != 0 {
+		lastError := gitCmd + ": " + er.output
+		if len(strings.TrimSpace(er.stderr)) > 0 {
+			lastError += ": " + strings.TrimSpace(er.stderr)
+		}
+		if httpsURL, ok := getHTTPSFallbackURL(gitModule); ok {
+			Warnf("WARN: git repository " + url + " is unreachable over ssh, retrying over https with " + httpsURL + ": " + strings.TrimSpace(lastError))
+			httpsModule := gitModule
+			httpsModule.git = httpsURL
+			httpsModule.sshURL = url
+			httpsModule.privateKey = ""
+			// the mirror stays in the cache directory of the ssh URL, so that both protocols share it
+			unlock()
+			return doMirrorOrUpdate(ctx, httpsModule, workDir, retryCount, st)
+		}
+		if config.UseCacheFallback && isMirror && config.MaxCacheAge > 0 {
+			cacheAge, ok := getCacheAge(workDir)
+			if !ok {
+				Fatalf("doMirrorOrUpdate(): Error: git repository " + url + " is unreachable and the last successful update of the cached repository " + workDir + " is unknown, not using the cache as max_cache_age is set to " + config.MaxCacheAge.String())
+			} else if cacheAge > config.MaxCacheAge {
+				Fatalf("doMirrorOrUpdate(): Error: git repository " + url + " is unreachable and the cached repository " + workDir + " was last updated " + cacheAge.Truncate(time.Second).String() + " ago, which exceeds max_cache_age of " + config.MaxCacheAge.String())
+			}
+		}
 		if config.UseCacheFallback {
 			Warnf("WARN: git repository " + url + " does not exist or is unreachable at this moment!")
 			Warnf("WARN: Trying to use cache for " + url + " git repository")
+			recordGitRepositoryResult(url, false, true, lastError)
 			return false
 		} else if config.RetryGitCommands && retryCount > 0 {
 			Warnf("WARN: git command failed: " + gitCmd + " deleting local cached repository and retrying...")
+			recordGitRepositoryResult(url, false, false, lastError)
 			purgeDir(workDir, "doMirrorOrUpdate, because git command failed, retrying")
-			return doMirrorOrUpdate(url, workDir, sshPrivateKey, false, retryCount-1)
+			gitModule.ignoreUnreachable = false
+			unlock()
+			return doMirrorOrUpdate(ctx, gitModule, workDir, retryCount-1, st)
 		}
 		Warnf("WARN: git repository " + url + " does not exist or is unreachable at this moment!")
+		recordGitRepositoryResult(url, false, false, lastError)
 		return false
 	}
+	if isMirror {
+		updateMirrorHead(workDir, runGitCommand)
+		if config.Git.CloneReferenceMode == "dissociate" {
+			dissociateMirror(workDir, gitModule.timeout)
+		}
+	}
+	recordGitRepositoryResult(url, true, false, "")
+	writeLastUpdateFile(workDir)
+	if isModuleRepository {
+		markModuleCacheDirUsed(workDir)
+		recordRunState("git_repository", url, "")
+	}
 	return true
 }
 
-func syncToModuleDir(srcDir string, targetDir string, tree string, allowFail bool, ignoreUnreachable bool, correspondingPuppetEnvironment string, onlyDelta bool) bool {
+// getHTTPSFallbackURL returns the https URL like https://host/org/repo.git of a git module with the ssh URL git@host:org/repo.git or ssh://git@host:port/org/repo.git
+// if https_fallback is enabled for the git module and it was not already retried over https
+func getHTTPSFallbackURL(gitModule GitModule) (string, bool) {
+	if !gitModule.httpsFallback && !config.HTTPSFallback || len(gitModule.sshURL) > 0 {
+		return "", false
+	}
+	url := gitModule.git
+	if strings.HasPrefix(url, "ssh://") {
+		hostAndPath := strings.SplitN(strings.TrimPrefix(url, "ssh://"), "/", 2)
+		if len(hostAndPath) != 2 {
+			return "", false
+		}
+		host := hostAndPath[0]
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+		if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		return "https://" + host + "/" + hostAndPath[1], true
+	}
+	if strings.Contains(url, "://") {
+		return "", false
+	}
+	hostAndPath := strings.SplitN(url, ":", 2)
+	if len(hostAndPath) != 2 || strings.Contains(hostAndPath[0], "/") {
+		// a local path
+		return "", false
+	}
+	host := hostAndPath[0]
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	return "https://" + host + "/" + strings.TrimPrefix(hostAndPath[1], "/"), true
+}
+
+// setMirrorRemoteURL sets the URL of the origin remote of the mirror workDir to url if it differs
+func setMirrorRemoteURL(ctx context.Context, workDir string, url string, timeout int) {
+	er := executeGitCommand(ctx, "git --git-dir "+workDir+" config remote.origin.url", timeout, true)
+	if strings.TrimSpace(er.output) == url {
+		return
+	}
+	Debugf("Changing the URL of git mirror " + workDir + " from " + strings.TrimSpace(er.output) + " to " + url)
+	executeGitCommand(ctx, "git --git-dir "+workDir+" remote set-url origin "+url, timeout, false)
+}
+
+// getCloneReferenceOptions returns the git clone options to borrow the objects of new mirrors from the git setting clone_reference
+// --reference-if-able clones without it if the reference repository does not exist, with clone_reference_mode dissociate the borrowed objects get copied
+func getCloneReferenceOptions() string {
+	if len(config.Git.CloneReference) == 0 {
+		return ""
+	}
+	options := " --reference-if-able " + config.Git.CloneReference
+	if config.Git.CloneReferenceMode == "dissociate" {
+		options += " --dissociate"
+	}
+	return options
+}
+
+// checkMirrorAlternates returns false if an object store listed in the alternates of the cached git repository workDir does not exist anymore
+// e.g. because the clone_reference repository got removed, which leaves the repository with missing objects
+func checkMirrorAlternates(workDir string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(workDir, "objects", "info", "alternates"))
+	if err != nil {
+		return true
+	}
+	for _, alternate := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		alternate = strings.TrimSpace(alternate)
+		if len(alternate) == 0 || strings.HasPrefix(alternate, "#") {
+			continue
+		}
+		if !filepath.IsAbs(alternate) {
+			alternate = filepath.Join(workDir, "objects", alternate)
+		}
+		if !isDir(alternate) {
+			Warnf("WARN: Object store " + alternate + " of the alternates of git repository " + workDir + " does not exist anymore, cloning it again")
+			return false
+		}
+	}
+	return true
+}
+
+// dissociateMirror copies the objects which the cached git repository workDir borrows from its alternates into its own object store and removes the alternates
+// like git clone --dissociate does, so that an existing mirror does not break if the clone_reference repository gets pruned or removed
+func dissociateMirror(workDir string, timeout int) {
+	alternatesFile := filepath.Join(workDir, "objects", "info", "alternates")
+	if !fileExists(alternatesFile) {
+		return
+	}
+	Debugf("Dissociating git repository " + workDir + " from its alternates")
+	if er := executeGitCommand(runContext, "git --git-dir "+workDir+" repack -a -d -q", timeout, true); er.returnCode != 0 {
+		Warnf("WARN: Could not repack git repository " + workDir + " to dissociate it from its alternates: " + strings.TrimSpace(er.output+er.stderr))
+		return
+	}
+	if err := os.Remove(alternatesFile); err != nil {
+		Warnf("WARN: Could not remove the alternates file " + alternatesFile + " Error: " + err.Error())
+	}
+}
+
+// setPartialCloneSSHCommand stores the SSH private key and options of the git module as core.sshCommand in the partial clone workDir
+// because git archive fetches the missing blobs without the ssh-agent and GIT_SSH_COMMAND that g10k uses for clone and update
+func setPartialCloneSSHCommand(workDir string, gitModule GitModule, needSSHKey bool, gitSSHCommand string) {
+	sshCommand := gitSSHCommand
+	if needSSHKey {
+		if len(sshCommand) == 0 {
+			sshCommand = "ssh"
+		}
+		sshCommand += " -i " + getSSHPrivateKey(gitModule.privateKey) + " -o IdentitiesOnly=yes"
+	}
+	if len(sshCommand) == 0 {
+		return
+	}
+	executeGitCommand(runContext, "git --git-dir "+workDir+" config core.sshCommand '"+sshCommand+"'", gitModule.timeout, false)
+}
+
+// updateMirrorHead points HEAD of the cached git repository workDir to the current default branch of the remote repository
+// if the branch HEAD pointed to was deleted, because git remote update does not change HEAD of a mirror
+func updateMirrorHead(workDir string, runGitCommand func(string) ExecResult) {
+	er := executeCommand(runContext, "git --git-dir "+workDir+" symbolic-ref HEAD", config.Timeout, true)
+	head := strings.TrimSpace(er.output)
+	if er.returnCode == 0 && executeCommand(runContext, "git --git-dir "+workDir+" rev-parse --verify --quiet "+head, config.Timeout, true).returnCode == 0 {
+		return
+	}
+	er = runGitCommand("git --git-dir " + workDir + " ls-remote --symref origin HEAD")
+	reSymref := regexp.MustCompile("(?m)^ref:\\s+(refs/heads/\\S+)\\s+HEAD$")
+	if m := reSymref.FindStringSubmatch(er.output); len(m) > 1 {
+		Debugf("Changing HEAD of " + workDir + " from " + head + " to " + m[1])
+		executeCommand(runContext, "git --git-dir "+workDir+" symbolic-ref HEAD "+m[1], config.Timeout, true)
+	}
+}
+
+// getDefaultBranch returns the branch HEAD of the cached git repository gitDir points to, which is the default branch of the remote repository
+// the default_branch setting of the git hash in the g10k config takes precedence, for remote repositories with a broken HEAD
+func getDefaultBranch(gitDir string) string {
+	if len(config.Git.DefaultBranch) > 0 {
+		return config.Git.DefaultBranch
+	}
+	er := executeCommand(runContext, "git --git-dir "+gitDir+" symbolic-ref --short HEAD", config.Timeout, true)
+	branch := strings.TrimSpace(er.output)
+	if er.returnCode != 0 || len(branch) == 0 {
+		Debugf("Could not detect the default branch of " + gitDir + ", using master")
+		return "master"
+	}
+	return branch
+}
+
+// getLastUpdateFile returns the path of the file inside the cached git repository workDir which contains the time of its last successful update
+func getLastUpdateFile(workDir string) string {
+	return filepath.Join(workDir, ".g10k-last-update")
+}
+
+// writeLastUpdateFile records the time of the last successful clone or update of the cached git repository workDir
+func writeLastUpdateFile(workDir string) {
+	lastUpdateFile := getLastUpdateFile(workDir)
+	err := ioutil.WriteFile(lastUpdateFile, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+	if err != nil {
+		Warnf("writeLastUpdateFile(): WARN: Could not write " + lastUpdateFile + " Error: " + err.Error())
+	}
+}
+
+// getCacheAge returns how long ago the cached git repository workDir was successfully updated
+// and false if the time of the last update is unknown
+func getCacheAge(workDir string) (time.Duration, bool) {
+	lastUpdateFile := getLastUpdateFile(workDir)
+	content, err := ioutil.ReadFile(lastUpdateFile)
+	if err != nil {
+		Debugf("Could not read " + lastUpdateFile + " Error: " + err.Error())
+		return 0, false
+	}
+	lastUpdate, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+	if err != nil {
+		Warnf("getCacheAge(): WARN: Could not parse last update time in " + lastUpdateFile + " Error: " + err.Error())
+		return 0, false
+	}
+	return time.Since(lastUpdate), true
+}
+
+// errTruncatedArchive is returned by runGitArchive() if git archive failed after it already streamed a part of the archive
+var errTruncatedArchive = errors.New("truncated stream")
+
+// isTruncatedArchive returns true if the extraction failed because the stream of git archive ended early
+func isTruncatedArchive(err error) bool {
+	return errors.Is(err, errTruncatedArchive) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// extractGitArchive extracts the git archive of tree of the git repository srcDir into targetDir
+// a failed extraction is retried untar_retries times with a purged targetDir, e.g. because of a full disk or an NFS hiccup
+// a truncated stream of git archive is retried truncated_archive_retries times on top of that, e.g. because git gc repacked the cached git repository meanwhile
+func extractGitArchive(ctx context.Context, srcDir string, targetDir string, tree string, allowFail bool, ignoreUnreachable bool, timeout int, st *SyncStats) bool {
+	attempt, truncatedAttempt := 1, 1
+	for {
+		retryTruncated := truncatedAttempt <= config.TruncatedArchiveRetries && !shutdownRequested()
+		success, err := runGitArchive(ctx, srcDir, targetDir, tree, allowFail, ignoreUnreachable, timeout, retryTruncated, st)
+		if err == nil {
+			return success
+		}
+		if retryTruncated && isTruncatedArchive(err) {
+			// only retry if the truncated stream was transient and the tree can still be archived
+			if executeCommand(ctx, "git --git-dir "+srcDir+" rev-parse --verify --quiet '"+tree+"^{tree}'", config.Timeout, true).returnCode == 0 {
+				Warnf("WARN: Truncated stream of git --git-dir " + srcDir + " archive " + tree + " to " + targetDir + ", retrying (" + strconv.Itoa(truncatedAttempt) + "/" + strconv.Itoa(config.TruncatedArchiveRetries) + ") Error: " + err.Error())
+				truncatedAttempt++
+				createOrPurgeDir(targetDir, "extractGitArchive(), to retry the truncated git archive")
+				continue
+			}
+			Debugf("Not retrying the truncated git --git-dir " + srcDir + " archive " + tree + ", because " + tree + " does not exist anymore")
+		}
+		if attempt <= config.UntarRetries && !shutdownRequested() {
+			Warnf("WARN: Failed to extract git --git-dir " + srcDir + " archive " + tree + " to " + targetDir + ", retrying (" + strconv.Itoa(attempt) + "/" + strconv.Itoa(config.UntarRetries) + ") Error: " + err.Error())
+			attempt++
+			createOrPurgeDir(targetDir, "extractGitArchive(), to retry the failed extraction")
+			continue
+		}
+		if ignoreUnreachable {
+			Warnf("WARN: Failed to extract git --git-dir " + srcDir + " archive " + tree + " to " + targetDir + " but ignore-unreachable is set. Continuing... Error: " + err.Error())
+			purgeDir(targetDir, "extractGitArchive(), because the extraction failed and ignore-unreachable is set for this module")
+			return false
+		}
+		Fatalf("syncToModuleDir(): Error while extracting git --git-dir " + srcDir + " archive " + tree + " to " + targetDir + " Error: " + err.Error())
+	}
+}
+
+// runGitArchive pipes the git archive of tree of the git repository srcDir into extractTar() and returns the error of the extraction separately, so that it can be retried
+// with retryTruncated a git archive which fails after it already streamed a part of the archive returns errTruncatedArchive instead of failing the module
+func runGitArchive(ctx context.Context, srcDir string, targetDir string, tree string, allowFail bool, ignoreUnreachable bool, timeout int, retryTruncated bool, st *SyncStats) (bool, error) {
+	defer timeTrack(time.Now(), funcName())
+	// limit the concurrent extractions to the max_memory_mb setting
+	memoryLimiter := getUntarMemoryLimiter()
+	reservedMemory := memoryLimiter.acquire(srcDir)
+	archiveReader := &countingReader{}
+	defer func() { memoryLimiter.release(srcDir, reservedMemory, archiveReader.n) }()
+
+	gitArchiveArgs := []string{"--git-dir", srcDir, "archive", tree}
+	if strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		gitArchiveArgs = append(gitArchiveArgs, getControlRepoArchiveExcludes(srcDir, tree)...)
+	}
+	cmd := exec.Command("git", gitArchiveArgs...)
+	cmd.Env = getGitEnvironment()
+	Debugf("Executing git " + strings.Join(gitArchiveArgs, " "))
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		if !allowFail {
+			Infof("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
+		} else {
+			return false, nil
+		}
+		Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+	// with read_concurrency the git archive only starts once a read slot is free
+	readSlots, writeSlots := getArchiveSlots()
+	acquireSlot(readSlots)
+	readSlotReleased := false
+	defer func() {
+		if !readSlotReleased {
+			releaseSlot(readSlots)
+		}
+	}()
+	archiveCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		archiveCtx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+		go func() {
+			<-archiveCtx.Done()
+			if archiveCtx.Err() == context.DeadlineExceeded {
+				Warnf("WARN: killing git --git-dir " + srcDir + " archive " + tree + " after timeout of " + strconv.Itoa(timeout) + " seconds")
+			}
+		}()
+	}
+	// after the shutdown grace period only this git archive gets killed, g10k then exits from the main goroutine like after any other failed module
+	archiveCtx, cancelArchive := context.WithCancel(archiveCtx)
+	defer cancelArchive()
+	gracePeriodExceeded := make(chan struct{})
+	finished, err := startCommand(archiveCtx, cmd)
+	if err != nil {
+		if allowFail {
+			return false, nil
+		}
+		Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+	defer finished()
+	archiveDone := make(chan struct{})
+	defer close(archiveDone)
+	go func() {
+		select {
+		case <-shutdown:
+			select {
+			case <-archiveDone:
+			case <-time.After(shutdownGracePeriod):
+				// the module directory gets synced again on the next run, because its .latest_commit was not written yet
+				Warnf("WARN: killing git --git-dir " + srcDir + " archive " + tree + ", because it did not finish within the shutdown grace period. " + targetDir + " is incomplete")
+				close(gracePeriodExceeded)
+				cancelArchive()
+			}
+		case <-archiveDone:
+		}
+	}()
+
+	before := time.Now()
+	archive := newRateLimitedReader(cmdOut, config.FetchRateLimitKBps)
+	archiveReader.r = archive
+	if len(config.ArchiveFilterCommand) > 0 && !strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		filterTimeout := config.Timeout
+		if timeout > 0 {
+			filterTimeout = timeout
+		}
+		filteredArchive, err := runArchiveFilter(archive, targetDir, tree, filterTimeout)
+		if err != nil {
+			killCommand(cmd)
+			cmd.Wait()
+			if allowFail && ignoreUnreachable {
+				Warnf("WARN: archive_filter_command failed for module " + targetDir + " but ignore-unreachable is set. Continuing... Error: " + err.Error())
+				purgeDir(targetDir, "syncToModuleDir, because the archive_filter_command failed and ignore-unreachable is set for this module")
+				return false, nil
+			}
+			Fatalf("syncToModuleDir(): Error archive_filter_command failed for git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+		}
+		archiveReader.r = filteredArchive
+	}
+	var extractReader io.Reader = archiveReader
+	if readSlots != nil {
+		buffered, err := bufferArchive(archiveReader)
+		if err != nil {
+			killCommand(cmd)
+			cmd.Wait()
+			return false, fmt.Errorf("Error while reading git --git-dir %s archive %s Error: %s", srcDir, tree, err.Error())
+		}
+		extractReader = buffered
+		releaseSlot(readSlots)
+		readSlotReleased = true
+	}
+	acquireSlot(writeSlots)
+	defer releaseSlot(writeSlots)
+	var remoteErr error
+	var untarErr error
+	if len(config.RemoteDeploy.Host) > 0 {
+		remoteTimeout := config.Timeout
+		if timeout > 0 {
+			remoteTimeout = timeout
+		}
+		if strings.HasPrefix(srcDir, config.EnvCacheDir) {
+			// the Puppetfile of the environment is needed locally, so the control repository gets extracted on both sides
+			pr, pw := io.Pipe()
+			remoteDone := make(chan error)
+			go func() {
+				err := extractRemoteArchive(pr, targetDir, false, remoteTimeout)
+				// keep reading if ssh exited early, so that the local extraction does not block
+				io.Copy(ioutil.Discard, pr)
+				remoteDone <- err
+			}()
+			tee := io.TeeReader(extractReader, pw)
+			untarErr = extractTar(tee, targetDir)
+			io.Copy(ioutil.Discard, tee)
+			pw.Close()
+			remoteErr = <-remoteDone
+		} else {
+			remoteErr = extractRemoteArchive(extractReader, targetDir, true, remoteTimeout)
+		}
+	} else {
+		untarErr = extractTar(extractReader, targetDir)
+	}
+	duration := time.Since(before).Seconds()
+	st.addIOGitTime(duration)
+	st.addModuleSyncTime(srcDir, duration)
+	select {
+	case <-gracePeriodExceeded:
+		cmd.Wait()
+		return false, nil
+	default:
+	}
+	if untarErr != nil {
+		killCommand(cmd)
+		cmd.Wait()
+		return false, untarErr
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		// a tar stream cut off between two entries extracts without an error, only the exit code of git archive tells
+		if retryTruncated && archiveReader.n > 0 {
+			return false, fmt.Errorf("git --git-dir %s archive %s failed with a %w after %d bytes Error: %s", srcDir, tree, errTruncatedArchive, archiveReader.n, err.Error())
+		}
+		// with trust_git_refs this is the first command that notices a missing object
+		if allowFail {
+			if ignoreUnreachable {
+				Debugf("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
+				purgeDir(targetDir, "syncToModuleDir, because ignore-unreachable is set for this module")
+			}
+			return false, nil
+		}
+		Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+	if remoteErr != nil {
+		if allowFail {
+			if ignoreUnreachable {
+				Warnf("WARN: Failed to populate module " + targetDir + " on remote_deploy host " + config.RemoteDeploy.Host + " but ignore-unreachable is set. Continuing... Error: " + remoteErr.Error())
+				purgeDir(targetDir, "syncToModuleDir, because the remote deploy failed and ignore-unreachable is set for this module")
+			}
+			return false, nil
+		}
+		Fatalf("syncToModuleDir(): Error while extracting git --git-dir " + srcDir + " archive " + tree + " to " + getRemoteDeployDir(targetDir) + " on remote_deploy host " + config.RemoteDeploy.Host + " Error: " + remoteErr.Error())
+	}
+
+	if config.PreserveMtimes && (len(config.RemoteDeploy.Host) == 0 || strings.HasPrefix(srcDir, config.EnvCacheDir)) {
+		if committedAt, ok := getCommitterTime(srcDir, tree, timeout); ok {
+			if err := setMtimes(targetDir, committedAt); err != nil {
+				Warnf("WARN: Could not set the modification times of " + targetDir + " to the commit date of " + tree + " Error: " + err.Error())
+			}
+		} else {
+			Warnf("WARN: Could not get the commit date of " + tree + " of " + srcDir + " to set the modification times of " + targetDir)
+		}
+	}
+
+	VerboseModulef("syncToModuleDir(): Executing git --git-dir " + srcDir + " archive " + tree + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	return true, nil
+}
+
+// setMtimes sets the modification time of all files and directories in dir to mtime
+// the directories are changed after their content, symlinks are skipped, so that their targets are not changed
+func setMtimes(dir string, mtime time.Time) error {
+	dirs := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return nil
+		case info.IsDir():
+			dirs = append(dirs, path)
+			return nil
+		}
+		return os.Chtimes(path, mtime, mtime)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i], mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getControlRepoArchiveExcludes returns the git archive pathspecs, which exclude the directories of the modules of the Puppetfile of tree in the control repository srcDir
+// the modules get deployed separately, so files of the control repository in their directories must not overwrite them
+// local modules are part of the control repository and are not excluded
+func getControlRepoArchiveExcludes(srcDir string, tree string) []string {
+	puppetfile, ok := readCachedPuppetfile(srcDir, tree, strings.TrimSuffix(filepath.Base(srcDir), ".git"), Source{})
+	if !ok {
+		return []string{}
+	}
+	moduleDirs := []string{}
+	for gitName, gitModule := range puppetfile.gitModules {
+		if gitModule.local {
+			continue
+		}
+		moduleName := gitName
+		if len(gitModule.targetName) > 0 {
+			moduleName = gitModule.targetName
+		}
+		if len(gitModule.installPath) > 0 {
+			moduleDirs = append(moduleDirs, filepath.Join(gitModule.installPath, moduleName))
+		} else {
+			moduleDirs = append(moduleDirs, filepath.Join(gitModule.moduleDir, moduleName))
+		}
+	}
+	for _, fm := range puppetfile.forgeModules {
+		moduleDirs = append(moduleDirs, filepath.Join(fm.moduleDir, fm.name))
+	}
+	if len(moduleDirs) == 0 {
+		return []string{}
+	}
+	sort.Strings(moduleDirs)
+	excludes := []string{"--", "."}
+	for _, moduleDir := range moduleDirs {
+		excludes = append(excludes, ":(exclude)"+moduleDir)
+	}
+	return excludes
+}
+
+// runArchiveFilter pipes the git archive of tree through the archive_filter_command and returns its output, which must be a tar archive
+// the target directory and the tree of the module are available to the command as G10K_MODULE_DIR and G10K_TREE environment variables
+func runArchiveFilter(archive io.Reader, targetDir string, tree string, timeout int) (*bytes.Buffer, error) {
+	parts, err := shellquote.Split(config.ArchiveFilterCommand)
+	if err != nil || len(parts) == 0 {
+		return nil, fmt.Errorf("could not parse archive_filter_command %s", config.ArchiveFilterCommand)
+	}
+	Debugf("Piping git archive of " + targetDir + " through " + config.ArchiveFilterCommand)
+	var output bytes.Buffer
+	var stderr bytes.Buffer
+	c := exec.Command(parts[0], parts[1:]...)
+	c.Env = append(os.Environ(), "G10K_MODULE_DIR="+targetDir, "G10K_TREE="+tree)
+	c.Stdin = archive
+	c.Stdout = &output
+	c.Stderr = &stderr
+	// the filter command gets killed with all of its child processes after the timeout or once g10k exits
+	ctx, cancel := context.WithTimeout(runContext, time.Duration(timeout)*time.Second)
+	defer cancel()
+	finished, err := startCommand(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Wait()
+	finished()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("killed after timeout of %d seconds", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return &output, nil
+}
+
+// getChangedFiles returns the files that changed in the git repository gitDir between the commits from and to
+func getChangedFiles(gitDir string, from string, to string) ([]string, bool) {
+	er := executeCommand(runContext, "git --git-dir "+gitDir+" diff --name-only "+from+" "+to+" --", config.Timeout, true)
+	if er.returnCode != 0 {
+		return nil, false
+	}
+	changedFiles := []string{}
+	for _, changedFile := range strings.Split(er.output, "\n") {
+		if len(changedFile) > 0 {
+			changedFiles = append(changedFiles, changedFile)
+		}
+	}
+	return changedFiles, true
+}
+
+// getGitEnvironment returns the environment of the git commands, which is the environment of g10k with the variables of the git env setting
+// GIT_TERMINAL_PROMPT=0 is set by default, so that git fails instead of hanging on a credential prompt
+func getGitEnvironment() []string {
+	env := append([]string{"GIT_TERMINAL_PROMPT=0"}, os.Environ()...)
+	names := []string{}
+	for name := range config.Git.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// later entries take precedence
+	for _, name := range names {
+		env = append(env, name+"="+config.Git.Env[name])
+	}
+	return env
+}
+
+// getGitSSHCommand returns the GIT_SSH_COMMAND with the SSH port, known_hosts file and StrictHostKeyChecking setting
+// of the git module or of the global git settings if they are not set for the git module
+func getGitSSHCommand(gitModule GitModule) string {
+	sshPort := config.Git.SSHPort
+	if gitModule.sshPort > 0 {
+		sshPort = gitModule.sshPort
+	}
+	sshKnownHosts := config.Git.SSHKnownHosts
+	if len(gitModule.sshKnownHosts) > 0 {
+		sshKnownHosts = gitModule.sshKnownHosts
+	}
+	sshStrictHostKeyChecking := config.Git.SSHStrictHostKeyChecking
+	if len(gitModule.sshStrictHostKeyChecking) > 0 {
+		sshStrictHostKeyChecking = gitModule.sshStrictHostKeyChecking
+	}
+
+	sshOptions := ""
+	if sshPort > 0 {
+		sshOptions += " -p " + strconv.Itoa(sshPort)
+	}
+	if len(sshKnownHosts) > 0 {
+		sshOptions += " -o UserKnownHostsFile=" + sshKnownHosts
+	}
+	if len(sshStrictHostKeyChecking) > 0 {
+		sshOptions += " -o StrictHostKeyChecking=" + sshStrictHostKeyChecking
+	}
+	if len(sshOptions) == 0 {
+		return ""
+	}
+	return "ssh" + sshOptions
+}
+
+// getGitClientCertificateOptions returns the git options to authenticate with the TLS client certificate of the first client_certificates entry matching the https URL
+// the url_pattern matches if it is a prefix of the URL or if it matches the URL as a shell pattern like https://*.example.com/*/*.git
+func getGitClientCertificateOptions(url string) string {
+	if !strings.HasPrefix(url, "https://") {
+		return ""
+	}
+	for _, cc := range config.Git.ClientCertificates {
+		matched, _ := path.Match(cc.URLPattern, url)
+		if !matched && !strings.HasPrefix(url, cc.URLPattern) {
+			continue
+		}
+		for _, file := range []string{cc.Cert, cc.Key} {
+			if !fileExists(file) {
+				Fatalf("getGitClientCertificateOptions(): Error: TLS client certificate or key " + file + " of client_certificates url_pattern " + cc.URLPattern + " for git repository " + url + " does not exist")
+			}
+		}
+		Debugf("Using TLS client certificate " + cc.Cert + " for git repository " + url)
+		return " -c http.sslCert=" + cc.Cert + " -c http.sslKey=" + cc.Key
+	}
+	return ""
+}
+
+// getRefNamespaceFetchRefspec returns the refspec that fetches the namespace of a full ref path like refs/pull/42/head into the mirror
+// some git servers hide these namespaces from mirror clones, branches and tags are always fetched, so no refspec is returned for them
+func getRefNamespaceFetchRefspec(ref string) string {
+	parts := strings.SplitN(ref, "/", 3)
+	if len(parts) != 3 || parts[0] != "refs" || len(parts[2]) == 0 || parts[1] == "heads" || parts[1] == "tags" {
+		return ""
+	}
+	return "+refs/" + parts[1] + "/*:refs/" + parts[1] + "/*"
+}
+
+// rewriteGitURL applies the first matching git url_rewrite_rules to the git URL of a module
+// the rewritten URL is used for everything including the cache directory, so that the old and new git server do not share a cached repository
+func rewriteGitURL(url string) string {
+	for _, rule := range config.Git.URLRewriteRules {
+		if rule.re != nil && rule.re.MatchString(url) {
+			rewritten := rule.re.ReplaceAllString(url, rule.Replacement)
+			Debugf("Rewriting git URL " + url + " to " + rewritten + " because of url_rewrite_rules pattern " + rule.Pattern)
+			return rewritten
+		}
+	}
+	return url
+}
+
+// addFetchRefspecs adds the given refspecs to the remote.origin.fetch config of the mirror in workDir if they are not already configured
+func addFetchRefspecs(ctx context.Context, workDir string, fetchRefspecs []string, timeout int) {
+	if len(fetchRefspecs) == 0 {
+		return
+	}
+	er := executeGitCommand(ctx, "git --git-dir "+workDir+" config --get-all remote.origin.fetch", timeout, true)
+	configuredRefspecs := strings.Split(strings.TrimSpace(er.output), "\n")
+	for _, refspec := range fetchRefspecs {
+		if stringSliceContains(configuredRefspecs, refspec) {
+			continue
+		}
+		Debugf("Adding fetch refspec " + refspec + " to git mirror " + workDir)
+		executeGitCommand(ctx, "git --git-dir "+workDir+" config --add remote.origin.fetch '"+refspec+"'", timeout, false)
+	}
+}
+
+// executeGitCommand executes the given git command with the additional environment variables env and the timeout of a git module, which overrides the global timeout if it is set
+func executeGitCommand(ctx context.Context, command string, timeout int, allowFail bool, env ...string) ExecResult {
+	if timeout == 0 {
+		timeout = config.Timeout
+	}
+	return executeCommand(ctx, command, timeout, allowFail, env...)
+}
+
+// resolveGitObject returns the object hash of tree in the git repository gitDir like the rev-parse command logCmd
+// trees which were already resolved by batchResolveGitObjects() or pinned with resolve_refs_once are not resolved again
+// with trust_git_refs the hash is read from the ref files of the repository instead, without verifying that the object exists,
+// a missing object then makes the following git archive fail
+func resolveGitObject(ctx context.Context, gitDir string, tree string, logCmd string, timeout int, allowFail bool) ExecResult {
+	if hash, ok := getBatchResolvedGitObject(gitDir, tree); ok {
+		Debugf("Using " + hash + " for " + tree + " of " + gitDir + " resolved by git cat-file --batch-check")
+		return ExecResult{returnCode: 0, output: hash + "\n"}
+	}
+	var er ExecResult
+	trusted := false
+	if config.TrustGitRefs {
+		if hash, ok := readGitRef(gitDir, tree); ok {
+			Debugf("Trusting " + tree + " of " + gitDir + " to point to " + hash)
+			er = ExecResult{returnCode: 0, output: hash + "\n"}
+			trusted = true
+		}
+	}
+	if !trusted {
+		er = executeGitCommand(ctx, logCmd, timeout, allowFail)
+	}
+	if config.ResolveRefsOnce && er.returnCode == 0 && !strings.HasPrefix(gitDir, config.EnvCacheDir) {
+		// the environments which get synced later in this run use the same object
+		er.output = pinGitObject(gitDir, tree, strings.TrimSuffix(er.output, "\n")) + "\n"
+	}
+	return er
+}
+
+// reFullCommitHash matches a full SHA-1 object hash
+var reFullCommitHash = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// readGitRef returns the hash that ref points to in the git repository gitDir by reading the loose and packed refs like git rev-parse
+// full commit hashes are returned as they are, other revisions like abbreviated hashes or master~1 can not be resolved
+func readGitRef(gitDir string, ref string) (string, bool) {
+	if reFullCommitHash.MatchString(ref) {
+		return ref, true
+	}
+	candidates := []string{"refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref}
+	if ref == "HEAD" || strings.HasPrefix(ref, "refs/") {
+		candidates = []string{ref}
+	}
+	for _, candidate := range candidates {
+		if content, err := ioutil.ReadFile(filepath.Join(gitDir, candidate)); err == nil {
+			value := strings.TrimSpace(string(content))
+			if strings.HasPrefix(value, "ref: ") {
+				return readGitRef(gitDir, strings.TrimPrefix(value, "ref: "))
+			}
+			if reFullCommitHash.MatchString(value) {
+				return value, true
+			}
+		}
+	}
+	packedRefs, err := ioutil.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return "", false
+	}
+	for _, candidate := range candidates {
+		for _, line := range strings.Split(string(packedRefs), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[1] == candidate && reFullCommitHash.MatchString(fields[0]) {
+				return fields[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+func syncToModuleDir(ctx context.Context, srcDir string, targetDir string, tree string, allowFail bool, ignoreUnreachable bool, correspondingPuppetEnvironment string, onlyDelta bool, timeout int, st *SyncStats) bool {
+	defer timeTrack(time.Now(), funcName())
 	startedAt := time.Now()
-	mutex.Lock()
-	syncGitCount++
-	mutex.Unlock()
+	if shutdownRequested() {
+		Debugf("Skipping sync of " + targetDir + ", because g10k is shutting down")
+		return false
+	}
+	st.addSyncedGitModule()
+	markModuleCacheDirUsed(srcDir)
 	if !isDir(srcDir) {
 		if config.UseCacheFallback {
 			Fatalf("Could not find cached git module " + srcDir)
 		}
 	}
+	if commit, ok := resumedRunState("module", targetDir); ok && !strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		if targetHash, err := ioutil.ReadFile(getLatestCommitFile(targetDir)); err == nil && string(targetHash) == commit {
+			Debugf("Skipping " + targetDir + ", because it was already synced to commit " + commit + " by the interrupted g10k run")
+			mutex.Lock()
+			resolvedModuleCommits[targetDir] = commit
+			mutex.Unlock()
+			st.addCacheResult(correspondingPuppetEnvironment, true)
+			return true
+		}
+	}
 	logCmd := "git --git-dir " + srcDir + " rev-parse --verify '" + tree
 	if config.GitObjectSyntaxNotSupported != true {
 		logCmd = logCmd + "^{object}'"
@@ -144,9 +1196,10 @@ func syncToModuleDir(srcDir string, targetDir string, tree string, allowFail boo
 		logCmd = logCmd + "'"
 	}
 
-	er := executeCommand(logCmd, config.Timeout, allowFail)
-	hashFile := filepath.Join(targetDir, ".latest_commit")
-	deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
+	er := resolveGitObject(ctx, srcDir, tree, logCmd, timeout, allowFail)
+	writeGitLog(srcDir, logCmd, er)
+	hashFile := getLatestCommitFile(targetDir)
+	deployFile := getDeployFile(targetDir)
 	needToSync := true
 	if er.returnCode != 0 {
 		if allowFail && ignoreUnreachable {
@@ -155,86 +1208,144 @@ func syncToModuleDir(srcDir string, targetDir string, tree string, allowFail boo
 		}
 		return false
 	}
+	mutex.Lock()
+	resolvedModuleCommits[targetDir] = strings.TrimSuffix(er.output, "\n")
+	mutex.Unlock()
+	// with resolve_refs_once the module gets archived at the resolved object instead of tree, which a concurrent update of the cached git repository could move
+	archiveTree := tree
+	if config.ResolveRefsOnce && !strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		archiveTree = strings.TrimSuffix(er.output, "\n")
+	}
+
+	if dryRun && len(er.output) > 0 && strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		dr := DeployResult{
+			Name:       tree,
+			Signature:  strings.TrimSuffix(er.output, "\n"),
+			StartedAt:  startedAt,
+			Labels:     deployLabels,
+			GitVersion: gitVersion,
+		}
+		writeDryRunDeployFile(targetDir, dr)
+	}
 
+	// deploy the module once per commit into the module store and symlink it into the environment
+	dedup := config.DedupModules && !onlyDelta && !strings.HasPrefix(srcDir, config.EnvCacheDir)
 	if len(er.output) > 0 {
-		if strings.HasPrefix(srcDir, config.EnvCacheDir) && fileExists(deployFile) {
+		if dedup && config.DedupModulesMode != "hardlink" && config.DedupModulesMode != "copy" {
+			link, _ := os.Readlink(filepath.Clean(targetDir))
+			if link == getModuleStoreDir(strings.TrimSuffix(er.output, "\n")) {
+				needToSync = false
+			}
+		} else if strings.HasPrefix(srcDir, config.EnvCacheDir) && fileExists(deployFile) {
 			dr := readDeployResultFile(deployFile)
 			if dr.Signature == strings.TrimSuffix(er.output, "\n") {
 				needToSync = false
 			}
 		} else {
-			targetHash, _ := ioutil.ReadFile(hashFile)
-			if string(targetHash) == er.output {
+			targetHash := readModuleCommit(targetDir, hashFile)
+			// a symlink to the module store needs to be replaced if dedup_modules got disabled
+			fi, err := os.Lstat(filepath.Clean(targetDir))
+			linked := err == nil && fi.Mode()&os.ModeSymlink != 0
+			// with metadata_dir the .latest_commit outlives a module directory that got removed by hand
+			// git rev-parse prints the commit with a trailing newline, which is not written to the .latest_commit
+			if targetHash == strings.TrimSuffix(er.output, "\n") && !linked && isDir(targetDir) {
 				needToSync = false
 				//Debugf("Skipping, because no diff found between " + srcDir + "(" + er.output + ") and " + targetDir + "(" + string(targetHash) + ")")
 			}
 		}
 
 	}
+	skippedBySince := false
+	if needToSync && !sinceTime.IsZero() && !strings.HasPrefix(srcDir, config.EnvCacheDir) && fileExists(hashFile) {
+		commit := strings.TrimSuffix(er.output, "\n")
+		if committedAt, ok := getCommitterTime(srcDir, commit, timeout); ok && committedAt.Before(sinceTime) {
+			InfoModulef("Not syncing " + targetDir + ", because commit " + commit + " of " + tree + " was committed at " + committedAt.Format(time.RFC3339) + " before -since " + sinceTime.Format(time.RFC3339))
+			needToSync = false
+			skippedBySince = true
+			// the module keeps its deployed commit
+			if targetHash, err := ioutil.ReadFile(hashFile); err == nil {
+				mutex.Lock()
+				resolvedModuleCommits[targetDir] = string(targetHash)
+				mutex.Unlock()
+			}
+		}
+	}
+	if !strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		st.addCacheResult(correspondingPuppetEnvironment, !needToSync)
+		if !needToSync && !skippedBySince {
+			recordRunState("module", targetDir, strings.TrimSuffix(er.output, "\n"))
+		}
+	}
 	if onlyDelta {
-		listGitRepoFiles(srcDir, tree, targetDir, hashFile)
+		listGitRepoFiles(srcDir, archiveTree, targetDir, hashFile, st)
 	}
-	if needToSync && er.returnCode == 0 {
-		Infof("Need to sync " + targetDir)
-		mutex.Lock()
-		needSyncDirs = append(needSyncDirs, targetDir)
-		if _, ok := needSyncEnvs[correspondingPuppetEnvironment]; !ok {
-			needSyncEnvs[correspondingPuppetEnvironment] = empty
+	if !needToSync {
+		st.addUnchangedDir(targetDir)
+	}
+	if needToSync && er.returnCode == 0 && interactive && !strings.HasPrefix(srcDir, config.EnvCacheDir) && !approveInteractiveSync(targetDir, hashFile, strings.TrimSuffix(er.output, "\n")) {
+		InfoModulef("Not syncing " + targetDir + ", because its sync was declined with -interactive")
+		// the module keeps its deployed commit
+		if targetHash, err := ioutil.ReadFile(hashFile); err == nil {
+			mutex.Lock()
+			resolvedModuleCommits[targetDir] = string(targetHash)
+			mutex.Unlock()
 		}
-		needSyncGitCount++
-		mutex.Unlock()
+		st.addUnchangedDir(targetDir)
+		return true
+	}
+	if needToSync && er.returnCode == 0 {
+		InfoModulef("Need to sync " + targetDir)
+		st.addNeedSyncGitDir(targetDir, correspondingPuppetEnvironment)
 
 		if !dryRun {
+			// running out of disk space during the extraction would leave a corrupt module directory behind
+			if ok, reason := hasFreeDiskSpace(targetDir); !ok {
+				if ignoreUnreachable {
+					Warnf("WARN: Skipping sync of " + targetDir + ", because " + reason + " and ignore-unreachable is set. Continuing...")
+					return false
+				}
+				Fatalf("syncToModuleDir(): Error: Not enough free disk space to sync " + targetDir + ", " + reason)
+			}
+			if !handleUnmanagedModuleDir(targetDir, ignoreUnreachable) {
+				return false
+			}
+			if dedup {
+				success := syncModuleStoreDir(ctx, srcDir, targetDir, strings.TrimSuffix(er.output, "\n"), allowFail, ignoreUnreachable, timeout, st)
+				if success {
+					recordRunState("module", targetDir, strings.TrimSuffix(er.output, "\n"))
+				}
+				return success
+			}
 			if !onlyDelta {
 				createOrPurgeDir(targetDir, "syncToModuleDir()")
 			} else {
 				checkDirAndCreate(targetDir, "git dir")
 			}
-			gitArchiveArgs := []string{"--git-dir", srcDir, "archive", tree}
-			cmd := exec.Command("git", gitArchiveArgs...)
-			Debugf("Executing git --git-dir " + srcDir + " archive " + tree)
-			cmdOut, err := cmd.StdoutPipe()
-			if err != nil {
-				if !allowFail {
-					Infof("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
-				} else {
-					return false
-				}
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
-			}
-			cmd.Start()
-
-			before := time.Now()
-			unTar(cmdOut, targetDir)
-			duration := time.Since(before).Seconds()
-			mutex.Lock()
-			ioGitTime += duration
-			mutex.Unlock()
-
-			err = cmd.Wait()
-			if err != nil {
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+			if !extractGitArchive(ctx, srcDir, targetDir, archiveTree, allowFail, ignoreUnreachable, timeout, st) {
+				return false
 			}
 
-			Verbosef("syncToModuleDir(): Executing git --git-dir " + srcDir + " archive " + tree + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-
-			er = executeCommand(logCmd, config.Timeout, false)
+			er = resolveGitObject(ctx, srcDir, tree, logCmd, timeout, false)
+			writeGitLog(srcDir, logCmd, er)
 			if len(er.output) > 0 {
 				commitHash := strings.TrimSuffix(er.output, "\n")
 				if strings.HasPrefix(srcDir, config.EnvCacheDir) {
 					Debugf("Writing to deploy file " + deployFile)
 					dr := DeployResult{
-						Name:      tree,
-						Signature: commitHash,
-						StartedAt: startedAt,
+						Name:       tree,
+						Signature:  commitHash,
+						StartedAt:  startedAt,
+						Labels:     deployLabels,
+						GitVersion: gitVersion,
 					}
-					writeStructJSONFile(deployFile, dr)
+					writeStructJSONFile(prepareMetadataFile(deployFile), dr)
 				} else {
 					Debugf("Writing hash " + commitHash + " from command " + logCmd + " to " + hashFile)
-					f, _ := os.Create(hashFile)
+					f, _ := os.Create(prepareMetadataFile(hashFile))
 					defer f.Close()
 					f.WriteString(commitHash)
 					f.Sync()
+					recordRunState("module", targetDir, commitHash)
 				}
 
 			}
@@ -243,25 +1354,247 @@ func syncToModuleDir(srcDir string, targetDir string, tree string, allowFail boo
 	return true
 }
 
-func listGitRepoFiles(gitDir string, tree string, targetDir string, hashFile string) {
+// getCommitterTime returns the committer date of commit in the git repository gitDir, commit can be any revision like a branch or a tag
+func getCommitterTime(gitDir string, commit string, timeout int) (time.Time, bool) {
+	er := executeGitCommand(runContext, "git --git-dir "+gitDir+" log -1 --format=%ct '"+commit+"'", timeout, true)
+	if er.returnCode != 0 {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(er.output), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// syncLocalToModuleDir copies the local module directory srcDir to targetDir instead of using git archive
+func syncLocalToModuleDir(srcDir string, targetDir string, ignoreUnreachable bool, correspondingPuppetEnvironment string, onlyDelta bool, st *SyncStats) bool {
+	if shutdownRequested() {
+		Debugf("Skipping sync of " + targetDir + ", because g10k is shutting down")
+		return false
+	}
+	st.addSyncedGitModule()
+	if !isDir(srcDir) {
+		if ignoreUnreachable {
+			Debugf("Failed to populate module " + targetDir + " from local module directory " + srcDir + " but ignore-unreachable is set. Continuing...")
+			purgeDir(targetDir, "syncLocalToModuleDir, because ignore-unreachable is set for this module")
+			return false
+		}
+		Fatalf("syncLocalToModuleDir(): Error local module directory " + srcDir + " does not exist or is not a directory")
+	}
+
+	resolvedSrcDir := resolvePath(srcDir)
+	resolvedTargetDir := resolvePath(targetDir)
+	if isSameOrSubDir(resolvedSrcDir, resolvedTargetDir) || isSameOrSubDir(resolvedTargetDir, resolvedSrcDir) {
+		Fatalf("syncLocalToModuleDir(): Error local module directory " + srcDir + " and target directory " + targetDir + " must not be the same or contain each other")
+	}
+
+	hashFile := getLatestCommitFile(targetDir)
+	if onlyDelta {
+		listLocalDirFiles(srcDir, targetDir, st)
+		st.addDesiredContent(hashFile)
+	}
+	// the content hash of the copied files is stored in .latest_commit, so that an unchanged local module directory does not get copied again
+	contentHash, err := getLocalDirContentHash(srcDir)
+	if err != nil {
+		Fatalf("syncLocalToModuleDir(): Error while hashing local module directory " + srcDir + " Error: " + err.Error())
+	}
+	if content, err := ioutil.ReadFile(hashFile); err == nil && strings.TrimSpace(string(content)) == contentHash && isDir(targetDir) {
+		Debugf("Skipping, because no diff found between local module directory " + srcDir + " (" + contentHash + ") and " + targetDir)
+		st.addUnchangedDir(targetDir)
+		st.addCacheResult(correspondingPuppetEnvironment, true)
+		return true
+	}
+	st.addCacheResult(correspondingPuppetEnvironment, false)
+
+	InfoModulef("Need to sync " + targetDir)
+	st.addNeedSyncGitDir(targetDir, correspondingPuppetEnvironment)
+
+	if !dryRun {
+		if !onlyDelta {
+			createOrPurgeDir(targetDir, "syncLocalToModuleDir()")
+		} else {
+			checkDirAndCreate(targetDir, "local module dir")
+		}
+		before := time.Now()
+		copyLocalDir(srcDir, targetDir)
+		if err := ioutil.WriteFile(prepareMetadataFile(hashFile), []byte(contentHash), 0644); err != nil {
+			Fatalf("syncLocalToModuleDir(): Error while writing " + hashFile + " Error: " + err.Error())
+		}
+		duration := time.Since(before).Seconds()
+		st.addIOGitTime(duration)
+		VerboseModulef("syncLocalToModuleDir(): Copying local module directory " + srcDir + " to " + targetDir + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	}
+	return true
+}
+
+// getLocalDirContentHash returns the content hash of the files of the local module directory srcDir which copyLocalDir() copies
+func getLocalDirContentHash(srcDir string) (string, error) {
+	return hashDirContent(srcDir, func(rel string, info os.FileInfo) bool {
+		return info.IsDir() && info.Name() == ".git" || matchBlacklistContent(rel)
+	})
+}
+
+// copyLocalDir copies the content of the local module directory srcDir without the .git directory to targetDir
+func copyLocalDir(srcDir string, targetDir string) {
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(srcDir, path)
+		if relPath == "." {
+			return nil
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if matchBlacklistContent(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(targetDir, relPath)
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, getDirMode(os.FileMode(0755))); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return nil
+		default:
+			if err := moveFile(path, target, false); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, getFileMode(info.Mode())); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		Fatalf("copyLocalDir(): Error while copying local module directory " + srcDir + " to " + targetDir + " Error: " + err.Error())
+	}
+}
+
+// listLocalDirFiles adds all files of the local module directory srcDir to the desired content of targetDir
+func listLocalDirFiles(srcDir string, targetDir string, st *SyncStats) {
+	filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, _ := filepath.Rel(srcDir, path)
+		if relPath == "." {
+			return nil
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		st.addDesiredContent(filepath.Join(targetDir, relPath))
+		return nil
+	})
+}
+
+// getExportIgnoredFiles returns the files of tree which git archive leaves out, because of the export-ignore attribute of a .gitattributes file in tree
+// the archive only gets listed if one of the .gitattributes files of gitFiles uses export-ignore, because git check-attr can not read the attributes of a bare repository
+func getExportIgnoredFiles(gitDir string, tree string, gitFiles []string) map[string]bool {
+	usesExportIgnore := false
+	for _, gitFile := range gitFiles {
+		if filepath.Base(gitFile) != ".gitattributes" {
+			continue
+		}
+		er := executeCommand(runContext, "git --git-dir "+gitDir+" show '"+tree+":"+gitFile+"'", config.Timeout, true)
+		if er.returnCode == 0 && strings.Contains(er.output, "export-ignore") {
+			usesExportIgnore = true
+			break
+		}
+	}
+	if !usesExportIgnore {
+		return nil
+	}
+
+	cmd := exec.Command("git", "--git-dir", gitDir, "archive", tree)
+	cmd.Env = getGitEnvironment()
+	Debugf("Executing git --git-dir " + gitDir + " archive " + tree + " to list the export-ignore files")
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		Fatalf("getExportIgnoredFiles(): Failed to execute command: git --git-dir " + gitDir + " archive " + tree + " Error: " + err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		Fatalf("getExportIgnoredFiles(): Failed to execute command: git --git-dir " + gitDir + " archive " + tree + " Error: " + err.Error())
+	}
+	archivedFiles := make(map[string]bool)
+	tarReader := tar.NewReader(cmdOut)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			killCommand(cmd)
+			cmd.Wait()
+			Fatalf("getExportIgnoredFiles(): Error while reading git --git-dir " + gitDir + " archive " + tree + " Error: " + err.Error())
+		}
+		archivedFiles[strings.TrimSuffix(header.Name, "/")] = true
+	}
+	if err := cmd.Wait(); err != nil {
+		Fatalf("getExportIgnoredFiles(): Failed to execute command: git --git-dir " + gitDir + " archive " + tree + " Error: " + err.Error())
+	}
+	exportIgnoredFiles := make(map[string]bool)
+	for _, gitFile := range gitFiles {
+		if !archivedFiles[gitFile] {
+			exportIgnoredFiles[gitFile] = true
+		}
+	}
+	return exportIgnoredFiles
+}
+
+func listGitRepoFiles(gitDir string, tree string, targetDir string, hashFile string, st *SyncStats) {
 	treeCmd := "git --git-dir " + gitDir + " ls-tree --full-tree -r --name-only " + tree
-	er := executeCommand(treeCmd, config.Timeout, false)
+	if config.MaxFileSizeKB > 0 {
+		// the object sizes are needed to leave out the files which unTar() skips because of max_file_size_kb
+		treeCmd = "git --git-dir " + gitDir + " ls-tree --full-tree -r -l " + tree
+	}
+	er := executeCommand(runContext, treeCmd, config.Timeout, false)
 	foundGitFiles := strings.Split(er.output, "\n")
-	mutex.Lock()
+	gitFiles := []string{}
+	for _, gitFile := range foundGitFiles[:len(foundGitFiles)-1] {
+		if config.MaxFileSizeKB > 0 {
+			// <mode> SP <type> SP <object> SP <object size> TAB <file>
+			entry := strings.SplitN(gitFile, "\t", 2)
+			if len(entry) != 2 {
+				continue
+			}
+			gitFile = entry[1]
+			if fields := strings.Fields(entry[0]); len(fields) == 4 {
+				if size, err := strconv.ParseInt(fields[3], 10, 64); err == nil && exceedsMaxFileSize(size) {
+					continue
+				}
+			}
+		}
+		gitFiles = append(gitFiles, gitFile)
+	}
+	exportIgnoredFiles := getExportIgnoredFiles(gitDir, tree, gitFiles)
 	// g10k must have purge whitelist items
-	desiredContent = append(desiredContent, hashFile)
-	desiredContent = append(desiredContent, ".last_commit")
-	for _, desiredFile := range foundGitFiles[:len(foundGitFiles)-1] {
+	desiredContent := []string{hashFile, ".last_commit"}
+	for _, desiredFile := range gitFiles {
+		if exportIgnoredFiles[desiredFile] {
+			continue
+		}
 		desiredContent = append(desiredContent, filepath.Join(targetDir, desiredFile))
 
-		// because we're using -r which prints git managed files in subfolders like this: foo/test3
-		// we have to split up the given string and add the possible parent directories (foo in this case)
-		parentDirs := strings.Split(desiredFile, "/")
-		if len(parentDirs) > 1 {
-			for _, dir := range parentDirs[:len(parentDirs)-1] {
-				desiredContent = append(desiredContent, filepath.Join(targetDir, dir))
-			}
+		// because we're using -r which prints git managed files in subfolders like this: foo/bar/test3
+		// we have to add all parent directories (foo and foo/bar in this case)
+		// this also keeps otherwise empty directories like files/ which only contain a tracked .gitkeep file
+		for dir := filepath.Dir(desiredFile); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			desiredContent = append(desiredContent, filepath.Join(targetDir, dir))
 		}
 	}
-	mutex.Unlock()
+	st.addDesiredContent(desiredContent...)
 }
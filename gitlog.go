@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitLogFiles serializes the writes of the goroutines to the same git log file
+var gitLogFiles = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// getGitLogFile returns the log file in the git_log_dir for the cached git repository gitDir
+// the directory name of gitDir is already a sanitized repository name, the name of its cache directory keeps modules and control repositories apart
+func getGitLogFile(gitDir string) string {
+	gitDir = filepath.Clean(gitDir)
+	return filepath.Join(config.GitLogDir, filepath.Base(filepath.Dir(gitDir))+"_"+filepath.Base(gitDir)+".log")
+}
+
+// writeGitLog appends the git command and its exit code and output to the log file of the cached git repository gitDir if git_log_dir is set
+// secrets get masked, errors only result in a warning
+func writeGitLog(gitDir string, command string, er ExecResult) {
+	if len(config.GitLogDir) == 0 {
+		return
+	}
+	logFile := getGitLogFile(gitDir)
+	gitLogFiles.Lock()
+	lock, ok := gitLogFiles.locks[logFile]
+	if !ok {
+		lock = &sync.Mutex{}
+		gitLogFiles.locks[logFile] = lock
+	}
+	gitLogFiles.Unlock()
+
+	entry := "# " + time.Now().Format(time.RFC3339) + " " + command + "\n# exit code " + strconv.Itoa(er.returnCode) + "\n"
+	for _, output := range []string{er.output, er.stderr} {
+		if len(output) > 0 {
+			entry += strings.TrimSuffix(output, "\n") + "\n"
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		Warnf("writeGitLog(): WARN: Could not open git log file " + logFile + " Error: " + err.Error())
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(maskSecrets(entry)); err != nil {
+		Warnf("writeGitLog(): WARN: Could not write git log file " + logFile + " Error: " + err.Error())
+	}
+}
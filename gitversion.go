@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gitVersion is the version of the git executable in PATH like 2.39.2, which gets detected once at startup
+var gitVersion string
+
+// minGitObjectSyntaxVersion is the first git version known to understand the ^{object} syntax, older versions like the 1.7.1 of CentOS 6 fail on it
+var minGitObjectSyntaxVersion = []int{1, 8, 0}
+
+// minGitConfigEnvVersion is the first git version which reads config settings from the GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n> environment variables
+var minGitConfigEnvVersion = []int{2, 31, 0}
+
+// reGitVersion matches the version number in the output of git --version like git version 2.39.2 or git version 2.39.3 (Apple Git-146)
+var reGitVersion = regexp.MustCompile("^git version (\\d+(?:\\.\\d+)*)")
+
+// detectGitVersion returns the version of the git executable in PATH or an empty string if it could not be detected
+func detectGitVersion() string {
+	er := executeCommand(runContext, "git --version", config.Timeout, true)
+	version := parseGitVersion(er.output)
+	if len(version) == 0 {
+		Warnf("WARN: Could not detect the git version from the output of git --version: " + strings.TrimSpace(er.output))
+	}
+	return version
+}
+
+// parseGitVersion returns the version number of the output of git --version
+func parseGitVersion(output string) string {
+	if m := reGitVersion.FindStringSubmatch(strings.TrimSpace(output)); len(m) > 0 {
+		return m[1]
+	}
+	return ""
+}
+
+// isGitVersionAtLeast returns true if the git version is the same or newer than the version min, missing parts of version count as 0
+func isGitVersionAtLeast(version string, min []int) bool {
+	parts := strings.Split(version, ".")
+	for i, m := range min {
+		v := 0
+		if i < len(parts) {
+			v, _ = strconv.Atoi(parts[i])
+		}
+		if v != m {
+			return v > m
+		}
+	}
+	return true
+}
+
+// applyGitVersion sets git_object_syntax_not_supported if the detected git version is too old to understand the ^{object} syntax
+func applyGitVersion() {
+	if len(gitVersion) == 0 || config.GitObjectSyntaxNotSupported {
+		return
+	}
+	if !isGitVersionAtLeast(gitVersion, minGitObjectSyntaxVersion) {
+		Verbosef("git version " + gitVersion + " does not support the ^{object} syntax, setting git_object_syntax_not_supported")
+		config.GitObjectSyntaxNotSupported = true
+	}
+}
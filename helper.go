@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -10,10 +13,14 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/fatih/color"
@@ -26,6 +33,7 @@ var validationMessages []string
 // Debugf is a helper function for debug logging if global variable debug is set to true
 func Debugf(s string) {
 	if debug != false {
+		s = maskSecrets(s)
 		pc, _, _, _ := runtime.Caller(1)
 		callingFunctionName := strings.Split(runtime.FuncForPC(pc).Name(), ".")[len(strings.Split(runtime.FuncForPC(pc).Name(), "."))-1]
 		if strings.HasPrefix(callingFunctionName, "func") {
@@ -40,14 +48,28 @@ func Debugf(s string) {
 // Verbosef is a helper function for verbose logging if global variable verbose is set to true
 func Verbosef(s string) {
 	if debug != false || verbose != false {
-		log.Print(fmt.Sprint(s))
+		log.Print(maskSecrets(s))
 	}
 }
 
 // Infof is a helper function for info logging if global variable info is set to true
 func Infof(s string) {
 	if debug != false || verbose != false || info != false {
-		color.Green(s)
+		color.Green(maskSecrets(s))
+	}
+}
+
+// InfoModulef is Infof for the per-module output, which the -summaryonly parameter suppresses
+func InfoModulef(s string) {
+	if !summaryOnly {
+		Infof(s)
+	}
+}
+
+// VerboseModulef is Verbosef for the per-module output, which the -summaryonly parameter suppresses
+func VerboseModulef(s string) {
+	if !summaryOnly {
+		Verbosef(s)
 	}
 }
 
@@ -67,16 +89,20 @@ func Validatef() {
 // Warnf is a helper function for warning logging
 func Warnf(s string) {
 	color.Set(color.FgYellow)
-	fmt.Println(s)
+	fmt.Println(maskSecrets(s))
 	color.Unset()
 }
 
 // Fatalf is a helper function for fatal logging
 func Fatalf(s string) {
+	s = maskSecrets(s)
 	if validate {
 		validationMessages = append(validationMessages, s)
 	} else {
 		color.New(color.FgRed).Fprintln(os.Stderr, s)
+		sendNotification(false, s)
+		sendFailedDeployEvents(s)
+		cancelRunningCommands()
 		os.Exit(1)
 	}
 }
@@ -143,6 +169,8 @@ func checkDirAndCreate(dir string, name string) string {
 }
 
 func createOrPurgeDir(dir string, callingFunction string) {
+	// without the trailing slash os.RemoveAll removes a symlink instead of the content of the directory it points to
+	dir = filepath.Clean(dir)
 	if !dryRun {
 		if !fileExists(dir) {
 			Debugf("Trying to create dir: " + dir + " called from " + callingFunction)
@@ -152,6 +180,7 @@ func createOrPurgeDir(dir string, callingFunction string) {
 			if err := os.RemoveAll(dir); err != nil {
 				log.Print("createOrPurgeDir(): error: removing dir failed", err)
 			}
+			purgeMetadataDir(dir)
 			Debugf("Trying to create dir: " + dir + " called from " + callingFunction)
 			os.MkdirAll(dir, 0777)
 		}
@@ -159,7 +188,9 @@ func createOrPurgeDir(dir string, callingFunction string) {
 }
 
 func purgeDir(dir string, callingFunction string) {
-	if !fileExists(dir) {
+	// without the trailing slash os.RemoveAll removes a symlink instead of the content of the directory it points to
+	dir = filepath.Clean(dir)
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
 		Debugf("Unnecessary to remove dir: " + dir + " it does not exist. Called from " + callingFunction)
 	} else {
 		Debugf("Trying to remove: " + dir + " called from " + callingFunction)
@@ -169,10 +200,13 @@ func purgeDir(dir string, callingFunction string) {
 				log.Print("purgeDir(): syscall.Unlink() error: removing link failed: ", err)
 			}
 		}
+		purgeMetadataDir(dir)
 	}
 }
 
-func executeCommand(command string, timeout int, allowFail bool) ExecResult {
+// executeCommand executes the given command and kills it and all of its child processes if it did not finish after timeout seconds or ctx got cancelled, 0 disables the timeout
+// the environment variables env get added to the environment of the command, e.g. for credentials which must not be visible in its command line
+func executeCommand(ctx context.Context, command string, timeout int, allowFail bool, env ...string) ExecResult {
 	Debugf("Executing " + command)
 	parts := strings.SplitN(command, " ", 2)
 	cmd := parts[0]
@@ -187,17 +221,58 @@ func executeCommand(command string, timeout int, allowFail bool) ExecResult {
 	}
 
 	before := time.Now()
-	out, err := exec.Command(cmd, cmdArgs...).CombinedOutput()
+	var err error
+	er := ExecResult{}
+	if replayed, ok := replayExecTrace(command); ok {
+		er = ExecResult{replayed.ReturnCode, replayed.Output, replayed.Stderr}
+		if replayed.ReturnCode != 0 {
+			err = fmt.Errorf("exit status %d", replayed.ReturnCode)
+		}
+	} else {
+		c := exec.CommandContext(ctx, cmd, cmdArgs...)
+		// git can also be started by env, ssh-agent or the rate limit wrapper
+		c.Env = append(getGitEnvironment(), env...)
+		var output bytes.Buffer
+		var stderr bytes.Buffer
+		c.Stdout = &output
+		c.Stderr = &stderr
+		// the command gets killed with all of its child processes like the git command started by ssh-agent after timeout seconds or once ctx gets cancelled
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+			defer cancel()
+		}
+		var finished func()
+		finished, err = startCommand(ctx, c)
+		if err == nil {
+			err = c.Wait()
+			finished()
+		}
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		er = ExecResult{0, output.String(), stderr.String()}
+		if msg, ok := err.(*exec.ExitError); ok { // there is error code
+			er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		if timedOut {
+			err = fmt.Errorf("killed after timeout of %d seconds", timeout)
+		}
+	}
 	duration := time.Since(before).Seconds()
-	er := ExecResult{0, string(out)}
-	if msg, ok := err.(*exec.ExitError); ok { // there is error code
-		er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
+	if err != nil && er.returnCode == 0 {
+		recordExecTrace(command, duration, 1, er.output, er.stderr)
+	} else {
+		recordExecTrace(command, duration, er.returnCode, er.output, er.stderr)
 	}
 	if (allowFail || config.UseCacheFallback) && err != nil {
 		Debugf("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	} else {
 		Verbosef("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	}
+	if err == nil && len(strings.TrimSpace(er.stderr)) > 0 {
+		// non-fatal warnings and advice of git like ambiguous refs
+		Verbosef("Command " + command + " succeeded, but wrote to stderr: " + strings.TrimSpace(er.stderr))
+	}
+	out := er.output + er.stderr
 	if err != nil {
 		if !allowFail && !config.UseCacheFallback && !config.RetryGitCommands {
 			if cmd == "git" {
@@ -223,10 +298,8 @@ func funcName() string {
 
 func timeTrack(start time.Time, name string) {
 	duration := time.Since(start).Seconds()
-	if name == "resolveForgeModules" {
-		syncForgeTime = duration
-	} else if name == "resolveGitRepositories" {
-		syncGitTime = duration
+	if profile {
+		addFunctionProfile(name, duration)
 	}
 	Debugf(name + "() took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 }
@@ -235,16 +308,16 @@ func timeTrack(start time.Time, name string) {
 func checkForAndExecutePostrunCommand() {
 	if len(config.PostRunCommand) > 0 {
 		postrunCommandString := strings.Join(config.PostRunCommand, " ")
-		postrunCommandString = strings.Replace(postrunCommandString, "$modifieddirs", strings.Join(needSyncDirs, " "), -1)
+		postrunCommandString = strings.Replace(postrunCommandString, "$modifieddirs", strings.Join(syncStats.needSyncDirs, " "), -1)
 
 		needSyncEnvText := ""
-		for needSyncEnv := range needSyncEnvs {
+		for needSyncEnv := range syncStats.needSyncEnvs {
 			needSyncEnvText += needSyncEnv + " "
 		}
 		postrunCommandString = strings.Replace(postrunCommandString, "$modifiedenvs", needSyncEnvText, -1)
 		postrunCommandString = strings.Replace(postrunCommandString, "$branchparam", branchParam, -1)
 
-		er := executeCommand(postrunCommandString, config.Timeout, false)
+		er := executeCommand(runContext, postrunCommandString, config.Timeout, false)
 		Debugf("postrun command '" + postrunCommandString + "' terminated with exit code " + strconv.Itoa(er.returnCode))
 	}
 }
@@ -293,6 +366,154 @@ func moveFile(sourcePath, destPath string, deleteSourceFileToggle bool) error {
 	return nil
 }
 
+// handleSignals lets g10k stop launching new module syncs after the first SIGINT or SIGTERM and exit immediately after the second one
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		receivedSignal = sig.(syscall.Signal)
+		Warnf("WARN: received signal " + sig.String() + ", waiting for in-flight module syncs to finish. Send the signal again to exit immediately")
+		close(shutdown)
+		<-signals
+		Warnf("WARN: received signal again, exiting immediately")
+		cancelRunningCommands()
+		os.Exit(signalExitCode())
+	}()
+}
+
+// shutdownRequested returns true if g10k received SIGINT or SIGTERM
+func shutdownRequested() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// signalExitCode returns the exit code g10k uses if it was interrupted by a signal
+func signalExitCode() int {
+	return 128 + int(receivedSignal)
+}
+
+// printStats prints the cache hits and misses of the git modules per environment and the number of git fetches
+func printStats(st *SyncStats) {
+	st.Lock()
+	defer st.Unlock()
+	envs := []string{}
+	for env := range st.cacheHits {
+		envs = append(envs, env)
+	}
+	for env := range st.cacheMisses {
+		if _, ok := st.cacheHits[env]; !ok {
+			envs = append(envs, env)
+		}
+	}
+	sort.Strings(envs)
+
+	totalHits := 0
+	totalMisses := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENVIRONMENT\tMODULES\tCACHE HITS\tCACHE MISSES\tHIT RATIO")
+	for _, env := range envs {
+		fmt.Fprintln(w, env+"\t"+strconv.Itoa(st.cacheHits[env]+st.cacheMisses[env])+"\t"+strconv.Itoa(st.cacheHits[env])+"\t"+strconv.Itoa(st.cacheMisses[env])+"\t"+hitRatio(st.cacheHits[env], st.cacheMisses[env]))
+		totalHits += st.cacheHits[env]
+		totalMisses += st.cacheMisses[env]
+	}
+	fmt.Fprintln(w, "total\t"+strconv.Itoa(totalHits+totalMisses)+"\t"+strconv.Itoa(totalHits)+"\t"+strconv.Itoa(totalMisses)+"\t"+hitRatio(totalHits, totalMisses))
+	w.Flush()
+	fmt.Println("git fetches performed: " + strconv.Itoa(st.gitFetchCount) + ", skipped via memoization: " + strconv.Itoa(st.gitFetchSkippedCount) + ", git I/O " + strconv.FormatFloat(st.ioGitTime, 'f', 1, 64) + "s")
+	if st.tarballDownloadTime > 0 {
+		fmt.Println("tarball downloads: " + strconv.FormatFloat(st.tarballDownloadTime, 'f', 1, 64) + "s")
+	}
+}
+
+// printChangeSummary prints to w how many modules and environments were synced and how many were skipped, because they were already up to date
+// the skipped ones are listed at verbose level, the purged unmanaged paths are always listed
+func printChangeSummary(w io.Writer, st *SyncStats) {
+	st.Lock()
+	defer st.Unlock()
+	fmt.Fprintln(w, strconv.Itoa(len(st.needSyncDirs))+" synced, "+strconv.Itoa(len(st.unchangedDirs))+" unchanged modules and environments")
+	unchangedDirs := append([]string{}, st.unchangedDirs...)
+	sort.Strings(unchangedDirs)
+	for _, dir := range unchangedDirs {
+		Verbosef("Unchanged: " + dir)
+	}
+	if len(st.purgedPaths) > 0 {
+		purgedPaths := append([]string{}, st.purgedPaths...)
+		sort.Strings(purgedPaths)
+		fmt.Fprintln(w, strconv.Itoa(len(purgedPaths))+" unmanaged paths purged")
+		for _, path := range purgedPaths {
+			fmt.Fprintln(w, "Purged: "+path)
+		}
+	}
+}
+
+// printSyncSummary prints only the number of processed environments, synced and unchanged modules and the duration of the sync for the -summaryonly parameter
+func printSyncSummary(w io.Writer, target string, st *SyncStats, duration time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+	envDirs := make(map[string]bool)
+	for _, de := range st.deployedEnvironments {
+		envDirs[normalizeDir(de.workDir)] = true
+	}
+	countModules := func(dirs []string) int {
+		modules := 0
+		for _, dir := range dirs {
+			if !envDirs[normalizeDir(dir)] {
+				modules++
+			}
+		}
+		return modules
+	}
+	fmt.Fprintln(w, "Synced "+target+": "+strconv.Itoa(len(st.deployedEnvironments))+" environments processed, "+strconv.Itoa(countModules(st.needSyncDirs))+" modules synced, "+strconv.Itoa(countModules(st.unchangedDirs))+" modules unchanged in "+strconv.FormatFloat(duration.Seconds(), 'f', 1, 64)+"s")
+}
+
+// printSlowestModules prints to w the n git repositories which took the longest to be fetched and to be archived and extracted into the module directories
+func printSlowestModules(w io.Writer, st *SyncStats, n int) {
+	timings := st.getSlowestModules(n)
+	if len(timings) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Slowest "+strconv.Itoa(len(timings))+" git repositories:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tFETCH\tSYNC\tSYNCS\tTOTAL")
+	for _, mt := range timings {
+		fmt.Fprintln(tw, mt.Name+"\t"+strconv.FormatFloat(mt.FetchDuration, 'f', 1, 64)+"s\t"+strconv.FormatFloat(mt.SyncDuration, 'f', 1, 64)+"s\t"+strconv.Itoa(mt.Syncs)+"\t"+strconv.FormatFloat(mt.FetchDuration+mt.SyncDuration, 'f', 1, 64)+"s")
+	}
+	tw.Flush()
+}
+
+// hitRatio returns the percentage of cache hits
+func hitRatio(hits int, misses int) string {
+	if hits+misses == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(hits)*100/float64(hits+misses), 'f', 1, 64) + "%"
+}
+
+// resolvePath returns the absolute path of the given path with all symlinks resolved, as far as the path already exists
+func resolvePath(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolvedPath, err := filepath.EvalSymlinks(absPath); err == nil {
+		return resolvedPath
+	}
+	return absPath
+}
+
+// isSameOrSubDir checks if dir is the same directory as or a subdirectory of parentDir
+func isSameOrSubDir(parentDir string, dir string) bool {
+	rel, err := filepath.Rel(parentDir, dir)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
 func stringSliceContains(slice []string, element string) bool {
 	for _, e := range slice {
 		if e == element {
@@ -315,6 +536,79 @@ func writeStructJSONFile(file string, v interface{}) {
 
 }
 
+// getDeployLabels returns the deploy_labels of the config file overridden by the -label parameters or nil if there are none
+func getDeployLabels() map[string]string {
+	if len(config.DeployLabels) == 0 && len(labelParams) == 0 {
+		return nil
+	}
+	labels := make(map[string]string)
+	for key, value := range config.DeployLabels {
+		labels[key] = value
+	}
+	for key, value := range labelParams {
+		labels[key] = value
+	}
+	return labels
+}
+
+// getUmask returns the umask setting and false if it is not set
+func getUmask() (os.FileMode, bool) {
+	if len(config.Umask) == 0 {
+		return 0, false
+	}
+	umask, _ := strconv.ParseUint(config.Umask, 8, 32)
+	return os.FileMode(umask), true
+}
+
+// applyUmask sets the umask setting as the umask of the g10k process, so that the created directories and files
+// get the same permissions regardless of the umask of the shell that started g10k
+func applyUmask() {
+	if umask, ok := getUmask(); ok {
+		Debugf("Setting umask to " + config.Umask)
+		syscall.Umask(int(umask))
+	}
+}
+
+// getDirMode returns the permissions of a directory of a deployed module, which is defaultMode or 0777 without the umask setting
+func getDirMode(defaultMode os.FileMode) os.FileMode {
+	if umask, ok := getUmask(); ok {
+		return 0777 &^ umask
+	}
+	return defaultMode
+}
+
+// getFileMode returns the permissions of a file of a deployed module with mode in the git or Forge module archive
+// with the umask setting only the executable bit of mode is kept like git does it for checked out files
+func getFileMode(mode os.FileMode) os.FileMode {
+	umask, ok := getUmask()
+	if !ok {
+		return mode
+	}
+	if mode&0111 != 0 {
+		return 0777 &^ umask
+	}
+	return 0666 &^ umask
+}
+
+// getDryRunDeployFile returns the deploy file that g10k writes in dry run mode instead of the .g10k-deploy.json inside the given environment directory
+func getDryRunDeployFile(targetDir string) string {
+	if len(config.DryRunDeployDir) > 0 {
+		return filepath.Join(config.DryRunDeployDir, filepath.Base(targetDir)+".g10k-deploy.json.dryrun")
+	}
+	return getMetadataFile(targetDir, ".g10k-deploy.json.dryrun")
+}
+
+// writeDryRunDeployFile writes the deploy result that would have been written to the given environment directory
+func writeDryRunDeployFile(targetDir string, dr DeployResult) {
+	dryRunDeployFile := getDryRunDeployFile(targetDir)
+	if len(config.DryRunDeployDir) == 0 && !isDir(targetDir) {
+		Debugf("Not writing dry run deploy file " + dryRunDeployFile + ", because the environment directory does not exist yet. Set dryrun_deploy_dir to get a deploy file for new environments")
+		return
+	}
+	Debugf("Writing to dry run deploy file " + dryRunDeployFile)
+	writeStructJSONFile(prepareMetadataFile(dryRunDeployFile), dr)
+}
+
 func readDeployResultFile(file string) DeployResult {
 	// Open our jsonFile
 	jsonFile, err := os.Open(file)
@@ -335,3 +629,46 @@ func readDeployResultFile(file string) DeployResult {
 	return dr
 
 }
+
+// readStdinDeployRequest reads the branch and optional module name to deploy from the given reader.
+// Supported are a plain branch name, a JSON payload like {"branch": "master", "module": "stdlib"}
+// or the "<old-rev> <new-rev> <ref-name>" lines a git post-receive hook receives on stdin
+func readStdinDeployRequest(r io.Reader) StdinDeployRequest {
+	var sdr StdinDeployRequest
+	content, err := ioutil.ReadAll(bufio.NewReader(r))
+	if err != nil {
+		Fatalf("readStdinDeployRequest(): Error while reading from stdin " + err.Error())
+	}
+	input := strings.TrimSpace(string(content))
+	if strings.HasPrefix(input, "{") {
+		if err := json.Unmarshal([]byte(input), &sdr); err != nil {
+			Fatalf("readStdinDeployRequest(): Error while parsing JSON payload from stdin " + input + " Error: " + err.Error())
+		}
+	} else if len(input) > 0 {
+		// only use the first line, g10k deploys a single environment in this mode
+		line := strings.Fields(strings.Split(input, "\n")[0])
+		if len(line) == 3 {
+			// git post-receive hook format
+			sdr.Branch = strings.TrimPrefix(line[2], "refs/heads/")
+		} else if len(line) == 1 {
+			sdr.Branch = line[0]
+		}
+	}
+	sdr.Branch = strings.TrimPrefix(strings.TrimSpace(sdr.Branch), "refs/heads/")
+	Debugf("read branch '" + sdr.Branch + "' and module '" + sdr.Module + "' from stdin")
+	return sdr
+}
+
+// parseSinceParam parses the -since parameter, which is either an RFC3339 timestamp, a unix timestamp or a duration before now like 2h
+func parseSinceParam(since string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if d, err := time.ParseDuration(since); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("must be an RFC3339 timestamp like 2006-01-02T15:04:05Z, a unix timestamp or a positive duration like 2h")
+}
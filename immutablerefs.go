@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MutableRef is a git module of a Puppet environment which is not pinned to a tag or a full commit hash
+type MutableRef struct {
+	environment string
+	module      string
+	location    string
+	reason      string
+}
+
+// getMutableRefReason returns why the git module is not pinned to an immutable ref or an empty string if it is pinned to a tag or a full commit hash
+// a :ref is looked up in the cached git repository moduleCacheDir to distinguish tags from branches
+func getMutableRefReason(gitModule GitModule, moduleCacheDir string) string {
+	if len(gitModule.commit) > 0 {
+		if reFullCommitHash.MatchString(gitModule.commit) {
+			return ""
+		}
+		return "commit " + gitModule.commit + " is not a full commit hash"
+	}
+	if len(gitModule.branch) > 0 {
+		return "branch " + gitModule.branch
+	}
+	if gitModule.link {
+		return "the branch of the control repository with :link"
+	}
+	if len(gitModule.tag) > 0 || len(gitModule.ref) > 0 {
+		ref := gitModule.tag
+		if len(ref) == 0 {
+			ref = gitModule.ref
+		}
+		if reFullCommitHash.MatchString(ref) {
+			return ""
+		}
+		if strings.HasPrefix(ref, "refs/") {
+			if strings.HasPrefix(ref, "refs/tags/") {
+				return ""
+			}
+			return "ref " + ref
+		}
+		if _, ok := readGitRef(moduleCacheDir, "refs/tags/"+ref); ok {
+			return ""
+		}
+		if _, ok := readGitRef(moduleCacheDir, "refs/heads/"+ref); ok {
+			return "ref " + ref + ", which is a branch"
+		}
+		return "ref " + ref + ", which is neither a tag nor a full commit hash"
+	}
+	return "the default branch"
+}
+
+// findMutableRefs returns the git modules of all Puppet environments which are pinned to a branch instead of a tag or a full commit hash sorted by environment and module
+// git modules pinned to another module with :ref => 'module:<name>' and local modules are skipped
+func findMutableRefs(allPuppetfiles map[string]Puppetfile) []MutableRef {
+	mutableRefs := []MutableRef{}
+	for env, pf := range allPuppetfiles {
+		for gitName, gitModule := range pf.gitModules {
+			if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.tarball) > 0 || strings.HasPrefix(gitModule.ref, moduleRefPrefix) {
+				continue
+			}
+			moduleCacheDir := getModuleCacheDir(gitModule.git)
+			if reason := getMutableRefReason(gitModule, moduleCacheDir); len(reason) > 0 {
+				location := filepath.Join(pf.workDir, "Puppetfile")
+				if pf.source == "global_modules" {
+					location = "global_modules in " + configFile
+				}
+				if len(gitModule.lineNumber) > 0 {
+					location += ":" + gitModule.lineNumber
+				}
+				mutableRefs = append(mutableRefs, MutableRef{environment: env, module: gitName, location: location, reason: reason})
+			}
+		}
+	}
+	sort.Slice(mutableRefs, func(i, j int) bool {
+		if mutableRefs[i].environment != mutableRefs[j].environment {
+			return mutableRefs[i].environment < mutableRefs[j].environment
+		}
+		return mutableRefs[i].module < mutableRefs[j].module
+	})
+	return mutableRefs
+}
+
+// enforceImmutableRefs warns about each git module which is not pinned to a tag or a full commit hash
+// and exits before any module gets synced if enforce_immutable_refs is set to fail
+func enforceImmutableRefs(allPuppetfiles map[string]Puppetfile) {
+	mutableRefs := findMutableRefs(allPuppetfiles)
+	for _, mr := range mutableRefs {
+		Warnf("WARN: git module " + mr.module + " of environment " + mr.environment + " in " + mr.location + " is pinned to " + mr.reason + " instead of a tag or a full commit hash")
+	}
+	if len(mutableRefs) > 0 && config.EnforceImmutableRefs == "fail" {
+		Fatalf("Error: Found git modules which are not pinned to a tag or a full commit hash and enforce_immutable_refs is set to fail")
+	}
+}
+
+// hasOnlyImmutableRefs returns true if all git modules of the Puppetfile are pinned to a tag or a full commit hash and all Forge modules to an exact version
+// so that resolving the same Puppetfile again deploys the same modules, local modules are not deployed by g10k and are skipped
+func hasOnlyImmutableRefs(puppetfile Puppetfile) bool {
+	for gitName, gitModule := range puppetfile.gitModules {
+		if gitModule.local || strings.HasPrefix(gitModule.ref, moduleRefPrefix) {
+			continue
+		}
+		if len(gitModule.localPath) > 0 || len(gitModule.tarball) > 0 && len(gitModule.tarballSHA256) == 0 {
+			Debugf("git module " + gitName + " of " + puppetfile.workDir + " can change without a change of its Puppetfile")
+			return false
+		}
+		if len(gitModule.tarball) > 0 {
+			continue
+		}
+		if reason := getMutableRefReason(gitModule, getModuleCacheDir(gitModule.git)); len(reason) > 0 {
+			Debugf("git module " + gitName + " of " + puppetfile.workDir + " is pinned to " + reason)
+			return false
+		}
+	}
+	for forgeModuleName, fm := range puppetfile.forgeModules {
+		if _, _, ok := parseVersion(fm.version); !ok {
+			Debugf("Forge module " + forgeModuleName + " of " + puppetfile.workDir + " is not pinned to an exact version, but " + fm.version)
+			return false
+		}
+	}
+	return true
+}
+
+// isPinnedPuppetfileUnchanged returns true if the Puppetfile pf did not change since the successful previous deploy and only contains immutable refs
+// its modules are then still deployed as they were and need not be resolved again
+func isPinnedPuppetfileUnchanged(pf string, previousDeploy DeployResult, puppetfile Puppetfile) bool {
+	if !config.SkipUnchangedPuppetfiles || force || len(moduleParam) > 0 || len(moduleOverrideParams) > 0 || len(config.GlobalModules) > 0 {
+		return false
+	}
+	if !previousDeploy.DeploySuccess || len(previousDeploy.PuppetfileChecksum) == 0 || len(previousDeploy.ModuleOverrides) > 0 {
+		return false
+	}
+	if getSha256sumFile(pf) != previousDeploy.PuppetfileChecksum {
+		return false
+	}
+	return hasOnlyImmutableRefs(puppetfile)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InteractiveSync is a git module which needs to be synced to another commit and gets approved with -interactive
+type InteractiveSync struct {
+	targetDir string
+	oldCommit string
+	newCommit string
+}
+
+// interactiveSyncs contains the syncs found by planInteractiveSyncs() and which of them got approved
+// approved is nil until the syncs got prompted, then every sync that is not approved gets declined
+var interactiveSyncs = struct {
+	sync.Mutex
+	planning bool
+	planned  []InteractiveSync
+	approved map[string]bool
+}{}
+
+// planInteractiveSyncs runs syncModules like -dryrun and records every git module that needs to be synced
+// the cached git repositories do not change afterwards, so the same commits get synced once the syncs got approved
+func planInteractiveSyncs(syncModules func()) {
+	realSyncStats := syncStats
+	syncStats = newSyncStats()
+	dryRun = true
+	interactiveSyncs.Lock()
+	interactiveSyncs.planning = true
+	interactiveSyncs.planned = nil
+	interactiveSyncs.approved = nil
+	interactiveSyncs.Unlock()
+	defer func() {
+		syncStats = realSyncStats
+		dryRun = false
+		interactiveSyncs.Lock()
+		interactiveSyncs.planning = false
+		interactiveSyncs.Unlock()
+	}()
+	syncModules()
+}
+
+// approveInteractiveSync returns false if the sync of the git module targetDir to newCommit was declined with -interactive
+// while planning the sync only gets recorded together with the commit in hashFile
+func approveInteractiveSync(targetDir string, hashFile string, newCommit string) bool {
+	interactiveSyncs.Lock()
+	defer interactiveSyncs.Unlock()
+	if interactiveSyncs.planning {
+		oldCommit, _ := ioutil.ReadFile(hashFile)
+		interactiveSyncs.planned = append(interactiveSyncs.planned, InteractiveSync{targetDir: targetDir, oldCommit: strings.TrimSpace(string(oldCommit)), newCommit: newCommit})
+		return true
+	}
+	return interactiveSyncs.approved == nil || interactiveSyncs.approved[targetDir]
+}
+
+// hasDeclinedInteractiveSyncs returns true if the sync of a git module inside the environment directory workDir was declined with -interactive
+func hasDeclinedInteractiveSyncs(workDir string) bool {
+	interactiveSyncs.Lock()
+	defer interactiveSyncs.Unlock()
+	if interactiveSyncs.approved == nil {
+		return false
+	}
+	for _, is := range interactiveSyncs.planned {
+		if !interactiveSyncs.approved[is.targetDir] && strings.HasPrefix(is.targetDir, normalizeDir(filepath.Clean(workDir))) {
+			return true
+		}
+	}
+	return false
+}
+
+// promptInteractiveSyncs lists the planned syncs of the git modules and asks for each of them whether it should be synced
+// y approves the sync, n declines it, a approves it and all remaining syncs and q declines it and all remaining syncs
+func promptInteractiveSyncs(in io.Reader, out io.Writer) {
+	interactiveSyncs.Lock()
+	defer interactiveSyncs.Unlock()
+	planned := interactiveSyncs.planned
+	sort.Slice(planned, func(i, j int) bool { return planned[i].targetDir < planned[j].targetDir })
+	interactiveSyncs.approved = make(map[string]bool)
+	if len(planned) == 0 {
+		fmt.Fprintln(out, "No git module needs to be synced")
+		return
+	}
+
+	fmt.Fprintln(out, len(planned), "git modules need to be synced:")
+	for _, is := range planned {
+		fmt.Fprintln(out, "  "+is.targetDir+" "+getInteractiveSyncChange(is))
+	}
+	reader := bufio.NewReader(in)
+	all, quit := false, false
+	for _, is := range planned {
+		approved := all
+		if !all && !quit {
+			switch readInteractiveAnswer(reader, out, "Sync "+is.targetDir+" "+getInteractiveSyncChange(is)+"? [y/n/a/q] ") {
+			case "y":
+				approved = true
+			case "a":
+				approved, all = true, true
+			case "q":
+				quit = true
+			}
+		}
+		interactiveSyncs.approved[is.targetDir] = approved
+	}
+}
+
+// readInteractiveAnswer prints the prompt until one of the answers y, n, a or q or their long forms got entered and returns its short form
+// q gets returned if there is nothing left to read
+func readInteractiveAnswer(reader *bufio.Reader, out io.Writer, prompt string) string {
+	for {
+		fmt.Fprint(out, prompt)
+		line, err := reader.ReadString('\n')
+		switch answer := strings.ToLower(strings.TrimSpace(line)); answer {
+		case "y", "yes", "n", "no", "a", "all", "q", "quit":
+			return answer[:1]
+		}
+		if err != nil {
+			fmt.Fprintln(out)
+			return "q"
+		}
+	}
+}
+
+// getInteractiveSyncChange returns the old and new commit of the sync like old -> new
+func getInteractiveSyncChange(is InteractiveSync) string {
+	oldCommit := is.oldCommit
+	if len(oldCommit) == 0 {
+		oldCommit = "(new)"
+	}
+	return oldCommit + " -> " + is.newCommit
+}
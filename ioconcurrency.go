@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+var (
+	archiveReadSlots  chan struct{}
+	archiveWriteSlots chan struct{}
+	archiveSlotsOnce  sync.Once
+)
+
+// getArchiveSlots returns the semaphores which bound the concurrent git archive reads from the module cache and the concurrent extractions into the module directories
+// a semaphore is nil if its read_concurrency or write_concurrency is not set, then only maxextractworker limits that side
+func getArchiveSlots() (chan struct{}, chan struct{}) {
+	archiveSlotsOnce.Do(func() {
+		if config.ReadConcurrency > 0 {
+			archiveReadSlots = make(chan struct{}, config.ReadConcurrency)
+		}
+		if config.WriteConcurrency > 0 {
+			archiveWriteSlots = make(chan struct{}, config.WriteConcurrency)
+		}
+	})
+	return archiveReadSlots, archiveWriteSlots
+}
+
+// acquireSlot blocks until a slot of the semaphore slots is free, a nil semaphore never blocks
+func acquireSlot(slots chan struct{}) {
+	if slots != nil {
+		slots <- struct{}{}
+	}
+}
+
+// releaseSlot frees a slot of the semaphore slots acquired with acquireSlot()
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// bufferArchive reads the whole archive r into memory, so that the read slot can be released before the extraction waits for a write slot
+func bufferArchive(r io.Reader) (io.Reader, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// defaultMaintainCacheMinAge is used if maintain_cache_min_age is not set
+const defaultMaintainCacheMinAge = 10 * time.Minute
+
+// getMirrorLockFile returns the lock file next to the cached git repository workDir
+// it must not be inside of workDir, because git clone needs an empty directory
+func getMirrorLockFile(workDir string) string {
+	return filepath.Clean(workDir) + ".lock"
+}
+
+// lockMirror locks the cached git repository workDir against other g10k runs and goroutines which update or maintain it
+// without wait it returns false instead of waiting if workDir is already locked
+// the returned function releases the lock and may be called more than once, git repositories in the read_only_cachedir are never locked
+func lockMirror(workDir string, wait bool) (func(), bool) {
+	if isReadOnlyCacheDir(workDir) {
+		return func() {}, true
+	}
+	return lockFile(getMirrorLockFile(workDir), wait)
+}
+
+// lockFile locks the file with flock against other g10k runs and goroutines
+// without wait it returns false instead of waiting if the file is already locked, the returned function releases the lock and may be called more than once
+func lockFile(file string, wait bool) (func(), bool) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		Warnf("lockFile(): WARN: Could not open lock file " + file + " Error: " + err.Error())
+		return func() {}, true
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if !wait && err == syscall.EWOULDBLOCK {
+			return nil, false
+		}
+		Warnf("lockFile(): WARN: Could not lock " + file + " Error: " + err.Error())
+		return func() {}, true
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			f.Close()
+		})
+	}, true
+}
+
+// getCachedGitRepositories returns the sorted cached git repositories of the modules and the control repositories
+func getCachedGitRepositories() []string {
+	dirs := []string{}
+	for _, cacheDir := range []string{config.ModulesCacheDir, config.EnvCacheDir} {
+		entries, err := ioutil.ReadDir(cacheDir)
+		if err != nil {
+			Debugf("Could not read cache directory " + cacheDir + " Error: " + err.Error())
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(cacheDir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// maintainCache runs git gc on all cached git repositories with maxextractworker in parallel, so that git archive stays fast after many updates
+// git repositories which were updated within maintain_cache_min_age or are being updated by a deploy right now are skipped
+// it returns the number of maintained, skipped and failed git repositories
+func maintainCache() (int, int, int) {
+	defer timeTrack(time.Now(), funcName())
+	minAge := config.MaintainCacheMinAge
+	if minAge == 0 {
+		minAge = defaultMaintainCacheMinAge
+	}
+	maintained, skipped, failed := 0, 0, 0
+	wg := sizedwaitgroup.New(config.MaxExtractworker)
+	for _, dir := range getCachedGitRepositories() {
+		if age, ok := getCacheAge(dir); ok && age < minAge {
+			Debugf("Skipping maintenance of " + dir + ", because it was updated " + age.Truncate(time.Second).String() + " ago, which is within maintain_cache_min_age of " + minAge.String())
+			mutex.Lock()
+			skipped++
+			mutex.Unlock()
+			continue
+		}
+		wg.Add()
+		go func(dir string) {
+			defer wg.Done()
+			unlock, ok := lockMirror(dir, false)
+			if !ok {
+				Debugf("Skipping maintenance of " + dir + ", because it is being updated right now")
+				mutex.Lock()
+				skipped++
+				mutex.Unlock()
+				return
+			}
+			defer unlock()
+			er := executeCommand(runContext, "git --git-dir "+dir+" gc --quiet", 0, true)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if er.returnCode != 0 {
+				Warnf("WARN: Could not run git gc on " + dir + ": " + strings.TrimSpace(er.output+er.stderr))
+				failed++
+				return
+			}
+			maintained++
+		}(dir)
+	}
+	wg.Wait()
+	return maintained, skipped, failed
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Masters contains the Puppet masters to which the basedirs of all sources get distributed with rsync over SSH after each deploy
+// the timeout in seconds applies to each rsync, 0 means no timeout
+type Masters struct {
+	Hosts   []string `yaml:"hosts"`
+	Timeout int      `yaml:"timeout"`
+}
+
+// MasterResult contains whether a Puppet master received the deployed environments
+type MasterResult struct {
+	Host   string `json:"host"`
+	InSync bool   `json:"in_sync"`
+	Error  string `json:"error,omitempty"`
+}
+
+// getMastersBasedirs returns the unique basedirs of all sources, which get distributed to the masters
+func getMastersBasedirs() []string {
+	basedirs := []string{}
+	for _, sa := range config.Sources {
+		basedir := normalizeDir(sa.Basedir)
+		if len(sa.Basedir) > 0 && !stringSliceContains(basedirs, basedir) {
+			basedirs = append(basedirs, basedir)
+		}
+	}
+	sort.Strings(basedirs)
+	return basedirs
+}
+
+// rsyncToMaster mirrors the local basedir to the same directory on the master host, the environments which got purged locally are removed there as well
+// symlinks pointing outside of the basedir like the ones into the module store of dedup_modules get replaced by the files they point to
+func rsyncToMaster(host string, basedir string) error {
+	command := "rsync -a --delete --copy-unsafe-links -e 'ssh -o BatchMode=yes' " + quoteRemoteShellArg(basedir) + " " + quoteRemoteShellArg(host+":"+basedir)
+	er := executeCommand(runContext, command, config.Masters.Timeout, true)
+	if er.returnCode != 0 {
+		return fmt.Errorf("%s: %s", er.output, strings.TrimSpace(er.stderr))
+	}
+	return nil
+}
+
+// distributeToMasters syncs the basedirs of all sources to all masters in parallel and records for each master whether it is in sync
+// a master which can not be synced is reported, but does not stop the distribution to the other masters
+func distributeToMasters(st *SyncStats) {
+	if len(config.Masters.Hosts) == 0 || dryRun || shutdownRequested() {
+		return
+	}
+	defer timeTrack(time.Now(), funcName())
+	basedirs := getMastersBasedirs()
+	var wg sync.WaitGroup
+	for _, host := range config.Masters.Hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			before := time.Now()
+			for _, basedir := range basedirs {
+				Debugf("Syncing " + basedir + " to master " + host)
+				if err := rsyncToMaster(host, basedir); err != nil {
+					Warnf("WARN: Could not sync " + basedir + " to master " + host + " Error: " + err.Error())
+					st.addMasterResult(host, err.Error())
+					return
+				}
+			}
+			Verbosef("Synced " + strings.Join(basedirs, ", ") + " to master " + host + " in " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64) + "s")
+			st.addMasterResult(host, "")
+		}(host)
+	}
+	wg.Wait()
+}
+
+// printMastersSummary prints to w which masters are in sync with the deployed environments and why the others are not
+func printMastersSummary(w io.Writer, st *SyncStats) {
+	inSync := []string{}
+	outOfSync := []string{}
+	for _, mr := range st.getMasterResults() {
+		if mr.InSync {
+			inSync = append(inSync, mr.Host)
+		} else {
+			outOfSync = append(outOfSync, mr.Host)
+		}
+	}
+	if len(inSync) > 0 {
+		fmt.Fprintln(w, strconv.Itoa(len(inSync))+" masters in sync: "+strings.Join(inSync, ", "))
+	}
+	if len(outOfSync) > 0 {
+		fmt.Fprintln(w, strconv.Itoa(len(outOfSync))+" masters out of sync: "+strings.Join(outOfSync, ", "))
+	}
+}
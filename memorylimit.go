@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultModuleSizeEstimate is the estimated memory usage of extracting a git module of which no size is known yet
+const defaultModuleSizeEstimate = 16 * 1024 * 1024
+
+// recentModuleSizesCount is the number of recently extracted git modules used to estimate the size of unknown git modules
+const recentModuleSizesCount = 20
+
+var (
+	untarMemoryLimiter     *MemoryLimiter
+	untarMemoryLimiterOnce sync.Once
+)
+
+// MemoryLimiter admits new git archive extractions only while the estimated memory usage of all running extractions stays below the limit
+// the memory usage of an extraction is estimated with the size of the last archive of the same git repository or the average size of the recently extracted archives
+type MemoryLimiter struct {
+	sync.Mutex
+	cond        *sync.Cond
+	limit       int64
+	inUse       int64
+	moduleSizes map[string]int64
+	recentSizes []int64
+}
+
+// newMemoryLimiter returns a MemoryLimiter with a limit of limitMB megabytes
+func newMemoryLimiter(limitMB int) *MemoryLimiter {
+	ml := &MemoryLimiter{limit: int64(limitMB) * 1024 * 1024, moduleSizes: make(map[string]int64)}
+	ml.cond = sync.NewCond(&ml.Mutex)
+	return ml
+}
+
+// getUntarMemoryLimiter returns the MemoryLimiter for the git archive extractions or nil if max_memory_mb is not set
+func getUntarMemoryLimiter() *MemoryLimiter {
+	untarMemoryLimiterOnce.Do(func() {
+		if config.MaxMemoryMB > 0 {
+			untarMemoryLimiter = newMemoryLimiter(config.MaxMemoryMB)
+		}
+	})
+	return untarMemoryLimiter
+}
+
+// estimate returns the estimated memory usage of extracting the git repository srcDir, the lock must be held
+func (ml *MemoryLimiter) estimate(srcDir string) int64 {
+	size, ok := ml.moduleSizes[srcDir]
+	if !ok {
+		size = defaultModuleSizeEstimate
+		if len(ml.recentSizes) > 0 {
+			var sum int64
+			for _, recentSize := range ml.recentSizes {
+				sum += recentSize
+			}
+			size = sum / int64(len(ml.recentSizes))
+		}
+	}
+	if size > ml.limit {
+		// a git module bigger than the limit can only be extracted on its own
+		size = ml.limit
+	}
+	return size
+}
+
+// acquire blocks until the extraction of the git repository srcDir fits into the limit and returns the reserved memory
+// an extraction is always admitted if no other extraction is running, so that big git modules can't block forever
+func (ml *MemoryLimiter) acquire(srcDir string) int64 {
+	if ml == nil {
+		return 0
+	}
+	ml.Lock()
+	defer ml.Unlock()
+	reserved := ml.estimate(srcDir)
+	for ml.inUse > 0 && ml.inUse+reserved > ml.limit {
+		Debugf("Waiting for memory to extract " + srcDir)
+		ml.cond.Wait()
+	}
+	ml.inUse += reserved
+	return reserved
+}
+
+// release frees the reserved memory and remembers the actual size of the extracted archive of the git repository srcDir
+func (ml *MemoryLimiter) release(srcDir string, reserved int64, size int64) {
+	if ml == nil {
+		return
+	}
+	ml.Lock()
+	ml.inUse -= reserved
+	if size > 0 {
+		ml.moduleSizes[srcDir] = size
+		ml.recentSizes = append(ml.recentSizes, size)
+		if len(ml.recentSizes) > recentModuleSizesCount {
+			ml.recentSizes = ml.recentSizes[1:]
+		}
+	}
+	ml.Unlock()
+	ml.cond.Broadcast()
+}
+
+// countingReader counts the bytes read from the underlying io.Reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// getMetadataFile returns the path of the g10k tracking file name of the deployed directory dir
+// with metadata_dir the file lives in a tree parallel to the deployed directories below the metadata_dir, e.g. <metadata_dir>/etc/puppetlabs/code/environments/production/.g10k-deploy.json
+func getMetadataFile(dir string, name string) string {
+	if len(config.MetadataDir) == 0 {
+		return filepath.Join(dir, name)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		Fatalf("getMetadataFile(): Error while resolving the absolute path of " + dir + " Error: " + err.Error())
+	}
+	return filepath.Join(config.MetadataDir, absDir, name)
+}
+
+// getLatestCommitFile returns the .latest_commit file which records the deployed commit of the git module in targetDir
+func getLatestCommitFile(targetDir string) string {
+	return getMetadataFile(targetDir, ".latest_commit")
+}
+
+// getDeployFile returns the .g10k-deploy.json file of the Puppet environment envDir
+func getDeployFile(envDir string) string {
+	return getMetadataFile(envDir, ".g10k-deploy.json")
+}
+
+// prepareMetadataFile creates the parent directory of the metadata file in the metadata_dir before it gets written
+func prepareMetadataFile(file string) string {
+	if len(config.MetadataDir) > 0 {
+		checkDirAndCreate(filepath.Dir(file), "metadata_dir")
+	}
+	return file
+}
+
+// purgeMetadataDir removes the tracking files of dir and all directories below it from the metadata_dir, because dir got removed
+// otherwise a module which gets deployed to the same directory again would be considered as already synced
+func purgeMetadataDir(dir string) {
+	if len(config.MetadataDir) == 0 {
+		return
+	}
+	metadataDir := filepath.Dir(getMetadataFile(dir, ".latest_commit"))
+	if _, err := os.Lstat(metadataDir); err == nil {
+		Debugf("Trying to remove the metadata " + metadataDir + " of " + dir)
+		if err := os.RemoveAll(metadataDir); err != nil {
+			Warnf("WARN: Could not remove the metadata " + metadataDir + " of " + dir + " Error: " + err.Error())
+		}
+	}
+}
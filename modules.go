@@ -2,23 +2,37 @@ package main
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func unTar(r io.Reader, targetBaseDir string) {
+	if err := extractTar(r, targetBaseDir); err != nil {
+		Fatalf(err.Error())
+	}
+}
+
+// extractTar extracts the tar archive r into targetBaseDir and returns the first error, so that the extraction can be retried
+func extractTar(r io.Reader, targetBaseDir string) error {
 	funcName := funcName()
+	defer timeTrack(time.Now(), funcName)
 	tarBallReader := tar.NewReader(r)
+	// entries which differ only in case overwrite each other on case-insensitive filesystems
+	caseFoldedFilenames := make(map[string]string)
 	for {
 		header, err := tarBallReader.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			Fatalf(funcName + "(): error while tar reader.Next() for io.Reader with targetBaseDir " + targetBaseDir + err.Error())
+			// keep io.ErrUnexpectedEOF of a truncated stream, so that the caller can retry it
+			return fmt.Errorf("%s(): error while tar reader.Next() for io.Reader with targetBaseDir %s%w", funcName, targetBaseDir, err)
 		}
 
 		// get the individual filename and extract to the current directory
@@ -33,47 +47,65 @@ func unTar(r io.Reader, targetBaseDir string) {
 			if len(blacklistFilenameComponents) > 1 {
 				blacklistFilename = blacklistFilenameComponents[1]
 			}
+			if len(config.ForgeExtractIgnore) > 0 && matchContentPatterns(blacklistFilename, config.ForgeExtractIgnore, "forge_extract_ignore") {
+				continue
+			}
 		}
 		if matchBlacklistContent(blacklistFilename) {
 			continue
 		}
 		targetFilename := filepath.Join(targetBaseDir, filename)
+		if config.CaseCollisions != "ignore" {
+			caseFolded := strings.ToLower(strings.TrimSuffix(filename, "/"))
+			if other, ok := caseFoldedFilenames[caseFolded]; ok && other != strings.TrimSuffix(filename, "/") {
+				message := "archive entries " + other + " and " + filename + " extracted to " + targetBaseDir + " differ only in case and overwrite each other on case-insensitive filesystems"
+				if config.CaseCollisions == "fail" {
+					return errors.New(funcName + "(): Error: " + message + ", case_collisions is set to fail")
+				}
+				Warnf("WARN: " + message)
+			}
+			caseFoldedFilenames[caseFolded] = strings.TrimSuffix(filename, "/")
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// handle directory
 			//fmt.Println("Creating directory :", filename)
 			//err = os.MkdirAll(targetFilename, os.FileMode(header.Mode)) // or use 0755 if you prefer
-			err = os.MkdirAll(targetFilename, os.FileMode(0755)) // or use 0755 if you prefer
+			err = os.MkdirAll(targetFilename, getDirMode(os.FileMode(0755))) // or use 0755 if you prefer
 
 			if err != nil {
-				Fatalf(funcName + "(): error while MkdirAll() file: " + filename + " Error: " + err.Error())
+				return errors.New(funcName + "(): error while MkdirAll() file: " + filename + " Error: " + err.Error())
 
 			}
 
 			err = os.Chtimes(targetFilename, header.AccessTime, header.ModTime)
 
 			if err != nil {
-				Fatalf(funcName + "(): error while Chtimes() file: " + filename + " Error: " + err.Error())
+				return errors.New(funcName + "(): error while Chtimes() file: " + filename + " Error: " + err.Error())
 
 			}
 
 		case tar.TypeReg:
 			// handle normal file
 			//fmt.Println("Untarring :", filename)
+			if exceedsMaxFileSize(header.Size) {
+				Warnf("WARN: Skipping file " + targetFilename + " with a size of " + strconv.FormatInt(header.Size/1024, 10) + " KB, because it exceeds max_file_size_kb of " + strconv.Itoa(config.MaxFileSizeKB) + " KB")
+				continue
+			}
 			writer, err := os.Create(targetFilename)
 
 			if err != nil {
-				Fatalf(funcName + "(): error while Create() file: " + filename + " Error: " + err.Error())
+				return errors.New(funcName + "(): error while Create() file: " + filename + " Error: " + err.Error())
 			}
 			if _, err = io.Copy(writer, tarBallReader); err != nil {
-				Fatalf(funcName + "(): error while io.copy() file: " + filename + " Error: " + err.Error())
+				return fmt.Errorf("%s(): error while io.copy() file: %s Error: %w", funcName, filename, err)
 			}
-			if err = os.Chmod(targetFilename, os.FileMode(header.Mode)); err != nil {
-				Fatalf(funcName + "(): error while Chmod() file: " + filename + " Error: " + err.Error())
+			if err = os.Chmod(targetFilename, getFileMode(os.FileMode(header.Mode))); err != nil {
+				return errors.New(funcName + "(): error while Chmod() file: " + filename + " Error: " + err.Error())
 			}
 			if err = os.Chtimes(targetFilename, header.AccessTime, header.ModTime); err != nil {
-				Fatalf(funcName + "(): error while Chtimes() file: " + filename + " Error: " + err.Error())
+				return errors.New(funcName + "(): error while Chtimes() file: " + filename + " Error: " + err.Error())
 			}
 
 			writer.Close()
@@ -82,10 +114,10 @@ func unTar(r io.Reader, targetBaseDir string) {
 			link, _ := os.Readlink(targetFilename)
 			if link != header.Linkname && fileExists(targetFilename) {
 				if err = os.Remove(targetFilename); err != nil {
-					Fatalf(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with symlink pointing to " + header.Linkname + " Error: " + err.Error())
+					return errors.New(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with symlink pointing to " + header.Linkname + " Error: " + err.Error())
 				}
 				if err = os.Symlink(header.Linkname, targetFilename); err != nil {
-					Fatalf(funcName + "(): error while creating symlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
+					return errors.New(funcName + "(): error while creating symlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
 				}
 			}
 
@@ -93,10 +125,10 @@ func unTar(r io.Reader, targetBaseDir string) {
 			link, _ := os.Readlink(targetFilename)
 			if link != header.Linkname && fileExists(targetFilename) {
 				if err = os.Remove(targetFilename); err != nil {
-					Fatalf(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with hardlink pointing to " + header.Linkname + " Error: " + err.Error())
+					return errors.New(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with hardlink pointing to " + header.Linkname + " Error: " + err.Error())
 				}
 				if err = os.Link(header.Linkname, targetFilename); err != nil {
-					Fatalf(funcName + "(): error while creating hardlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
+					return errors.New(funcName + "(): error while creating hardlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
 				}
 			}
 
@@ -105,7 +137,7 @@ func unTar(r io.Reader, targetBaseDir string) {
 			continue
 
 		default:
-			Fatalf(funcName + "(): Unable to untar type: " + string(header.Typeflag) + " in file " + filename)
+			return errors.New(funcName + "(): Unable to untar type: " + string(header.Typeflag) + " in file " + filename)
 		}
 	}
 	// tarball produced by git archive has trailing nulls in the stream which are not
@@ -118,16 +150,71 @@ func unTar(r io.Reader, targetBaseDir string) {
 		Debugf(fmt.Sprintf("Discarded %d bytes of trailing data from tar", nread))
 		nread, err = r.Read(buf)
 	}
+	return nil
+}
+
+// writeTar adds the content of srcDir to the tar archive with the directory prefix, which is the counterpart of unTar
+func writeTar(tw *tar.Writer, srcDir string, prefix string) {
+	funcName := funcName()
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		Fatalf(funcName + "(): error while adding " + srcDir + " to tar archive Error: " + err.Error())
+	}
+}
+
+// exceedsMaxFileSize returns true if a file of size bytes must not be extracted because of the max_file_size_kb setting
+func exceedsMaxFileSize(size int64) bool {
+	return config.MaxFileSizeKB > 0 && size > int64(config.MaxFileSizeKB)*1024
 }
 
 func matchBlacklistContent(filePath string) bool {
-	for _, blPattern := range config.PurgeBlacklist {
-		filepathResult, _ := filepath.Match(blPattern, filePath)
-		if strings.HasPrefix(filePath, blPattern) || filepathResult {
-			Debugf("skipping file " + filePath + " because purge_blacklist pattern '" + blPattern + "' matches")
+	return matchContentPatterns(filePath, config.PurgeBlacklist, "purge_blacklist")
+}
+
+// matchContentPatterns checks if the given file path starts with or matches one of the given patterns of the given config setting
+func matchContentPatterns(filePath string, patterns []string, settingName string) bool {
+	for _, pattern := range patterns {
+		filepathResult, _ := filepath.Match(pattern, filePath)
+		if strings.HasPrefix(filePath, pattern) || filepathResult {
+			Debugf("skipping file " + filePath + " because " + settingName + " pattern '" + pattern + "' matches")
 			return true
 		}
 	}
-	Debugf("not skipping file " + filePath + " because no purge_blacklist pattern matches")
+	Debugf("not skipping file " + filePath + " because no " + settingName + " pattern matches")
 	return false
 }
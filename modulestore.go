@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// moduleStoreGracePeriod protects recently used module store directories from being purged, as a concurrent g10k run could be about to link them
+const moduleStoreGracePeriod = time.Hour
+
+// moduleStoreLocks contains a mutex for each module store directory, so that the same commit gets extracted only once
+var moduleStoreLocks sync.Map
+
+// getModuleStoreDir returns the directory of the module store in which the git module with the commit commitHash gets deployed
+func getModuleStoreDir(commitHash string) string {
+	return filepath.Join(config.ModuleStoreDir, commitHash)
+}
+
+// syncModuleStoreDir extracts the commit commitHash of the git repository srcDir into the module store if it is not already there
+// and replaces targetDir with a symlink to the module store directory or with a hardlinked or copied directory depending on dedup_modules_mode and copy_strategy
+func syncModuleStoreDir(ctx context.Context, srcDir string, targetDir string, commitHash string, allowFail bool, ignoreUnreachable bool, timeout int, st *SyncStats) bool {
+	storeDir := getModuleStoreDir(commitHash)
+	lock, _ := moduleStoreLocks.LoadOrStore(storeDir, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	storeHashFile := filepath.Join(storeDir, ".latest_commit")
+	if !fileExists(storeHashFile) {
+		Debugf("Extracting commit " + commitHash + " of " + srcDir + " to module store " + storeDir)
+		tmpDir := storeDir + ".tmp"
+		createOrPurgeDir(tmpDir, "syncModuleStoreDir()")
+		if !extractGitArchive(ctx, srcDir, tmpDir, commitHash, allowFail, ignoreUnreachable, timeout, st) {
+			purgeDir(tmpDir, "syncModuleStoreDir(), because the git archive could not be extracted")
+			return false
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, ".latest_commit"), []byte(commitHash), 0644); err != nil {
+			Fatalf("syncModuleStoreDir(): Error while writing " + filepath.Join(tmpDir, ".latest_commit") + " Error: " + err.Error())
+		}
+		purgeDir(storeDir, "syncModuleStoreDir(), because the module store directory is incomplete")
+		if err := os.Rename(tmpDir, storeDir); err != nil {
+			Fatalf("syncModuleStoreDir(): Error while renaming " + tmpDir + " to " + storeDir + " Error: " + err.Error())
+		}
+	} else {
+		// mark the module store directory as recently used for purgeModuleStore()
+		now := time.Now()
+		os.Chtimes(storeDir, now, now)
+	}
+
+	if config.DedupModulesMode == "hardlink" || config.DedupModulesMode == "copy" {
+		dir := filepath.Clean(targetDir)
+		purgeDir(dir, "syncModuleStoreDir(), to populate it from "+storeDir)
+		checkDirAndCreate(dir, "syncModuleStoreDir()")
+		if len(config.CopyStrategy) > 0 {
+			return populateModuleDir(ctx, srcDir, storeDir, dir, commitHash, allowFail, ignoreUnreachable, timeout, st)
+		}
+		if config.DedupModulesMode == "copy" {
+			copyLocalDir(storeDir, dir)
+		} else {
+			linkModuleStoreDir(storeDir, dir)
+		}
+		return true
+	}
+
+	link := filepath.Clean(targetDir)
+	purgeDir(link, "syncModuleStoreDir(), to replace it with a symlink to "+storeDir)
+	checkDirAndCreate(filepath.Dir(link), "syncModuleStoreDir()")
+	if err := os.Symlink(storeDir, link); err != nil {
+		Fatalf("syncModuleStoreDir(): Error while creating symlink " + link + " pointing to " + storeDir + " Error: " + err.Error())
+	}
+	return true
+}
+
+// linkModuleStoreDir recreates the module store directory storeDir in targetDir with hardlinks to its files
+// the files get copied if they can not be hardlinked, e.g. because the module store is on another filesystem
+func linkModuleStoreDir(storeDir string, targetDir string) {
+	err := filepath.Walk(storeDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(storeDir, path)
+		if relPath == "." {
+			return nil
+		}
+		target := filepath.Join(targetDir, relPath)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := os.Link(path, target); err != nil {
+				Debugf("Copying " + path + " to " + target + ", because it could not be hardlinked. Error: " + err.Error())
+				if err := moveFile(path, target, false); err != nil {
+					return err
+				}
+				return os.Chmod(target, info.Mode())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Fatalf("linkModuleStoreDir(): Error while hardlinking module store directory " + storeDir + " to " + targetDir + " Error: " + err.Error())
+	}
+}
+
+// purgeModuleStore removes the module store directories which are not linked from any environment of the given basedirs anymore
+func purgeModuleStore(basedirs []string) {
+	linked := make(map[string]bool)
+	for _, basedir := range basedirs {
+		filepath.Walk(basedir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if link, err := os.Readlink(path); err == nil && strings.HasPrefix(link, config.ModuleStoreDir) {
+					linked[filepath.Clean(link)] = true
+				}
+			}
+			return nil
+		})
+	}
+
+	storeDirs, err := ioutil.ReadDir(config.ModuleStoreDir)
+	if err != nil {
+		Warnf("purgeModuleStore(): WARN: Could not read module store " + config.ModuleStoreDir + " Error: " + err.Error())
+		return
+	}
+	for _, storeDir := range storeDirs {
+		dir := filepath.Join(config.ModuleStoreDir, storeDir.Name())
+		if linked[dir] || time.Since(storeDir.ModTime()) < moduleStoreGracePeriod {
+			continue
+		}
+		Infof("Removing unused module store directory " + dir)
+		if !dryRun {
+			purgeDir(dir, "purgeModuleStore()")
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ModuleUsage is a module of the Puppetfile of an environment which matches the module queried with -moduleusage
+type ModuleUsage struct {
+	environment string
+	module      string
+	source      string
+	ref         string
+}
+
+// matchesModuleUsageName returns true if the queried name is the name of the git module, its target name or its git repository url with or without .git suffix
+func matchesModuleUsageName(name string, gitName string, gm GitModule) bool {
+	if name == gitName || (len(gm.targetName) > 0 && name == gm.targetName) {
+		return true
+	}
+	if len(gm.git) == 0 {
+		return false
+	}
+	url := strings.TrimSuffix(strings.TrimSuffix(gm.git, "/"), ".git")
+	return name == gm.git || name == url || name == path.Base(url)
+}
+
+// matchesForgeModuleUsageName returns true if the queried name is the name of the Forge module with or without its author, e.g. stdlib, puppetlabs-stdlib or puppetlabs/stdlib
+func matchesForgeModuleUsageName(name string, fm ForgeModule) bool {
+	return name == fm.name || name == fm.author+"-"+fm.name || name == fm.author+"/"+fm.name
+}
+
+// describeGitModuleRef returns which ref of the git module the Puppetfile uses, e.g. tag v1.0.0
+func describeGitModuleRef(gm GitModule) string {
+	switch {
+	case gm.local:
+		return "local"
+	case len(gm.localPath) > 0:
+		return "local path " + gm.localPath
+	case len(gm.tarball) > 0:
+		return "tarball " + gm.tarball
+	case gm.link:
+		return "control repository branch"
+	case len(gm.commit) > 0:
+		return "commit " + gm.commit
+	case len(gm.tag) > 0:
+		return "tag " + gm.tag
+	case len(gm.ref) > 0:
+		return "ref " + gm.ref
+	case len(gm.branch) > 0:
+		return "branch " + gm.branch
+	}
+	return "default branch"
+}
+
+// getModuleUsages parses the Puppetfiles of all branches of all cached control repositories and returns every module matching name sorted by environment
+// only the cached control repositories get read, so sources which were never deployed or warmed with -warmcache are skipped
+func getModuleUsages(name string) []ModuleUsage {
+	usages := []ModuleUsage{}
+	sources := []string{}
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		sa := config.Sources[source]
+		workDir := config.EnvCacheDir + source + ".git"
+		if !isDir(workDir) {
+			Warnf("WARN: Skipping source " + source + ", because its control repository " + sa.Remote + " is not cached yet in " + workDir)
+			continue
+		}
+		for _, branch := range getCachedControlRepoBranches(workDir, sa) {
+			puppetfile, ok := readCachedPuppetfile(workDir, branch, source, sa)
+			if !ok {
+				continue
+			}
+			env := resolveSourcePrefix(source, sa) + branch
+			for gitName, gm := range puppetfile.gitModules {
+				if matchesModuleUsageName(name, gitName, gm) {
+					repo := gm.git
+					if len(repo) == 0 {
+						repo = "-"
+					}
+					usages = append(usages, ModuleUsage{environment: env, module: gitName, source: repo, ref: describeGitModuleRef(gm)})
+				}
+			}
+			for forgeName, fm := range puppetfile.forgeModules {
+				if matchesForgeModuleUsageName(name, fm) {
+					usages = append(usages, ModuleUsage{environment: env, module: forgeName, source: "forge " + fm.author + "-" + fm.name, ref: "version " + fm.version})
+				}
+			}
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].environment != usages[j].environment {
+			return usages[i].environment < usages[j].environment
+		}
+		return usages[i].module < usages[j].module
+	})
+	return usages
+}
+
+// printModuleUsage prints every environment which uses the module name and at which ref to w
+// it returns false if no environment uses the module
+func printModuleUsage(w io.Writer, name string) bool {
+	usages := getModuleUsages(name)
+	if len(usages) == 0 {
+		fmt.Fprintln(w, "Module "+name+" is not used by any environment")
+		return false
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENVIRONMENT\tMODULE\tSOURCE\tREF")
+	for _, mu := range usages {
+		fmt.Fprintln(tw, mu.environment+"\t"+mu.module+"\t"+mu.source+"\t"+mu.ref)
+	}
+	tw.Flush()
+	return true
+}
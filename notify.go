@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notificationOnce makes sure that only one notification gets sent per g10k run, even if multiple goroutines fail
+var notificationOnce sync.Once
+
+// Notification is the JSON body that gets POSTed to the notify_url after each g10k run
+type Notification struct {
+	Success        bool                      `json:"success"`
+	Error          string                    `json:"error,omitempty"`
+	Duration       float64                   `json:"duration"`
+	Environments   []EnvironmentNotification `json:"environments"`
+	GitVersion     string                    `json:"git_version,omitempty"`
+	SlowestModules []ModuleTiming            `json:"slowest_modules,omitempty"`
+	Masters        []MasterResult            `json:"masters,omitempty"`
+}
+
+// EnvironmentNotification contains the deploy result of a Puppet environment
+type EnvironmentNotification struct {
+	Name           string   `json:"name"`
+	Commit         string   `json:"commit"`
+	Success        bool     `json:"success"`
+	ChangedModules []string `json:"changed_modules"`
+	PurgedPaths    []string `json:"purged_paths,omitempty"`
+}
+
+// DeployedEnvironment contains the directory and the deploy result of a Puppet environment that got synced
+type DeployedEnvironment struct {
+	workDir      string
+	deployResult DeployResult
+}
+
+// newNotification creates the Notification of the synced Puppet environments with the directories that needed to be synced
+func newNotification(success bool, errorMessage string, duration time.Duration, st *SyncStats) Notification {
+	n := Notification{Success: success, Error: errorMessage, Duration: duration.Seconds(), Environments: []EnvironmentNotification{}, GitVersion: gitVersion}
+	if slowestModules > 0 {
+		n.SlowestModules = st.getSlowestModules(slowestModules)
+	}
+	if masters := st.getMasterResults(); len(masters) > 0 {
+		n.Masters = masters
+	}
+	st.Lock()
+	defer st.Unlock()
+	envs := []string{}
+	for env := range st.deployedEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		de := st.deployedEnvironments[env]
+		en := EnvironmentNotification{Name: env, Commit: de.deployResult.Signature, Success: de.deployResult.DeploySuccess, ChangedModules: getChangedModules(de.workDir, st.needSyncDirs)}
+		if purgedPaths := getChangedModules(de.workDir, st.purgedPaths); len(purgedPaths) > 0 {
+			en.PurgedPaths = purgedPaths
+		}
+		n.Environments = append(n.Environments, en)
+	}
+	return n
+}
+
+// getChangedModules returns the sorted directories of needSyncDirs relative to the Puppet environment directory workDir
+func getChangedModules(workDir string, needSyncDirs []string) []string {
+	changedModules := []string{}
+	for _, dir := range needSyncDirs {
+		rel, err := filepath.Rel(workDir, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		changedModules = append(changedModules, rel)
+	}
+	sort.Strings(changedModules)
+	return changedModules
+}
+
+// sendNotification POSTs the result of this g10k run to the notify_url if it is configured
+// a failed notification only results in a warning and never fails the deploy
+func sendNotification(success bool, errorMessage string) {
+	if len(config.NotifyURL) == 0 {
+		return
+	}
+	notificationOnce.Do(func() {
+		n := newNotification(success, errorMessage, time.Since(runStartedAt), syncStats)
+		body, err := json.Marshal(n)
+		if err != nil {
+			Warnf("sendNotification(): WARN: Could not create JSON body for " + config.NotifyURL + " Error: " + err.Error())
+			return
+		}
+		req, err := http.NewRequest("POST", config.NotifyURL, bytes.NewReader(body))
+		if err != nil {
+			Warnf("sendNotification(): WARN: Could not create request for " + config.NotifyURL + " Error: " + err.Error())
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+		if len(config.NotifyAuthHeader) > 0 {
+			req.Header.Set("Authorization", config.NotifyAuthHeader)
+		}
+		proxyURL, err := http.ProxyFromEnvironment(req)
+		if err != nil {
+			Warnf("sendNotification(): WARN: Error while getting http proxy with golang http.ProxyFromEnvironment() " + err.Error())
+			return
+		}
+		client := &http.Client{Timeout: time.Duration(config.Timeout) * time.Second, Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Do(req)
+		if err != nil {
+			Warnf("sendNotification(): WARN: Could not send notification to " + config.NotifyURL + " Error: " + err.Error())
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			Warnf("sendNotification(): WARN: Notification to " + config.NotifyURL + " returned HTTP status code " + strconv.Itoa(resp.StatusCode))
+			return
+		}
+		Debugf("Sent notification to " + config.NotifyURL)
+	})
+}
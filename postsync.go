@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// runPostSync runs the :post_sync command of the git module gitName of the environment env in its module directory targetDir after it got synced
+// if the command fails the module directory gets removed, so that the next run syncs the module and runs the command again
+// it returns false if the command failed and ignoreUnreachable, the :ignore_unreachable of the module in the Puppetfile, is set and exits otherwise
+func runPostSync(gitName string, gitModule GitModule, targetDir string, env string, ignoreUnreachable bool) bool {
+	if dryRun {
+		Debugf("Not running post_sync " + gitModule.postSync + " of module " + gitName + " in " + targetDir + ", because of -dryrun")
+		return true
+	}
+	if len(config.RemoteDeploy.Host) > 0 {
+		Warnf("WARN: Not running post_sync " + gitModule.postSync + " of module " + gitName + ", because its module directory " + targetDir + " is on the remote_deploy host " + config.RemoteDeploy.Host)
+		return true
+	}
+	command := "sh -c " + shellquote.Join("cd "+shellquote.Join(targetDir)+" && "+gitModule.postSync)
+	er := executeCommand(runContext, command, config.Timeout, true)
+	if er.returnCode == 0 {
+		Debugf("post_sync " + gitModule.postSync + " of module " + gitName + " in " + targetDir + " succeeded")
+		return true
+	}
+	purgeDir(targetDir, "runPostSync(), because the post_sync of the module failed")
+	message := "post_sync " + gitModule.postSync + " of module " + gitName + " of environment " + env + " failed with exit code " + strconv.Itoa(er.returnCode) + " Output: " + strings.TrimSpace(er.output+er.stderr)
+	if ignoreUnreachable {
+		Warnf("WARN: " + message + ", but ignore-unreachable is set. Continuing...")
+		return false
+	}
+	Fatalf("Error: " + message)
+	return false
+}
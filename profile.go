@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+)
+
+// FunctionProfile contains the number of calls and the total duration of a function tracked with timeTrack()
+type FunctionProfile struct {
+	calls int
+	total float64
+}
+
+var (
+	functionProfiles      = make(map[string]*FunctionProfile)
+	functionProfilesMutex sync.Mutex
+)
+
+// addFunctionProfile adds a call of the function name which took duration seconds to the -profile report
+func addFunctionProfile(name string, duration float64) {
+	functionProfilesMutex.Lock()
+	fp, ok := functionProfiles[name]
+	if !ok {
+		fp = &FunctionProfile{}
+		functionProfiles[name] = fp
+	}
+	fp.calls++
+	fp.total += duration
+	functionProfilesMutex.Unlock()
+}
+
+// printProfile prints the calls and durations of all functions tracked with timeTrack(), sorted by total duration
+func printProfile() {
+	functionProfilesMutex.Lock()
+	defer functionProfilesMutex.Unlock()
+	names := []string{}
+	for name := range functionProfiles {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if functionProfiles[names[i]].total == functionProfiles[names[j]].total {
+			return names[i] < names[j]
+		}
+		return functionProfiles[names[i]].total > functionProfiles[names[j]].total
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FUNCTION\tCALLS\tTOTAL\tAVG")
+	for _, name := range names {
+		fp := functionProfiles[name]
+		fmt.Fprintln(w, name+"\t"+strconv.Itoa(fp.calls)+"\t"+strconv.FormatFloat(fp.total, 'f', 3, 64)+"s\t"+strconv.FormatFloat(fp.total/float64(fp.calls), 'f', 3, 64)+"s")
+	}
+	w.Flush()
+}
+
+// startCPUProfile writes a pprof CPU profile to file until the returned function gets called
+func startCPUProfile(file string) func() {
+	f, err := os.Create(file)
+	if err != nil {
+		Fatalf("startCPUProfile(): Error while creating CPU profile " + file + " Error: " + err.Error())
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		Fatalf("startCPUProfile(): Error while starting CPU profile " + file + " Error: " + err.Error())
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+	}
+}
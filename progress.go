@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/xorpaul/uiprogress"
+)
+
+// ModuleProgress counts the git and Forge modules resolved by resolveModules() and shows them in a progress bar
+// the count and the bar get updated together under the lock, so that the displayed count only increases and ends at the number of resolved modules
+type ModuleProgress struct {
+	sync.Mutex
+	bar      *uiprogress.Bar
+	total    int
+	resolved int
+}
+
+// moduleProgress is the progress of the last resolveModules() run
+var moduleProgress *ModuleProgress
+
+// newModuleProgress adds the progress bar for total git and Forge modules, which gets rendered once uiprogress got started
+func newModuleProgress(total int) *ModuleProgress {
+	mp := &ModuleProgress{total: total}
+	mp.bar = uiprogress.AddBar(total).AppendCompleted().PrependElapsed()
+	mp.bar.PrependFunc(func(b *uiprogress.Bar) string {
+		return fmt.Sprintf("Resolving Git and Forge modules (%d/%d)", b.Current(), total)
+	})
+	return mp
+}
+
+// resolve counts another resolved module and advances the bar to the new count
+func (mp *ModuleProgress) resolve() {
+	mp.Lock()
+	defer mp.Unlock()
+	if mp.resolved >= mp.total {
+		return
+	}
+	mp.resolved++
+	mp.bar.Incr()
+}
+
+// getResolved returns the number of resolved modules
+func (mp *ModuleProgress) getResolved() int {
+	mp.Lock()
+	defer mp.Unlock()
+	return mp.resolved
+}
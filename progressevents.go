@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProgressEvent is a line of the -progressfd output, which reports the progress of the sync to a wrapping tool instead of the progress bar
+type ProgressEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Module      string    `json:"module,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Success     *bool     `json:"success,omitempty"`
+}
+
+// progressEvents contains the file descriptor to which the progress events get written
+// and the module directories which need to be synced, so that a finished module can be reported as synced or skipped
+var progressEvents = struct {
+	sync.Mutex
+	file    *os.File
+	syncing map[string]bool
+}{}
+
+// openProgressEvents uses the already open file descriptor fd of the calling process for the progress events
+func openProgressEvents(fd int) {
+	progressEvents.Lock()
+	defer progressEvents.Unlock()
+	f := os.NewFile(uintptr(fd), "progress fd "+strconv.Itoa(fd))
+	if f == nil {
+		Fatalf("Error: Invalid value " + strconv.Itoa(fd) + " of parameter -progressfd")
+	}
+	if _, err := f.Stat(); err != nil {
+		Fatalf("Error: -progressfd " + strconv.Itoa(fd) + " is not an open file descriptor Error: " + err.Error())
+	}
+	progressEvents.file = f
+	progressEvents.syncing = make(map[string]bool)
+}
+
+// isProgressEventsEnabled returns true if the progress gets written to a file descriptor instead of shown in the progress bar
+func isProgressEventsEnabled() bool {
+	progressEvents.Lock()
+	defer progressEvents.Unlock()
+	return progressEvents.file != nil
+}
+
+// writeProgressEvent writes the event as JSON line to the -progressfd file descriptor
+// the events get disabled after the first failed write, e.g. because the reading end of the pipe got closed
+func writeProgressEvent(pe ProgressEvent) {
+	progressEvents.Lock()
+	defer progressEvents.Unlock()
+	writeProgressEventLocked(pe)
+}
+
+// writeProgressEventLocked must only be called while holding the lock
+func writeProgressEventLocked(pe ProgressEvent) {
+	if progressEvents.file == nil {
+		return
+	}
+	if pe.Time.IsZero() {
+		pe.Time = time.Now()
+	}
+	line, _ := json.Marshal(pe)
+	if _, err := progressEvents.file.Write(append(line, '\n')); err != nil {
+		Warnf("WARN: Could not write to " + progressEvents.file.Name() + ", not writing any further progress events Error: " + err.Error())
+		progressEvents.file = nil
+	}
+}
+
+// sendModuleStarted reports that the git repository or Forge module started to be fetched into the cachedir
+func sendModuleStarted(module string) {
+	writeProgressEvent(ProgressEvent{Event: "module_started", Module: module})
+}
+
+// sendModuleFetched reports that the git repository or Forge module got fetched into the cachedir
+func sendModuleFetched(module string, success bool) {
+	writeProgressEvent(ProgressEvent{Event: "module_fetched", Module: module, Success: &success})
+}
+
+// markModuleSyncing records that the module directory targetDir needs to be synced
+func markModuleSyncing(targetDir string) {
+	progressEvents.Lock()
+	defer progressEvents.Unlock()
+	if progressEvents.file == nil {
+		return
+	}
+	progressEvents.syncing[targetDir] = true
+}
+
+// sendModuleSynced reports that the module of the environment env in targetDir got synced or skipped, because it did not change
+func sendModuleSynced(module string, env string, targetDir string, success bool) {
+	progressEvents.Lock()
+	defer progressEvents.Unlock()
+	if progressEvents.file == nil {
+		return
+	}
+	event := "module_skipped"
+	if progressEvents.syncing[targetDir] || !success {
+		event = "module_synced"
+	}
+	delete(progressEvents.syncing, targetDir)
+	writeProgressEventLocked(ProgressEvent{Event: event, Module: module, Environment: env, Path: targetDir, Success: &success})
+}
+
+// sendEnvironmentComplete reports that all modules of the environment env got synced into its environment directory envDir
+func sendEnvironmentComplete(env string, envDir string, success bool) {
+	writeProgressEvent(ProgressEvent{Event: "environment_complete", Environment: env, Path: envDir, Success: &success})
+}
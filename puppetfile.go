@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,7 @@ func sourceSanityCheck(source string, sa Source) {
 		if _, err := os.Stat(sa.PrivateKey); err != nil {
 			Fatalf("resolvePuppetEnvironment(): could not find SSH private key " + sa.PrivateKey + " for source " + source + " in config file " + configFile + " Error: " + err.Error())
 		}
+		prepareSSHPrivateKey(sa.PrivateKey, "source "+source)
 	}
 	if len(sa.Basedir) <= 0 {
 		Fatalf("resolvePuppetEnvironment(): config setting basedir is not set for source " + source + " in config file " + configFile)
@@ -30,11 +33,86 @@ func sourceSanityCheck(source string, sa Source) {
 	}
 }
 
+// readEnvironmentsFile reads the newline separated environment names of the -environmentsfrom file, empty lines and lines starting with # are ignored
+func readEnvironmentsFile(file string) map[string]bool {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Fatalf("readEnvironmentsFile(): Error while reading environments file " + file + " Error: " + err.Error())
+	}
+	environments := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		environments[line] = true
+	}
+	if len(environments) == 0 {
+		Warnf("WARNING: environments file " + file + " does not contain any environment, nothing will be deployed")
+	}
+	return environments
+}
+
+// matchesEnvironmentFilter returns true if the branch of the source is selected by the -environment and -environmentsfrom parameters
+func matchesEnvironmentFilter(source string, branch string) bool {
+	if len(environmentParam) > 0 && source+"_"+branch != environmentParam {
+		return false
+	}
+	if environmentsFilter != nil && !environmentsFilter[source+"_"+branch] {
+		return false
+	}
+	return true
+}
+
+// environmentFilterActive returns true if only some environments get deployed because of the -environment or -environmentsfrom parameter
+// the other environments must not be purged by the deployment purge level in this case
+func environmentFilterActive() bool {
+	return len(environmentParam) > 0 || environmentsFilter != nil
+}
+
+// checkEnvironmentsFilterMatches warns about or with -strictenvironments fails for each environment of the -environmentsfrom file which could not be found in any source
+func checkEnvironmentsFilterMatches(matchedEnvironments map[string]bool) {
+	missing := []string{}
+	for env := range environmentsFilter {
+		if !matchedEnvironments[env] {
+			missing = append(missing, env)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	sort.Strings(missing)
+	if strictEnvironments {
+		Fatalf("resolvePuppetEnvironment(): Error: Environments " + strings.Join(missing, ", ") + " of the environments file " + environmentsFromParam + " cannot be found in any source")
+	}
+	for _, env := range missing {
+		Warnf("WARNING: Environment '" + env + "' of the environments file " + environmentsFromParam + " cannot be found in any source and will not be deployed.")
+	}
+}
+
+// checkEmptyEnvironments warns about or with empty_environments fail exits before any module gets synced if an environment has no Puppetfile or its Puppetfile does not contain any module
+// a broken Puppetfile would otherwise purge all modules of the environment
+func checkEmptyEnvironments(emptyEnvironments []string) {
+	if len(emptyEnvironments) == 0 || len(config.EmptyEnvironments) == 0 || config.EmptyEnvironments == "ignore" {
+		return
+	}
+	sort.Strings(emptyEnvironments)
+	if config.EmptyEnvironments == "fail" {
+		Fatalf("resolvePuppetEnvironment(): Error: Environments " + strings.Join(emptyEnvironments, ", ") + " would not contain any module, empty_environments is set to fail")
+	}
+	for _, env := range emptyEnvironments {
+		Warnf("WARNING: Environment '" + env + "' does not contain any module, because it has no Puppetfile or its Puppetfile is empty")
+	}
+}
+
 func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string) {
 	wg := sizedwaitgroup.New(config.MaxExtractworker + 1)
 	allPuppetfiles := make(map[string]Puppetfile)
 	allEnvironments := make(map[string]bool)
 	allBasedirs := make(map[string]bool)
+	matchedEnvironments := make(map[string]bool)
+	filteredEnvironments := make(map[string]bool)
+	emptyEnvironments := []string{}
 	for source, sa := range config.Sources {
 		wg.Add()
 		go func(source string, sa Source) {
@@ -44,6 +122,7 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 			}
 
 			sa.Basedir = checkDirAndCreate(sa.Basedir, "basedir for source "+source)
+			checkFreeDiskSpace(sa.Basedir)
 			Debugf("Puppet environment: " + source + " (" + fmt.Sprintf("%+v", sa) + ")")
 
 			// check for a valid source that has all necessary attributes (basedir, remote, SSH key exist if given)
@@ -53,15 +132,35 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 			// check if sa.Basedir exists
 			checkDirAndCreate(sa.Basedir, "basedir")
 
-			if success := doMirrorOrUpdate(sa.Remote, workDir, sa.PrivateKey, true, 1); success {
+			controlRepo := GitModule{git: sa.Remote, privateKey: sa.PrivateKey, ignoreUnreachable: true}
+			// a full ref path like refs/pull/42/head deploys a pull request, whose namespace must be fetched as well
+			refspec := getRefNamespaceFetchRefspec(envBranch)
+			if len(refspec) > 0 {
+				controlRepo.fetchRefspecs = []string{refspec}
+			}
+			if success := doMirrorOrUpdate(runContext, controlRepo, workDir, getGitRetryCount(), syncStats); success {
 
-				// get all branches
-				er := executeCommand("git --git-dir "+workDir+" branch", config.Timeout, false)
-				outputBranches := er.output
+				// get all branches or only the requested one to skip the discovery of all other branches
+				branchFilter := ""
+				if len(envBranch) > 0 {
+					branchFilter = " --list '" + envBranch + "'"
+				}
+				outputBranches := ""
+				if len(refspec) > 0 {
+					if executeCommand(runContext, "git --git-dir "+workDir+" rev-parse --verify --quiet '"+envBranch+"^{commit}'", config.Timeout, true).returnCode == 0 {
+						outputBranches = envBranch + "\n"
+					}
+				} else {
+					outputBranches = executeCommand(runContext, "git --git-dir "+workDir+" branch"+branchFilter, config.Timeout, false).output
+				}
 				outputTags := ""
 
 				if tags == true {
-					er := executeCommand("git --git-dir "+workDir+" tag", config.Timeout, false)
+					er := executeCommand(runContext, "git --git-dir "+workDir+" tag"+branchFilter, config.Timeout, false)
+					outputTags = er.output
+				} else if len(sa.TagPattern) > 0 && len(refspec) == 0 {
+					// the tags matching tag_pattern become environments just like the branches, the requested branch is filtered below
+					er := executeCommand(runContext, "git --git-dir "+workDir+" tag --list '"+sa.TagPattern+"'", config.Timeout, false)
 					outputTags = er.output
 				}
 
@@ -82,6 +181,18 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 						Debugf("Skipping branch " + branch + " of source " + source + ", because of invalid character(s) inside the branch name")
 						continue
 					}
+					if !matchesBranchRegexes(sa, branch) {
+						Debugf("Skipping branch " + branch + " of source " + source + ", because it does not match branch_include_regex or matches branch_exclude_regex")
+						// a previously deployed environment of a filtered branch is left alone by the deployment purge
+						filteredEnv := strings.Replace(branch, "/", "_", -1)
+						if sa.AutoCorrectEnvironmentNames == "correct" || sa.AutoCorrectEnvironmentNames == "correct_and_warn" {
+							filteredEnv = reInvalidCharacters.ReplaceAllString(branch, "_")
+						}
+						mutex.Lock()
+						filteredEnvironments[prefix+filteredEnv] = true
+						mutex.Unlock()
+						continue
+					}
 					if len(envBranch) > 0 {
 						if branch == envBranch {
 							foundBranch = true
@@ -89,11 +200,14 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 							Debugf("Environment " + prefix + branch + " of source " + source + " does not match branch name filter '" + envBranch + "', skipping")
 							continue
 						}
-					} else if len(environmentParam) > 0 {
-						if source+"_"+branch == environmentParam {
+					} else if environmentFilterActive() {
+						if matchesEnvironmentFilter(source, branch) {
 							foundMatch = true
+							mutex.Lock()
+							matchedEnvironments[source+"_"+branch] = true
+							mutex.Unlock()
 						} else {
-							Debugf("Environment " + prefix + branch + " of source " + source + " does not match environment name filter '" + environmentParam + "', skipping")
+							Debugf("Environment " + prefix + branch + " of source " + source + " does not match environment name filter, skipping")
 							continue
 						}
 					}
@@ -127,29 +241,97 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 							targetDir = normalizeDir(targetDir)
 
 							env := strings.Replace(strings.Replace(targetDir, sa.Basedir, "", 1), "/", "", -1)
-							syncToModuleDir(workDir, targetDir, branch, false, false, env, true)
 							pf := filepath.Join(targetDir, "Puppetfile")
-							deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
+							deployFile := getDeployFile(targetDir)
+							skipEnvironment := false
+							if isDeployLocked(targetDir) {
+								Warnf("WARN: Skipping environment " + source + "_" + branch + ", because it is locked by " + filepath.Join(targetDir, deployLockFile) + ", remove it or use -force to deploy the environment")
+								skipEnvironment = true
+							} else if onlyNew && isDir(targetDir) && fileExists(deployFile) {
+								Infof("Skipping existing environment " + source + "_" + branch + ", because -onlynew is set")
+								skipEnvironment = true
+							}
+							if skipEnvironment {
+								// keep the whole environment, so that neither the deployment nor the environment purge touches it
+								syncStats.addDesiredContent(targetDir)
+								mutex.Lock()
+								allEnvironments[env] = true
+								allBasedirs[sa.Basedir] = true
+								mutex.Unlock()
+								return
+							}
+							// the version ranges of Forge modules are resolved to the versions of the previous deploy, which syncing the control repository overwrites
+							var previousDeploy DeployResult
+							if fileExists(deployFile) {
+								previousDeploy = readDeployResultFile(deployFile)
+							}
+							if config.CompactDeployMetadata {
+								loadCompactModuleCommits(targetDir, previousDeploy)
+							}
+							// with atomic_deploy the environment gets built in a staging directory, which replaces targetDir after all its modules got synced
+							syncDir := targetDir
+							if isAtomicDeploy() {
+								syncDir = startAtomicEnvironment(env, targetDir)
+								pf = filepath.Join(syncDir, "Puppetfile")
+							}
+							syncToModuleDir(runContext, workDir, syncDir, branch, false, false, env, true, 0, syncStats)
 							if !fileExists(pf) {
 								Debugf("Skipping branch " + source + "_" + branch + " because " + targetDir + "Puppetfile does not exist")
-							} else {
-								if fileExists(deployFile) {
-									pfHashSum := getSha256sumFile(pf)
-									dr := readDeployResultFile(deployFile)
-									if pfHashSum == dr.PuppetfileChecksum && dr.DeploySuccess {
-										Infof("Skipping Puppetfile sync of branch " + source + "_" + branch + " because " + targetDir + "Puppetfile did not change")
-										dr.FinishedAt = time.Now()
-										writeStructJSONFile(deployFile, dr)
-									}
+								if isAtomicDeploy() {
+									validateAtomicEnvironment(env)
+									finishAtomicEnvironment(env, syncStats)
 								}
+								mutex.Lock()
+								emptyEnvironments = append(emptyEnvironments, env)
+								mutex.Unlock()
+							} else {
 								puppetfile := readPuppetfile(pf, sa.PrivateKey, source, sa.ForceForgeVersions, false)
-								puppetfile.workDir = normalizeDir(targetDir)
+								puppetfile = addGlobalModules(puppetfile, pf)
+								puppetfile.workDir = normalizeDir(syncDir)
 								puppetfile.controlRepoBranch = branch
+								puppetfile.previousForgeVersions = previousDeploy.ForgeVersions
 								mutex.Lock()
+								if len(puppetfile.gitModules) == 0 && len(puppetfile.forgeModules) == 0 {
+									emptyEnvironments = append(emptyEnvironments, env)
+								}
 								for _, moduleDir := range puppetfile.moduleDirs {
-									desiredContent = append(desiredContent, filepath.Join(puppetfile.workDir, moduleDir))
+									syncStats.addDesiredContent(filepath.Join(puppetfile.workDir, moduleDir))
+								}
+								// a staging directory only contains the control repository and needs all modules
+								if !isAtomicDeploy() && incremental && len(moduleParam) == 0 && !puppetfileChangedSinceDeploy(workDir, previousDeploy, branch) {
+									Infof("Skipping Puppetfile resolution of branch " + source + "_" + branch + " because its Puppetfile did not change since the last successful deploy of commit " + previousDeploy.Signature)
+									if !dryRun {
+										dr := readDeployResultFile(deployFile)
+										dr.DeploySuccess = true
+										dr.FinishedAt = time.Now()
+										dr.Labels = deployLabels
+										dr.PuppetfileChecksum = getSha256sumFile(pf)
+										if config.CompactDeployMetadata {
+											dr.ModuleCommits = previousDeploy.ModuleCommits
+										}
+										writeStructJSONFile(deployFile, dr)
+									}
+								} else if !isAtomicDeploy() && isPinnedPuppetfileUnchanged(pf, previousDeploy, puppetfile) {
+									Infof("Skipping Puppetfile resolution of branch " + source + "_" + branch + " because " + targetDir + "Puppetfile did not change since the last successful deploy and all its modules are pinned to tags, full commit hashes or exact Forge versions")
+									if !dryRun {
+										// syncing the control repository overwrote the deploy file
+										dr := readDeployResultFile(deployFile)
+										dr.DeploySuccess = true
+										dr.FinishedAt = time.Now()
+										dr.Labels = deployLabels
+										dr.PuppetfileChecksum = previousDeploy.PuppetfileChecksum
+										dr.ForgeVersions = previousDeploy.ForgeVersions
+										dr.ForgeToGit = previousDeploy.ForgeToGit
+										if config.CompactDeployMetadata {
+											dr.ModuleCommits = previousDeploy.ModuleCommits
+										}
+										writeStructJSONFile(deployFile, dr)
+									}
+								} else if commit, ok := resumedRunState("environment", env); ok && !isAtomicDeploy() && fileExists(deployFile) && readDeployResultFile(deployFile).Signature == commit {
+									Infof("Skipping Puppetfile resolution of branch " + source + "_" + branch + ", because it was already synced to commit " + commit + " by the interrupted g10k run")
+								} else {
+									allPuppetfiles[env] = puppetfile
 								}
-								allPuppetfiles[env] = puppetfile
 								allEnvironments[env] = true
 								allBasedirs[sa.Basedir] = true
 								mutex.Unlock()
@@ -169,7 +351,7 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 				}
 			} else {
 				Warnf("WARNING: Could not resolve git repository in source '" + source + "' (" + sa.Remote + ")")
-				if sa.ExitIfUnreachable == true {
+				if sa.ExitIfUnreachable == true || failFast {
 					os.Exit(1)
 				}
 			}
@@ -177,16 +359,40 @@ func resolvePuppetEnvironment(envBranch string, tags bool, outputNameTag string)
 	}
 
 	wg.Wait()
+	if environmentsFilter != nil {
+		checkEnvironmentsFilterMatches(matchedEnvironments)
+	}
+	checkEmptyEnvironments(emptyEnvironments)
 	//fmt.Println("allPuppetfiles: ", allPuppetfiles, len(allPuppetfiles))
 	//fmt.Println("allPuppetfiles[0]: ", allPuppetfiles["postinstall"])
 	resolvePuppetfile(allPuppetfiles)
+	if isAtomicDeploy() {
+		rollbackAtomicEnvironments()
+	}
 	//fmt.Println(desiredContent)
-	purgeUnmanagedContent(envBranch, allBasedirs, allEnvironments)
+	purgeUnmanagedContent(envBranch, allBasedirs, allEnvironments, filteredEnvironments)
+	if config.ContentHash && !dryRun && !shutdownRequested() {
+		writeContentHashes(allPuppetfiles, syncStats)
+	}
+	if config.DedupModules && !shutdownRequested() {
+		basedirs := []string{}
+		for _, sa := range config.Sources {
+			basedirs = append(basedirs, sa.Basedir)
+		}
+		purgeModuleStore(basedirs)
+	}
 }
 
-func purgeUnmanagedContent(envBranch string, allBasedirs map[string]bool, allEnvironments map[string]bool) {
+// purgeUnmanagedContent removes the environments in allBasedirs which do not belong to any branch and the stale content of the environments in allEnvironments
+// the environments in filteredEnvironments belong to branches skipped by branch_include_regex or branch_exclude_regex and are kept as they are
+func purgeUnmanagedContent(envBranch string, allBasedirs map[string]bool, allEnvironments map[string]bool, filteredEnvironments map[string]bool) {
+	defer timeTrack(time.Now(), funcName())
+	if shutdownRequested() {
+		// the desired content is incomplete, because g10k stopped syncing
+		return
+	}
 	if !stringSliceContains(config.PurgeLevels, "deployment") {
-		if !stringSliceContains(config.PurgeLevels, "environment") {
+		if !stringSliceContains(config.PurgeLevels, "environment") && !environmentPurgeLevelsContain("strict") {
 			// nothing allowed to purge
 			return
 		}
@@ -201,29 +407,19 @@ func purgeUnmanagedContent(envBranch string, allBasedirs map[string]bool, allEnv
 				Debugf("Glob'ing with path " + globPath)
 				environments, _ := filepath.Glob(globPath)
 
-				whitelistEnvironments := []string{}
-				if len(config.DeploymentPurgeWhitelist) > 0 {
-					for _, wlpattern := range config.DeploymentPurgeWhitelist {
-						whitelistGlobPath := filepath.Join(basedir, wlpattern)
-						Debugf("deployment_purge_whitelist Glob'ing with path " + whitelistGlobPath)
-						we, _ := filepath.Glob(whitelistGlobPath)
-						whitelistEnvironments = append(whitelistEnvironments, we...)
-					}
-				}
-
 				for _, env := range environments {
 					envPath := strings.Split(env, "/")
 					envName := envPath[len(envPath)-1]
-					if stringSliceContains(config.PurgeLevels, "environment") {
-						if allEnvironments[envName] {
-							checkForStaleContent(env)
-						}
+					if allEnvironments[envName] && purgeEnvironmentContent(envName) {
+						checkForStaleContent(env, syncStats)
 					}
-					if stringSliceContains(config.PurgeLevels, "deployment") {
+					if stringSliceContains(config.PurgeLevels, "deployment") && !environmentFilterActive() {
 						Debugf("Checking if environment should exist: " + envName)
 						if allEnvironments[envName] {
 							Debugf("Not purging environment " + envName)
-						} else if stringSliceContains(whitelistEnvironments, filepath.Join(basedir, envName)) {
+						} else if filteredEnvironments[envName] {
+							Debugf("Not purging environment " + envName + ", because its branch is filtered by branch_include_regex or branch_exclude_regex")
+						} else if isDeploymentPurgeWhitelisted(basedir, envName) {
 							Debugf("Not purging environment " + envName + " due to deployment_purge_whitelist match")
 						} else {
 							Infof("Removing unmanaged environment " + envName)
@@ -235,34 +431,232 @@ func purgeUnmanagedContent(envBranch string, allBasedirs map[string]bool, allEnv
 				}
 			}
 		} else {
-			if stringSliceContains(config.PurgeLevels, "environment") {
+			if purgeEnvironmentContent(prefix + envBranch) {
 				// check for purgeable content inside -branch folder
-				checkForStaleContent(filepath.Join(sa.Basedir, prefix+envBranch))
+				checkForStaleContent(filepath.Join(sa.Basedir, prefix+envBranch), syncStats)
 			}
 		}
 	}
 }
 
-func checkForStaleContent(workDir string) {
-	// add purge whitelist
-	if len(config.PurgeWhitelist) > 0 {
-		Debugf("additional purge whitelist items: " + strings.Join(config.PurgeWhitelist, " "))
-		for _, wlItem := range config.PurgeWhitelist {
-			desiredContent = append(desiredContent, filepath.Join(workDir, wlItem))
+// isDeploymentPurgeWhitelisted returns true if the directory envName in basedir matches one of the deployment_purge_whitelist patterns
+// and therefore must not be purged by the deployment purge level, even if it does not belong to a branch
+func isDeploymentPurgeWhitelisted(basedir string, envName string) bool {
+	for _, wlpattern := range config.DeploymentPurgeWhitelist {
+		// the patterns are relative to the basedir like the environment directories
+		if matched, _ := filepath.Match(filepath.Join(basedir, wlpattern), filepath.Join(basedir, envName)); matched {
+			Debugf("Directory " + envName + " in " + basedir + " matches the deployment_purge_whitelist pattern " + wlpattern)
+			return true
 		}
 	}
+	return false
+}
 
-	checkForStaleContent := func(path string, info os.FileInfo, err error) error {
-		stale := true
-		for _, desiredFile := range desiredContent {
-			if strings.HasPrefix(path, desiredFile) || path == workDir {
-				stale = false
+// getEnvironmentPurgeLevel returns the purge level of the environment from the setting environment_purge_levels
+// an exact environment name takes precedence over the longest matching pattern, unmatched environments use the purge level whitelist
+func getEnvironmentPurgeLevel(env string) string {
+	if level, ok := config.EnvironmentPurgeLevels[env]; ok {
+		return level
+	}
+	matchedPattern := ""
+	for pattern := range config.EnvironmentPurgeLevels {
+		if matched, _ := filepath.Match(pattern, env); matched {
+			if len(pattern) > len(matchedPattern) || len(pattern) == len(matchedPattern) && pattern < matchedPattern {
+				matchedPattern = pattern
+			}
+		}
+	}
+	if len(matchedPattern) > 0 {
+		return config.EnvironmentPurgeLevels[matchedPattern]
+	}
+	return "whitelist"
+}
+
+// environmentPurgeLevelsContain returns true if any environment name pattern of the setting environment_purge_levels uses the purge level
+func environmentPurgeLevelsContain(level string) bool {
+	for _, l := range config.EnvironmentPurgeLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeEnvironmentContent returns true if the unmanaged content inside the environment should be purged
+// which the purge level strict always does, the purge level none never does and otherwise the purge level environment decides
+func purgeEnvironmentContent(env string) bool {
+	switch getEnvironmentPurgeLevel(env) {
+	case "none":
+		Debugf("Not purging unmanaged content of environment " + env + ", because its environment_purge_levels is none")
+		return false
+	case "strict":
+		return true
+	}
+	return stringSliceContains(config.PurgeLevels, "environment")
+}
+
+// gcDeployMetadata removes the deploy files of environments whose branch does not exist anymore in their source
+// environments are only checked if all sources that deploy into the same basedir could be updated
+func gcDeployMetadata() int {
+	type sourceRefs struct {
+		prefix string
+		refs   map[string]bool
+	}
+	basedirSources := make(map[string][]sourceRefs)
+	unknownBasedirs := make(map[string]bool)
+	for source, sa := range config.Sources {
+		sourceSanityCheck(source, sa)
+		basedir := normalizeDir(sa.Basedir)
+		workDir := config.EnvCacheDir + source + ".git"
+		if !doMirrorOrUpdate(runContext, GitModule{git: sa.Remote, privateKey: sa.PrivateKey, ignoreUnreachable: true}, workDir, getGitRetryCount(), syncStats) {
+			Warnf("WARNING: Could not resolve git repository in source '" + source + "' (" + sa.Remote + "), not removing any deploy metadata in " + basedir)
+			unknownBasedirs[basedir] = true
+			continue
+		}
+		refs := make(map[string]bool)
+		// tags are always included, because an environment could have been deployed from a tag with -tags
+		er := executeCommand(runContext, "git --git-dir "+workDir+" branch", config.Timeout, false)
+		erTags := executeCommand(runContext, "git --git-dir "+workDir+" tag", config.Timeout, false)
+		for _, ref := range strings.Split(er.output+erTags.output, "\n") {
+			ref = strings.TrimLeft(strings.TrimSpace(ref), "* ")
+			if len(ref) > 0 {
+				refs[ref] = true
+			}
+		}
+		basedirSources[basedir] = append(basedirSources[basedir], sourceRefs{prefix: resolveSourcePrefix(source, sa), refs: refs})
+	}
+
+	removed := 0
+	for basedir, sources := range basedirSources {
+		if unknownBasedirs[basedir] {
+			continue
+		}
+		environments, _ := filepath.Glob(filepath.Join(basedir, "*"))
+		for _, env := range environments {
+			envName := filepath.Base(env)
+			deployFile := getDeployFile(env)
+			if !fileExists(deployFile) {
+				continue
+			}
+			dr := readDeployResultFile(deployFile)
+			managed := false
+			branchExists := false
+			for _, sr := range sources {
+				if strings.HasPrefix(envName, sr.prefix) {
+					managed = true
+					if sr.refs[dr.Name] {
+						branchExists = true
+					}
+				}
+			}
+			if !managed || branchExists {
+				continue
 			}
+			Infof("Removing deploy metadata of environment " + envName + ", because its branch " + dr.Name + " does not exist anymore")
+			removed++
+			if !dryRun {
+				for _, metadataFile := range []string{deployFile, getMetadataFile(env, ".g10k-deploy.json.dryrun"), getDryRunDeployFile(env)} {
+					if fileExists(metadataFile) {
+						purgeDir(metadataFile, "gcDeployMetadata()")
+					}
+				}
+			}
+		}
+	}
+	return removed
+}
+
+var (
+	globalModules     Puppetfile
+	globalModulesOnce sync.Once
+)
+
+// getGlobalModules returns the modules of the global_modules setting, which are parsed like the mod lines of a Puppetfile
+func getGlobalModules() Puppetfile {
+	globalModulesOnce.Do(func() {
+		lines := []string{}
+		for _, module := range config.GlobalModules {
+			lines = append(lines, strings.Join(strings.Fields(module), " "))
+		}
+		globalModules = readPuppetfile(strings.Join(lines, "\n"), "", "global_modules", false, true)
+	})
+	return globalModules
+}
+
+// addGlobalModules adds the modules of the global_modules setting to the first module directory of the Puppetfile pf
+// modules which are declared in the Puppetfile itself take precedence over the global modules with the same name
+func addGlobalModules(puppetfile Puppetfile, pf string) Puppetfile {
+	if len(config.GlobalModules) == 0 {
+		return puppetfile
+	}
+	gm := getGlobalModules()
+	moduleDir := puppetfile.moduleDirs[0]
+	for name, gitModule := range gm.gitModules {
+		if puppetfile.declaresModule(name) {
+			Debugf("Not adding global git module " + name + " to " + pf + " because it is declared in the Puppetfile")
+			continue
+		}
+		gitModule.moduleDir = moduleDir
+		puppetfile.gitModules[name] = gitModule
+	}
+	for name, forgeModule := range gm.forgeModules {
+		if puppetfile.declaresModule(name) {
+			Debugf("Not adding global Forge module " + name + " to " + pf + " because it is declared in the Puppetfile")
+			continue
+		}
+		forgeModule.moduleDir = moduleDir
+		puppetfile.forgeModules[name] = forgeModule
+	}
+	checkModuleDirCollisions(puppetfile, pf)
+	checkModuleRefs(puppetfile, pf)
+	return puppetfile
+}
+
+// declaresModule returns true if the Puppetfile contains a git or Forge module with the given name
+func (puppetfile Puppetfile) declaresModule(name string) bool {
+	if _, ok := puppetfile.gitModules[name]; ok {
+		return true
+	}
+	_, ok := puppetfile.forgeModules[name]
+	return ok
+}
+
+// puppetfileChangedSinceDeploy checks with git diff of the control repository in gitDir if the Puppetfile of the given branch changed since the given previous deploy
+func puppetfileChangedSinceDeploy(gitDir string, previousDeploy DeployResult, branch string) bool {
+	if !previousDeploy.DeploySuccess || len(previousDeploy.Signature) == 0 {
+		Debugf("No successful previous deploy found for branch " + branch + ", resolving its Puppetfile")
+		return true
+	}
+	changedFiles, ok := getChangedFiles(gitDir, previousDeploy.Signature, branch)
+	if !ok {
+		Debugf("Could not get the changed files of branch " + branch + " since commit " + previousDeploy.Signature + ", resolving its Puppetfile")
+		return true
+	}
+	Debugf("Found " + strconv.Itoa(len(changedFiles)) + " changed files in branch " + branch + " since commit " + previousDeploy.Signature)
+	return stringSliceContains(changedFiles, "Puppetfile")
+}
+
+func checkForStaleContent(workDir string, st *SyncStats) {
+	defer timeTrack(time.Now(), funcName())
+	// add purge whitelist, which the purge level strict ignores
+	if len(config.PurgeWhitelist) > 0 && getEnvironmentPurgeLevel(filepath.Base(workDir)) != "strict" {
+		Debugf("additional purge whitelist items: " + strings.Join(config.PurgeWhitelist, " "))
+		for _, wlItem := range config.PurgeWhitelist {
+			st.addDesiredContent(filepath.Join(workDir, wlItem))
 		}
+	}
+	// the deploy file of the environment is written by g10k itself
+	st.addDesiredContent(getDeployFile(workDir))
+	desiredContent := st.getDesiredContent()
 
-		if stale {
+	checkForStaleContent := func(path string, info os.FileInfo, err error) error {
+		if isStaleContent(path, workDir, desiredContent) {
 			Infof("Removing unmanaged path " + path)
 			purgeDir(path, "checkForStaleContent()")
+			// Walk reports the content of an already purged directory with an error
+			if err == nil {
+				st.addPurgedPath(path)
+			}
 		}
 		return nil
 	}
@@ -271,6 +665,61 @@ func checkForStaleContent(workDir string) {
 	Debugf("filepath.Walk'ing directory " + workDir)
 	go func() { c <- filepath.Walk(workDir, checkForStaleContent) }()
 	<-c // Walk done
+
+	if len(config.VerifyPurge) > 0 {
+		verifyPurge(workDir, desiredContent, st)
+	}
+}
+
+// isStaleContent returns true if path inside workDir is not part of the desired content
+func isStaleContent(path string, workDir string, desiredContent []string) bool {
+	if path == workDir {
+		return false
+	}
+	for _, desiredFile := range desiredContent {
+		if strings.HasPrefix(path, desiredFile) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyPurge walks workDir again after checkForStaleContent() and warns about every path that is not part of the desired content
+// e.g. because another process created it during the purge, with verify_purge set to purge these paths also get removed
+func verifyPurge(workDir string, desiredContent []string, st *SyncStats) int {
+	found := 0
+	filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !isStaleContent(path, workDir, desiredContent) {
+			return nil
+		}
+		found++
+		Warnf("WARN: Found unmanaged path " + path + " in " + workDir + " after purging")
+		if config.VerifyPurge == "purge" && !dryRun {
+			purgeDir(path, "verifyPurge()")
+			st.addPurgedPath(path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return found
+}
+
+// handleMissingControlBranch returns the tree and ignore-unreachable setting with which the git module gitName gets synced
+// if its module repository has no branch matching the environment branch tree and the module has neither :default_branch nor :ignore_unreachable
+// with missing_control_branch set to warn the default branch of the module repository gets deployed, with skip the module is left out of the environment
+func handleMissingControlBranch(gitName string, moduleCacheDir string, tree string, env string) (string, bool) {
+	switch config.MissingControlBranch {
+	case "warn":
+		defaultBranch := getDefaultBranch(moduleCacheDir)
+		Warnf("WARN: Branch " + tree + " of module " + gitName + " in environment " + env + " not found, deploying default branch " + defaultBranch + " instead")
+		return defaultBranch, false
+	case "skip":
+		Warnf("WARN: Branch " + tree + " of module " + gitName + " in environment " + env + " not found, skipping the module")
+		return tree, true
+	}
+	return tree, false
 }
 
 // resolveSourcePrefix implements the prefix read out from each source given in the config file, like r10k https://github.com/puppetlabs/r10k/blob/master/doc/dynamic-environments/configuration.mkd#prefix
@@ -284,30 +733,65 @@ func resolveSourcePrefix(source string, sa Source) string {
 	}
 }
 
+// deployLockFile is the file in an environment directory with which operators pause the deploys of the environment
+const deployLockFile = ".g10k-deploy.lock"
+
+// isDeployLocked returns true if the deploys of the Puppet environment envDir are paused by its .g10k-deploy.lock file and -force is not set
+func isDeployLocked(envDir string) bool {
+	return !force && fileExists(filepath.Join(envDir, deployLockFile))
+}
+
+// matchesBranchRegexes returns true if the branch of the source should become an environment according to its branch_include_regex and branch_exclude_regex
+// a branch matching branch_exclude_regex is skipped even if it matches branch_include_regex as well
+func matchesBranchRegexes(sa Source, branch string) bool {
+	if sa.branchExcludeRe != nil && sa.branchExcludeRe.MatchString(branch) {
+		return false
+	}
+	return sa.branchIncludeRe == nil || sa.branchIncludeRe.MatchString(branch)
+}
+
 func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
-	wg := sizedwaitgroup.New(config.MaxExtractworker)
+	defer timeTrack(time.Now(), funcName())
 	exisitingModuleDirs := make(map[string]struct{})
 	uniqueGitModules := make(map[string]GitModule)
 	// if we made it this far initialize the global maps
 	latestForgeModules.m = make(map[string]string)
+	startDeployEvents(allPuppetfiles)
+	// git modules skipped because of the -module parameter, which can still be referenced with :ref => 'module:<name>'
+	skippedGitModules := make(map[string]map[string]GitModule)
+	matchedModuleOverrides := make(map[string]bool)
 	for env, pf := range allPuppetfiles {
 		Debugf("Resolving branch " + env + " of source " + pf.source)
 		//fmt.Println(pf)
+		skippedGitModules[env] = make(map[string]GitModule)
 		for gitName, gitModule := range pf.gitModules {
+			if name, ok := getModuleOverrideName(gitName, gitModule); ok {
+				Infof("Overriding the ref of git module " + gitName + " in environment " + env + " with " + moduleOverrideParams[name] + ", because of parameter -moduleoverride")
+				gitModule = overrideGitModuleRef(gitModule, moduleOverrideParams[name])
+				pf.gitModules[gitName] = gitModule
+				matchedModuleOverrides[name] = true
+			}
 			if len(moduleParam) > 0 {
 				if gitName != moduleParam {
 					Debugf("Skipping git module " + gitName + ", because parameter -module is set to " + moduleParam)
+					skippedGitModules[env][gitName] = gitModule
 					delete(pf.gitModules, gitName)
 					continue
 				}
 			}
-			if gitModule.local {
+			if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.tarball) > 0 {
 				continue
 			}
 
-			gitModule.privateKey = pf.privateKey
-			if _, ok := uniqueGitModules[gitModule.git]; !ok {
+			// the private_key of the source is the default for all git modules of its environments
+			if len(gitModule.privateKey) == 0 {
+				gitModule.privateKey = pf.privateKey
+			}
+			if ugm, ok := uniqueGitModules[gitModule.git]; !ok {
 				uniqueGitModules[gitModule.git] = gitModule
+			} else {
+				syncStats.addGitFetchSkipped()
+				uniqueGitModules[gitModule.git] = mergeUniqueGitModule(ugm, gitModule)
 			}
 		}
 		for forgeModuleName, fm := range pf.forgeModules {
@@ -321,6 +805,16 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			//fmt.Println("Found Forge module ", fm.author, "/", forgeModuleName, " with version", fm.version)
 			fm.baseURL = pf.forgeBaseURL
 			fm.cacheTTL = pf.forgeCacheTTL
+			if isForgeVersionRange(fm.version) {
+				fm.versionRange = fm.version
+				version, ok := resolveForgeVersionRange(fm, pf.previousForgeVersions[fm.author+"-"+fm.name], syncStats)
+				if !ok {
+					Fatalf("resolvePuppetfile(): Error: No release of Forge module " + fm.author + "-" + fm.name + " satisfies the version range " + fm.versionRange + " in environment " + env)
+				}
+				Debugf("Resolved the version range " + fm.versionRange + " of Forge module " + fm.author + "-" + fm.name + " in environment " + env + " to version " + version)
+				fm.version = version
+				pf.forgeModules[forgeModuleName] = fm
+			}
 			forgeModuleName = strings.Replace(forgeModuleName, "/", "-", -1)
 			uniqueForgeModuleName := fm.author + "/" + forgeModuleName + "-" + fm.version
 			if _, ok := uniqueForgeModules[uniqueForgeModuleName]; !ok {
@@ -334,21 +828,117 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			}
 		}
 	}
-	if !debug && !verbose && !info && !quiet && terminal.IsTerminal(int(os.Stdout.Fd())) {
+	for name := range moduleOverrideParams {
+		if !matchedModuleOverrides[name] {
+			Warnf("WARN: -moduleoverride " + name + "=" + moduleOverrideParams[name] + " does not match any git module")
+		}
+	}
+	// the Forge modules must be checked before any of them gets downloaded
+	enforceForgeAllowlist(allPuppetfiles)
+	checkSSHPrivateKeys(uniqueGitModules)
+	if !debug && !verbose && !info && !quiet && !interactive && !isProgressEventsEnabled() && terminal.IsTerminal(int(os.Stdout.Fd())) {
 		uiprogress.Start()
 	}
-	var wgResolve sync.WaitGroup
-	wgResolve.Add(2)
-	go func() {
-		defer wgResolve.Done()
-		resolveGitRepositories(uniqueGitModules)
-	}()
-	go func() {
-		defer wgResolve.Done()
-		resolveForgeModules(uniqueForgeModules)
-	}()
-	wgResolve.Wait()
+	resolveModules(uniqueGitModules, uniqueForgeModules, syncStats)
+	// abbreviated or mistyped commit hashes would otherwise only fail later in the middle of syncing the modules
+	verifyCommitHashes(allPuppetfiles)
+	if enforceImmutableRefsMode || len(config.EnforceImmutableRefs) > 0 {
+		// the cached git repositories are needed to tell tags from branches
+		enforceImmutableRefs(allPuppetfiles)
+	}
+	batchResolveGitObjects(allPuppetfiles)
 	//log.Println(config.Sources["cmdlineparam"])
+	if interactive {
+		planInteractiveSyncs(func() {
+			syncPuppetfileModules(allPuppetfiles, make(map[string]struct{}), skippedGitModules, true)
+		})
+		promptInteractiveSyncs(os.Stdin, os.Stdout)
+	}
+	syncPuppetfileModules(allPuppetfiles, exisitingModuleDirs, skippedGitModules, false)
+
+	if config.ResolveDependencies && !shutdownRequested() {
+		for env, pf := range allPuppetfiles {
+			for _, dir := range resolveModuleDependencies(env, pf, syncStats) {
+				delete(exisitingModuleDirs, dir)
+			}
+		}
+	}
+
+	if stringSliceContains(config.PurgeLevels, "puppetfile") && !shutdownRequested() {
+		if len(exisitingModuleDirs) > 0 && len(moduleParam) == 0 {
+			for d := range exisitingModuleDirs {
+				if strings.HasSuffix(d, ".resource_types") && isDir(d) {
+					continue
+				}
+				if env, ok := getEnvironmentOfDir(allPuppetfiles, d); ok && getEnvironmentPurgeLevel(env) == "none" {
+					Debugf("Not removing unmanaged path " + d + ", because the environment_purge_levels of environment " + env + " is none")
+					continue
+				}
+				Infof("Removing unmanaged path " + d)
+				if !dryRun {
+					purgeDir(d, "purge_level puppetfile")
+				}
+			}
+		}
+	}
+	if !debug && !verbose && !info && !quiet && !interactive && !isProgressEventsEnabled() && terminal.IsTerminal(int(os.Stdout.Fd())) {
+		uiprogress.Stop()
+	}
+
+	for env, pf := range allPuppetfiles {
+		if shutdownRequested() {
+			break
+		}
+		deployFile := getDeployFile(pf.workDir)
+		if dryRun {
+			deployFile = getDryRunDeployFile(pf.workDir)
+		}
+		if fileExists(deployFile) {
+			Debugf("Finishing writing to deploy file " + deployFile)
+			dr := readDeployResultFile(deployFile)
+			// an environment with declined -interactive syncs does not match its Puppetfile and must be resolved again by the next run
+			dr.DeploySuccess = !hasDeclinedInteractiveSyncs(pf.workDir)
+			dr.FinishedAt = time.Now()
+			dr.Labels = deployLabels
+			dr.ModuleOverrides = getModuleOverrides(pf)
+			dr.ForgeVersions = getForgeVersions(pf)
+			dr.ForgeToGit = getForgeToGitCommits(pf)
+			dr.PuppetfileChecksum = getSha256sumFile(filepath.Join(pf.workDir, "Puppetfile"))
+			if !config.ContentHash {
+				dr.ContentHash = ""
+			}
+			dr.ModuleCommits = nil
+			if config.CompactDeployMetadata {
+				dr.ModuleCommits = getModuleCommits(pf.workDir)
+			}
+			writeStructJSONFile(deployFile, dr)
+			if isAtomicDeploy() {
+				validateAtomicEnvironment(env)
+				liveDir, failure := finishAtomicEnvironment(env, syncStats)
+				if len(failure) > 0 {
+					sendDeployEvent(env, false, dr.Signature, 0, "the environment got rolled back, because "+failure)
+					sendEnvironmentComplete(env, liveDir, false)
+					continue
+				}
+				pf.workDir = liveDir
+				allPuppetfiles[env] = pf
+			}
+			syncStats.addDeployedEnvironment(env, pf.workDir, dr)
+			syncStats.Lock()
+			changedModules := len(getChangedModules(pf.workDir, syncStats.needSyncDirs))
+			syncStats.Unlock()
+			sendDeployEvent(env, true, dr.Signature, changedModules, "")
+			sendEnvironmentComplete(env, pf.workDir, dr.DeploySuccess)
+			recordRunState("environment", env, dr.Signature)
+		}
+	}
+
+}
+
+// syncPuppetfileModules syncs the git and Forge modules of all Puppetfiles into their environments
+// the module directories that get synced are removed from exisitingModuleDirs, with planOnly only the git modules get resolved for -interactive
+func syncPuppetfileModules(allPuppetfiles map[string]Puppetfile, exisitingModuleDirs map[string]struct{}, skippedGitModules map[string]map[string]GitModule, planOnly bool) {
+	wg := sizedwaitgroup.New(config.MaxExtractworker)
 	for env, pf := range allPuppetfiles {
 		Debugf("Syncing " + env + " with workDir " + pf.workDir)
 		basedir := checkDirAndCreate(pf.workDir, "basedir 2 for source "+pf.source)
@@ -371,15 +961,26 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			mutex.Unlock()
 		}
 
-		for gitName, gitModule := range pf.gitModules {
+		// modules pinned to the commit of another module wait until that module got synced
+		moduleSynced := make(map[string]chan struct{})
+		for gitName := range pf.gitModules {
+			moduleSynced[gitName] = make(chan struct{})
+		}
+		for _, gitName := range sortGitModulesByRef(pf.gitModules) {
+			gitModule := pf.gitModules[gitName]
 			moduleDir := pf.workDir + gitModule.moduleDir
 			moduleDir = normalizeDir(moduleDir)
+			moduleName := gitName
+			if len(gitModule.targetName) > 0 {
+				moduleName = gitModule.targetName
+			}
 			if gitModule.local {
-				Debugf("Not deleting " + moduleDir + gitName + " as it is declared as a local module")
+				close(moduleSynced[gitName])
+				Debugf("Not deleting " + moduleDir + moduleName + " as it is declared as a local module")
 				// remove this module from the exisitingModuleDirs map
-				moduleDirectory := moduleDir + gitName
+				moduleDirectory := moduleDir + moduleName
 				if len(gitModule.installPath) > 0 {
-					moduleDirectory = normalizeDir(basedir) + normalizeDir(gitModule.installPath) + gitName
+					moduleDirectory = normalizeDir(basedir) + normalizeDir(gitModule.installPath) + moduleName
 				}
 				moduleDirectory = normalizeDir(moduleDirectory)
 				mutex.Lock()
@@ -397,17 +998,28 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 				continue
 			}
 			wg.Add()
-			go func(gitName string, gitModule GitModule, env string) {
+			go func(gitName string, moduleName string, gitModule GitModule, env string) {
 				defer wg.Done()
-				targetDir := normalizeDir(moduleDir + gitName)
+				defer close(moduleSynced[gitName])
+				targetDir := normalizeDir(moduleDir + moduleName)
 				//fmt.Println("targetDir: " + targetDir)
-				tree := "master"
+				tree := ""
 				if len(gitModule.branch) > 0 {
 					tree = gitModule.branch
 				} else if len(gitModule.commit) > 0 {
 					tree = gitModule.commit
 				} else if len(gitModule.tag) > 0 {
 					tree = gitModule.tag
+				} else if strings.HasPrefix(gitModule.ref, moduleRefPrefix) {
+					refName := strings.TrimPrefix(gitModule.ref, moduleRefPrefix)
+					refModule, ok := pf.gitModules[refName]
+					if ok {
+						<-moduleSynced[refName]
+					} else {
+						refModule = skippedGitModules[env][refName]
+					}
+					tree = getResolvedModuleCommit(pf.workDir, basedir, refName, refModule)
+					Debugf("Using commit " + tree + " of module " + refName + " for module " + gitName)
 				} else if len(gitModule.ref) > 0 {
 					tree = gitModule.ref
 				} else if gitModule.link {
@@ -425,18 +1037,36 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 				}
 
 				if len(gitModule.installPath) > 0 {
-					targetDir = basedir + normalizeDir(gitModule.installPath) + gitName
+					targetDir = basedir + normalizeDir(gitModule.installPath) + moduleName
 				}
 				targetDir = normalizeDir(targetDir)
+				// the last fallback branch and missing_control_branch change gitModule.ignoreUnreachable, which must not ignore a failed post_sync
+				ignoreUnreachable := gitModule.ignoreUnreachable
 				success := false
-				moduleCacheDir := config.ModulesCacheDir + strings.Replace(strings.Replace(gitModule.git, "/", "_", -1), ":", "-", -1)
+				moduleCacheDir := getModuleCacheDir(gitModule.git)
+				if len(tree) == 0 && len(gitModule.localPath) == 0 && len(gitModule.tarball) == 0 {
+					tree = getDefaultBranch(moduleCacheDir)
+					Debugf("Using default branch " + tree + " of " + moduleCacheDir + " for module " + gitName)
+				}
 
-				if gitModule.link {
+				if gitModule.link && len(gitModule.localPath) == 0 && len(gitModule.tarball) == 0 {
 					Debugf("Trying to resolve " + moduleCacheDir + " with branch " + tree)
-					success = syncToModuleDir(moduleCacheDir, targetDir, tree, true, gitModule.ignoreUnreachable, env, false)
+					success = syncToModuleDir(runContext, moduleCacheDir, targetDir, tree, true, gitModule.ignoreUnreachable, env, false, gitModule.timeout, syncStats)
+					if !success && len(gitModule.fallback) == 0 && !gitModule.ignoreUnreachable {
+						tree, gitModule.ignoreUnreachable = handleMissingControlBranch(gitName, moduleCacheDir, tree, env)
+					}
 				}
 
-				if len(gitModule.fallback) > 0 {
+				// only the syncs of git modules get approved with -interactive
+				if len(gitModule.localPath) > 0 {
+					if !planOnly {
+						success = syncLocalToModuleDir(gitModule.localPath, targetDir, gitModule.ignoreUnreachable, env, false, syncStats)
+					}
+				} else if len(gitModule.tarball) > 0 {
+					if !planOnly {
+						success = syncTarballToModuleDir(gitModule, targetDir, env, false, syncStats)
+					}
+				} else if len(gitModule.fallback) > 0 {
 					if !success {
 						for i, fallbackBranch := range gitModule.fallback {
 							if i == len(gitModule.fallback)-1 {
@@ -444,20 +1074,30 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 								gitModule.ignoreUnreachable = true
 							}
 							Debugf("Trying to resolve " + moduleCacheDir + " with branch " + fallbackBranch)
-							success = syncToModuleDir(moduleCacheDir, targetDir, fallbackBranch, true, gitModule.ignoreUnreachable, env, false)
+							success = syncToModuleDir(runContext, moduleCacheDir, targetDir, fallbackBranch, true, gitModule.ignoreUnreachable, env, false, gitModule.timeout, syncStats)
 							if success {
 								break
 							}
 						}
 					}
 				} else {
-					syncToModuleDir(moduleCacheDir, targetDir, tree, gitModule.ignoreUnreachable, gitModule.ignoreUnreachable, env, false)
+					success = syncToModuleDir(runContext, moduleCacheDir, targetDir, tree, gitModule.ignoreUnreachable, gitModule.ignoreUnreachable, env, false, gitModule.timeout, syncStats)
+				}
+				if success && !planOnly && len(gitModule.postSync) > 0 && syncStats.isNeedSyncDir(targetDir) {
+					success = runPostSync(gitName, gitModule, targetDir, env, ignoreUnreachable)
+				}
+				if !success && isAtomicDeploy() {
+					// a staging directory with a missing module must not replace the environment
+					failAtomicEnvironment(env, "not all of its modules could be synced")
+				}
+				if !planOnly {
+					sendModuleSynced(gitName, env, targetDir, success)
 				}
 
 				// remove this module from the exisitingModuleDirs map
-				moduleDirectory := filepath.Join(moduleDir, gitName)
+				moduleDirectory := filepath.Join(moduleDir, moduleName)
 				if len(gitModule.installPath) > 0 {
-					moduleDirectory = filepath.Join(normalizeDir(basedir), normalizeDir(gitModule.installPath), gitName)
+					moduleDirectory = filepath.Join(normalizeDir(basedir), normalizeDir(gitModule.installPath), moduleName)
 				}
 				moduleDirectory = normalizeDir(moduleDirectory)
 				mutex.Lock()
@@ -472,7 +1112,10 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 					}
 				}
 				mutex.Unlock()
-			}(gitName, gitModule, env)
+			}(gitName, moduleName, gitModule, env)
+		}
+		if planOnly {
+			continue
 		}
 		for forgeModuleName, fm := range pf.forgeModules {
 			wg.Add()
@@ -480,7 +1123,8 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			moduleDir = normalizeDir(moduleDir)
 			go func(forgeModuleName string, fm ForgeModule, moduleDir string, env string) {
 				defer wg.Done()
-				syncForgeToModuleDir(forgeModuleName, fm, moduleDir, env)
+				syncForgeToModuleDir(forgeModuleName, fm, moduleDir, env, syncStats)
+				sendModuleSynced(forgeModuleName, env, normalizeDir(moduleDir+fm.name), true)
 				// remove this module from the exisitingModuleDirs map
 				mutex.Lock()
 				if _, ok := exisitingModuleDirs[moduleDir+fm.name]; ok {
@@ -491,34 +1135,139 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 		}
 	}
 	wg.Wait()
+}
 
-	if stringSliceContains(config.PurgeLevels, "puppetfile") {
-		if len(exisitingModuleDirs) > 0 && len(moduleParam) == 0 {
-			for d := range exisitingModuleDirs {
-				if strings.HasSuffix(d, ".resource_types") && isDir(d) {
-					continue
-				}
-				Infof("Removing unmanaged path " + d)
-				if !dryRun {
-					purgeDir(d, "purge_level puppetfile")
-				}
-			}
+// getEnvironmentOfDir returns the name of the environment whose directory contains dir
+func getEnvironmentOfDir(allPuppetfiles map[string]Puppetfile, dir string) (string, bool) {
+	for env, pf := range allPuppetfiles {
+		if isSameOrSubDir(pf.workDir, dir) {
+			return env, true
 		}
 	}
-	if !debug && !verbose && !info && !quiet && terminal.IsTerminal(int(os.Stdout.Fd())) {
-		uiprogress.Stop()
+	return "", false
+}
+
+// mergeUniqueGitModule merges the fetch settings of gitModule into ugm, which uses the same git repository
+func mergeUniqueGitModule(ugm GitModule, gitModule GitModule) GitModule {
+	// merge the custom fetch refspecs of all modules using the same git repository
+	for _, refspec := range gitModule.fetchRefspecs {
+		if !stringSliceContains(ugm.fetchRefspecs, refspec) {
+			ugm.fetchRefspecs = append(ugm.fetchRefspecs, refspec)
+		}
+	}
+	if gitModule.fetchTags {
+		ugm.fetchTags = true
 	}
+	if gitModule.httpsFallback {
+		ugm.httpsFallback = true
+	}
+	// the mirror needs the history since the earliest shallow_since of all modules using the same git repository and the full history if any of them has none
+	if len(gitModule.shallowSince) == 0 || gitModule.shallowSince < ugm.shallowSince {
+		ugm.shallowSince = gitModule.shallowSince
+	}
+	for _, commit := range getPinnedCommits(gitModule) {
+		if !stringSliceContains(getPinnedCommits(ugm), commit) {
+			ugm.pinnedCommits = append(ugm.pinnedCommits, commit)
+		}
+	}
+	// use the longest timeout of all modules using the same git repository
+	if gitModule.timeout > ugm.timeout {
+		ugm.timeout = gitModule.timeout
+	}
+	return ugm
+}
 
-	for _, pf := range allPuppetfiles {
-		deployFile := filepath.Join(pf.workDir, ".g10k-deploy.json")
-		if fileExists(deployFile) {
-			Debugf("Finishing writing to deploy file " + deployFile)
-			dr := readDeployResultFile(deployFile)
-			dr.DeploySuccess = true
-			dr.FinishedAt = time.Now()
-			dr.PuppetfileChecksum = getSha256sumFile(filepath.Join(pf.workDir, "Puppetfile"))
-			writeStructJSONFile(deployFile, dr)
+// getModuleOverrideName returns the name of the -moduleoverride parameter which matches the name or the :target_name of the git module
+func getModuleOverrideName(gitName string, gitModule GitModule) (string, bool) {
+	if _, ok := moduleOverrideParams[gitName]; ok {
+		return gitName, true
+	}
+	if _, ok := moduleOverrideParams[gitModule.targetName]; ok && len(gitModule.targetName) > 0 {
+		return gitModule.targetName, true
+	}
+	return "", false
+}
+
+// overrideGitModuleRef returns the git module pinned to ref instead of its branch, tag, commit or ref from the Puppetfile
+func overrideGitModuleRef(gitModule GitModule, ref string) GitModule {
+	gitModule.branch = ""
+	gitModule.tag = ""
+	gitModule.commit = ""
+	gitModule.link = false
+	gitModule.fallback = nil
+	gitModule.ref = ref
+	if refspec := getRefNamespaceFetchRefspec(ref); len(refspec) > 0 && !stringSliceContains(gitModule.fetchRefspecs, refspec) {
+		gitModule.fetchRefspecs = append(gitModule.fetchRefspecs, refspec)
+	}
+	return gitModule
+}
+
+// getModuleOverrides returns the -moduleoverride parameters which matched a git module of the Puppetfile
+func getModuleOverrides(pf Puppetfile) map[string]string {
+	var overrides map[string]string
+	for gitName, gitModule := range pf.gitModules {
+		if name, ok := getModuleOverrideName(gitName, gitModule); ok {
+			if overrides == nil {
+				overrides = make(map[string]string)
+			}
+			overrides[name] = moduleOverrideParams[name]
+		}
+	}
+	return overrides
+}
+
+// sortGitModulesByRef returns the names of the git modules sorted, so that modules which are referenced by
+// :ref => 'module:<name>' come before the modules that reference them
+func sortGitModulesByRef(gitModules map[string]GitModule) []string {
+	names := make([]string, 0, len(gitModules))
+	for gitName := range gitModules {
+		names = append(names, gitName)
+	}
+	sort.Strings(names)
+	sorted := make([]string, 0, len(names))
+	added := make(map[string]bool)
+	var add func(gitName string)
+	add = func(gitName string) {
+		if added[gitName] {
+			return
+		}
+		// mark the module first, cycles were already rejected while reading the Puppetfile
+		added[gitName] = true
+		refName := strings.TrimPrefix(gitModules[gitName].ref, moduleRefPrefix)
+		if _, ok := gitModules[refName]; ok && strings.HasPrefix(gitModules[gitName].ref, moduleRefPrefix) {
+			add(refName)
 		}
+		sorted = append(sorted, gitName)
 	}
+	for _, gitName := range names {
+		add(gitName)
+	}
+	return sorted
+}
 
+// getResolvedModuleCommit returns the commit to which the git module refName got resolved
+// if the module was not synced during this run, e.g. because of the -module parameter, the currently deployed commit is used
+func getResolvedModuleCommit(workDir string, basedir string, refName string, refModule GitModule) string {
+	targetDir := normalizeDir(workDir + refModule.moduleDir)
+	moduleName := refName
+	if len(refModule.targetName) > 0 {
+		moduleName = refModule.targetName
+	}
+	targetDir = normalizeDir(targetDir + moduleName)
+	if len(refModule.installPath) > 0 {
+		targetDir = normalizeDir(basedir + normalizeDir(refModule.installPath) + moduleName)
+	}
+	mutex.Lock()
+	commit, ok := resolvedModuleCommits[targetDir]
+	mutex.Unlock()
+	if ok {
+		return commit
+	}
+	hashFile := getLatestCommitFile(targetDir)
+	if fileExists(hashFile) {
+		content, _ := ioutil.ReadFile(hashFile)
+		return strings.TrimSpace(string(content))
+	}
+	Fatalf("getResolvedModuleCommit(): Error: Could not find the resolved commit of module " + refName + " in " + targetDir)
+	return ""
 }
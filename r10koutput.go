@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// printR10kOutput prints the deployed Puppet environments and the modules that needed to be synced to w in the format of r10k deploy -v info
+// so that log parsers written for r10k keep working
+func printR10kOutput(w io.Writer, st *SyncStats) {
+	st.Lock()
+	defer st.Unlock()
+	envs := []string{}
+	for env := range st.deployedEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		de := st.deployedEnvironments[env]
+		workDir := filepath.Clean(de.workDir)
+		fmt.Fprintln(w, "INFO\t -> Deploying environment "+workDir)
+		fmt.Fprintln(w, "INFO\t -> Environment "+env+" is now at "+de.deployResult.Signature)
+		fmt.Fprintln(w, "INFO\t -> Using Puppetfile '"+filepath.Join(workDir, "Puppetfile")+"'")
+		moduleDirs := []string{}
+		for _, dir := range st.needSyncDirs {
+			rel, err := filepath.Rel(workDir, dir)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			moduleDirs = append(moduleDirs, filepath.Clean(dir))
+		}
+		sort.Strings(moduleDirs)
+		for _, dir := range moduleDirs {
+			fmt.Fprintln(w, "INFO\t -> Deploying Puppetfile content "+dir)
+		}
+	}
+}
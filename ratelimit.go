@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitChunksPerSecond is the number of reads per second, which keeps the throttled byte stream smooth
+const rateLimitChunksPerSecond = 10
+
+var (
+	tricklePath     string
+	tricklePathOnce sync.Once
+)
+
+// rateLimitedReader throttles the reads from the underlying io.Reader to bytesPerSecond
+type rateLimitedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	n              int64
+}
+
+// newRateLimitedReader returns r throttled to kbps kilobytes per second or r itself if kbps is not positive
+func newRateLimitedReader(r io.Reader, kbps int) io.Reader {
+	if kbps <= 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, bytesPerSecond: int64(kbps) * 1024}
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	if rl.start.IsZero() {
+		rl.start = time.Now()
+	}
+	chunkSize := rl.bytesPerSecond / rateLimitChunksPerSecond
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	if int64(len(p)) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := rl.r.Read(p)
+	rl.n += int64(n)
+	expected := time.Duration(float64(rl.n) / float64(rl.bytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(rl.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
+
+// getRateLimitedGitCommand prefixes gitCmd with trickle to limit its download bandwidth to the fetch_rate_limit_kbps setting
+// git itself has no setting to cap the bandwidth, so the command is returned unchanged if trickle is not installed
+func getRateLimitedGitCommand(gitCmd string) string {
+	if config.FetchRateLimitKBps <= 0 {
+		return gitCmd
+	}
+	tricklePathOnce.Do(func() {
+		path, err := exec.LookPath("trickle")
+		if err != nil {
+			Warnf("WARN: fetch_rate_limit_kbps is set, but trickle could not be found in PATH. Only git archive extractions are rate limited")
+			return
+		}
+		tricklePath = path
+	})
+	if len(tricklePath) == 0 {
+		return gitCmd
+	}
+	return tricklePath + " -s -d " + strconv.Itoa(config.FetchRateLimitKBps) + " " + gitCmd
+}
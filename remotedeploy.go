@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RemoteDeploy contains the host to which the git archives of the environments and modules get streamed over SSH
+// and the directory on that host which replaces the basedir of the sources
+type RemoteDeploy struct {
+	Host string `yaml:"host"`
+	Path string `yaml:"path"`
+}
+
+// getRemoteDeployDir returns the directory on the remote_deploy host which corresponds to the local targetDir
+// the basedir of the source is replaced with the path of remote_deploy, other directories are placed below it
+func getRemoteDeployDir(targetDir string) string {
+	for _, sa := range config.Sources {
+		basedir := normalizeDir(sa.Basedir)
+		if len(sa.Basedir) > 0 && strings.HasPrefix(normalizeDir(targetDir), basedir) {
+			return normalizeDir(filepath.Join(config.RemoteDeploy.Path, strings.TrimPrefix(normalizeDir(targetDir), basedir)))
+		}
+	}
+	return normalizeDir(filepath.Join(config.RemoteDeploy.Path, targetDir))
+}
+
+// quoteRemoteShellArg quotes the string for the shell of the remote_deploy host
+func quoteRemoteShellArg(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// extractRemoteArchive pipes the tar archive over SSH to the remote_deploy host and extracts it into the directory corresponding to targetDir
+// if purge is set, the remote directory gets removed first, so that no stale files survive
+func extractRemoteArchive(archive io.Reader, targetDir string, purge bool, timeout int) error {
+	remoteDir := getRemoteDeployDir(targetDir)
+	remoteCmd := "mkdir -p " + quoteRemoteShellArg(remoteDir) + " && tar -x -C " + quoteRemoteShellArg(remoteDir)
+	if purge {
+		remoteCmd = "rm -rf " + quoteRemoteShellArg(remoteDir) + " && " + remoteCmd
+	}
+	Debugf("Executing ssh " + config.RemoteDeploy.Host + " " + remoteCmd)
+	var stderr bytes.Buffer
+	c := exec.Command("ssh", "-o", "BatchMode=yes", config.RemoteDeploy.Host, remoteCmd)
+	c.Stdin = archive
+	c.Stdout = ioutil.Discard
+	c.Stderr = &stderr
+	ctx := runContext
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(runContext, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	finished, err := startCommand(ctx, c)
+	if err != nil {
+		return err
+	}
+	err = c.Wait()
+	finished()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("killed after timeout of %d seconds", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
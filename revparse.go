@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// batchResolvedGitObjects contains the object hashes of the module trees which got resolved with one git cat-file --batch-check per cached git repository
+// syncToModuleDir() uses them instead of running one git rev-parse per module, trees that could not be resolved are missing and fall back to git rev-parse
+var batchResolvedGitObjects = struct {
+	sync.Mutex
+	m map[string]map[string]string
+}{m: make(map[string]map[string]string)}
+
+// getBatchResolvedGitObject returns the object hash of tree in the cached git repository gitDir if it got resolved by batchResolveGitObjects()
+func getBatchResolvedGitObject(gitDir string, tree string) (string, bool) {
+	batchResolvedGitObjects.Lock()
+	defer batchResolvedGitObjects.Unlock()
+	hash, ok := batchResolvedGitObjects.m[gitDir][tree]
+	return hash, ok
+}
+
+// pinGitObject records hash as the object of tree in the cached git repository gitDir for the rest of the run, unless tree was already resolved, and returns the recorded object
+func pinGitObject(gitDir string, tree string, hash string) string {
+	batchResolvedGitObjects.Lock()
+	defer batchResolvedGitObjects.Unlock()
+	if _, ok := batchResolvedGitObjects.m[gitDir]; !ok {
+		batchResolvedGitObjects.m[gitDir] = make(map[string]string)
+	}
+	if pinned, ok := batchResolvedGitObjects.m[gitDir][tree]; ok {
+		return pinned
+	}
+	batchResolvedGitObjects.m[gitDir][tree] = hash
+	return hash
+}
+
+// forgetBatchResolvedGitObjects drops the resolved trees of gitDir, because the cached git repository is about to change
+func forgetBatchResolvedGitObjects(gitDir string) {
+	batchResolvedGitObjects.Lock()
+	defer batchResolvedGitObjects.Unlock()
+	delete(batchResolvedGitObjects.m, gitDir)
+}
+
+// getBatchResolvableTree returns the tree of the git module that does not depend on the environment or on another module
+func getBatchResolvableTree(gitModule GitModule) string {
+	switch {
+	case len(gitModule.branch) > 0:
+		return gitModule.branch
+	case len(gitModule.commit) > 0:
+		return gitModule.commit
+	case len(gitModule.tag) > 0:
+		return gitModule.tag
+	case len(gitModule.ref) > 0 && !strings.HasPrefix(gitModule.ref, moduleRefPrefix):
+		return gitModule.ref
+	}
+	return ""
+}
+
+// batchResolveGitObjects resolves the trees of all git modules of allPuppetfiles with one git cat-file --batch-check per cached git repository
+// the cached git repositories are processed in parallel, so that a run in which nothing changed does not wait for one git rev-parse per module
+func batchResolveGitObjects(allPuppetfiles map[string]Puppetfile) {
+	defer timeTrack(time.Now(), funcName())
+	trees := make(map[string]map[string]bool)
+	for _, pf := range allPuppetfiles {
+		for _, gitModule := range pf.gitModules {
+			if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.tarball) > 0 || gitModule.link {
+				continue
+			}
+			tree := getBatchResolvableTree(gitModule)
+			if len(tree) == 0 {
+				continue
+			}
+			gitDir := getModuleCacheDir(gitModule.git)
+			if _, ok := trees[gitDir]; !ok {
+				trees[gitDir] = make(map[string]bool)
+			}
+			trees[gitDir][tree] = true
+		}
+	}
+
+	// the cached git repositories could have been changed since the last run of g10k serve
+	batchResolvedGitObjects.Lock()
+	batchResolvedGitObjects.m = make(map[string]map[string]string)
+	batchResolvedGitObjects.Unlock()
+	execTrace.Lock()
+	replaying := execTrace.replay != nil
+	execTrace.Unlock()
+	if replaying {
+		// the replayed git rev-parse commands must be used instead
+		return
+	}
+	wg := sizedwaitgroup.New(config.MaxExtractworker)
+	for gitDir, treeSet := range trees {
+		if !isDir(gitDir) {
+			continue
+		}
+		sortedTrees := []string{}
+		for tree := range treeSet {
+			sortedTrees = append(sortedTrees, tree)
+		}
+		sort.Strings(sortedTrees)
+		wg.Add()
+		go func(gitDir string, sortedTrees []string) {
+			defer wg.Done()
+			resolved := catFileBatchCheck(gitDir, sortedTrees)
+			batchResolvedGitObjects.Lock()
+			batchResolvedGitObjects.m[gitDir] = resolved
+			batchResolvedGitObjects.Unlock()
+		}(gitDir, sortedTrees)
+	}
+	wg.Wait()
+}
+
+// catFileBatchCheck returns the object hashes of trees in the git repository gitDir like git rev-parse --verify 'tree^{object}'
+// trees which are missing or ambiguous are left out
+func catFileBatchCheck(gitDir string, trees []string) map[string]string {
+	var input bytes.Buffer
+	for _, tree := range trees {
+		if config.GitObjectSyntaxNotSupported {
+			input.WriteString(tree + "\n")
+		} else {
+			input.WriteString(tree + "^{object}\n")
+		}
+	}
+	Debugf("Executing git --git-dir " + gitDir + " cat-file --batch-check for " + strconv.Itoa(len(trees)) + " trees")
+	before := time.Now()
+	c := exec.Command("git", "--git-dir", gitDir, "cat-file", "--batch-check")
+	c.Env = getGitEnvironment()
+	var output bytes.Buffer
+	var stderr bytes.Buffer
+	c.Stdin = &input
+	c.Stdout = &output
+	c.Stderr = &stderr
+	finished, err := startCommand(runContext, c)
+	if err == nil {
+		err = c.Wait()
+		finished()
+	}
+	Verbosef("git --git-dir " + gitDir + " cat-file --batch-check for " + strconv.Itoa(len(trees)) + " trees took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	resolved := make(map[string]string)
+	if err != nil {
+		Debugf("catFileBatchCheck(): git cat-file --batch-check failed for " + gitDir + ", falling back to git rev-parse. Error: " + err.Error() + " " + stderr.String())
+		return resolved
+	}
+	// git cat-file prints one line per input line, either <hash> <type> <size> or <input> missing
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != len(trees) {
+		Debugf("catFileBatchCheck(): Expected " + strconv.Itoa(len(trees)) + " lines from git cat-file --batch-check for " + gitDir + ", but got " + strconv.Itoa(len(lines)) + ", falling back to git rev-parse")
+		return resolved
+	}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && reFullCommitHash.MatchString(fields[0]) {
+			resolved[trees[i]] = fields[0]
+		}
+	}
+	return resolved
+}
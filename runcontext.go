@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// runContext is the context of the whole g10k run from which the contexts passed to doMirrorOrUpdate(), syncToModuleDir() and executeCommand() are derived
+// it gets cancelled right before g10k exits because of a fatal error or a second shutdown signal
+// all commands started with startCommand() get killed together with their child processes, so that no orphaned git processes keep on writing into the cache
+var runContext, cancelRunContext = context.WithCancel(context.Background())
+
+// runningCommands contains all commands started with startCommand() which did not finish yet
+var runningCommands = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]struct{}
+}{cmds: make(map[*exec.Cmd]struct{})}
+
+// startCommand starts c in a dedicated process group and kills the whole process group once ctx gets cancelled
+// the returned function must be called after c.Wait() returned
+func startCommand(ctx context.Context, c *exec.Cmd) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return func() {}, err
+	}
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+	runningCommands.Lock()
+	defer runningCommands.Unlock()
+	if err := c.Start(); err != nil {
+		return func() {}, err
+	}
+	runningCommands.cmds[c] = struct{}{}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killCommand(c)
+		case <-done:
+		}
+	}()
+	return func() {
+		runningCommands.Lock()
+		defer runningCommands.Unlock()
+		delete(runningCommands.cmds, c)
+		close(done)
+	}, nil
+}
+
+// killCommand kills the process group of the command c, which was started with startCommand()
+func killCommand(c *exec.Cmd) {
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
+
+// cancelRunningCommands cancels the runContext and kills all running commands before g10k exits
+func cancelRunningCommands() {
+	cancelRunContext()
+	runningCommands.Lock()
+	defer runningCommands.Unlock()
+	for c := range runningCommands.cmds {
+		killCommand(c)
+	}
+}
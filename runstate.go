@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// RunStateEntry is a line of the run_state_file, which records a git repository, module or environment that got synced successfully
+type RunStateEntry struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Commit string `json:"commit,omitempty"`
+}
+
+// runState contains the entries of the run_state_file of an interrupted g10k run and the file to which the entries of this run get appended
+var runState = struct {
+	sync.Mutex
+	resumed map[string]string
+	file    *os.File
+}{resumed: make(map[string]string)}
+
+// openRunState reads the entries of an interrupted g10k run from the run_state_file and opens it to append the entries of this run
+// the entries are written as JSON lines while the run is in progress, so that they survive a crash of g10k
+func openRunState(file string) {
+	runState.Lock()
+	defer runState.Unlock()
+	if f, err := os.Open(file); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry RunStateEntry
+			// the last line might be incomplete if g10k got killed while writing it
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				runState.resumed[entry.Type+":"+entry.Name] = entry.Commit
+			}
+		}
+		f.Close()
+		if len(runState.resumed) > 0 {
+			Infof("Resuming interrupted g10k run with " + strconv.Itoa(len(runState.resumed)) + " synced git repositories, modules and environments from run_state_file " + file)
+		}
+	}
+	checkDirAndCreate(filepath.Dir(file), "directory of run_state_file")
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		Fatalf("openRunState(): Error while opening run_state_file " + file + " Error: " + err.Error())
+	}
+	runState.file = f
+}
+
+// recordRunState appends a successfully synced git repository, module or environment to the run_state_file
+func recordRunState(entryType string, name string, commit string) {
+	runState.Lock()
+	defer runState.Unlock()
+	if runState.file == nil {
+		return
+	}
+	line, _ := json.Marshal(RunStateEntry{Type: entryType, Name: name, Commit: commit})
+	if _, err := runState.file.Write(append(line, '\n')); err != nil {
+		Warnf("WARN: Could not write to run_state_file " + runState.file.Name() + " Error: " + err.Error())
+	}
+}
+
+// resumedRunState returns the commit of the git repository, module or environment if it got synced by the interrupted g10k run
+func resumedRunState(entryType string, name string) (string, bool) {
+	runState.Lock()
+	defer runState.Unlock()
+	commit, ok := runState.resumed[entryType+":"+name]
+	return commit, ok
+}
+
+// clearRunState removes the run_state_file after a fully successful g10k run, so that the next run checks everything again
+func clearRunState() {
+	runState.Lock()
+	defer runState.Unlock()
+	if runState.file == nil {
+		return
+	}
+	runState.file.Close()
+	if err := os.Remove(runState.file.Name()); err != nil {
+		Warnf("WARN: Could not remove run_state_file " + runState.file.Name() + " Error: " + err.Error())
+	}
+	runState.file = nil
+	runState.resumed = make(map[string]string)
+}
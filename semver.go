@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseVersion returns the major, minor and patch numbers of the semantic version and if it is a pre-release
+func parseVersion(version string) ([3]int, bool, bool) {
+	var numbers [3]int
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	preRelease := false
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		preRelease = version[i] == '-'
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return numbers, false, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, false, false
+		}
+		numbers[i] = n
+	}
+	return numbers, preRelease, true
+}
+
+// compareVersions returns -1, 0 or 1 if the semantic version a is lower, equal or higher than b
+func compareVersions(a [3]int, b [3]int) int {
+	for i := 0; i < 3; i++ {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionMatchesRequirement returns true if version satisfies the version_requirement of a metadata.json dependency
+// supported are exact versions, the comparators >, >=, <, <= and =, wildcards like 1.x, hyphen ranges like 1.0.0 - 2.0.0, ~ and ^ ranges and alternatives separated by ||
+// pre-release versions only match exact requirements
+func versionMatchesRequirement(version string, requirement string) bool {
+	v, preRelease, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	for _, alternative := range strings.Split(requirement, "||") {
+		alternative = strings.TrimSpace(alternative)
+		if alternative == strings.TrimSpace(version) {
+			return true
+		}
+		if preRelease {
+			continue
+		}
+		if matchesVersionRange(v, alternative) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesVersionRange returns true if the version v satisfies all space separated constraints of versionRange
+func matchesVersionRange(v [3]int, versionRange string) bool {
+	if m := strings.Split(versionRange, " - "); len(m) == 2 {
+		return matchesVersionConstraint(v, ">="+strings.TrimSpace(m[0])) && matchesVersionConstraint(v, "<="+strings.TrimSpace(m[1]))
+	}
+	// allow a space between the comparator and the version like >= 1.0.0 < 2.0.0
+	fields := strings.Fields(versionRange)
+	constraints := []string{}
+	for i := 0; i < len(fields); i++ {
+		if strings.Trim(fields[i], "<>=~^") == "" && i+1 < len(fields) {
+			constraints = append(constraints, fields[i]+fields[i+1])
+			i++
+		} else {
+			constraints = append(constraints, fields[i])
+		}
+	}
+	for _, constraint := range constraints {
+		if !matchesVersionConstraint(v, constraint) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesVersionConstraint returns true if the version v satisfies a single constraint like >=1.2.0, 1.x or ~1.2
+func matchesVersionConstraint(v [3]int, constraint string) bool {
+	operator := constraint[:len(constraint)-len(strings.TrimLeft(constraint, "<>=~^"))]
+	bound := strings.TrimSpace(constraint[len(operator):])
+	if bound == "" || bound == "*" || bound == "x" || bound == "X" {
+		return operator == "" || operator == ">=" || operator == "="
+	}
+	lower, precision, ok := parsePartialVersion(bound)
+	if !ok {
+		return false
+	}
+	// the upper bound (exclusive) of a partial version like 1.2 or 1.2.x
+	upper := lower
+	switch precision {
+	case 1:
+		upper = [3]int{lower[0] + 1, 0, 0}
+	case 2:
+		upper = [3]int{lower[0], lower[1] + 1, 0}
+	}
+	switch operator {
+	case "", "=":
+		if precision == 3 {
+			return compareVersions(v, lower) == 0
+		}
+		return compareVersions(v, lower) >= 0 && compareVersions(v, upper) < 0
+	case ">":
+		if precision == 3 {
+			return compareVersions(v, lower) > 0
+		}
+		return compareVersions(v, upper) >= 0
+	case ">=":
+		return compareVersions(v, lower) >= 0
+	case "<":
+		return compareVersions(v, lower) < 0
+	case "<=":
+		if precision == 3 {
+			return compareVersions(v, lower) <= 0
+		}
+		return compareVersions(v, upper) < 0
+	case "~":
+		if precision == 1 {
+			return compareVersions(v, lower) >= 0 && compareVersions(v, upper) < 0
+		}
+		return compareVersions(v, lower) >= 0 && compareVersions(v, [3]int{lower[0], lower[1] + 1, 0}) < 0
+	case "^":
+		return compareVersions(v, lower) >= 0 && compareVersions(v, [3]int{lower[0] + 1, 0, 0}) < 0
+	}
+	return false
+}
+
+// parsePartialVersion parses versions like 1, 1.2, 1.x or 1.2.3 and returns the number of given version parts
+func parsePartialVersion(version string) ([3]int, int, bool) {
+	var numbers [3]int
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return numbers, 0, false
+	}
+	precision := 0
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, 0, false
+		}
+		numbers[i] = n
+		precision++
+	}
+	if precision == 0 {
+		return numbers, 0, false
+	}
+	return numbers, precision, true
+}
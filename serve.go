@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServeDeployRequest is the JSON body of a POST to the /deploy endpoint of the -serve HTTP server
+type ServeDeployRequest struct {
+	Environment string `json:"environment"`
+	Branch      string `json:"branch"`
+}
+
+// serveMutex serializes the deploys of the -serve HTTP server, because they share the global state of g10k
+var serveMutex sync.Mutex
+
+// serveDeploys runs the HTTP server of the -serve mode, which deploys a Puppet environment for each POST to /deploy
+// the git repositories stay cached between the deploys, on a shutdown signal the server exits after the running deploy
+func serveDeploys(addr string) {
+	go func() {
+		<-shutdown
+		serveMutex.Lock()
+		os.Exit(signalExitCode())
+	}()
+	http.HandleFunc("/deploy", handleDeployRequest)
+	Infof("Listening on " + addr + " for deploy requests")
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		Fatalf("serveDeploys(): Error while listening on " + addr + " Error: " + err.Error())
+	}
+}
+
+// handleDeployRequest deploys the environment or branch of the request and responds with the deploy result as JSON
+func handleDeployRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var dr ServeDeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&dr); err != nil {
+		http.Error(w, "could not parse JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (len(dr.Environment) == 0) == (len(dr.Branch) == 0) {
+		http.Error(w, "either environment or branch must be set", http.StatusBadRequest)
+		return
+	}
+	if shutdownRequested() {
+		http.Error(w, "g10k is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	n := runServeDeploy(dr)
+	w.Header().Set("Content-Type", "application/json")
+	if len(n.Environments) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	} else if !n.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(n)
+}
+
+// runServeDeploy deploys the environment or branch of the deploy request like a g10k run with -environment or -branch
+// and returns the deploy result, which also gets sent to the notify_url
+func runServeDeploy(dr ServeDeployRequest) Notification {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+	Infof("Deploying environment " + dr.Environment + dr.Branch + " requested over HTTP")
+	runStartedAt = time.Now()
+	syncStats = newSyncStats()
+	uniqueForgeModules = make(map[string]ForgeModule)
+	gitRepositoryResults = make(map[string]*GitRepositoryResult)
+	resolvedModuleCommits = make(map[string]string)
+	compactModuleCommits.m = make(map[string]string)
+	usedModuleCacheDirs.dirs = make(map[string]bool)
+	notificationOnce = sync.Once{}
+	environmentParam = dr.Environment
+	branchParam = dr.Branch
+	defer func() {
+		environmentParam = ""
+		branchParam = ""
+	}()
+
+	resolvePuppetEnvironment(dr.Branch, tags, "")
+	n := newNotification(true, "", time.Since(runStartedAt), syncStats)
+	for _, en := range n.Environments {
+		if !en.Success {
+			n.Success = false
+		}
+	}
+	if len(n.Environments) == 0 {
+		n.Success = false
+		n.Error = "environment " + dr.Environment + dr.Branch + " not found"
+	}
+	if config.MaxCacheSizeGB > 0 && !shutdownRequested() {
+		evictModuleCache(int64(config.MaxCacheSizeGB) << 30)
+	}
+	sendNotification(n.Success, n.Error)
+	if n.Success {
+		checkForAndExecutePostrunCommand()
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// reShallowSinceDays matches a :shallow_since relative to today like 90 days ago
+var reShallowSinceDays = regexp.MustCompile("^(\\d+) days? ago$")
+
+// parseShallowSince returns the date of the :shallow_since value, which is either a date like 2024-01-31 or relative to today like 90 days ago
+// relative values get converted to a date, so that the shallow_since of all modules using the same git repository can be compared
+func parseShallowSince(value string) (string, bool) {
+	if m := reShallowSinceDays.FindStringSubmatch(value); len(m) > 0 {
+		days, _ := strconv.Atoi(m[1])
+		return time.Now().AddDate(0, 0, -days).Format("2006-01-02"), true
+	}
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// getPinnedCommits returns the commits to which the git module and the git modules merged into it are pinned with :commit or a :ref looking like a commit hash
+func getPinnedCommits(gitModule GitModule) []string {
+	commits := append([]string{}, gitModule.pinnedCommits...)
+	for _, commit := range []string{gitModule.commit, gitModule.ref} {
+		if reCommitHash.MatchString(commit) && !stringSliceContains(commits, commit) {
+			commits = append(commits, commit)
+		}
+	}
+	return commits
+}
+
+// isShallowMirror returns true if the cached git repository workDir does not contain the full history
+func isShallowMirror(workDir string) bool {
+	return fileExists(filepath.Join(workDir, "shallow"))
+}
+
+// deepenShallowMirror fetches the full history into the shallow git repository workDir if a pinned commit of the git module is older than its shallow_since
+// the mirror then stays complete, so that the following updates do not need to deepen it again
+func deepenShallowMirror(gitModule GitModule, workDir string, runGitCommand func(string) ExecResult) ExecResult {
+	for _, commit := range getPinnedCommits(gitModule) {
+		if executeGitCommand(runContext, "git --git-dir "+workDir+" cat-file -e '"+commit+"^{commit}'", gitModule.timeout, true).returnCode == 0 {
+			continue
+		}
+		Warnf("WARN: commit " + commit + " of git repository " + getTokenFreeGitURL(gitModule.git) + " is not reachable since the shallow_since " + gitModule.shallowSince + ", fetching its full history")
+		return runGitCommand("git --git-dir " + workDir + " fetch --unshallow origin")
+	}
+	return ExecResult{returnCode: 0}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sshPrivateKeyCopies contains the copies with the permissions 0600 of the SSH private keys whose permissions ssh refuses
+// they only get created if fix_ssh_key_permissions is set
+var sshPrivateKeyCopies = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// errSSHPrivateKeyPermissions is returned by checkSSHPrivateKey() if the group or others can access the SSH private key
+var errSSHPrivateKeyPermissions = errors.New("is accessible by others")
+
+// checkSSHPrivateKey returns an error if the SSH private key file does not exist or if ssh would refuse it, because the group or others can access it
+func checkSSHPrivateKey(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("is not a regular file")
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return errSSHPrivateKeyPermissions
+	}
+	return nil
+}
+
+// getSSHPrivateKey returns the SSH private key file that g10k passes to ssh, which is the copy created by prepareSSHPrivateKey() if there is one
+func getSSHPrivateKey(file string) string {
+	sshPrivateKeyCopies.Lock()
+	defer sshPrivateKeyCopies.Unlock()
+	if keyCopy, ok := sshPrivateKeyCopies.m[file]; ok {
+		return keyCopy
+	}
+	return file
+}
+
+// prepareSSHPrivateKey exits with an actionable error if the SSH private key file of users can not be used by ssh
+// with fix_ssh_key_permissions set, a key with too open permissions gets copied into the cachedir with the permissions 0600 instead
+func prepareSSHPrivateKey(file string, users string) {
+	err := checkSSHPrivateKey(file)
+	if err == nil {
+		return
+	}
+	if err != errSSHPrivateKeyPermissions {
+		Fatalf("prepareSSHPrivateKey(): Error: SSH private key " + file + " of " + users + " can not be used: " + err.Error())
+	}
+	fi, _ := os.Stat(file)
+	mode := "0" + strconv.FormatUint(uint64(fi.Mode().Perm()), 8)
+	if !config.FixSSHKeyPermissions {
+		Fatalf("prepareSSHPrivateKey(): Error: SSH private key " + file + " of " + users + " has the permissions " + mode + ", which ssh refuses. Run chmod 600 " + file + " or set fix_ssh_key_permissions to let g10k use a copy with the permissions 0600")
+	}
+	keyDir := checkDirAndCreate(config.CacheDir+"ssh_keys/", "cachedir/ssh_keys")
+	if err := os.Chmod(keyDir, 0700); err != nil {
+		Fatalf("prepareSSHPrivateKey(): Error while changing the permissions of " + keyDir + " Error: " + err.Error())
+	}
+	sum := sha256.Sum256([]byte(file))
+	keyCopy := filepath.Join(keyDir, hex.EncodeToString(sum[:])+".key")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Fatalf("prepareSSHPrivateKey(): Error while reading SSH private key " + file + " Error: " + err.Error())
+	}
+	if err := ioutil.WriteFile(keyCopy, content, 0600); err != nil {
+		Fatalf("prepareSSHPrivateKey(): Error while writing " + keyCopy + " Error: " + err.Error())
+	}
+	// WriteFile does not change the permissions of an existing copy
+	if err := os.Chmod(keyCopy, 0600); err != nil {
+		Fatalf("prepareSSHPrivateKey(): Error while changing the permissions of " + keyCopy + " Error: " + err.Error())
+	}
+	Warnf("WARN: SSH private key " + file + " of " + users + " has the permissions " + mode + ", using the copy " + keyCopy + " with the permissions 0600, because fix_ssh_key_permissions is set")
+	sshPrivateKeyCopies.Lock()
+	sshPrivateKeyCopies.m[file] = keyCopy
+	sshPrivateKeyCopies.Unlock()
+}
+
+// checkSSHPrivateKeys checks each distinct SSH private key of uniqueGitModules with prepareSSHPrivateKey() before the git repositories get mirrored
+// so that a key which ssh refuses results in one clear error instead of a git failure for each module
+func checkSSHPrivateKeys(uniqueGitModules map[string]GitModule) {
+	users := make(map[string][]string)
+	for url, gm := range uniqueGitModules {
+		// doMirrorOrUpdate() does not use the SSH private key for github.com
+		if len(gm.privateKey) > 0 && !strings.Contains(url, "github.com") {
+			users[gm.privateKey] = append(users[gm.privateKey], url)
+		}
+	}
+	keys := []string{}
+	for key := range users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sort.Strings(users[key])
+		prepareSSHPrivateKey(key, "git repositories "+strings.Join(users[key], ", "))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// StaleCacheEntry is a cached git repository of the module cache which no Puppetfile of the cached control repositories uses anymore
+type StaleCacheEntry struct {
+	dir        string
+	size       int64
+	lastUpdate time.Time
+}
+
+// getReferencedModuleCacheDirs returns the cached git repositories of all git modules used by the Puppetfiles of all branches of all cached control repositories
+// only the cached control repositories get read, so the git modules of sources which were never deployed or warmed with -warmcache are missing
+func getReferencedModuleCacheDirs() map[string]bool {
+	referenced := make(map[string]bool)
+	sources := []string{}
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		sa := config.Sources[source]
+		workDir := config.EnvCacheDir + source + ".git"
+		if !isDir(workDir) {
+			Warnf("WARN: Skipping source " + source + ", because its control repository " + sa.Remote + " is not cached yet in " + workDir + ", the git repositories of its modules are reported as stale")
+			continue
+		}
+		for _, branch := range getCachedControlRepoBranches(workDir, sa) {
+			puppetfile, ok := readCachedPuppetfile(workDir, branch, source, sa)
+			if !ok {
+				continue
+			}
+			for _, gitModule := range puppetfile.gitModules {
+				if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.git) == 0 {
+					continue
+				}
+				// the git repository can also be used from the read_only_cachedir, which must not make its copy in the writable cachedir stale
+				referenced[filepath.Join(config.ModulesCacheDir, filepath.Base(getModuleCacheDir(gitModule.git)))] = true
+			}
+		}
+	}
+	return referenced
+}
+
+// getStaleCacheEntries returns the cached git repositories of the module cache which are not used by any Puppetfile of the cached control repositories sorted by directory
+func getStaleCacheEntries() []StaleCacheEntry {
+	entries, err := ioutil.ReadDir(config.ModulesCacheDir)
+	if err != nil {
+		Warnf("getStaleCacheEntries(): WARN: Could not read module cache " + config.ModulesCacheDir + " Error: " + err.Error())
+		return nil
+	}
+	referenced := getReferencedModuleCacheDirs()
+	stale := []StaleCacheEntry{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(config.ModulesCacheDir, entry.Name())
+		if referenced[dir] {
+			continue
+		}
+		sce := StaleCacheEntry{dir: dir, size: getDirSize(dir)}
+		if age, ok := getCacheAge(dir); ok {
+			sce.lastUpdate = time.Now().Add(-age).Round(time.Second)
+		}
+		stale = append(stale, sce)
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].dir < stale[j].dir })
+	return stale
+}
+
+// printStaleCacheReport prints the cached git repositories of the module cache which no Puppetfile uses anymore together with their size and last update to w
+// nothing gets removed, it returns the number of stale git repositories
+func printStaleCacheReport(w io.Writer) int {
+	stale := getStaleCacheEntries()
+	if len(stale) == 0 {
+		fmt.Fprintln(w, "No stale git repositories in module cache "+config.ModulesCacheDir)
+		return 0
+	}
+	var total int64
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CACHED GIT REPOSITORY\tSIZE\tLAST UPDATE")
+	for _, sce := range stale {
+		lastUpdate := "unknown"
+		if !sce.lastUpdate.IsZero() {
+			lastUpdate = sce.lastUpdate.Format(time.RFC3339)
+		}
+		fmt.Fprintln(tw, sce.dir+"\t"+strconv.FormatInt(sce.size>>10, 10)+" KB\t"+lastUpdate)
+		total += sce.size
+	}
+	tw.Flush()
+	fmt.Fprintln(w, strconv.Itoa(len(stale))+" stale git repositories using "+strconv.FormatInt(total>>20, 10)+" MB in module cache "+config.ModulesCacheDir)
+	return len(stale)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SyncStats contains the counters, timings and synced directories of a g10k run
+// all methods are safe to be called from multiple goroutines
+type SyncStats struct {
+	sync.Mutex
+	syncGitCount          int
+	syncForgeCount        int
+	needSyncGitCount      int
+	needSyncForgeCount    int
+	needSyncDirs          []string
+	unchangedDirs         []string
+	needSyncEnvs          map[string]struct{}
+	syncGitTime           float64
+	syncForgeTime         float64
+	ioGitTime             float64
+	ioForgeTime           float64
+	tarballDownloadTime   float64
+	forgeJSONParseTime    float64
+	metadataJSONParseTime float64
+	desiredContent        []string
+	purgedPaths           []string
+	cacheHits             map[string]int
+	cacheMisses           map[string]int
+	gitFetchCount         int
+	gitFetchSkippedCount  int
+	deployedEnvironments  map[string]DeployedEnvironment
+	moduleTimings         map[string]*ModuleTiming
+	masterResults         map[string]string
+}
+
+// ModuleTiming contains how long the git repository of a module took to be fetched and to be archived and extracted into module directories
+type ModuleTiming struct {
+	Name          string  `json:"name"`
+	FetchDuration float64 `json:"fetch_duration"`
+	SyncDuration  float64 `json:"sync_duration"`
+	Syncs         int     `json:"syncs"`
+}
+
+// newSyncStats returns empty SyncStats with initialized maps
+func newSyncStats() *SyncStats {
+	return &SyncStats{
+		needSyncEnvs:         make(map[string]struct{}),
+		cacheHits:            make(map[string]int),
+		cacheMisses:          make(map[string]int),
+		deployedEnvironments: make(map[string]DeployedEnvironment),
+		moduleTimings:        make(map[string]*ModuleTiming),
+		masterResults:        make(map[string]string),
+	}
+}
+
+// addSyncedGitModule counts a git module or environment that g10k tried to sync
+func (st *SyncStats) addSyncedGitModule() {
+	st.Lock()
+	st.syncGitCount++
+	st.Unlock()
+}
+
+// addSyncedForgeModule counts a Forge module that g10k tried to sync
+func (st *SyncStats) addSyncedForgeModule() {
+	st.Lock()
+	st.syncForgeCount++
+	st.Unlock()
+}
+
+// addNeedSyncGitDir records that the git module or environment targetDir needs to be synced
+func (st *SyncStats) addNeedSyncGitDir(targetDir string, correspondingPuppetEnvironment string) {
+	st.Lock()
+	st.addNeedSyncDir(targetDir, correspondingPuppetEnvironment)
+	st.needSyncGitCount++
+	st.Unlock()
+}
+
+// addNeedSyncForgeDir records that the Forge module targetDir needs to be synced
+func (st *SyncStats) addNeedSyncForgeDir(targetDir string, correspondingPuppetEnvironment string) {
+	st.Lock()
+	st.addNeedSyncDir(targetDir, correspondingPuppetEnvironment)
+	st.needSyncForgeCount++
+	st.Unlock()
+}
+
+// addNeedSyncDir must only be called while holding the lock
+func (st *SyncStats) addNeedSyncDir(targetDir string, correspondingPuppetEnvironment string) {
+	st.needSyncDirs = append(st.needSyncDirs, targetDir)
+	markModuleSyncing(targetDir)
+	if _, ok := st.needSyncEnvs[correspondingPuppetEnvironment]; !ok {
+		st.needSyncEnvs[correspondingPuppetEnvironment] = empty
+	}
+}
+
+// isNeedSyncDir returns true if the module or environment targetDir needed to be synced, because it changed
+func (st *SyncStats) isNeedSyncDir(targetDir string) bool {
+	st.Lock()
+	defer st.Unlock()
+	return stringSliceContains(st.needSyncDirs, targetDir)
+}
+
+// addUnchangedDir records that the module or environment targetDir was skipped, because it is already up to date
+func (st *SyncStats) addUnchangedDir(targetDir string) {
+	st.Lock()
+	st.unchangedDirs = append(st.unchangedDirs, targetDir)
+	st.Unlock()
+}
+
+// addOutdatedForgeModule counts a Forge module for which a newer version is available
+func (st *SyncStats) addOutdatedForgeModule() {
+	st.Lock()
+	st.needSyncForgeCount++
+	st.Unlock()
+}
+
+// setSyncGitTime sets the time it took to resolve all git repositories
+func (st *SyncStats) setSyncGitTime(duration float64) {
+	st.Lock()
+	st.syncGitTime = duration
+	st.Unlock()
+}
+
+// setSyncForgeTime sets the time it took to resolve all Forge modules
+func (st *SyncStats) setSyncForgeTime(duration float64) {
+	st.Lock()
+	st.syncForgeTime = duration
+	st.Unlock()
+}
+
+// addSyncForgeTime adds the time of a Forge API query or download
+func (st *SyncStats) addSyncForgeTime(duration float64) {
+	st.Lock()
+	st.syncForgeTime += duration
+	st.Unlock()
+}
+
+// addIOGitTime adds the time it took to populate a git module or environment directory
+func (st *SyncStats) addIOGitTime(duration float64) {
+	st.Lock()
+	st.ioGitTime += duration
+	st.Unlock()
+}
+
+// addTarballDownloadTime adds the time it took to download the tarball of a :tarball module
+func (st *SyncStats) addTarballDownloadTime(duration float64) {
+	st.Lock()
+	st.tarballDownloadTime += duration
+	st.Unlock()
+}
+
+// getModuleTiming returns the timings of the cached git repository gitDir, it must only be called while holding the lock
+func (st *SyncStats) getModuleTiming(gitDir string) *ModuleTiming {
+	mt, ok := st.moduleTimings[gitDir]
+	if !ok {
+		mt = &ModuleTiming{Name: gitDir}
+		st.moduleTimings[gitDir] = mt
+	}
+	return mt
+}
+
+// addModuleFetchTime adds the time it took to clone or update the cached git repository gitDir of the git repository url
+func (st *SyncStats) addModuleFetchTime(gitDir string, url string, duration float64) {
+	st.Lock()
+	mt := st.getModuleTiming(gitDir)
+	mt.Name = url
+	mt.FetchDuration += duration
+	st.Unlock()
+}
+
+// addModuleSyncTime adds the time it took to archive the cached git repository gitDir and extract it into a module directory
+func (st *SyncStats) addModuleSyncTime(gitDir string, duration float64) {
+	st.Lock()
+	mt := st.getModuleTiming(gitDir)
+	mt.SyncDuration += duration
+	mt.Syncs++
+	st.Unlock()
+}
+
+// getSlowestModules returns the timings of the n git repositories which took the longest to be fetched and synced
+func (st *SyncStats) getSlowestModules(n int) []ModuleTiming {
+	st.Lock()
+	defer st.Unlock()
+	timings := make([]ModuleTiming, 0, len(st.moduleTimings))
+	for _, mt := range st.moduleTimings {
+		timings = append(timings, *mt)
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		ti, tj := timings[i].FetchDuration+timings[i].SyncDuration, timings[j].FetchDuration+timings[j].SyncDuration
+		if ti == tj {
+			return timings[i].Name < timings[j].Name
+		}
+		return ti > tj
+	})
+	if len(timings) > n {
+		timings = timings[:n]
+	}
+	return timings
+}
+
+// addMasterResult records that the master host is in sync or why it could not be synced
+func (st *SyncStats) addMasterResult(host string, errorMessage string) {
+	st.Lock()
+	st.masterResults[host] = errorMessage
+	st.Unlock()
+}
+
+// getMasterResults returns whether each master is in sync, sorted by host
+func (st *SyncStats) getMasterResults() []MasterResult {
+	st.Lock()
+	defer st.Unlock()
+	results := []MasterResult{}
+	for host, errorMessage := range st.masterResults {
+		results = append(results, MasterResult{Host: host, InSync: len(errorMessage) == 0, Error: errorMessage})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+	return results
+}
+
+// addIOForgeTime adds the time it took to extract or populate a Forge module
+func (st *SyncStats) addIOForgeTime(duration float64) {
+	st.Lock()
+	st.ioForgeTime += duration
+	st.Unlock()
+}
+
+// addForgeJSONParseTime adds the time it took to parse a Forge API response
+func (st *SyncStats) addForgeJSONParseTime(duration float64) {
+	st.Lock()
+	st.forgeJSONParseTime += duration
+	st.Unlock()
+}
+
+// addMetadataJSONParseTime adds the time it took to parse the metadata.json of a Forge module
+func (st *SyncStats) addMetadataJSONParseTime(duration float64) {
+	st.Lock()
+	st.metadataJSONParseTime += duration
+	st.Unlock()
+}
+
+// addDesiredContent adds files and directories which must not be purged
+func (st *SyncStats) addDesiredContent(paths ...string) {
+	st.Lock()
+	st.desiredContent = append(st.desiredContent, paths...)
+	st.Unlock()
+}
+
+// getDesiredContent returns a copy of the files and directories which must not be purged
+func (st *SyncStats) getDesiredContent() []string {
+	st.Lock()
+	defer st.Unlock()
+	return append([]string{}, st.desiredContent...)
+}
+
+// rebaseDirs moves the recorded paths below the directory from to the directory to, because an environment built in the staging directory from got swapped with to
+func (st *SyncStats) rebaseDirs(from string, to string) {
+	st.Lock()
+	defer st.Unlock()
+	for _, paths := range []*[]string{&st.needSyncDirs, &st.unchangedDirs, &st.desiredContent, &st.purgedPaths} {
+		for i, path := range *paths {
+			if !isSameOrSubDir(from, path) {
+				continue
+			}
+			rel, _ := filepath.Rel(from, path)
+			rebased := filepath.Join(to, rel)
+			if strings.HasSuffix(path, "/") {
+				rebased += "/"
+			}
+			(*paths)[i] = rebased
+		}
+	}
+}
+
+// addPurgedPath records that the unmanaged path got purged, so that every removed path shows up in the summary and the notification
+func (st *SyncStats) addPurgedPath(path string) {
+	st.Lock()
+	st.purgedPaths = append(st.purgedPaths, path)
+	st.Unlock()
+}
+
+// addCacheResult counts a git module sync of the Puppet environment as cache hit or miss
+func (st *SyncStats) addCacheResult(correspondingPuppetEnvironment string, hit bool) {
+	st.Lock()
+	if hit {
+		st.cacheHits[correspondingPuppetEnvironment]++
+	} else {
+		st.cacheMisses[correspondingPuppetEnvironment]++
+	}
+	st.Unlock()
+}
+
+// addGitFetch counts a git clone or update of a cached git repository
+func (st *SyncStats) addGitFetch() {
+	st.Lock()
+	st.gitFetchCount++
+	st.Unlock()
+}
+
+// addGitFetchSkipped counts a git repository fetch which was skipped because it is used by multiple modules
+func (st *SyncStats) addGitFetchSkipped() {
+	st.Lock()
+	st.gitFetchSkippedCount++
+	st.Unlock()
+}
+
+// addDeployedEnvironment records the deploy result of the Puppet environment env in workDir
+func (st *SyncStats) addDeployedEnvironment(env string, workDir string, dr DeployResult) {
+	st.Lock()
+	st.deployedEnvironments[env] = DeployedEnvironment{workDir: workDir, deployResult: dr}
+	st.Unlock()
+}
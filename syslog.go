@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log/syslog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog contains the settings for the deploy events which get sent to the local syslog after each Puppet environment
+type Syslog struct {
+	Enabled  bool   `yaml:"enabled"`
+	Facility string `yaml:"facility"`
+	Tag      string `yaml:"tag"`
+}
+
+// syslogFacilities maps the supported facility names of the syslog setting to their priorities
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH,
+	"syslog": syslog.LOG_SYSLOG, "authpriv": syslog.LOG_AUTHPRIV, "cron": syslog.LOG_CRON,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// deployEventWriter is implemented by *syslog.Writer
+type deployEventWriter interface {
+	Info(m string) error
+	Err(m string) error
+}
+
+// deployEventStart contains the directory of a Puppet environment whose deploy event was not sent yet and when its deploy started
+type deployEventStart struct {
+	workDir   string
+	startedAt time.Time
+}
+
+// deployEvents contains the connection to the local syslog and the Puppet environments whose deploy event was not sent yet
+var deployEvents = struct {
+	sync.Mutex
+	writer  deployEventWriter
+	failed  bool
+	started map[string]deployEventStart
+}{started: make(map[string]deployEventStart)}
+
+// getDeployEventWriter connects to the local syslog on first use
+// if the connection fails, a warning gets printed once and no deploy events are sent in this run, deployEvents must be locked
+func getDeployEventWriter() deployEventWriter {
+	if deployEvents.writer != nil || deployEvents.failed {
+		return deployEvents.writer
+	}
+	tag := config.Syslog.Tag
+	if len(tag) == 0 {
+		tag = "g10k"
+	}
+	facility, ok := syslogFacilities[config.Syslog.Facility]
+	if !ok {
+		facility = syslog.LOG_USER
+	}
+	w, err := syslog.New(facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		deployEvents.failed = true
+		Warnf("getDeployEventWriter(): WARN: Could not connect to the local syslog, no deploy events will be sent. Error: " + err.Error())
+		return nil
+	}
+	deployEvents.writer = w
+	return w
+}
+
+// startDeployEvents records when the deploy of the Puppet environments started, so that a deploy event can be sent for each of them
+func startDeployEvents(allPuppetfiles map[string]Puppetfile) {
+	if !config.Syslog.Enabled {
+		return
+	}
+	deployEvents.Lock()
+	defer deployEvents.Unlock()
+	for env, pf := range allPuppetfiles {
+		deployEvents.started[env] = deployEventStart{workDir: pf.workDir, startedAt: time.Now()}
+	}
+}
+
+// formatDeployEvent returns the deploy event as space separated key=value pairs, values with spaces get quoted
+func formatDeployEvent(env string, success bool, commit string, changedModules int, duration time.Duration, errorMessage string) string {
+	fields := []string{"event=deploy", "environment=" + env, "success=" + strconv.FormatBool(success)}
+	if len(commit) > 0 {
+		fields = append(fields, "commit="+commit)
+	}
+	fields = append(fields, "changed_modules="+strconv.Itoa(changedModules), "duration="+strconv.FormatFloat(duration.Seconds(), 'f', 3, 64))
+	if len(errorMessage) > 0 {
+		fields = append(fields, "error="+strconv.Quote(errorMessage))
+	}
+	return strings.Join(fields, " ")
+}
+
+// sendDeployEvent sends the deploy event of the Puppet environment env with the duration since startDeployEvents() to the local syslog if syslog is enabled
+// syslog errors only result in a warning and never fail the deploy
+func sendDeployEvent(env string, success bool, commit string, changedModules int, errorMessage string) {
+	if !config.Syslog.Enabled {
+		return
+	}
+	deployEvents.Lock()
+	defer deployEvents.Unlock()
+	var duration time.Duration
+	if des, ok := deployEvents.started[env]; ok {
+		duration = time.Since(des.startedAt)
+		delete(deployEvents.started, env)
+	}
+	w := getDeployEventWriter()
+	if w == nil {
+		return
+	}
+	event := maskSecrets(formatDeployEvent(env, success, commit, changedModules, duration, errorMessage))
+	Debugf("Sending deploy event to syslog: " + event)
+	var err error
+	if success {
+		err = w.Info(event)
+	} else {
+		err = w.Err(event)
+	}
+	if err != nil {
+		Warnf("sendDeployEvent(): WARN: Could not send deploy event of environment " + env + " to syslog Error: " + err.Error())
+	}
+}
+
+// sendFailedDeployEvents sends a failed deploy event for each Puppet environment which was being deployed when g10k had to exit
+func sendFailedDeployEvents(errorMessage string) {
+	if !config.Syslog.Enabled {
+		return
+	}
+	deployEvents.Lock()
+	workDirs := make(map[string]string)
+	envs := []string{}
+	for env, des := range deployEvents.started {
+		workDirs[env] = des.workDir
+		envs = append(envs, env)
+	}
+	deployEvents.Unlock()
+	sort.Strings(envs)
+	for _, env := range envs {
+		syncStats.Lock()
+		changedModules := len(getChangedModules(workDirs[env], syncStats.needSyncDirs))
+		syncStats.Unlock()
+		sendDeployEvent(env, false, "", changedModules, errorMessage)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reSha256sum matches the :sha256sum of a :tarball module
+var reSha256sum = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+// tarballLocks contains a mutex for each cached tarball, so that the same tarball gets downloaded only once
+var tarballLocks sync.Map
+
+// getTarballCacheDir returns the directory in which the downloaded and extracted tarballs of :tarball modules are cached
+func getTarballCacheDir() string {
+	return config.CacheDir + "tarballs/"
+}
+
+// getTarballCacheKey returns the name of the cache directory of the tarball url with the expected checksum
+// a changed :sha256sum gets its own cache directory, so that the tarball gets downloaded again
+func getTarballCacheKey(url string, checksum string) string {
+	sum := sha256.Sum256([]byte(url + "\n" + strings.ToLower(checksum)))
+	return hex.EncodeToString(sum[:])
+}
+
+// errTarballNotModified is returned by downloadTarball() if the server answered the conditional request with 304 Not Modified
+var errTarballNotModified = errors.New("tarball not modified")
+
+// TarballValidators contains the ETag and Last-Modified response headers of a downloaded tarball
+// they are sent with the next request, so that a tarball without :sha256sum only gets downloaded again if it changed
+type TarballValidators struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// readTarballValidators returns the TarballValidators stored in file or empty ones if file can not be read
+func readTarballValidators(file string) TarballValidators {
+	var tv TarballValidators
+	if content, err := ioutil.ReadFile(file); err == nil {
+		if err := json.Unmarshal(content, &tv); err != nil {
+			Debugf("Ignoring invalid tarball validators file " + file + " Error: " + err.Error())
+			return TarballValidators{}
+		}
+	}
+	return tv
+}
+
+// getTarball returns the cache directory with the extracted content of the tarball of the :tarball module gm and the SHA256 sum of the tarball
+// with :sha256sum the cached tarball is used as is, without it the cached tarball gets revalidated with the ETag and Last-Modified of its last download
+func getTarball(gm GitModule, st *SyncStats) (string, string, error) {
+	cacheDir := filepath.Join(getTarballCacheDir(), getTarballCacheKey(gm.tarball, gm.tarballSHA256))
+	lock, _ := tarballLocks.LoadOrStore(cacheDir, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	sumFile := cacheDir + ".sha256"
+	validatorsFile := cacheDir + ".validators"
+	cachedSum := ""
+	if isDir(cacheDir) && fileExists(sumFile) {
+		if content, err := ioutil.ReadFile(sumFile); err == nil {
+			cachedSum = strings.TrimSpace(string(content))
+		}
+	}
+	if len(cachedSum) > 0 && len(gm.tarballSHA256) > 0 {
+		Debugf("Using cached tarball " + cacheDir + " of " + gm.tarball)
+		return cacheDir, cachedSum, nil
+	}
+	var validators TarballValidators
+	if len(cachedSum) > 0 {
+		validators = readTarballValidators(validatorsFile)
+	}
+
+	checkDirAndCreate(getTarballCacheDir(), "cachedir/tarballs")
+	downloadFile := cacheDir + ".download"
+	defer os.Remove(downloadFile)
+	sum, validators, err := downloadTarball(gm.tarball, downloadFile, gm.timeout, validators, st)
+	if err == errTarballNotModified {
+		Debugf("Using cached tarball " + cacheDir + " of " + gm.tarball + ", because it was not modified")
+		return cacheDir, cachedSum, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if len(gm.tarballSHA256) > 0 && !strings.EqualFold(sum, gm.tarballSHA256) {
+		return "", "", errors.New("SHA256 sum " + sum + " of " + gm.tarball + " does not match the expected :sha256sum " + gm.tarballSHA256)
+	}
+
+	tmpDir := cacheDir + ".tmp"
+	createOrPurgeDir(tmpDir, "getTarball()")
+	defer purgeDir(tmpDir, "getTarball()")
+	if err := extractTarball(downloadFile, tmpDir); err != nil {
+		return "", "", err
+	}
+	// most tarballs contain a single top-level directory like module-1.0.0/, which must not end up in the module directory
+	root := tmpDir
+	if entries, err := ioutil.ReadDir(tmpDir); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmpDir, entries[0].Name())
+	}
+	purgeDir(cacheDir, "getTarball(), because the cached tarball is incomplete")
+	if err := os.Rename(root, cacheDir); err != nil {
+		return "", "", errors.New("Error while renaming " + root + " to " + cacheDir + " Error: " + err.Error())
+	}
+	if err := ioutil.WriteFile(sumFile, []byte(sum+"\n"), 0644); err != nil {
+		return "", "", errors.New("Error while writing " + sumFile + " Error: " + err.Error())
+	}
+	if len(gm.tarballSHA256) == 0 {
+		writeStructJSONFile(validatorsFile, validators)
+	}
+	return cacheDir, sum, nil
+}
+
+// downloadTarball downloads url to file and returns the SHA256 sum of the downloaded content and its TarballValidators
+// non-empty validators make the request conditional, errTarballNotModified is returned if the tarball did not change since
+func downloadTarball(url string, file string, timeout int, validators TarballValidators, st *SyncStats) (string, TarballValidators, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", validators, errors.New("Error creating GET request for " + url + " Error: " + err.Error())
+	}
+	if len(validators.ETag) > 0 {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if len(validators.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return "", validators, errors.New("Error while getting http proxy with golang http.ProxyFromEnvironment() " + err.Error())
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	if timeout > 0 {
+		client.Timeout = time.Duration(timeout) * time.Second
+	}
+	before := time.Now()
+	defer func() { st.addTarballDownloadTime(time.Since(before).Seconds()) }()
+	Debugf("GETing " + url)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", validators, errors.New("Error while GETing " + url + " Error: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return "", validators, errTarballNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", validators, errors.New("Unexpected response code while GETing " + url + " " + resp.Status)
+	}
+
+	out, err := os.Create(file)
+	if err != nil {
+		return "", validators, errors.New("Error while creating file " + file + " Error: " + err.Error())
+	}
+	defer out.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		return "", validators, errors.New("Error while downloading " + url + " to " + file + " Error: " + err.Error())
+	}
+	Verbosef("GETing " + url + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	return hex.EncodeToString(h.Sum(nil)), TarballValidators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// extractTarball extracts the plain or gzip compressed tar archive file into targetDir
+func extractTarball(file string, targetDir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.New("Error while opening " + file + " Error: " + err.Error())
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var tarReader io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return errors.New("Error while reading gzip compressed tarball " + file + " Error: " + err.Error())
+		}
+		defer gzipReader.Close()
+		tarReader = gzipReader
+	}
+	return extractTar(tarReader, targetDir)
+}
+
+// syncTarballToModuleDir populates targetDir with the content of the tarball of the :tarball module gm
+// the SHA256 sum of the tarball gets stored in .latest_commit, so that an unchanged tarball does not get synced again
+func syncTarballToModuleDir(gm GitModule, targetDir string, correspondingPuppetEnvironment string, onlyDelta bool, st *SyncStats) bool {
+	if shutdownRequested() {
+		Debugf("Skipping sync of " + targetDir + ", because g10k is shutting down")
+		return false
+	}
+	st.addSyncedGitModule()
+	srcDir, sum, err := getTarball(gm, st)
+	if err != nil {
+		if gm.ignoreUnreachable {
+			Debugf("Failed to populate module " + targetDir + " from tarball " + gm.tarball + " but ignore-unreachable is set. Continuing... Error: " + err.Error())
+			purgeDir(targetDir, "syncTarballToModuleDir, because ignore-unreachable is set for this module")
+			return false
+		}
+		Fatalf("syncTarballToModuleDir(): Error while getting tarball " + gm.tarball + " for " + targetDir + " " + err.Error())
+	}
+
+	hashFile := getLatestCommitFile(targetDir)
+	if onlyDelta {
+		listLocalDirFiles(srcDir, targetDir, st)
+		st.addDesiredContent(hashFile)
+	}
+	if content, err := ioutil.ReadFile(hashFile); err == nil && strings.TrimSpace(string(content)) == sum {
+		Debugf("Skipping, because no diff found between tarball " + gm.tarball + " (" + sum + ") and " + targetDir)
+		st.addUnchangedDir(targetDir)
+		st.addCacheResult(correspondingPuppetEnvironment, true)
+		return true
+	}
+	st.addCacheResult(correspondingPuppetEnvironment, false)
+
+	InfoModulef("Need to sync " + targetDir)
+	st.addNeedSyncGitDir(targetDir, correspondingPuppetEnvironment)
+	if !dryRun {
+		if !handleUnmanagedModuleDir(targetDir, gm.ignoreUnreachable) {
+			return false
+		}
+		createOrPurgeDir(targetDir, "syncTarballToModuleDir()")
+		before := time.Now()
+		copyLocalDir(srcDir, targetDir)
+		if err := ioutil.WriteFile(prepareMetadataFile(hashFile), []byte(sum), 0644); err != nil {
+			Fatalf("syncTarballToModuleDir(): Error while writing " + hashFile + " Error: " + err.Error())
+		}
+		duration := time.Since(before).Seconds()
+		st.addIOGitTime(duration)
+		Verbosef("syncTarballToModuleDir(): Copying tarball " + gm.tarball + " to " + targetDir + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	}
+	return true
+}
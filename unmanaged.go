@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isUnmanagedModuleDir returns true if targetDir exists and is not empty, but was not deployed by g10k,
+// because it contains neither the .latest_commit of a module nor the .g10k-deploy.json of an environment
+func isUnmanagedModuleDir(targetDir string) bool {
+	dir := filepath.Clean(targetDir)
+	fi, err := os.Lstat(dir)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		// symlinks are created by dedup_modules
+		return false
+	}
+	if !fi.IsDir() {
+		return true
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) == 0 {
+		return false
+	}
+	return !fileExists(getLatestCommitFile(dir)) && !fileExists(getDeployFile(dir))
+}
+
+// getUnmanagedModuleDirBackup returns the directory in the cachedir to which the unmanaged targetDir gets moved with unmanaged_module_dirs backup
+func getUnmanagedModuleDirBackup(targetDir string, now time.Time) string {
+	return filepath.Join(config.CacheDir, "unmanaged_module_dirs", strings.Trim(strings.Replace(filepath.Clean(targetDir), "/", "_", -1), "_")+"_"+now.Format("20060102T150405"))
+}
+
+// handleUnmanagedModuleDir is called before g10k overwrites targetDir and handles it according to the unmanaged_module_dirs setting if it was not deployed by g10k
+// it returns false if targetDir must not be overwritten, which with fail only happens if ignore-unreachable is set, otherwise g10k exits
+func handleUnmanagedModuleDir(targetDir string, ignoreUnreachable bool) bool {
+	if len(config.UnmanagedModuleDirs) == 0 || config.UnmanagedModuleDirs == "overwrite" || dryRun || !isUnmanagedModuleDir(targetDir) {
+		return true
+	}
+	if config.UnmanagedModuleDirs == "fail" {
+		if ignoreUnreachable {
+			Warnf("WARN: Skipping sync of " + targetDir + ", because it was not deployed by g10k, unmanaged_module_dirs is set to fail and ignore-unreachable is set. Continuing...")
+			return false
+		}
+		Fatalf("handleUnmanagedModuleDir(): Error: " + targetDir + " was not deployed by g10k and unmanaged_module_dirs is set to fail, remove it or set unmanaged_module_dirs to backup or overwrite")
+	}
+
+	backupDir := getUnmanagedModuleDirBackup(targetDir, time.Now())
+	checkDirAndCreate(filepath.Dir(backupDir), "unmanaged_module_dirs backup directory")
+	if err := os.Rename(filepath.Clean(targetDir), backupDir); err != nil {
+		// the cachedir can be on another filesystem
+		Debugf("Could not move " + targetDir + " to " + backupDir + ", copying it instead. Error: " + err.Error())
+		if er := executeCommand(runContext, "cp -a "+filepath.Clean(targetDir)+" "+backupDir, config.Timeout, true); er.returnCode != 0 {
+			Fatalf("handleUnmanagedModuleDir(): Error while backing up " + targetDir + " to " + backupDir + " Error: " + er.output + er.stderr)
+		}
+		purgeDir(targetDir, "handleUnmanagedModuleDir(), because it was backed up to "+backupDir)
+	}
+	Warnf("WARN: Moved " + targetDir + " to " + backupDir + ", because it was not deployed by g10k")
+	return true
+}
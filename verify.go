@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// DeployedDrift is a module or control repository of a deployed Puppet environment which does not match what its source and ref resolve to
+type DeployedDrift struct {
+	environment string
+	module      string
+	deployed    string
+	expected    string
+}
+
+// VerifiedEnvironment is a deployed Puppet environment with its Puppetfile, which gets verified against its sources
+type VerifiedEnvironment struct {
+	name       string
+	dir        string
+	workDir    string
+	deploy     DeployResult
+	puppetfile Puppetfile
+}
+
+// readDeployedEnvironments returns the deployed Puppet environments of all sources, which have a .g10k-deploy.json
+func readDeployedEnvironments() []VerifiedEnvironment {
+	environments := []VerifiedEnvironment{}
+	sources := []string{}
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		sa := config.Sources[source]
+		workDir := config.EnvCacheDir + source + ".git"
+		if !config.UseCacheFallback {
+			doMirrorOrUpdate(runContext, GitModule{git: sa.Remote, privateKey: sa.PrivateKey, ignoreUnreachable: true}, workDir, getGitRetryCount(), syncStats)
+		}
+		envDirs, _ := filepath.Glob(filepath.Join(sa.Basedir, resolveSourcePrefix(source, sa)+"*"))
+		sort.Strings(envDirs)
+		for _, envDir := range envDirs {
+			deployFile := getDeployFile(envDir)
+			if !fileExists(deployFile) {
+				continue
+			}
+			de := VerifiedEnvironment{name: filepath.Base(envDir), dir: normalizeDir(envDir), workDir: workDir, deploy: readDeployResultFile(deployFile)}
+			if pf := filepath.Join(envDir, "Puppetfile"); fileExists(pf) {
+				de.puppetfile = readPuppetfile(pf, sa.PrivateKey, source, sa.ForceForgeVersions, false)
+				de.puppetfile.workDir = de.dir
+			}
+			environments = append(environments, de)
+		}
+	}
+	return environments
+}
+
+// getExpectedGitObject returns the object hash to which tree resolves in the cached git repository gitDir or an empty string if it does not exist
+func getExpectedGitObject(gitDir string, tree string) string {
+	logCmd := "git --git-dir " + gitDir + " rev-parse --verify --quiet '" + tree
+	if config.GitObjectSyntaxNotSupported != true {
+		logCmd = logCmd + "^{object}'"
+	} else {
+		logCmd = logCmd + "'"
+	}
+	er := resolveGitObject(runContext, gitDir, tree, logCmd, config.Timeout, true)
+	if er.returnCode != 0 {
+		return ""
+	}
+	return strings.TrimSpace(er.output)
+}
+
+// readDeployedCommit returns the content of the .latest_commit file of the module in targetDir or - if it does not exist
+func readDeployedCommit(targetDir string) string {
+	content, err := ioutil.ReadFile(getLatestCommitFile(targetDir))
+	if err != nil {
+		return "-"
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// verifyVerifiedEnvironment returns the control repository and modules of the deployed Puppet environment which do not match their pinned refs in the cached git repositories
+// modules with a fallback match if any of their branches matches, local modules are skipped
+func verifyVerifiedEnvironment(de VerifiedEnvironment) []DeployedDrift {
+	drifts := []DeployedDrift{}
+	expected := getExpectedGitObject(de.workDir, de.deploy.Name)
+	if expected != de.deploy.Signature {
+		if len(expected) == 0 {
+			expected = "branch " + de.deploy.Name + " does not exist"
+		}
+		drifts = append(drifts, DeployedDrift{environment: de.name, module: "(control repository)", deployed: de.deploy.Signature, expected: expected})
+	}
+	if len(de.deploy.ContentHash) > 0 {
+		// the files of the environment were changed on disk after the deploy
+		if contentHash, err := getContentHash(de.dir); err != nil || contentHash != de.deploy.ContentHash {
+			if err != nil {
+				contentHash = "content hash failed: " + err.Error()
+			}
+			drifts = append(drifts, DeployedDrift{environment: de.name, module: "(content hash)", deployed: contentHash, expected: de.deploy.ContentHash})
+		}
+	}
+
+	pf := de.puppetfile
+	gitNames := []string{}
+	for gitName := range pf.gitModules {
+		gitNames = append(gitNames, gitName)
+	}
+	sort.Strings(gitNames)
+	for _, gitName := range gitNames {
+		gitModule := pf.gitModules[gitName]
+		if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.tarball) > 0 {
+			continue
+		}
+		moduleName := gitName
+		if len(gitModule.targetName) > 0 {
+			moduleName = gitModule.targetName
+		}
+		targetDir := normalizeDir(filepath.Join(pf.workDir, gitModule.moduleDir, moduleName))
+		if len(gitModule.installPath) > 0 {
+			targetDir = normalizeDir(filepath.Join(pf.workDir, gitModule.installPath, moduleName))
+		}
+		rel, _ := filepath.Rel(pf.workDir, targetDir)
+		moduleCacheDir := getModuleCacheDir(gitModule.git)
+		trees := []string{}
+		if len(gitModule.branch) > 0 {
+			trees = append(trees, gitModule.branch)
+		} else if len(gitModule.commit) > 0 {
+			trees = append(trees, gitModule.commit)
+		} else if len(gitModule.tag) > 0 {
+			trees = append(trees, gitModule.tag)
+		} else if strings.HasPrefix(gitModule.ref, moduleRefPrefix) {
+			refName := strings.TrimPrefix(gitModule.ref, moduleRefPrefix)
+			if refModule, ok := pf.gitModules[refName]; ok {
+				refModuleName := refName
+				if len(refModule.targetName) > 0 {
+					refModuleName = refModule.targetName
+				}
+				refDir := filepath.Join(pf.workDir, refModule.moduleDir, refModuleName)
+				if len(refModule.installPath) > 0 {
+					refDir = filepath.Join(pf.workDir, refModule.installPath, refModuleName)
+				}
+				trees = append(trees, readDeployedCommit(refDir))
+			}
+		} else if len(gitModule.ref) > 0 {
+			trees = append(trees, gitModule.ref)
+		} else if gitModule.link {
+			trees = append(trees, de.deploy.Name)
+		} else {
+			trees = append(trees, getDefaultBranch(moduleCacheDir))
+		}
+		if gitModule.link || len(gitModule.fallback) > 0 {
+			trees = append(trees, gitModule.fallback...)
+		}
+
+		deployed := readDeployedCommit(targetDir)
+		expected := ""
+		for _, tree := range trees {
+			if expected = getExpectedGitObject(moduleCacheDir, tree); len(expected) > 0 {
+				break
+			}
+		}
+		if len(expected) == 0 {
+			expected = strings.Join(trees, "|") + " does not exist"
+		}
+		if deployed != expected {
+			drifts = append(drifts, DeployedDrift{environment: de.name, module: rel, deployed: deployed, expected: expected})
+		}
+	}
+
+	forgeNames := []string{}
+	for forgeName := range pf.forgeModules {
+		forgeNames = append(forgeNames, forgeName)
+	}
+	sort.Strings(forgeNames)
+	for _, forgeName := range forgeNames {
+		fm := pf.forgeModules[forgeName]
+		if fm.version == "latest" || fm.version == "present" || len(fm.version) == 0 {
+			continue
+		}
+		targetDir := filepath.Join(pf.workDir, fm.moduleDir, fm.name)
+		rel, _ := filepath.Rel(pf.workDir, targetDir)
+		deployed := "-"
+		if fileExists(filepath.Join(targetDir, "metadata.json")) {
+			deployed = "version " + readModuleMetadata(filepath.Join(targetDir, "metadata.json"), syncStats).version
+		}
+		if isForgeVersionRange(fm.version) {
+			if deployed == "-" || !versionMatchesRequirement(strings.TrimPrefix(deployed, "version "), fm.version) {
+				drifts = append(drifts, DeployedDrift{environment: de.name, module: rel, deployed: deployed, expected: "version " + fm.version})
+			}
+		} else if deployed != "version "+fm.version {
+			drifts = append(drifts, DeployedDrift{environment: de.name, module: rel, deployed: deployed, expected: "version " + fm.version})
+		}
+	}
+	return drifts
+}
+
+// verifyDeployedEnvironments prints the control repositories and modules of all deployed Puppet environments to w, which drifted from what their sources and pinned refs resolve to
+// the cached git repositories are updated first, unless use_cache_fallback is set, then only the cache is used
+// it returns true if any environment drifted
+func verifyDeployedEnvironments(w io.Writer) bool {
+	environments := readDeployedEnvironments()
+	if !config.UseCacheFallback {
+		uniqueGitModules := make(map[string]GitModule)
+		for _, de := range environments {
+			for _, gitModule := range de.puppetfile.gitModules {
+				if len(gitModule.git) > 0 && !gitModule.local && len(gitModule.localPath) == 0 {
+					uniqueGitModules[gitModule.git] = gitModule
+				}
+			}
+		}
+		resolveModules(uniqueGitModules, nil, syncStats)
+	}
+
+	drifts := []DeployedDrift{}
+	for _, de := range environments {
+		drifts = append(drifts, verifyVerifiedEnvironment(de)...)
+	}
+	if len(drifts) == 0 {
+		fmt.Fprintln(w, "All "+strconv.Itoa(len(environments))+" deployed environments match their sources")
+		return false
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENVIRONMENT\tMODULE\tDEPLOYED\tEXPECTED")
+	for _, d := range drifts {
+		fmt.Fprintln(tw, d.environment+"\t"+d.module+"\t"+d.deployed+"\t"+d.expected)
+	}
+	tw.Flush()
+	return true
+}
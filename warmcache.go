@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readCachedPuppetfile parses the Puppetfile of the branch of the cached control repository workDir without deploying the branch
+// the second return value is false if the branch does not contain a Puppetfile
+func readCachedPuppetfile(workDir string, branch string, source string, sa Source) (Puppetfile, bool) {
+	er := executeCommand(runContext, "git --git-dir "+workDir+" show '"+branch+":Puppetfile'", config.Timeout, true)
+	if er.returnCode != 0 {
+		Debugf("Skipping branch " + source + "_" + branch + ", because it does not contain a Puppetfile")
+		return Puppetfile{}, false
+	}
+	tmpFile, err := ioutil.TempFile("", "g10k-cached-Puppetfile")
+	if err != nil {
+		Fatalf("readCachedPuppetfile(): Error while creating temporary Puppetfile Error: " + err.Error())
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString(er.output); err != nil {
+		Fatalf("readCachedPuppetfile(): Error while writing temporary Puppetfile " + tmpFile.Name() + " Error: " + err.Error())
+	}
+	tmpFile.Close()
+	puppetfile := readPuppetfile(tmpFile.Name(), sa.PrivateKey, source, sa.ForceForgeVersions, false)
+	return addGlobalModules(puppetfile, tmpFile.Name()), true
+}
+
+// getCachedControlRepoBranches returns the branches of the cached control repository workDir and its tags matching tag_pattern or all tags with -tags
+// which are not skipped by branch_include_regex or branch_exclude_regex
+func getCachedControlRepoBranches(workDir string, sa Source) []string {
+	refs := executeCommand(runContext, "git --git-dir "+workDir+" for-each-ref '--format=%(refname:short)' refs/heads/", config.Timeout, false).output
+	if tags || len(sa.TagPattern) > 0 {
+		tagPattern := sa.TagPattern
+		if tags {
+			tagPattern = "*"
+		}
+		refs += "\n" + executeCommand(runContext, "git --git-dir "+workDir+" tag --list '"+tagPattern+"'", config.Timeout, false).output
+	}
+	branches := []string{}
+	for _, branch := range strings.Split(strings.TrimSpace(refs), "\n") {
+		branch = strings.TrimSpace(branch)
+		if len(branch) > 0 && matchesBranchRegexes(sa, branch) {
+			branches = append(branches, branch)
+		}
+	}
+	return branches
+}
+
+// getWarmCacheGitModules mirrors or updates the control repositories of all sources
+// and returns the git modules of the Puppetfiles of all their branches and tag_pattern tags
+func getWarmCacheGitModules() map[string]GitModule {
+	uniqueGitModules := make(map[string]GitModule)
+	sources := []string{}
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		sa := config.Sources[source]
+		sourceSanityCheck(source, sa)
+		workDir := config.EnvCacheDir + source + ".git"
+		controlRepo := GitModule{git: sa.Remote, privateKey: sa.PrivateKey, ignoreUnreachable: true}
+		if !doMirrorOrUpdate(runContext, controlRepo, workDir, getGitRetryCount(), syncStats) {
+			Warnf("WARNING: Could not resolve git repository in source '" + source + "' (" + sa.Remote + ")")
+			if sa.ExitIfUnreachable {
+				os.Exit(1)
+			}
+			continue
+		}
+		for _, branch := range getCachedControlRepoBranches(workDir, sa) {
+			puppetfile, ok := readCachedPuppetfile(workDir, branch, source, sa)
+			if !ok {
+				continue
+			}
+			Debugf("Found " + strconv.Itoa(len(puppetfile.gitModules)) + " git modules in branch " + source + "_" + branch)
+			for _, gitModule := range puppetfile.gitModules {
+				if gitModule.local || len(gitModule.localPath) > 0 || len(gitModule.git) == 0 {
+					continue
+				}
+				if len(gitModule.privateKey) == 0 {
+					gitModule.privateKey = puppetfile.privateKey
+				}
+				if ugm, ok := uniqueGitModules[gitModule.git]; ok {
+					gitModule = mergeUniqueGitModule(ugm, gitModule)
+				}
+				uniqueGitModules[gitModule.git] = gitModule
+			}
+		}
+	}
+	return uniqueGitModules
+}
+
+// warmCache mirrors or updates the git repositories of all modules used by any branch of any source without deploying anything
+// it returns the number of git repositories and how many of them could not be mirrored or updated
+func warmCache() (int, int) {
+	uniqueGitModules := getWarmCacheGitModules()
+	checkSSHPrivateKeys(uniqueGitModules)
+	resolveModules(uniqueGitModules, nil, syncStats)
+	failed := 0
+	mutex.Lock()
+	defer mutex.Unlock()
+	for url := range uniqueGitModules {
+		if grr, ok := gitRepositoryResults[url]; ok && !grr.success {
+			failed++
+		}
+	}
+	return len(uniqueGitModules), failed
+}